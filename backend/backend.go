@@ -0,0 +1,146 @@
+// Package backend is the interface between tanya's IRC server and the chat system behind it. The Slack
+// gateway is one implementation; anything else that can list users and conversations, send and fetch
+// messages, and report events as they happen can sit behind the same IRC server.
+//
+// Conversations are named the way IRC clients see them: channels by their name, starting with "#", DMs by
+// the nick of the other user, and group DMs by the nicks of the other users joined with ",".
+package backend
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// User is a user of the chat system
+type User struct {
+	// ID is the chat system's own identifier for the user, stable across nick changes
+	ID       string
+	Nick     string
+	RealName string
+}
+
+// Topic is a channel's topic, and who set it when
+type Topic struct {
+	Text  string
+	SetBy string
+	SetAt time.Time
+}
+
+// Channel is a channel on the chat system, which may or may not have been joined
+type Channel struct {
+	Name    string
+	Topic   Topic
+	Created time.Time
+	Private bool
+}
+
+// Message is a line of text sent to a channel or DM
+type Message struct {
+	From User
+	// Channel the message was sent to, or the nick of the user it was sent to directly
+	Target string
+	Text   string
+
+	// When the message was sent, and its ID, if it's one the backend can fetch history around
+	Time time.Time
+	ID   string
+}
+
+// ConversationActivity is when a channel or DM last had a message
+type ConversationActivity struct {
+	Target string
+	Latest time.Time
+}
+
+// UnreadCount is how many messages in a channel or DM haven't been read
+type UnreadCount struct {
+	Target string
+	DM     bool
+
+	// Number of unread messages, or zero if the backend only knows there are some
+	Unreads  int
+	Mentions int
+}
+
+// SearchResults is a page of the messages matching a search, newest first
+type SearchResults struct {
+	Messages []Message
+	// Which page this is, counting from 1, of how many
+	Page, Pages int
+	// How many messages match, on every page
+	Total int
+}
+
+// Status is the state of a backend's connection to its chat system
+type Status struct {
+	Connected bool
+	// When the backend connected, or disconnected if it isn't connected
+	Since time.Time
+	// Anything else worth knowing about the connection, e.g. how it's made
+	Detail string
+}
+
+// ErrUnknownCommand is returned by SlashCommand for commands the chat system doesn't have
+var ErrUnknownCommand = errors.New("no such command")
+
+// Backend is a chat system tanya's IRC server can be a client for
+type Backend interface {
+	// Run connects to the chat system and sends events to eventChan until stopChan is closed. The first
+	// event sent on every connection is a ConnectedEvent.
+	Run(eventChan chan<- *Event, stopChan <-chan struct{})
+	// Tag identifies the backend in log lines
+	Tag() string
+	// Status reports on the connection to the chat system
+	Status() Status
+	// Reconnect drops the connection to the chat system and makes a new one
+	Reconnect() error
+	// Resync reloads users and channels from the chat system, sending events for anything that changed
+	Resync() error
+
+	// Channel returns a channel by name
+	Channel(name string) (Channel, bool)
+	// ChannelMembers returns the users in a channel
+	ChannelMembers(name string) ([]User, error)
+	// JoinedChannels returns the names of the channels we're in
+	JoinedChannels() []string
+	// JoinChannel joins a channel, sending a SelfJoinEvent unless we were already in it
+	JoinChannel(name string) error
+	// LeaveChannel leaves a channel, sending a SelfPartEvent unless we weren't in it
+	LeaveChannel(name string) error
+	// UserByNick returns a user by nick
+	UserByNick(nick string) (User, bool)
+
+	// Send sends a message to a channel, DM or group DM, returning the name of the conversation it was sent
+	// to. For a comma-separated list of nicks, that's the group DM's channel name.
+	Send(target, text string) (string, error)
+	// SlashCommand runs a command such as "/remind" with its arguments in a channel or DM, returning any
+	// reply meant only for us
+	SlashCommand(target, command, args string) (string, error)
+	// HasSlashCommand returns whether SlashCommand can run a command
+	HasSlashCommand(command string) bool
+
+	// History returns the messages sent to a channel or DM strictly between after and before (either of
+	// which may be zero), oldest first. If there are more than limit, the newest are returned if latest is
+	// set, otherwise the oldest.
+	History(target string, after, before time.Time, limit int, latest bool) ([]Message, error)
+	// ActiveConversations returns the channels and DMs with messages strictly between after and before
+	ActiveConversations(after, before time.Time) ([]ConversationActivity, error)
+	// MessageTime resolves a message ID to the time the message was sent
+	MessageTime(id string) (time.Time, bool)
+	// Search returns a page of the messages matching a query, in the chat system's own query language
+	Search(query string, page int) (SearchResults, error)
+
+	// ReadMarker returns the time up to which a channel or DM has been read, or the zero time if unknown
+	ReadMarker(target string) (time.Time, error)
+	// SetReadMarker marks a channel or DM as read up to a time, returning the resulting read marker,
+	// which never moves backwards
+	SetReadMarker(target string, t time.Time) (time.Time, error)
+	// UnreadCounts returns the channels and DMs with unread messages, and whether they're known yet
+	UnreadCounts() ([]UnreadCount, bool)
+
+	// UploadFile shares a file to a channel or DM, with an optional comment
+	UploadFile(target, filename string, file io.Reader, size int, comment string) error
+	// DownloadFile downloads a file shared on the chat system, by the URL it was offered with
+	DownloadFile(url string, w io.Writer) error
+}
@@ -0,0 +1,86 @@
+package backend
+
+import "time"
+
+// EventType represents a variant of Event
+type EventType int
+
+// Constants corresponding to event types, and the type of the Data each carries
+const (
+	ConnectedEvent        EventType = iota // *ConnectedEventData
+	MessageEvent                           // *Message
+	NickChangeEvent                        // *NickChangeEventData
+	TopicChangeEvent                       // *TopicChangeEventData
+	SelfJoinEvent                          // *JoinPartEventData
+	SelfPartEvent                          // *JoinPartEventData
+	JoinEvent                              // *JoinPartEventData
+	PartEvent                              // *JoinPartEventData
+	ChannelRenameEvent                     // *ChannelRenameEventData
+	ReadMarkerEvent                        // *ReadMarkerEventData
+	UnreadSummaryEvent                     // nil; UnreadCounts is ready
+	MentionEvent                           // *Message, which mentions us
+	MultilineMessageEvent                  // *MultilineMessageEventData
+	FileSharedEvent                        // *FileSharedEventData
+	NoticeEvent                            // *Message, meant only for us, such as one from Slackbot
+)
+
+// An Event is something that happened on the chat system that should be communicated to any connected
+// IRC clients
+type Event struct {
+	EventType EventType
+	Data      interface{}
+}
+
+// ConnectedEventData is sent whenever the backend (re)connects, with who we are connected as
+type ConnectedEventData struct {
+	Self User
+}
+
+// MultilineMessageEventData represents the lines of a multi-line message, which capable IRC clients can
+// receive as a single message
+type MultilineMessageEventData struct {
+	Lines []*Message
+}
+
+// FileSharedEventData represents a file shared to a channel, which IRC clients can be offered for download
+type FileSharedEventData struct {
+	From   User
+	Target string
+
+	Name string
+	Size int64
+	URL  string
+}
+
+// NickChangeEventData represents a user changing their nick
+type NickChangeEventData struct {
+	From    User
+	NewNick string
+}
+
+// TopicChangeEventData represents a user changing a channel's topic
+type TopicChangeEventData struct {
+	From     User
+	Target   string
+	NewTopic string
+}
+
+// JoinPartEventData represents a user, or us for SelfJoinEvent and SelfPartEvent, joining or leaving a
+// channel
+type JoinPartEventData struct {
+	User   User
+	Target string
+	Reason string
+}
+
+// ChannelRenameEventData represents a channel we are in being renamed
+type ChannelRenameEventData struct {
+	OldName string
+	NewName string
+}
+
+// ReadMarkerEventData represents a conversation being read up to a time elsewhere
+type ReadMarkerEventData struct {
+	Target string
+	Time   time.Time
+}
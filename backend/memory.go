@@ -0,0 +1,512 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of messages on each page of search results
+const memorySearchPageSize = 20
+
+// Memory is a chat system that exists only in memory, for demos and tests. Users and channels are added to
+// it directly, and Post plays the part of other users sending messages.
+type Memory struct {
+	self     User
+	users    map[string]*User
+	channels map[string]*memoryChannel
+	// Messages by conversation: channel name, or the other user's nick for DMs
+	history     map[string][]Message
+	readMarkers map[string]time.Time
+	files       map[string][]byte
+
+	events        chan *Event
+	lastTimestamp time.Time
+	// When Run last "connected", or zero if it hasn't
+	connectedSince time.Time
+
+	sync.Mutex
+}
+
+type memoryChannel struct {
+	Channel
+	members []string
+	joined  bool
+}
+
+// NewMemory creates an empty in-memory chat system in which we are self
+func NewMemory(self User) *Memory {
+	m := &Memory{
+		self:        self,
+		users:       make(map[string]*User),
+		channels:    make(map[string]*memoryChannel),
+		history:     make(map[string][]Message),
+		readMarkers: make(map[string]time.Time),
+		files:       make(map[string][]byte),
+		events:      make(chan *Event, 100),
+	}
+	m.users[self.Nick] = &self
+	return m
+}
+
+// AddUser adds a user
+func (m *Memory) AddUser(user User) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.users[user.Nick] = &user
+}
+
+// AddChannel adds a channel with the given members, by nick. We're in it if we're one of them.
+func (m *Memory) AddChannel(channel Channel, members ...string) {
+	m.Lock()
+	defer m.Unlock()
+
+	if channel.Created.IsZero() {
+		channel.Created = time.Now()
+	}
+	c := &memoryChannel{Channel: channel, members: members}
+	for _, member := range members {
+		c.joined = c.joined || member == m.self.Nick
+	}
+	m.channels[channel.Name] = c
+}
+
+// Post sends a message from a user to a channel, or to us if target is our nick
+func (m *Memory) Post(from, target, text string) error {
+	m.Lock()
+	user, found := m.users[from]
+	if !found {
+		m.Unlock()
+		return fmt.Errorf("no such nick: %v", from)
+	}
+	conversation := target
+	if target == m.self.Nick {
+		conversation = from
+	}
+	message := m.post(conversation, Message{From: *user, Target: target, Text: text})
+	m.Unlock()
+
+	m.events <- &Event{EventType: MessageEvent, Data: &message}
+	if target != m.self.Nick && strings.Contains(text, m.self.Nick) {
+		m.events <- &Event{EventType: MentionEvent, Data: &message}
+	}
+	return nil
+}
+
+// post adds a message to a conversation's history. Memory must be locked.
+func (m *Memory) post(conversation string, message Message) Message {
+	// Message IDs are their times, so they're kept unique
+	t := time.Now()
+	if !t.After(m.lastTimestamp) {
+		t = m.lastTimestamp.Add(time.Nanosecond)
+	}
+	m.lastTimestamp = t
+
+	message.Time = t
+	message.ID = strconv.FormatInt(t.UnixNano(), 10)
+	m.history[conversation] = append(m.history[conversation], message)
+	return message
+}
+
+// Messages returns the messages sent to a channel, or between us and the user with a nick, oldest first
+func (m *Memory) Messages(conversation string) []Message {
+	m.Lock()
+	defer m.Unlock()
+
+	return append([]Message(nil), m.history[conversation]...)
+}
+
+// conversation returns the key of a channel or DM's history. Memory must be locked.
+func (m *Memory) conversation(target string) (string, error) {
+	if strings.HasPrefix(target, "#") {
+		if _, found := m.channels[target]; !found {
+			return "", fmt.Errorf("no such channel: %v", target)
+		}
+	} else if _, found := m.users[target]; !found {
+		return "", fmt.Errorf("no such nick: %v", target)
+	}
+	return target, nil
+}
+
+// Run implements Backend.Run
+func (m *Memory) Run(eventChan chan<- *Event, stopChan <-chan struct{}) {
+	m.Lock()
+	m.connectedSince = time.Now()
+	m.Unlock()
+
+	select {
+	case eventChan <- &Event{EventType: ConnectedEvent, Data: &ConnectedEventData{Self: m.self}}:
+	case <-stopChan:
+		return
+	}
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case event := <-m.events:
+			select {
+			case eventChan <- event:
+			case <-stopChan:
+				return
+			}
+		}
+	}
+}
+
+// Tag implements Backend.Tag
+func (m *Memory) Tag() string {
+	return fmt.Sprintf("[%-12s]", "memory")
+}
+
+// Status implements Backend.Status
+func (m *Memory) Status() Status {
+	m.Lock()
+	defer m.Unlock()
+
+	return Status{Connected: !m.connectedSince.IsZero(), Since: m.connectedSince, Detail: "in memory"}
+}
+
+// Reconnect implements Backend.Reconnect. There's nothing to reconnect to, so it only starts over with
+// another ConnectedEvent.
+func (m *Memory) Reconnect() error {
+	m.Lock()
+	m.connectedSince = time.Now()
+	m.Unlock()
+
+	m.events <- &Event{EventType: ConnectedEvent, Data: &ConnectedEventData{Self: m.self}}
+	return nil
+}
+
+// Resync implements Backend.Resync. Everything is always up to date, so there's nothing to do.
+func (m *Memory) Resync() error {
+	return nil
+}
+
+// Channel implements Backend.Channel
+func (m *Memory) Channel(name string) (Channel, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	c, found := m.channels[name]
+	if !found {
+		return Channel{}, false
+	}
+	return c.Channel, true
+}
+
+// ChannelMembers implements Backend.ChannelMembers
+func (m *Memory) ChannelMembers(name string) ([]User, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	c, found := m.channels[name]
+	if !found {
+		return nil, fmt.Errorf("no such channel: %v", name)
+	}
+
+	var users []User
+	for _, nick := range c.members {
+		if user, found := m.users[nick]; found {
+			users = append(users, *user)
+		}
+	}
+	return users, nil
+}
+
+// JoinedChannels implements Backend.JoinedChannels
+func (m *Memory) JoinedChannels() []string {
+	m.Lock()
+	defer m.Unlock()
+
+	var names []string
+	for name, c := range m.channels {
+		if c.joined {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// JoinChannel implements Backend.JoinChannel
+func (m *Memory) JoinChannel(name string) error {
+	m.Lock()
+	c, found := m.channels[name]
+	if !found {
+		m.Unlock()
+		return fmt.Errorf("no such channel: %v", name)
+	}
+	wasJoined := c.joined
+	if !wasJoined {
+		c.joined = true
+		c.members = append(c.members, m.self.Nick)
+	}
+	m.Unlock()
+
+	if !wasJoined {
+		m.events <- &Event{EventType: SelfJoinEvent, Data: &JoinPartEventData{User: m.self, Target: name}}
+	}
+	return nil
+}
+
+// LeaveChannel implements Backend.LeaveChannel
+func (m *Memory) LeaveChannel(name string) error {
+	m.Lock()
+	c, found := m.channels[name]
+	if !found {
+		m.Unlock()
+		return fmt.Errorf("no such channel: %v", name)
+	}
+	wasJoined := c.joined
+	if wasJoined {
+		c.joined = false
+		var members []string
+		for _, member := range c.members {
+			if member != m.self.Nick {
+				members = append(members, member)
+			}
+		}
+		c.members = members
+	}
+	m.Unlock()
+
+	if wasJoined {
+		m.events <- &Event{EventType: SelfPartEvent, Data: &JoinPartEventData{User: m.self, Target: name}}
+	}
+	return nil
+}
+
+// UserByNick implements Backend.UserByNick
+func (m *Memory) UserByNick(nick string) (User, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	user, found := m.users[nick]
+	if !found {
+		return User{}, false
+	}
+	return *user, true
+}
+
+// SlashCommand implements Backend.SlashCommand. There are no commands.
+func (m *Memory) SlashCommand(target, command, args string) (string, error) {
+	return "", ErrUnknownCommand
+}
+
+// HasSlashCommand implements Backend.HasSlashCommand. There are no commands.
+func (m *Memory) HasSlashCommand(command string) bool {
+	return false
+}
+
+// Send implements Backend.Send. Group DMs aren't supported.
+func (m *Memory) Send(target, text string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	conversation, err := m.conversation(target)
+	if err != nil {
+		return "", err
+	}
+	m.post(conversation, Message{From: m.self, Target: target, Text: text})
+	return target, nil
+}
+
+// History implements Backend.History
+func (m *Memory) History(target string, after, before time.Time, limit int, latest bool) ([]Message, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	conversation, err := m.conversation(target)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []Message
+	for _, message := range m.history[conversation] {
+		if (after.IsZero() || message.Time.After(after)) && (before.IsZero() || message.Time.Before(before)) {
+			messages = append(messages, message)
+		}
+	}
+	if len(messages) > limit {
+		if latest {
+			messages = messages[len(messages)-limit:]
+		} else {
+			messages = messages[:limit]
+		}
+	}
+	return messages, nil
+}
+
+// ActiveConversations implements Backend.ActiveConversations
+func (m *Memory) ActiveConversations(after, before time.Time) ([]ConversationActivity, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var activity []ConversationActivity
+	for conversation, messages := range m.history {
+		for i := len(messages) - 1; i >= 0; i-- {
+			t := messages[i].Time
+			if (after.IsZero() || t.After(after)) && (before.IsZero() || t.Before(before)) {
+				activity = append(activity, ConversationActivity{Target: conversation, Latest: t})
+				break
+			}
+		}
+	}
+	sort.Slice(activity, func(i, j int) bool { return activity[i].Latest.Before(activity[j].Latest) })
+	return activity, nil
+}
+
+// MessageTime implements Backend.MessageTime
+func (m *Memory) MessageTime(id string) (time.Time, bool) {
+	nanos, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// Search implements Backend.Search. Messages match if they contain every word of the query, ignoring
+// case, except for in:<channel or nick> and from:<nick>, which limit where they were sent and by whom.
+func (m *Memory) Search(query string, page int) (SearchResults, error) {
+	var in, from string
+	var words []string
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		switch {
+		case strings.HasPrefix(word, "in:"):
+			in = strings.TrimLeft(strings.TrimPrefix(word, "in:"), "#@")
+		case strings.HasPrefix(word, "from:"):
+			from = strings.TrimPrefix(strings.TrimPrefix(word, "from:"), "@")
+		default:
+			words = append(words, word)
+		}
+	}
+
+	m.Lock()
+	var matches []Message
+	for conversation, messages := range m.history {
+		if in != "" && strings.TrimPrefix(strings.ToLower(conversation), "#") != in {
+			continue
+		}
+	Messages:
+		for _, message := range messages {
+			if from != "" && strings.ToLower(message.From.Nick) != from {
+				continue
+			}
+			for _, word := range words {
+				if !strings.Contains(strings.ToLower(message.Text), word) {
+					continue Messages
+				}
+			}
+			matches = append(matches, message)
+		}
+	}
+	m.Unlock()
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Time.After(matches[j].Time) })
+	results := SearchResults{
+		Page:  page,
+		Pages: (len(matches) + memorySearchPageSize - 1) / memorySearchPageSize,
+		Total: len(matches),
+	}
+	if start := (page - 1) * memorySearchPageSize; page > 0 && start < len(matches) {
+		results.Messages = matches[start:min(start+memorySearchPageSize, len(matches))]
+	}
+	return results, nil
+}
+
+// ReadMarker implements Backend.ReadMarker
+func (m *Memory) ReadMarker(target string) (time.Time, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	conversation, err := m.conversation(target)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return m.readMarkers[conversation], nil
+}
+
+// SetReadMarker implements Backend.SetReadMarker
+func (m *Memory) SetReadMarker(target string, t time.Time) (time.Time, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	conversation, err := m.conversation(target)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t.After(m.readMarkers[conversation]) {
+		m.readMarkers[conversation] = t
+	}
+	return m.readMarkers[conversation], nil
+}
+
+// UnreadCounts implements Backend.UnreadCounts
+func (m *Memory) UnreadCounts() ([]UnreadCount, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	var counts []UnreadCount
+	for conversation, messages := range m.history {
+		count := UnreadCount{Target: conversation, DM: !strings.HasPrefix(conversation, "#")}
+		for _, message := range messages {
+			if message.From.ID == m.self.ID || !message.Time.After(m.readMarkers[conversation]) {
+				continue
+			}
+			count.Unreads++
+			if count.DM || strings.Contains(message.Text, m.self.Nick) {
+				count.Mentions++
+			}
+		}
+		if count.Unreads > 0 {
+			counts = append(counts, count)
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Target < counts[j].Target })
+	return counts, true
+}
+
+// UploadFile implements Backend.UploadFile. The file is shared as a message with a memory:// link to it.
+func (m *Memory) UploadFile(target, filename string, file io.Reader, size int, comment string) error {
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	conversation, err := m.conversation(target)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("memory://files/%d/%s", len(m.files), filename)
+	m.files[url] = content
+
+	text := url
+	if comment != "" {
+		text = comment + " " + url
+	}
+	m.post(conversation, Message{From: m.self, Target: target, Text: text})
+	return nil
+}
+
+// DownloadFile implements Backend.DownloadFile
+func (m *Memory) DownloadFile(url string, w io.Writer) error {
+	m.Lock()
+	content, found := m.files[url]
+	m.Unlock()
+
+	if !found {
+		return fmt.Errorf("no such file: %v", url)
+	}
+	_, err := io.Copy(w, bytes.NewReader(content))
+	return err
+}
@@ -0,0 +1,169 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestMemory(t *testing.T, texts ...string) (*Memory, []Message) {
+	m := NewMemory(User{ID: "U1", Nick: "papika"})
+	m.AddUser(User{ID: "U2", Nick: "kedo"})
+	m.AddChannel(Channel{Name: "#general"}, "papika", "kedo")
+	for _, text := range texts {
+		if err := m.Post("kedo", "#general", text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m, m.Messages("#general")
+}
+
+func TestMemoryHistory(t *testing.T) {
+	m, messages := newTestMemory(t, "one", "two", "three", "four")
+
+	tests := []struct {
+		name          string
+		after, before time.Time
+		limit         int
+		latest        bool
+		want          []string
+	}{
+		{"everything", time.Time{}, time.Time{}, 10, false, []string{"one", "two", "three", "four"}},
+		{"oldest", time.Time{}, time.Time{}, 2, false, []string{"one", "two"}},
+		{"latest", time.Time{}, time.Time{}, 2, true, []string{"three", "four"}},
+		{"strictly between", messages[0].Time, messages[3].Time, 10, false, []string{"two", "three"}},
+		{"after", messages[2].Time, time.Time{}, 10, false, []string{"four"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history, err := m.History("#general", tt.after, tt.before, tt.limit, tt.latest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, message := range history {
+				got = append(got, message.Text)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("History() = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("History() = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+
+	if _, err := m.History("#nowhere", time.Time{}, time.Time{}, 10, false); err == nil {
+		t.Errorf("History() of an unknown channel succeeded")
+	}
+	if got, ok := m.MessageTime(messages[1].ID); !ok || !got.Equal(messages[1].Time) {
+		t.Errorf("MessageTime(%v) = %v, want %v", messages[1].ID, got, messages[1].Time)
+	}
+}
+
+func TestMemoryUnreads(t *testing.T) {
+	m, messages := newTestMemory(t, "one", "hi papika", "three")
+	if _, err := m.Send("#general", "replying"); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, ready := m.UnreadCounts()
+	if !ready || len(counts) != 1 || counts[0].Unreads != 3 || counts[0].Mentions != 1 {
+		t.Errorf("UnreadCounts() = %+v, want 3 unread in #general, our own message not counted, 1 mention", counts)
+	}
+
+	if marker, _ := m.SetReadMarker("#general", messages[1].Time); !marker.Equal(messages[1].Time) {
+		t.Errorf("SetReadMarker() = %v, want %v", marker, messages[1].Time)
+	}
+	if marker, _ := m.SetReadMarker("#general", messages[0].Time); !marker.Equal(messages[1].Time) {
+		t.Errorf("SetReadMarker() moved backwards to %v", marker)
+	}
+	if counts, _ := m.UnreadCounts(); len(counts) != 1 || counts[0].Unreads != 1 || counts[0].Mentions != 0 {
+		t.Errorf("UnreadCounts() = %+v, want 1 unread in #general", counts)
+	}
+}
+
+func TestMemoryJoinLeave(t *testing.T) {
+	m, _ := newTestMemory(t)
+	m.AddChannel(Channel{Name: "#random"}, "kedo")
+
+	tests := []struct {
+		name      string
+		action    func(string) error
+		channel   string
+		wantEvent EventType
+		wantErr   bool
+	}{
+		{"join", m.JoinChannel, "#random", SelfJoinEvent, false},
+		{"join again", m.JoinChannel, "#random", -1, false},
+		{"leave", m.LeaveChannel, "#random", SelfPartEvent, false},
+		{"leave again", m.LeaveChannel, "#random", -1, false},
+		{"join unknown", m.JoinChannel, "#nowhere", -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.action(tt.channel); (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			select {
+			case event := <-m.events:
+				if event.EventType != tt.wantEvent || event.Data.(*JoinPartEventData).Target != tt.channel {
+					t.Errorf("event = %+v, want %v for %v", event, tt.wantEvent, tt.channel)
+				}
+			default:
+				if tt.wantEvent != -1 {
+					t.Errorf("no event, want %v", tt.wantEvent)
+				}
+			}
+		})
+	}
+
+	if joined := m.JoinedChannels(); len(joined) != 1 || joined[0] != "#general" {
+		t.Errorf("JoinedChannels() = %v, want only #general", joined)
+	}
+}
+
+func TestMemorySearch(t *testing.T) {
+	m, _ := newTestMemory(t, "good morning", "Morning tea", "good night")
+	m.AddChannel(Channel{Name: "#random"}, "papika", "kedo")
+	if err := m.Post("papika", "#random", "morning run"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"morning", []string{"morning run", "Morning tea", "good morning"}},
+		{"GOOD morning", []string{"good morning"}},
+		{"morning in:#general", []string{"Morning tea", "good morning"}},
+		{"in:random", []string{"morning run"}},
+		{"morning from:@papika", []string{"morning run"}},
+		{"evening", nil},
+	}
+	for _, tt := range tests {
+		results, err := m.Search(tt.query, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, message := range results.Messages {
+			got = append(got, message.Text)
+		}
+		if len(got) != len(tt.want) || results.Total != len(tt.want) {
+			t.Errorf("Search(%q) = %q of %d, want %q", tt.query, got, results.Total, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("Search(%q) = %q, want %q", tt.query, got, tt.want)
+				break
+			}
+		}
+	}
+
+	if results, _ := m.Search("morning", 2); len(results.Messages) != 0 || results.Pages != 1 {
+		t.Errorf("Search() page 2 = %v messages of %d pages, want none of 1", len(results.Messages), results.Pages)
+	}
+}
@@ -5,16 +5,17 @@ import (
 	"os"
 
 	"github.com/BurntSushi/toml"
+	"github.com/nolanlum/tanya/gateway"
 	"github.com/nolanlum/tanya/irc"
 	"github.com/nolanlum/tanya/token"
 )
 
-type slack struct {
-	Token string
-}
-
 // Config holds configuration data for Tanya
 type Config struct {
+	// If set, IRC clients can connect to any gateway here, choosing one by Name when they log in. Gateways
+	// whose IRC ListenAddr is the same are only reachable here.
+	SharedListenAddr string
+
 	Gateway []GatewayInstance
 }
 
@@ -27,13 +28,19 @@ func (c *Config) SetDefaults() {
 
 // GatewayInstance holds configuration data for a single IRC<->Slack bridge instance
 type GatewayInstance struct {
-	Slack slack
+	// Name clients choose this gateway by on the shared listener
+	Name string
+
+	Slack gateway.Config
 	IRC   irc.Config
+	Relay irc.RelayConfig
 }
 
 // SetDefaults overwrites config entries with their default values
 func (g *GatewayInstance) SetDefaults() {
+	g.Slack.SetDefaults()
 	g.IRC.SetDefaults()
+	g.Relay.SetDefaults()
 }
 
 // LoadConfig parses a config if it exists, or generates a new one
@@ -59,7 +66,7 @@ func initializeConfig() (*Config, error) {
 		return nil, err
 	}
 
-	conf.Gateway = []GatewayInstance{{Slack: slack{Token: slackToken}}}
+	conf.Gateway = []GatewayInstance{{Slack: gateway.Config{Token: slackToken}}}
 
 	fmt.Print("Writing config.toml...")
 	f, err := os.Create("config.toml")
@@ -0,0 +1,589 @@
+package fakeslack
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// response is the body of a Web API response, without "ok"
+type response map[string]interface{}
+
+// methodError is a Web API error, as in {"ok": false, "error": "channel_not_found"}
+type methodError string
+
+// handleMethod serves a Web API method
+func (s *Server) handleMethod(w http.ResponseWriter, r *http.Request) {
+	method := strings.TrimPrefix(r.URL.Path, "/api/")
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp response
+	var err methodError
+	if r.FormValue("token") == "" && !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		err = "not_authed"
+	} else if handler, found := methods[method]; found {
+		s.Lock()
+		if failure, failing := s.failures[method]; failing {
+			err = methodError(failure)
+		} else {
+			resp, err = handler(s, r.Form)
+		}
+		s.Unlock()
+	} else {
+		log.Printf("fakeslack: unhandled method %v", method)
+		err = "unknown_method"
+	}
+
+	if err != "" {
+		resp = response{"ok": false, "error": string(err)}
+	} else {
+		resp["ok"] = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// methods holds the Web API methods the fake server implements. Each is called with the server locked.
+var methods = map[string]func(s *Server, form url.Values) (response, methodError){
+	"auth.test":                    (*Server).authTest,
+	"rtm.connect":                  (*Server).rtmConnect,
+	"apps.connections.open":        (*Server).appsConnectionsOpen,
+	"users.list":                   (*Server).usersList,
+	"users.info":                   (*Server).usersInfo,
+	"usergroups.list":              (*Server).usergroupsList,
+	"conversations.list":           (*Server).conversationsList,
+	"conversations.info":           (*Server).conversationsInfo,
+	"conversations.members":        (*Server).conversationsMembers,
+	"conversations.history":        (*Server).conversationsHistory,
+	"conversations.replies":        (*Server).conversationsReplies,
+	"conversations.open":           (*Server).conversationsOpen,
+	"conversations.join":           (*Server).conversationsJoin,
+	"conversations.leave":          (*Server).conversationsLeave,
+	"conversations.mark":           (*Server).conversationsMark,
+	"search.messages":              (*Server).searchMessages,
+	"client.counts":                (*Server).clientCounts,
+	"chat.postMessage":             (*Server).chatPostMessage,
+	"chat.command":                 (*Server).chatCommand,
+	"commands.list":                (*Server).commandsList,
+	"files.info":                   (*Server).filesInfo,
+	"files.getUploadURLExternal":   (*Server).filesGetUploadURLExternal,
+	"files.completeUploadExternal": (*Server).filesCompleteUploadExternal,
+}
+
+func (s *Server) authTest(url.Values) (response, methodError) {
+	self := s.user(s.self)
+	return response{
+		"url":     "https://" + Team.Domain + ".slack.com/",
+		"team":    Team.Name,
+		"team_id": Team.ID,
+		"user":    self.Name,
+		"user_id": self.ID,
+		"bot_id":  BotID,
+	}, ""
+}
+
+func (s *Server) rtmConnect(url.Values) (response, methodError) {
+	self := s.user(s.self)
+	return response{
+		"url":  s.websocketURL("/rtm"),
+		"self": response{"id": self.ID, "name": self.Name},
+		"team": Team,
+	}, ""
+}
+
+func (s *Server) appsConnectionsOpen(url.Values) (response, methodError) {
+	return response{"url": s.websocketURL("/socket")}, ""
+}
+
+func (s *Server) usersList(url.Values) (response, methodError) {
+	return response{"members": s.users, "response_metadata": response{"next_cursor": ""}}, ""
+}
+
+func (s *Server) usersInfo(form url.Values) (response, methodError) {
+	user := s.user(form.Get("user"))
+	if user == nil {
+		return nil, "user_not_found"
+	}
+	return response{"user": user}, ""
+}
+
+func (s *Server) usergroupsList(url.Values) (response, methodError) {
+	return response{"usergroups": s.usergroups}, ""
+}
+
+// conversationType returns a conversation's type, as conversations.list filters them
+func conversationType(channel *slack.Channel) string {
+	switch {
+	case channel.IsIM:
+		return "im"
+	case channel.IsMpIM:
+		return "mpim"
+	case channel.IsPrivate:
+		return "private_channel"
+	default:
+		return "public_channel"
+	}
+}
+
+// withLastRead returns a copy of a channel including its read cursor
+func (s *Server) withLastRead(channel *slack.Channel) slack.Channel {
+	c := *channel
+	c.LastRead = s.lastRead[channel.ID]
+	return c
+}
+
+func (s *Server) conversationsList(form url.Values) (response, methodError) {
+	types := map[string]bool{"public_channel": true}
+	if form.Get("types") != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(form.Get("types"), ",") {
+			types[t] = true
+		}
+	}
+
+	channels := []slack.Channel{}
+	for _, channel := range s.channels {
+		if types[conversationType(channel)] && !(channel.IsArchived && form.Get("exclude_archived") == "true") {
+			channels = append(channels, s.withLastRead(channel))
+		}
+	}
+	return response{"channels": channels, "response_metadata": response{"next_cursor": ""}}, ""
+}
+
+func (s *Server) conversationsInfo(form url.Values) (response, methodError) {
+	channel := s.channel(form.Get("channel"))
+	if channel == nil {
+		return nil, "channel_not_found"
+	}
+	return response{"channel": s.withLastRead(channel)}, ""
+}
+
+func (s *Server) conversationsMembers(form url.Values) (response, methodError) {
+	if s.channel(form.Get("channel")) == nil {
+		return nil, "channel_not_found"
+	}
+	return response{"members": s.members[form.Get("channel")], "response_metadata": response{"next_cursor": ""}}, ""
+}
+
+func (s *Server) conversationsHistory(form url.Values) (response, methodError) {
+	channelID := form.Get("channel")
+	if s.channel(channelID) == nil {
+		return nil, "channel_not_found"
+	}
+
+	oldest, latest := form.Get("oldest"), form.Get("latest")
+	inclusive := form.Get("inclusive") == "true" || form.Get("inclusive") == "1"
+	limit, _ := strconv.Atoi(form.Get("limit"))
+	if limit <= 0 {
+		limit = 100
+	}
+
+	// Newest first, like Slack
+	messages := []slack.Message{}
+	history := s.history[channelID]
+	for i := len(history) - 1; i >= 0; i-- {
+		ts := history[i].Timestamp
+		if oldest != "" && (compareTimestamps(ts, oldest) < 0 || !inclusive && ts == oldest) {
+			continue
+		}
+		if latest != "" && (compareTimestamps(ts, latest) > 0 || !inclusive && ts == latest) {
+			continue
+		}
+		messages = append(messages, history[i])
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	return response{"messages": messages, "has_more": hasMore}, ""
+}
+
+func (s *Server) conversationsReplies(form url.Values) (response, methodError) {
+	channelID, ts := form.Get("channel"), form.Get("ts")
+	if s.channel(channelID) == nil {
+		return nil, "channel_not_found"
+	}
+
+	messages := []slack.Message{}
+	for _, message := range s.history[channelID] {
+		if message.Timestamp == ts || message.ThreadTimestamp == ts {
+			messages = append(messages, message)
+		}
+	}
+	if len(messages) == 0 {
+		return nil, "thread_not_found"
+	}
+	return response{"messages": messages, "has_more": false}, ""
+}
+
+func (s *Server) conversationsOpen(form url.Values) (response, methodError) {
+	if channel := s.channel(form.Get("channel")); channel != nil {
+		return response{"channel": channel, "already_open": true}, ""
+	} else if form.Get("users") == "" {
+		return nil, "channel_not_found"
+	}
+
+	users := strings.Split(form.Get("users"), ",")
+	for _, user := range users {
+		if s.user(user) == nil {
+			return nil, "user_not_found"
+		}
+	}
+	if len(users) == 1 {
+		return response{"channel": s.channel(s.openDM(users[0]))}, ""
+	}
+
+	// Group DMs have to be added up front, and are found by their members
+	users = append(users, s.self)
+	for _, channel := range s.channels {
+		if channel.IsMpIM && sameMembers(s.members[channel.ID], users) {
+			return response{"channel": channel, "already_open": true}, ""
+		}
+	}
+	return nil, "not_supported"
+}
+
+func (s *Server) conversationsJoin(form url.Values) (response, methodError) {
+	channel := s.channel(form.Get("channel"))
+	if channel == nil {
+		return nil, "channel_not_found"
+	} else if conversationType(channel) != "public_channel" {
+		return nil, "method_not_supported_for_channel_type"
+	}
+
+	if !channel.IsMember {
+		channel.IsMember = true
+		s.members[channel.ID] = append(s.members[channel.ID], s.self)
+		s.notify()
+	}
+	return response{"channel": s.withLastRead(channel)}, ""
+}
+
+func (s *Server) conversationsLeave(form url.Values) (response, methodError) {
+	channel := s.channel(form.Get("channel"))
+	if channel == nil {
+		return nil, "channel_not_found"
+	} else if !channel.IsMember {
+		return response{"not_in_channel": true}, ""
+	}
+
+	channel.IsMember = false
+	var members []string
+	for _, member := range s.members[channel.ID] {
+		if member != s.self {
+			members = append(members, member)
+		}
+	}
+	s.members[channel.ID] = members
+	s.notify()
+	return response{}, ""
+}
+
+func (s *Server) conversationsMark(form url.Values) (response, methodError) {
+	if s.channel(form.Get("channel")) == nil {
+		return nil, "channel_not_found"
+	}
+	s.lastRead[form.Get("channel")] = form.Get("ts")
+	s.notify()
+	return response{}, ""
+}
+
+func (s *Server) clientCounts(url.Values) (response, methodError) {
+	counts := map[string][]response{"channels": {}, "mpims": {}, "ims": {}}
+	for _, channel := range s.channels {
+		if !channel.IsMember && !channel.IsIM && !channel.IsMpIM {
+			continue
+		}
+
+		lastRead := s.lastRead[channel.ID]
+		hasUnreads := false
+		for _, message := range s.history[channel.ID] {
+			if message.User != s.self && compareTimestamps(message.Timestamp, lastRead) > 0 {
+				hasUnreads = true
+			}
+		}
+
+		key := "channels"
+		if channel.IsIM {
+			key = "ims"
+		} else if channel.IsMpIM {
+			key = "mpims"
+		}
+		counts[key] = append(counts[key], response{
+			"id":            channel.ID,
+			"last_read":     lastRead,
+			"has_unreads":   hasUnreads,
+			"mention_count": 0,
+		})
+	}
+	return response{"channels": counts["channels"], "mpims": counts["mpims"], "ims": counts["ims"]}, ""
+}
+
+// searchMessages finds the messages in conversations we're in containing every word of the query, newest first.
+// Of Slack's modifiers, only in:#channel and from:@user are understood.
+func (s *Server) searchMessages(form url.Values) (response, methodError) {
+	query := form.Get("query")
+	if strings.TrimSpace(query) == "" {
+		return nil, "no_query"
+	}
+	count, _ := strconv.Atoi(form.Get("count"))
+	if count <= 0 {
+		count = 20
+	}
+	page, _ := strconv.Atoi(form.Get("page"))
+	if page <= 0 {
+		page = 1
+	}
+
+	var in, from string
+	var words []string
+	for _, word := range strings.Fields(query) {
+		switch {
+		case strings.HasPrefix(word, "in:"):
+			in = strings.TrimLeft(strings.TrimPrefix(word, "in:"), "#")
+		case strings.HasPrefix(word, "from:"):
+			from = strings.TrimLeft(strings.TrimPrefix(word, "from:"), "@")
+		default:
+			words = append(words, strings.ToLower(word))
+		}
+	}
+
+	matches := []slack.SearchMessage{}
+	for _, channel := range s.channels {
+		if !channel.IsMember && !channel.IsIM && !channel.IsMpIM || in != "" && channel.Name != in {
+			continue
+		}
+	MessageLoop:
+		for _, message := range s.history[channel.ID] {
+			user := s.user(message.User)
+			if from != "" && (user == nil || user.Name != from) {
+				continue
+			}
+			for _, word := range words {
+				if !strings.Contains(strings.ToLower(message.Text), word) {
+					continue MessageLoop
+				}
+			}
+
+			match := slack.SearchMessage{
+				Type:      "message",
+				Channel:   slack.CtxChannel{ID: channel.ID, Name: channel.Name, IsMPIM: channel.IsMpIM, IsPrivate: channel.IsPrivate},
+				User:      message.User,
+				Username:  message.Username,
+				Timestamp: message.Timestamp,
+				Text:      message.Text,
+			}
+			if user != nil {
+				match.Username = user.Name
+			}
+			matches = append(matches, match)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return compareTimestamps(matches[i].Timestamp, matches[j].Timestamp) > 0 })
+
+	total := len(matches)
+	pages := (total + count - 1) / count
+	if start := (page - 1) * count; start < total {
+		matches = matches[start:min(start+count, total)]
+	} else {
+		matches = matches[:0]
+	}
+	return response{
+		"query": query,
+		"messages": response{
+			"matches": matches,
+			"paging":  slack.Paging{Count: count, Total: total, Page: page, Pages: pages},
+			"total":   total,
+		},
+	}, ""
+}
+
+// chatPostMessage posts a message as the server's own user, which like Slack is echoed back to clients
+func (s *Server) chatPostMessage(form url.Values) (response, methodError) {
+	channelID := form.Get("channel")
+	if s.channel(channelID) == nil {
+		return nil, "channel_not_found"
+	}
+	if form.Get("text") == "" {
+		return nil, "no_text"
+	}
+
+	message := s.post(slack.Msg{Channel: channelID, User: s.self, Text: form.Get("text")})
+	go s.SendEvent(message)
+	return response{"channel": channelID, "ts": message.Timestamp, "message": message}, ""
+}
+
+// chatCommand runs a slash command added with AddSlashCommand
+func (s *Server) chatCommand(form url.Values) (response, methodError) {
+	channelID := form.Get("channel")
+	if s.channel(channelID) == nil {
+		return nil, "channel_not_found"
+	}
+	run, found := s.commands[form.Get("command")]
+	if !found {
+		return nil, "invalid_command"
+	}
+	return response{"response": run(channelID, form.Get("text"))}, ""
+}
+
+// commandsList lists the slash commands added with AddSlashCommand
+func (s *Server) commandsList(url.Values) (response, methodError) {
+	commands := make(map[string]interface{})
+	for command := range s.commands {
+		commands[command] = map[string]string{"name": command}
+	}
+	return response{"commands": commands}, ""
+}
+
+func (s *Server) filesInfo(form url.Values) (response, methodError) {
+	f, found := s.files[form.Get("file")]
+	if !found {
+		return nil, "file_not_found"
+	}
+	return response{"file": f.File, "comments": []interface{}{}, "response_metadata": response{"next_cursor": ""}}, ""
+}
+
+func (s *Server) filesGetUploadURLExternal(form url.Values) (response, methodError) {
+	if form.Get("filename") == "" {
+		return nil, "invalid_arguments"
+	}
+
+	fileID := s.newID("F")
+	s.files[fileID] = &file{File: slack.File{ID: fileID, Name: form.Get("filename"), User: s.self}}
+	return response{"upload_url": s.server.URL + "/upload/" + fileID, "file_id": fileID}, ""
+}
+
+// filesCompleteUploadExternal shares an uploaded file to a channel, telling clients about it as Slack does
+func (s *Server) filesCompleteUploadExternal(form url.Values) (response, methodError) {
+	var summaries []slack.FileSummary
+	if err := json.Unmarshal([]byte(form.Get("files")), &summaries); err != nil || len(summaries) == 0 {
+		return nil, "invalid_arguments"
+	}
+
+	channelID := form.Get("channel_id")
+	if channelID != "" && s.channel(channelID) == nil {
+		return nil, "channel_not_found"
+	}
+
+	var shared []slack.File
+	for _, summary := range summaries {
+		f, found := s.files[summary.ID]
+		if !found || f.content == nil {
+			return nil, "file_not_found"
+		}
+		f.Title = summary.Title
+		if channelID != "" {
+			f.Channels = append(f.Channels, channelID)
+		}
+		shared = append(shared, f.File)
+	}
+
+	if channelID != "" {
+		message := s.post(slack.Msg{
+			Channel: channelID, User: s.self, SubType: "file_share", Text: form.Get("initial_comment"), Files: shared,
+		})
+		go func() {
+			s.SendEvent(message)
+			for _, f := range shared {
+				s.SendEvent(response{
+					"type":       "file_shared",
+					"file_id":    f.ID,
+					"user_id":    s.self,
+					"channel_id": channelID,
+					"file":       response{"id": f.ID},
+					"event_ts":   message.Timestamp,
+				})
+			}
+		}()
+	}
+
+	return response{"files": summaries}, ""
+}
+
+// handleUpload receives the content of a file, at the URL given by files.getUploadURLExternal
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	fileID := path.Base(r.URL.Path)
+
+	var content []byte
+	upload, _, err := r.FormFile("file")
+	if err == nil {
+		content, err = io.ReadAll(upload)
+		upload.Close()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	f, found := s.files[fileID]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	f.content = content
+	f.Size = len(content)
+	f.URLPrivate = s.server.URL + "/files/" + fileID + "/" + url.PathEscape(f.Name)
+	f.URLPrivateDownload = f.URLPrivate
+	s.notify()
+}
+
+// handleDownload serves the content of a file at its private URL, to requests with a token
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		http.Error(w, "not authed", http.StatusUnauthorized)
+		return
+	}
+
+	fileID := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/files/"), "/", 2)[0]
+	s.Lock()
+	f, found := s.files[fileID]
+	s.Unlock()
+	if !found || f.content == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(f.content)
+}
+
+// compareTimestamps compares two message ts, treating "" as before any message
+func compareTimestamps(a, b string) int {
+	pad := func(ts string) string {
+		secs, micros, _ := strings.Cut(ts, ".")
+		return strings.Repeat("0", 20-len(secs)) + secs + "." + micros
+	}
+	if a == "" || b == "" {
+		return strings.Compare(a, b)
+	}
+	return strings.Compare(pad(a), pad(b))
+}
+
+// sameMembers reports whether two lists of user IDs have the same users, in any order
+func sameMembers(a, b []string) bool {
+	count := make(map[string]int)
+	for _, userID := range a {
+		count[userID]++
+	}
+	for _, userID := range b {
+		count[userID]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
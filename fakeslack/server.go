@@ -0,0 +1,327 @@
+// Package fakeslack is an in-process fake of the parts of Slack tanya talks to: the Web API methods it
+// calls, and the RTM and Socket Mode websockets. It keeps just enough workspace state to answer them
+// consistently, so a whole gateway can be run against it in tests without a network connection.
+package fakeslack
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Team is the workspace the fake server pretends to be
+var Team = slack.Team{ID: "T0TANYA", Name: "Tanya Test", Domain: "tanya-test"}
+
+// BotID is the bot the server's token pretends to belong to, as reported by auth.test
+const BotID = "B0TANYA"
+
+// Server is a fake Slack workspace, serving the Web API under APIURL
+type Server struct {
+	server *httptest.Server
+	self   string
+
+	users      []*slack.User
+	channels   []*slack.Channel
+	members    map[string][]string
+	history    map[string][]slack.Message
+	lastRead   map[string]string
+	usergroups []slack.UserGroup
+	files      map[string]*file
+	commands   map[string]func(channelID, text string) string
+	// Web API methods made to fail, and the error they fail with
+	failures map[string]string
+
+	sockets map[*socket]struct{}
+	acks    []string
+
+	lastTimestamp time.Time
+	nextID        int
+	// Closed and replaced whenever state changes, to wake anything waiting on it
+	changed chan struct{}
+
+	sync.Mutex
+}
+
+type file struct {
+	slack.File
+	content []byte
+}
+
+// NewServer starts a fake Slack workspace in which self is the user the token belongs to
+func NewServer(self slack.User) *Server {
+	s := &Server{
+		self:     self.ID,
+		members:  make(map[string][]string),
+		history:  make(map[string][]slack.Message),
+		lastRead: make(map[string]string),
+		files:    make(map[string]*file),
+		commands: make(map[string]func(channelID, text string) string),
+		failures: make(map[string]string),
+		sockets:  make(map[*socket]struct{}),
+		changed:  make(chan struct{}),
+	}
+	s.users = append(s.users, &self)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", s.handleMethod)
+	mux.HandleFunc("/rtm", s.handleWebsocket(rtmSocket))
+	mux.HandleFunc("/socket", s.handleWebsocket(socketModeSocket))
+	mux.HandleFunc("/upload/", s.handleUpload)
+	mux.HandleFunc("/files/", s.handleDownload)
+	s.server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Close disconnects every websocket and stops the server
+func (s *Server) Close() {
+	s.Lock()
+	for sock := range s.sockets {
+		sock.conn.Close()
+	}
+	s.Unlock()
+
+	s.server.Close()
+}
+
+// APIURL is the base URL of the fake Web API, to be used in place of slack.APIURL
+func (s *Server) APIURL() string {
+	return s.server.URL + "/api/"
+}
+
+func (s *Server) websocketURL(path string) string {
+	return "ws" + strings.TrimPrefix(s.server.URL, "http") + path
+}
+
+// AddUser adds a user to the workspace
+func (s *Server) AddUser(user slack.User) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.users = append(s.users, &user)
+}
+
+// AddChannel adds a channel with the given members to the workspace. The channel counts as joined if the
+// server's own user is one of them.
+func (s *Server) AddChannel(channel slack.Channel, members ...string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if channel.Created == 0 {
+		channel.Created = slack.JSONTime(time.Now().Unix())
+	}
+	for _, member := range members {
+		if member == s.self {
+			channel.IsMember = true
+		}
+	}
+	s.channels = append(s.channels, &channel)
+	s.members[channel.ID] = members
+	s.notify()
+}
+
+// AddDM opens a DM with a user, returning its ID
+func (s *Server) AddDM(userID string) string {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.openDM(userID)
+}
+
+func (s *Server) openDM(userID string) string {
+	for _, channel := range s.channels {
+		if channel.IsIM && channel.User == userID {
+			return channel.ID
+		}
+	}
+
+	channel := &slack.Channel{}
+	channel.ID = s.newID("D")
+	channel.IsIM = true
+	channel.IsOpen = true
+	channel.User = userID
+	channel.Created = slack.JSONTime(time.Now().Unix())
+	s.channels = append(s.channels, channel)
+	s.members[channel.ID] = []string{s.self, userID}
+	s.notify()
+	return channel.ID
+}
+
+// AddUsergroup adds a usergroup to the workspace
+func (s *Server) AddUsergroup(usergroup slack.UserGroup) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.usergroups = append(s.usergroups, usergroup)
+}
+
+// AddSlashCommand adds a slash command such as "/remind", which run calls with the conversation it's run in
+// and its arguments, returning the reply shown only to whoever ran it. run is called with the server locked.
+func (s *Server) AddSlashCommand(command string, run func(channelID, text string) string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.commands[command] = run
+}
+
+// FailMethod makes calls to a Web API method, such as "users.list", fail with an error like "internal_error"
+// until it's called again with an empty error
+func (s *Server) FailMethod(method, err string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err == "" {
+		delete(s.failures, method)
+	} else {
+		s.failures[method] = err
+	}
+}
+
+// AddFile adds a file shared by a user to a channel, returning its ID. Clients aren't told about it.
+func (s *Server) AddFile(channelID, userID, name string, content []byte) string {
+	s.Lock()
+	defer s.Unlock()
+
+	fileID := s.newID("F")
+	f := &file{File: slack.File{ID: fileID, Name: name, Title: name, User: userID, Size: len(content)}, content: content}
+	f.Channels = []string{channelID}
+	f.URLPrivate = s.server.URL + "/files/" + fileID + "/" + url.PathEscape(name)
+	f.URLPrivateDownload = f.URLPrivate
+	s.files[fileID] = f
+	return fileID
+}
+
+// FileContent returns the content of an uploaded file
+func (s *Server) FileContent(fileID string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	f, found := s.files[fileID]
+	if !found {
+		return nil, false
+	}
+	return f.content, true
+}
+
+// Post adds a message from a user to a conversation and sends it to every connected client, returning its ts
+func (s *Server) Post(channelID, userID, text string) string {
+	s.Lock()
+	message := s.post(slack.Msg{Channel: channelID, User: userID, Text: text})
+	s.Unlock()
+
+	s.SendEvent(message)
+	return message.Timestamp
+}
+
+func (s *Server) post(msg slack.Msg) slack.Message {
+	msg.Type = "message"
+	msg.Timestamp = s.newTimestamp()
+	message := slack.Message{Msg: msg}
+
+	s.history[msg.Channel] = append(s.history[msg.Channel], message)
+	s.notify()
+	return message
+}
+
+// Messages returns the messages sent to a conversation, oldest first
+func (s *Server) Messages(channelID string) []slack.Message {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]slack.Message(nil), s.history[channelID]...)
+}
+
+// LastRead returns how far a conversation has been marked read by conversations.mark
+func (s *Server) LastRead(channelID string) string {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.lastRead[channelID]
+}
+
+// Acks returns the envelope IDs of the Socket Mode requests acknowledged so far
+func (s *Server) Acks() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]string(nil), s.acks...)
+}
+
+// WaitFor waits until cond, which is called with the server locked, is true. It returns false if that
+// didn't happen within timeout.
+func (s *Server) WaitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.After(timeout)
+	for {
+		s.Lock()
+		done := cond()
+		changed := s.changed
+		s.Unlock()
+
+		if done {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// WaitForMessages waits until a conversation has at least n messages, returning them
+func (s *Server) WaitForMessages(channelID string, n int, timeout time.Duration) []slack.Message {
+	s.WaitFor(timeout, func() bool { return len(s.history[channelID]) >= n })
+	return s.Messages(channelID)
+}
+
+// WaitForConnection waits until a client has connected by RTM or Socket Mode
+func (s *Server) WaitForConnection(timeout time.Duration) bool {
+	return s.WaitFor(timeout, func() bool { return len(s.sockets) > 0 })
+}
+
+// notify wakes up anything waiting for the state to change. The server must be locked.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// newID makes up a new Slack ID with the given prefix. The server must be locked.
+func (s *Server) newID(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s%08d", prefix, s.nextID)
+}
+
+// newTimestamp returns a message ts after every one before it. The server must be locked.
+func (s *Server) newTimestamp() string {
+	t := time.Now().Truncate(time.Microsecond)
+	if !t.After(s.lastTimestamp) {
+		t = s.lastTimestamp.Add(time.Microsecond)
+	}
+	s.lastTimestamp = t
+
+	return fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/int(time.Microsecond))
+}
+
+func (s *Server) user(userID string) *slack.User {
+	for _, user := range s.users {
+		if user.ID == userID {
+			return user
+		}
+	}
+	return nil
+}
+
+func (s *Server) channel(channelID string) *slack.Channel {
+	for _, channel := range s.channels {
+		if channel.ID == channelID {
+			return channel
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package fakeslack
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type socketKind int
+
+const (
+	rtmSocket socketKind = iota
+	socketModeSocket
+)
+
+// How often Socket Mode connections are pinged, which the client expects Slack to do
+const socketModePingInterval = 10 * time.Second
+
+var upgrader = websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+
+// socket is a client's RTM or Socket Mode connection
+type socket struct {
+	kind socketKind
+	conn *websocket.Conn
+
+	sync.Mutex
+}
+
+func (sock *socket) write(v interface{}) error {
+	sock.Lock()
+	defer sock.Unlock()
+
+	return sock.conn.WriteJSON(v)
+}
+
+// handleWebsocket accepts RTM or Socket Mode connections, greeting them and then answering pings and
+// recording acknowledgements until they disconnect
+func (s *Server) handleWebsocket(kind socketKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("fakeslack: websocket upgrade failed: %v", err)
+			return
+		}
+		sock := &socket{kind: kind, conn: conn}
+
+		switch kind {
+		case rtmSocket:
+			err = sock.write(map[string]interface{}{"type": "hello"})
+		case socketModeSocket:
+			err = sock.write(map[string]interface{}{
+				"type":            "hello",
+				"num_connections": 1,
+				"connection_info": map[string]string{"app_id": "A0TANYA"},
+			})
+		}
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		s.Lock()
+		s.sockets[sock] = struct{}{}
+		s.notify()
+		s.Unlock()
+
+		stopPinging := make(chan struct{})
+		if kind == socketModeSocket {
+			go sock.ping(stopPinging)
+		}
+
+		s.readSocket(sock)
+
+		close(stopPinging)
+		conn.Close()
+		s.Lock()
+		delete(s.sockets, sock)
+		s.notify()
+		s.Unlock()
+	}
+}
+
+func (sock *socket) ping(stopChan <-chan struct{}) {
+	ticker := time.NewTicker(socketModePingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			sock.Lock()
+			err := sock.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+			sock.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) readSocket(sock *socket) {
+	for {
+		var message struct {
+			Type       string `json:"type"`
+			ID         int    `json:"id"`
+			EnvelopeID string `json:"envelope_id"`
+		}
+		if err := sock.conn.ReadJSON(&message); err != nil {
+			return
+		}
+
+		switch {
+		case message.Type == "ping":
+			sock.write(map[string]interface{}{"type": "pong", "reply_to": message.ID})
+		case message.EnvelopeID != "":
+			s.Lock()
+			s.acks = append(s.acks, message.EnvelopeID)
+			s.notify()
+			s.Unlock()
+		}
+	}
+}
+
+// SendEvent sends an event to every connected client: as it is over RTM, and wrapped as an Events API
+// callback over Socket Mode
+func (s *Server) SendEvent(event interface{}) {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		log.Panicf("fakeslack: could not marshal event %+v: %v", event, err)
+	}
+
+	s.Lock()
+	sockets := make([]*socket, 0, len(s.sockets))
+	for sock := range s.sockets {
+		sockets = append(sockets, sock)
+	}
+	envelopeID := s.newID("envelope")
+	eventID := s.newID("Ev")
+	s.Unlock()
+
+	for _, sock := range sockets {
+		switch sock.kind {
+		case rtmSocket:
+			err = sock.write(json.RawMessage(raw))
+		case socketModeSocket:
+			err = sock.write(map[string]interface{}{
+				"envelope_id":              envelopeID,
+				"type":                     "events_api",
+				"accepts_response_payload": false,
+				"payload": map[string]interface{}{
+					"token":      "fake",
+					"team_id":    Team.ID,
+					"api_app_id": "A0TANYA",
+					"type":       "event_callback",
+					"event_id":   eventID,
+					"event_time": time.Now().Unix(),
+					"event":      json.RawMessage(raw),
+				},
+			})
+		}
+		if err != nil {
+			log.Printf("fakeslack: could not send event: %v", err)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nolanlum/tanya/backend"
+	"github.com/slack-go/slack"
+)
+
+// Backend is a SlackClient as a backend.Backend, so it can sit behind the IRC server
+type Backend struct {
+	sc *SlackClient
+}
+
+// NewBackend makes an initialized SlackClient into a backend.Backend
+func NewBackend(sc *SlackClient) *Backend {
+	return &Backend{sc: sc}
+}
+
+func backendUser(u *SlackUser) backend.User {
+	return backend.User{ID: u.SlackID, Nick: u.Nick, RealName: u.RealName}
+}
+
+func backendMessage(m *MessageEventData) *backend.Message {
+	message := &backend.Message{From: backendUser(&m.From), Target: m.Target, Text: m.Message}
+	if m.Timestamp != "" {
+		message.Time = ParseSlackTimestamp(m.Timestamp)
+		message.ID = m.MsgID
+	}
+	return message
+}
+
+// backendEvent translates an event from Slack into its backend equivalent
+func backendEvent(e *SlackEvent) *backend.Event {
+	switch e.EventType {
+	case SlackConnectedEvent:
+		d := e.Data.(*SlackConnectedEventData)
+		return &backend.Event{EventType: backend.ConnectedEvent, Data: &backend.ConnectedEventData{Self: backendUser(d.UserInfo)}}
+	case MessageEvent:
+		return &backend.Event{EventType: backend.MessageEvent, Data: backendMessage(e.Data.(*MessageEventData))}
+	case MentionEvent:
+		return &backend.Event{EventType: backend.MentionEvent, Data: backendMessage(e.Data.(*MessageEventData))}
+	case NoticeEvent:
+		return &backend.Event{EventType: backend.NoticeEvent, Data: backendMessage(e.Data.(*MessageEventData))}
+	case MultilineMessageEvent:
+		var lines []*backend.Message
+		for _, line := range e.Data.(*MultilineMessageEventData).Lines {
+			lines = append(lines, backendMessage(line))
+		}
+		return &backend.Event{EventType: backend.MultilineMessageEvent, Data: &backend.MultilineMessageEventData{Lines: lines}}
+	case NickChangeEvent:
+		d := e.Data.(*NickChangeEventData)
+		return &backend.Event{EventType: backend.NickChangeEvent, Data: &backend.NickChangeEventData{
+			From: backendUser(&d.From), NewNick: d.NewNick}}
+	case TopicChangeEvent:
+		d := e.Data.(*TopicChangeEventData)
+		return &backend.Event{EventType: backend.TopicChangeEvent, Data: &backend.TopicChangeEventData{
+			From: backendUser(&d.From), Target: d.Target, NewTopic: d.NewTopic}}
+	case SelfJoinEvent, SelfPartEvent, JoinEvent, PartEvent:
+		eventTypes := map[SlackEventType]backend.EventType{
+			SelfJoinEvent: backend.SelfJoinEvent,
+			SelfPartEvent: backend.SelfPartEvent,
+			JoinEvent:     backend.JoinEvent,
+			PartEvent:     backend.PartEvent,
+		}
+		d := e.Data.(*JoinPartEventData)
+		return &backend.Event{EventType: eventTypes[e.EventType], Data: &backend.JoinPartEventData{
+			User: backendUser(&d.User), Target: d.Target, Reason: d.Reason}}
+	case ChannelRenameEvent:
+		d := e.Data.(*ChannelRenameEventData)
+		return &backend.Event{EventType: backend.ChannelRenameEvent, Data: &backend.ChannelRenameEventData{
+			OldName: d.OldName, NewName: d.NewName}}
+	case ReadMarkerEvent:
+		d := e.Data.(*ReadMarkerEventData)
+		return &backend.Event{EventType: backend.ReadMarkerEvent, Data: &backend.ReadMarkerEventData{
+			Target: d.Target, Time: ParseSlackTimestamp(d.Timestamp)}}
+	case UnreadSummaryEvent:
+		return &backend.Event{EventType: backend.UnreadSummaryEvent}
+	case FileSharedEvent:
+		d := e.Data.(*FileSharedEventData)
+		return &backend.Event{EventType: backend.FileSharedEvent, Data: &backend.FileSharedEventData{
+			From: backendUser(&d.From), Target: d.Target, Name: d.Name, Size: int64(d.Size), URL: d.URL}}
+	}
+	return nil
+}
+
+// Run implements backend.Backend.Run
+func (b *Backend) Run(eventChan chan<- *backend.Event, stopChan <-chan struct{}) {
+	slackEventChan := make(chan *SlackEvent)
+	go b.sc.Poop(&ClientChans{
+		IncomingChan: slackEventChan,
+		StopChan:     stopChan,
+	})
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case e := <-slackEventChan:
+			event := backendEvent(e)
+			if event == nil {
+				continue
+			}
+			select {
+			case eventChan <- event:
+			case <-stopChan:
+				return
+			}
+		}
+	}
+}
+
+// Tag implements backend.Backend.Tag
+func (b *Backend) Tag() string {
+	return b.sc.Tag()
+}
+
+// Status implements backend.Backend.Status
+func (b *Backend) Status() backend.Status {
+	connected, since := b.sc.ConnectionStatus()
+
+	transport := b.sc.config.Transport
+	if transport == "" {
+		transport = TransportRTM
+	}
+	return backend.Status{Connected: connected, Since: since, Detail: "over " + transport}
+}
+
+// Reconnect implements backend.Backend.Reconnect
+func (b *Backend) Reconnect() error {
+	return b.sc.Reconnect()
+}
+
+// Resync implements backend.Backend.Resync
+func (b *Backend) Resync() error {
+	return b.sc.Resync()
+}
+
+// Channel implements backend.Backend.Channel
+func (b *Backend) Channel(name string) (backend.Channel, bool) {
+	channel := b.sc.ResolveNameToChannel(name)
+	if channel == nil {
+		return backend.Channel{}, false
+	}
+
+	c := backend.Channel{
+		Name:    channel.Name,
+		Created: channel.Created,
+		Private: channel.Private,
+		Topic: backend.Topic{
+			Text:  b.sc.ParseMessageText(channel.Topic.Value),
+			SetAt: channel.Topic.LastSet.Time(),
+		},
+	}
+	if channel.Topic.Creator != "" {
+		setBy, err := b.sc.ResolveUser(channel.Topic.Creator)
+		if err != nil {
+			log.Printf("%s error while querying topic creator for %v: %v", b.sc.Tag(), name, err)
+		} else {
+			c.Topic.SetBy = setBy.Nick
+		}
+	}
+	return c, true
+}
+
+// ChannelMembers implements backend.Backend.ChannelMembers
+func (b *Backend) ChannelMembers(name string) ([]backend.User, error) {
+	channel := b.sc.ResolveNameToChannel(name)
+	if channel == nil {
+		return nil, fmt.Errorf("no such channel: %v", name)
+	}
+
+	channelUsers, err := b.sc.GetChannelUsers(channel.SlackID)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []backend.User
+	for _, user := range channelUsers {
+		users = append(users, backendUser(&user))
+	}
+	return users, nil
+}
+
+// JoinedChannels implements backend.Backend.JoinedChannels
+func (b *Backend) JoinedChannels() []string {
+	var channelNames []string
+	for _, channel := range b.sc.GetChannelMemberships() {
+		channelNames = append(channelNames, channel.Name)
+	}
+	return channelNames
+}
+
+// JoinChannel implements backend.Backend.JoinChannel
+func (b *Backend) JoinChannel(name string) error {
+	channel := b.sc.ResolveNameToChannel(name)
+	if channel == nil {
+		return fmt.Errorf("no such channel: %v", name)
+	}
+	return b.sc.JoinChannel(channel)
+}
+
+// LeaveChannel implements backend.Backend.LeaveChannel
+func (b *Backend) LeaveChannel(name string) error {
+	channel := b.sc.ResolveNameToChannel(name)
+	if channel == nil {
+		return fmt.Errorf("no such channel: %v", name)
+	}
+	return b.sc.LeaveChannel(channel)
+}
+
+// UserByNick implements backend.Backend.UserByNick
+func (b *Backend) UserByNick(nick string) (backend.User, bool) {
+	slackUser := b.sc.ResolveNickToUser(nick)
+	if slackUser == nil {
+		return backend.User{}, false
+	}
+	return backendUser(slackUser), true
+}
+
+// Send implements backend.Backend.Send
+func (b *Backend) Send(target, text string) (string, error) {
+	if strings.HasPrefix(target, "#") {
+		channel := b.sc.ResolveNameToChannel(target)
+		if channel == nil {
+			return "", fmt.Errorf("no such channel: %v", target)
+		}
+		return target, b.sc.SendMessage(channel, text)
+	}
+
+	// Messaging a list of nicks opens (or reuses) the group DM with exactly those users
+	var slackUsers []*SlackUser
+	for _, nick := range strings.Split(target, ",") {
+		slackUser := b.sc.ResolveNickToUser(nick)
+		if slackUser == nil {
+			return "", fmt.Errorf("no such nick: %v", nick)
+		}
+		slackUsers = append(slackUsers, slackUser)
+	}
+	if len(slackUsers) > 1 {
+		return b.sc.SendGroupDirectMessage(slackUsers, text)
+	}
+	return target, b.sc.SendDirectMessage(slackUsers[0], text)
+}
+
+// SlashCommand implements backend.Backend.SlashCommand
+func (b *Backend) SlashCommand(target, command, args string) (string, error) {
+	conversationID, err := b.resolveConversation(target)
+	if err != nil {
+		return "", err
+	}
+	response, err := b.sc.RunSlashCommand(conversationID, command, args)
+	var slackErr slack.SlackErrorResponse
+	if errors.As(err, &slackErr) && slackErr.Err == "invalid_command" {
+		return "", backend.ErrUnknownCommand
+	}
+	return response, err
+}
+
+// HasSlashCommand implements backend.Backend.HasSlashCommand
+func (b *Backend) HasSlashCommand(command string) bool {
+	return b.sc.HasSlashCommand(command)
+}
+
+// resolveConversation resolves a channel name or nick to a Slack conversation ID
+func (b *Backend) resolveConversation(target string) (string, error) {
+	if strings.HasPrefix(target, "#") {
+		channel := b.sc.ResolveNameToChannel(target)
+		if channel == nil {
+			return "", fmt.Errorf("no such channel: %v", target)
+		}
+		return channel.SlackID, nil
+	}
+
+	slackUser := b.sc.ResolveNickToUser(target)
+	if slackUser == nil {
+		return "", fmt.Errorf("no such nick: %v", target)
+	}
+	return b.sc.ResolveUserToDM(slackUser)
+}
+
+// History implements backend.Backend.History
+func (b *Backend) History(target string, after, before time.Time, limit int, latest bool) ([]backend.Message, error) {
+	conversationID, err := b.resolveConversation(target)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := b.sc.GetHistory(conversationID, FormatSlackTimestamp(after), FormatSlackTimestamp(before), limit, latest)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []backend.Message
+	for _, m := range history {
+		messages = append(messages, *backendMessage(m))
+	}
+	return messages, nil
+}
+
+// ActiveConversations implements backend.Backend.ActiveConversations
+func (b *Backend) ActiveConversations(after, before time.Time) ([]backend.ConversationActivity, error) {
+	activity, err := b.sc.GetActiveConversations(FormatSlackTimestamp(after), FormatSlackTimestamp(before))
+	if err != nil {
+		return nil, err
+	}
+
+	var conversations []backend.ConversationActivity
+	for _, a := range activity {
+		conversations = append(conversations, backend.ConversationActivity{Target: a.Target, Latest: ParseSlackTimestamp(a.Timestamp)})
+	}
+	return conversations, nil
+}
+
+// MessageTime implements backend.Backend.MessageTime
+func (b *Backend) MessageTime(id string) (time.Time, bool) {
+	t := ParseSlackTimestamp(MsgIDTimestamp(id))
+	return t, !t.IsZero()
+}
+
+// Search implements backend.Backend.Search
+func (b *Backend) Search(query string, page int) (backend.SearchResults, error) {
+	results, err := b.sc.SearchMessages(query, page)
+	if err != nil {
+		return backend.SearchResults{}, err
+	}
+
+	backendResults := backend.SearchResults{Page: results.Page, Pages: results.Pages, Total: results.Total}
+	for _, message := range results.Messages {
+		backendResults.Messages = append(backendResults.Messages, *backendMessage(message))
+	}
+	return backendResults, nil
+}
+
+// ReadMarker implements backend.Backend.ReadMarker
+func (b *Backend) ReadMarker(target string) (time.Time, error) {
+	conversationID, err := b.resolveConversation(target)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return ParseSlackTimestamp(b.sc.GetReadCursor(conversationID)), nil
+}
+
+// SetReadMarker implements backend.Backend.SetReadMarker
+func (b *Backend) SetReadMarker(target string, t time.Time) (time.Time, error) {
+	conversationID, err := b.resolveConversation(target)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return ParseSlackTimestamp(b.sc.MarkConversationRead(conversationID, FormatSlackTimestamp(t))), nil
+}
+
+// UnreadCounts implements backend.Backend.UnreadCounts
+func (b *Backend) UnreadCounts() ([]backend.UnreadCount, bool) {
+	counts, ready := b.sc.GetUnreadCounts()
+
+	var unreads []backend.UnreadCount
+	for _, count := range counts {
+		unreads = append(unreads, backend.UnreadCount{
+			Target:   count.Target,
+			DM:       count.DM,
+			Unreads:  count.Unreads,
+			Mentions: count.Mentions,
+		})
+	}
+	return unreads, ready
+}
+
+// UploadFile implements backend.Backend.UploadFile
+func (b *Backend) UploadFile(target, filename string, file io.Reader, size int, comment string) error {
+	conversationID, err := b.resolveConversation(target)
+	if err != nil {
+		return err
+	}
+	return b.sc.UploadFile(conversationID, filename, file, size, comment)
+}
+
+// DownloadFile implements backend.Backend.DownloadFile
+func (b *Backend) DownloadFile(url string, w io.Writer) error {
+	return b.sc.DownloadFile(url, w)
+}
@@ -0,0 +1,207 @@
+package gateway
+
+import (
+	"errors"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// handleChannelCreated caches a newly created channel. We won't be a member unless we created it,
+// in which case Slack follows up with a channel_joined event.
+func (sc *SlackClient) handleChannelCreated(info *slack.ChannelCreatedInfo) {
+	channel := &SlackChannel{
+		SlackID: info.ID,
+		Name:    "#" + info.Name,
+		Created: time.Unix(int64(info.Created), 0),
+	}
+
+	sc.Lock()
+	sc.channelInfo[channel.SlackID] = channel
+	sc.channelNameToIDMap[channel.Name] = channel.SlackID
+	sc.Unlock()
+}
+
+// handleChannelRenamed updates the cached name of a channel, returning a ChannelRenameEvent if we
+// are a member of it. The channel object is replaced rather than modified, as other goroutines may
+// hold references to the old one.
+func (sc *SlackClient) handleChannelRenamed(channelID, newName string) *SlackEvent {
+	sc.Lock()
+	defer sc.Unlock()
+
+	channel, found := sc.channelInfo[channelID]
+	if !found || channel.GroupDM {
+		// If we've never seen this channel, we'll get the new name whenever we resolve it
+		return nil
+	}
+
+	return sc.renameChannel(channel, "#"+newName)
+}
+
+// renameChannel replaces a cached channel with a copy under a new name, returning a ChannelRenameEvent if
+// we are a member of it. Callers must hold the lock.
+func (sc *SlackClient) renameChannel(channel *SlackChannel, newName string) *SlackEvent {
+	if newName == channel.Name {
+		return nil
+	}
+
+	channelID := channel.SlackID
+	renamed := *channel
+	renamed.Name = newName
+
+	if sc.channelNameToIDMap[channel.Name] == channelID {
+		delete(sc.channelNameToIDMap, channel.Name)
+	}
+	sc.channelNameToIDMap[renamed.Name] = channelID
+	sc.channelInfo[channelID] = &renamed
+
+	if _, isMember := sc.channelMemberships[channelID]; !isMember {
+		return nil
+	}
+	sc.channelMemberships[channelID] = &renamed
+
+	return &SlackEvent{
+		EventType: ChannelRenameEvent,
+		Data: &ChannelRenameEventData{
+			OldName: channel.Name,
+			NewName: renamed.Name,
+		},
+	}
+}
+
+// handleChannelRemoved drops a channel which was archived or deleted from our mappings, returning a
+// SelfPartEvent if we were a member of it
+func (sc *SlackClient) handleChannelRemoved(channelID, reason string) *SlackEvent {
+	sc.Lock()
+	defer sc.Unlock()
+
+	channel, found := sc.channelInfo[channelID]
+	if !found {
+		return nil
+	}
+
+	_, isMember := sc.channelMemberships[channelID]
+	if sc.channelNameToIDMap[channel.Name] == channelID {
+		delete(sc.channelNameToIDMap, channel.Name)
+	}
+	delete(sc.channelInfo, channelID)
+	delete(sc.channelMemberships, channelID)
+	delete(sc.channelMembers, channelID)
+
+	if !isMember {
+		return nil
+	}
+
+	return &SlackEvent{
+		EventType: SelfPartEvent,
+		Data: &JoinPartEventData{
+			User:   *sc.self,
+			Target: channel.Name,
+			Reason: reason,
+		},
+	}
+}
+
+// handleChannelRefreshed re-fetches a channel whose properties changed (e.g. on unarchival or conversion
+// to a private channel), replacing any cached copy. Returns a SelfJoinEvent if we are newly a member of it.
+func (sc *SlackClient) handleChannelRefreshed(channelID string) (*SlackEvent, error) {
+	channelInfo, err := sc.client.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: channelID})
+	if err != nil {
+		return nil, err
+	}
+
+	channel := slackChannelFromDto(channelInfo)
+	if channel.GroupDM {
+		if err = sc.nameGroupDM(channel); err != nil {
+			return nil, err
+		}
+	}
+
+	sc.Lock()
+	oldChannel, found := sc.channelInfo[channelID]
+	if found && sc.channelNameToIDMap[oldChannel.Name] == channelID {
+		delete(sc.channelNameToIDMap, oldChannel.Name)
+	}
+	sc.channelInfo[channelID] = channel
+	sc.channelNameToIDMap[channel.Name] = channelID
+
+	_, wasMember := sc.channelMemberships[channelID]
+	isMember := channelInfo.IsMember || channel.GroupDM
+	if isMember {
+		sc.channelMemberships[channelID] = channel
+	} else {
+		delete(sc.channelMemberships, channelID)
+	}
+	sc.Unlock()
+
+	switch {
+	case isMember && !wasMember:
+		return &SlackEvent{
+			EventType: SelfJoinEvent,
+			Data: &JoinPartEventData{
+				User:   *sc.self,
+				Target: channel.Name,
+			},
+		}, nil
+
+	case isMember && found && oldChannel.Name != channel.Name:
+		return &SlackEvent{
+			EventType: ChannelRenameEvent,
+			Data: &ChannelRenameEventData{
+				OldName: oldChannel.Name,
+				NewName: channel.Name,
+			},
+		}, nil
+
+	case !isMember && wasMember:
+		return &SlackEvent{
+			EventType: SelfPartEvent,
+			Data: &JoinPartEventData{
+				User:   *sc.self,
+				Target: channel.Name,
+			},
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// JoinChannel joins a channel on Slack, sending a SelfJoinEvent without waiting for Slack to tell us
+func (sc *SlackClient) JoinChannel(channel *SlackChannel) error {
+	if _, _, _, err := sc.client.JoinConversation(channel.SlackID); err != nil {
+		return err
+	}
+
+	sc.RLock()
+	self := sc.self
+	sc.RUnlock()
+	if self == nil {
+		return errors.New("not connected to slack yet")
+	}
+
+	joinEvent, err := sc.handleMemberJoinedChannel(channel.SlackID, self.SlackID)
+	if err != nil || joinEvent == nil {
+		return err
+	}
+	return sc.sendEvent(joinEvent)
+}
+
+// LeaveChannel leaves a channel on Slack, sending a SelfPartEvent without waiting for Slack to tell us
+func (sc *SlackClient) LeaveChannel(channel *SlackChannel) error {
+	if _, err := sc.client.LeaveConversation(channel.SlackID); err != nil {
+		return err
+	}
+
+	sc.RLock()
+	self := sc.self
+	sc.RUnlock()
+	if self == nil {
+		return errors.New("not connected to slack yet")
+	}
+
+	partEvent, err := sc.handleMemberLeftChannel(channel.SlackID, self.SlackID)
+	if err != nil || partEvent == nil {
+		return err
+	}
+	return sc.sendEvent(partEvent)
+}
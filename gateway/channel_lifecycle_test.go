@@ -0,0 +1,82 @@
+package gateway
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newLifecycleTestClient() *SlackClient {
+	sc := NewSlackClient()
+	sc.self = &SlackUser{SlackID: "U0SELF", Nick: "papika"}
+	sc.channelInfo = map[string]*SlackChannel{
+		"C2EFNRK1S": {SlackID: "C2EFNRK1S", Name: "#chatter-technical"},
+		"C024BE91L": {SlackID: "C024BE91L", Name: "#random"},
+	}
+	sc.channelMemberships = map[string]*SlackChannel{
+		"C2EFNRK1S": sc.channelInfo["C2EFNRK1S"],
+	}
+	sc.regenerateReverseMappings()
+	return sc
+}
+
+func TestSlackClient_handleChannelRenamed(t *testing.T) {
+	sc := newLifecycleTestClient()
+
+	got := sc.handleChannelRenamed("C2EFNRK1S", "chatter-nontechnical")
+	want := &SlackEvent{
+		EventType: ChannelRenameEvent,
+		Data: &ChannelRenameEventData{
+			OldName: "#chatter-technical",
+			NewName: "#chatter-nontechnical",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SlackClient.handleChannelRenamed() = %+v, want %+v", got, want)
+	}
+
+	if channel := sc.ResolveNameToChannel("#chatter-nontechnical"); channel == nil || channel.SlackID != "C2EFNRK1S" {
+		t.Errorf("SlackClient.ResolveNameToChannel() of new name = %+v", channel)
+	}
+	if channel := sc.ResolveNameToChannel("#chatter-technical"); channel != nil {
+		t.Errorf("SlackClient.ResolveNameToChannel() of old name = %+v, want nil", channel)
+	}
+	if memberships := sc.GetChannelMemberships(); memberships[0].Name != "#chatter-nontechnical" {
+		t.Errorf("SlackClient.GetChannelMemberships() = %+v", memberships)
+	}
+
+	// Renames of channels we aren't in only update the mappings
+	if got := sc.handleChannelRenamed("C024BE91L", "general"); got != nil {
+		t.Errorf("SlackClient.handleChannelRenamed() for non-member = %+v, want nil", got)
+	}
+	if channel := sc.ResolveNameToChannel("#general"); channel == nil {
+		t.Error("SlackClient.ResolveNameToChannel() of non-member new name = nil")
+	}
+}
+
+func TestSlackClient_handleChannelRemoved(t *testing.T) {
+	sc := newLifecycleTestClient()
+
+	got := sc.handleChannelRemoved("C2EFNRK1S", "Channel archived")
+	want := &SlackEvent{
+		EventType: SelfPartEvent,
+		Data: &JoinPartEventData{
+			User:   *sc.self,
+			Target: "#chatter-technical",
+			Reason: "Channel archived",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SlackClient.handleChannelRemoved() = %+v, want %+v", got, want)
+	}
+
+	if channel := sc.ResolveNameToChannel("#chatter-technical"); channel != nil {
+		t.Errorf("SlackClient.ResolveNameToChannel() of removed channel = %+v, want nil", channel)
+	}
+	if memberships := sc.GetChannelMemberships(); len(memberships) != 0 {
+		t.Errorf("SlackClient.GetChannelMemberships() = %+v, want none", memberships)
+	}
+
+	if got := sc.handleChannelRemoved("C024BE91L", "Channel deleted"); got != nil {
+		t.Errorf("SlackClient.handleChannelRemoved() for non-member = %+v, want nil", got)
+	}
+}
@@ -8,36 +8,52 @@ import (
 	"github.com/slack-go/slack"
 )
 
-// getChannelUsersFromAPI queries the Slack API for a list of users in the given channel, returning
-// SlackUser objects for each one
-func (sc *SlackClient) getChannelUsersFromAPI(channelID string) (users []*SlackUser, err error) {
+// getChannelUserIDsFromAPI queries the Slack API for the IDs of the users in the given channel
+func (sc *SlackClient) getChannelUserIDsFromAPI(channelID string) (userIDs []string, err error) {
 	hasMore := true
 	guicp := &slack.GetUsersInConversationParameters{
 		ChannelID: channelID,
 		Limit:     1000,
 	}
 	for hasMore {
-		var userIDs []string
-		userIDs, guicp.Cursor, err = sc.client.GetUsersInConversation(guicp)
+		var pageUserIDs []string
+		var cursor string
+		err = sc.retryRateLimited("conversations.members", func() (err error) {
+			pageUserIDs, cursor, err = sc.client.GetUsersInConversation(guicp)
+			return
+		})
 		if err != nil {
 			return
 		}
+		guicp.Cursor = cursor
 
-		for _, userID := range userIDs {
-			var user *SlackUser
-			user, err = sc.ResolveUser(userID)
-			if err != nil {
-				return
-			}
-			users = append(users, user)
-		}
-
+		userIDs = append(userIDs, pageUserIDs...)
 		hasMore = guicp.Cursor != ""
 	}
 
 	return
 }
 
+// getChannelUsersFromAPI queries the Slack API for a list of users in the given channel, returning
+// SlackUser objects for each one
+func (sc *SlackClient) getChannelUsersFromAPI(channelID string) (users []*SlackUser, err error) {
+	userIDs, err := sc.getChannelUserIDsFromAPI(channelID)
+	if err != nil {
+		return
+	}
+
+	for _, userID := range userIDs {
+		var user *SlackUser
+		user, err = sc.ResolveUser(userID)
+		if err != nil {
+			return
+		}
+		users = append(users, user)
+	}
+
+	return
+}
+
 // bootstrapChannelUserList fetches user lists for all channels the SlackClient is a member of
 func (sc *SlackClient) bootstrapChannelUserList() {
 	var wg sync.WaitGroup
@@ -62,7 +78,10 @@ func (sc *SlackClient) bootstrapChannelUserList() {
 	}
 	wg.Wait()
 
-	log.Printf("%s slack:init channel_userlists:%v time:%v", sc.Tag(), len(sc.channelMembers), time.Since(startTime))
+	sc.RLock()
+	channelUserLists := len(sc.channelMembers)
+	sc.RUnlock()
+	log.Printf("%s slack:init channel_userlists:%v time:%v", sc.Tag(), channelUserLists, time.Since(startTime))
 }
 
 // GetChannelUsers returns a locally cached list of users in the given channel
@@ -123,6 +142,16 @@ func (sc *SlackClient) handleMemberJoinedChannel(channelID, userID string) (*Sla
 	eventType := JoinEvent
 	if user == sc.self {
 		eventType = SelfJoinEvent
+
+		sc.Lock()
+		_, alreadyJoined := sc.channelMemberships[channelID]
+		sc.channelMemberships[channelID] = target
+		sc.Unlock()
+
+		// Slack may tell us about our own membership more than once, e.g. when a channel is made private
+		if alreadyJoined {
+			return nil, nil
+		}
 	}
 
 	return &SlackEvent{
@@ -154,8 +183,23 @@ func (sc *SlackClient) handleMemberLeftChannel(channelID, userID string) (*Slack
 		sc.Unlock()
 	}
 
+	eventType := PartEvent
+	if user == sc.self {
+		eventType = SelfPartEvent
+
+		sc.Lock()
+		_, wasJoined := sc.channelMemberships[channelID]
+		delete(sc.channelMemberships, channelID)
+		sc.Unlock()
+
+		// We may have already handled leaving, e.g. when we left from IRC
+		if !wasJoined {
+			return nil, nil
+		}
+	}
+
 	return &SlackEvent{
-		EventType: PartEvent,
+		EventType: eventType,
 		Data: &JoinPartEventData{
 			User:   *user,
 			Target: target.Name,
@@ -0,0 +1,78 @@
+package gateway
+
+import (
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Config holds configurable parameters for the Slack side of a gateway
+type Config struct {
+	Token string
+
+	// Base URL of the Slack Web API, if not Slack's own, e.g. for testing against a fake
+	APIURL string
+
+	// How events are received from Slack: "rtm", "socketmode" or "events"
+	Transport string
+	// App-level token (xapp-...) with connections:write, needed for Socket Mode
+	AppToken string
+	// Where the Events API receiver listens for requests from Slack, and the secret they're signed with
+	EventsListenAddr string
+	SigningSecret    string
+
+	// Convert a leading "nick: " in outgoing messages into a Slack mention
+	NickColonMentions bool
+
+	// Words which count as mentioning us, in addition to our name, usergroups, @channel and @here
+	MentionKeywords []string
+
+	// Messages from Slackbot (reminders, its replies, and apps' ephemeral messages) matching any of these
+	// regular expressions, ignoring case, aren't passed on to IRC
+	IgnoreSlackbot []string
+
+	// Messages from IRC with at least this many lines or bytes are uploaded as a snippet instead, as is
+	// anything wrapped in ```. Zero disables either limit.
+	SnippetMinLines int
+	SnippetMinBytes int
+
+	// If set, links to files shared on Slack go through a proxy listening here, which fetches them with
+	// the token so they open without logging in
+	FileProxyListenAddr string
+	// Base URL of the file proxy as IRC clients reach it, if not http:// and the listen address
+	FileProxyURL string
+	// How long file proxy links work for
+	FileProxyLinkTTL time.Duration
+	// Bytes of recently fetched files the file proxy keeps in memory
+	FileProxyCacheSize int64
+}
+
+// apiURL returns the base URL of the Web API, with the trailing slash slack-go expects
+func (c *Config) apiURL() string {
+	if c.APIURL == "" {
+		return slack.APIURL
+	}
+	return strings.TrimSuffix(c.APIURL, "/") + "/"
+}
+
+// usesRTM reports whether events are received over RTM, which sends some events the others don't
+func (c *Config) usesRTM() bool {
+	return c.Transport == "" || c.Transport == TransportRTM
+}
+
+// hasUserToken reports whether Token acts as a user rather than a bot, which some methods the official
+// clients use, such as chat.command, need
+func (c *Config) hasUserToken() bool {
+	return strings.HasPrefix(c.Token, "xoxp-") || strings.HasPrefix(c.Token, "xoxc-")
+}
+
+// SetDefaults overwrites config entries with their default values
+func (c *Config) SetDefaults() {
+	c.Transport = TransportRTM
+	c.NickColonMentions = false
+	c.SnippetMinLines = 10
+	c.SnippetMinBytes = 4000
+	c.FileProxyLinkTTL = 24 * time.Hour
+	c.FileProxyCacheSize = 64 << 20
+}
@@ -4,21 +4,34 @@ import (
 	"log"
 	"sync"
 	"time"
-
-	"github.com/slack-go/slack"
 )
 
-// ConversationMarker handles coordination and de-duplication of marking conversations as read
+// How long a conversation must go without further read marker updates before we tell Slack
+const markConversationDelay = 5 * time.Second
+
+// ConversationMarker tracks the read cursor of each conversation, and debounces updating it on Slack
+// so that reading through a busy conversation doesn't send a mark request per message.
 type ConversationMarker struct {
-	conversationToReadCursorMap map[string]string
+	readCursors map[string]string
+	pending     map[string]pendingMark
+
+	// wake interrupts the scheduler when a new mark is pending
+	wake chan struct{}
 
 	sync.Mutex
 }
 
+type pendingMark struct {
+	timestamp string
+	due       time.Time
+}
+
 // NewConversationMarker creates a new conversation marker
 func NewConversationMarker() *ConversationMarker {
 	return &ConversationMarker{
-		conversationToReadCursorMap: map[string]string{},
+		readCursors: map[string]string{},
+		pending:     map[string]pendingMark{},
+		wake:        make(chan struct{}, 1),
 	}
 }
 
@@ -27,30 +40,117 @@ func (cm *ConversationMarker) Reset() {
 	cm.Lock()
 	defer cm.Unlock()
 
-	cm.conversationToReadCursorMap = make(map[string]string)
+	cm.pending = make(map[string]pendingMark)
 }
 
-func (cm *ConversationMarker) markConversationDelayed(sc *slack.Client, conversationID, timestamp string) {
-	time.Sleep(5 * time.Second)
+// ReadCursor returns the ts up to which a conversation has been read, if known.
+func (cm *ConversationMarker) ReadCursor(conversationID string) (string, bool) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	timestamp, found := cm.readCursors[conversationID]
+	return timestamp, found
+}
 
+// SetReadCursor records a read cursor reported by Slack, returning false if it doesn't move the cursor
+// forward. Pending marks which it supersedes are dropped.
+func (cm *ConversationMarker) SetReadCursor(conversationID, timestamp string) bool {
 	cm.Lock()
-	shouldMark := cm.conversationToReadCursorMap[conversationID] == timestamp
-	cm.Unlock()
+	defer cm.Unlock()
 
-	if shouldMark {
-		err := sc.MarkConversation(conversationID, timestamp)
-		if err != nil {
-			log.Printf("error while marking conversation %v: %v", conversationID, err)
-		}
+	if current, found := cm.readCursors[conversationID]; found && timestamp <= current {
+		return false
+	}
+	cm.readCursors[conversationID] = timestamp
+
+	if pending, found := cm.pending[conversationID]; found && pending.timestamp <= timestamp {
+		delete(cm.pending, conversationID)
+	}
+	return true
+}
+
+// MarkConversation moves a conversation's read cursor forward, and schedules Slack to be updated once
+// the delay elapses. Returns the resulting read cursor, which never moves backwards.
+func (cm *ConversationMarker) MarkConversation(conversationID, timestamp string) string {
+	cm.Lock()
+	defer cm.Unlock()
+
+	if current, found := cm.readCursors[conversationID]; found && timestamp <= current {
+		return current
+	}
+
+	cm.readCursors[conversationID] = timestamp
+	cm.schedule(conversationID, timestamp)
+	return timestamp
+}
+
+// ScheduleMark schedules Slack's read cursor for a conversation to be updated once the delay elapses, without
+// moving our own. It is used for messages we send, so the new cursor is picked up when Slack announces it.
+func (cm *ConversationMarker) ScheduleMark(conversationID, timestamp string) {
+	cm.Lock()
+	defer cm.Unlock()
+
+	if current, found := cm.readCursors[conversationID]; found && timestamp <= current {
+		return
 	}
+	cm.schedule(conversationID, timestamp)
 }
 
-// MarkConversation prepares a conversation marker to be updated after a delay elapses.
-// Subsequent calls within the delay period supercede prior calls to MarkConversation.
-func (cm *ConversationMarker) MarkConversation(sc *slack.Client, conversationID, timestamp string) {
+// schedule adds or supersedes a pending mark, and wakes the scheduler. Callers must hold the lock.
+func (cm *ConversationMarker) schedule(conversationID, timestamp string) {
+	cm.pending[conversationID] = pendingMark{timestamp, time.Now().Add(markConversationDelay)}
+
+	select {
+	case cm.wake <- struct{}{}:
+	default:
+	}
+}
+
+// takeDueMarks removes and returns the pending marks which are due, along with the time the next one will be
+func (cm *ConversationMarker) takeDueMarks(now time.Time) (due map[string]string, next time.Time) {
 	cm.Lock()
 	defer cm.Unlock()
 
-	cm.conversationToReadCursorMap[conversationID] = timestamp
-	go cm.markConversationDelayed(sc, conversationID, timestamp)
+	due = make(map[string]string)
+	for conversationID, mark := range cm.pending {
+		if !mark.due.After(now) {
+			due[conversationID] = mark.timestamp
+			delete(cm.pending, conversationID)
+		} else if next.IsZero() || mark.due.Before(next) {
+			next = mark.due
+		}
+	}
+	return
+}
+
+// Run is a goroutine entry point which sends pending marks to Slack as they become due.
+func (cm *ConversationMarker) Run(mark func(conversationID, timestamp string) error, stopChan <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-cm.wake:
+		case <-timer.C:
+		}
+
+		due, next := cm.takeDueMarks(time.Now())
+		for conversationID, timestamp := range due {
+			if err := mark(conversationID, timestamp); err != nil {
+				log.Printf("error while marking conversation %v: %v", conversationID, err)
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
 }
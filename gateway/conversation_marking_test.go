@@ -0,0 +1,44 @@
+package gateway
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConversationMarker(t *testing.T) {
+	cm := NewConversationMarker()
+
+	if got := cm.MarkConversation("C1", "1500000000.000200"); got != "1500000000.000200" {
+		t.Errorf("ConversationMarker.MarkConversation() = %v, want 1500000000.000200", got)
+	}
+	if got := cm.MarkConversation("C1", "1500000000.000100"); got != "1500000000.000200" {
+		t.Errorf("ConversationMarker.MarkConversation() moved backwards to %v", got)
+	}
+	cm.ScheduleMark("D1", "1500000000.000300")
+	cm.ScheduleMark("D1", "1500000000.000400")
+
+	if cm.SetReadCursor("C1", "1500000000.000200") {
+		t.Error("ConversationMarker.SetReadCursor() reported an unchanged cursor as moved")
+	}
+	if ts, _ := cm.ReadCursor("D1"); ts != "" {
+		t.Errorf("ConversationMarker.ScheduleMark() moved the read cursor to %v", ts)
+	}
+
+	if due, _ := cm.takeDueMarks(time.Now()); len(due) != 0 {
+		t.Errorf("ConversationMarker.takeDueMarks() = %v before the delay elapsed", due)
+	}
+
+	due, next := cm.takeDueMarks(time.Now().Add(markConversationDelay))
+	want := map[string]string{"C1": "1500000000.000200", "D1": "1500000000.000400"}
+	if !reflect.DeepEqual(due, want) || !next.IsZero() {
+		t.Errorf("ConversationMarker.takeDueMarks() = %v, %v, want %v", due, next, want)
+	}
+
+	// Slack reporting a newer cursor supersedes our pending mark
+	cm.MarkConversation("C1", "1500000000.000500")
+	cm.SetReadCursor("C1", "1500000000.000600")
+	if due, _ := cm.takeDueMarks(time.Now().Add(markConversationDelay)); len(due) != 0 {
+		t.Errorf("ConversationMarker.takeDueMarks() = %v after being superseded", due)
+	}
+}
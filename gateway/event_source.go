@@ -0,0 +1,470 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+)
+
+// Transports events can be received from Slack over
+const (
+	TransportRTM        = "rtm"
+	TransportSocketMode = "socketmode"
+	TransportEventsAPI  = "events"
+)
+
+// Number of Events API event IDs remembered, to drop the retries of events we've already handled
+const recentEventIDs = 1000
+
+// Longest wait between attempts to reconnect Socket Mode
+const maxReconnectDelay = time.Minute
+
+// Largest Events API request body accepted
+const maxEventsAPIBody = 1 << 20
+
+// eventSource receives events from Slack over one of the transports. Events are delivered in the shape
+// the RTM API uses, so the same code handles them whichever transport they came over.
+type eventSource interface {
+	// Run receives events until stopChan is closed
+	Run(stopChan <-chan struct{})
+	Events() <-chan slack.RTMEvent
+	// Reconnect drops the connection to Slack, if there is one, and makes a new one
+	Reconnect() error
+}
+
+// newEventSource creates the event source for the configured transport
+func newEventSource(client *slack.Client, config *Config, options ...socketmode.Option) (eventSource, error) {
+	switch config.Transport {
+	case "", TransportRTM:
+		return newRTMEventSource(client), nil
+	case TransportSocketMode:
+		return newSocketModeEventSource(client, options...), nil
+	case TransportEventsAPI:
+		if config.SigningSecret == "" {
+			return nil, errors.New("the events transport needs a SigningSecret")
+		}
+		return newEventsAPIEventSource(client, config.EventsListenAddr, config.SigningSecret), nil
+	default:
+		return nil, fmt.Errorf("unknown slack transport %q", config.Transport)
+	}
+}
+
+// rtmEventSource receives events over the deprecated RTM API
+type rtmEventSource struct {
+	client *slack.Client
+
+	events    chan slack.RTMEvent
+	reconnect chan struct{}
+}
+
+func newRTMEventSource(client *slack.Client) *rtmEventSource {
+	return &rtmEventSource{
+		client:    client,
+		events:    make(chan slack.RTMEvent, 50),
+		reconnect: make(chan struct{}, 1),
+	}
+}
+
+func (s *rtmEventSource) Run(stopChan <-chan struct{}) {
+	// An RTM connection which has been disconnected can't be used again, so each reconnection makes a new one
+	for {
+		rtm := s.client.NewRTM()
+		go rtm.ManageConnection()
+		if !s.forward(rtm, stopChan) {
+			return
+		}
+	}
+}
+
+// forward passes on an RTM connection's events until it's dropped, returning whether to make a new one
+func (s *rtmEventSource) forward(rtm *slack.RTM, stopChan <-chan struct{}) bool {
+	var disconnected chan error
+	for {
+		select {
+		case <-stopChan:
+			rtm.Disconnect()
+			return false
+
+		case <-s.reconnect:
+			// Disconnect waits for the connection to notice, which it may not until it's done connecting
+			disconnected = make(chan error, 1)
+			go func() { disconnected <- rtm.Disconnect() }()
+
+		case err := <-disconnected:
+			// The connection had already given up, so it has nothing more to say
+			if err != nil {
+				return true
+			}
+
+		case event := <-rtm.IncomingEvents:
+			select {
+			case s.events <- event:
+			case <-stopChan:
+				rtm.Disconnect()
+				return false
+			}
+			if disconnected != nil && event.Type == "disconnected" {
+				return true
+			}
+		}
+	}
+}
+
+func (s *rtmEventSource) Events() <-chan slack.RTMEvent {
+	return s.events
+}
+
+func (s *rtmEventSource) Reconnect() error {
+	select {
+	case s.reconnect <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// decodeEvent decodes an Events API event into the type RTM uses for it
+func decodeEvent(raw json.RawMessage) slack.RTMEvent {
+	var event struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return slack.RTMEvent{Type: "unmarshalling_error", Data: &slack.UnmarshallingErrorEvent{ErrorObj: err}}
+	}
+
+	v, found := slack.EventMapping[event.Type]
+	if !found {
+		return slack.RTMEvent{Type: "unmarshalling_error", Data: &slack.UnmarshallingErrorEvent{
+			ErrorObj: slack.NewUnmappedError("Events API", event.Type, raw),
+		}}
+	}
+
+	data := reflect.New(reflect.TypeOf(v)).Interface()
+	if err := json.Unmarshal(raw, data); err != nil {
+		return slack.RTMEvent{Type: "unmarshalling_error", Data: &slack.UnmarshallingErrorEvent{ErrorObj: err}}
+	}
+	return slack.RTMEvent{Type: event.Type, Data: data}
+}
+
+// connectedEvent makes up the event RTM sends on connecting, for transports which don't tell us who we are
+func connectedEvent(client *slack.Client, connectionCount int) (slack.RTMEvent, error) {
+	auth, err := client.AuthTest()
+	if err != nil {
+		return slack.RTMEvent{}, err
+	}
+
+	return slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{
+		ConnectionCount: connectionCount,
+		Info: &slack.Info{
+			URL:  auth.URL,
+			User: &slack.UserDetails{ID: auth.UserID, Name: auth.User},
+			Team: &slack.Team{ID: auth.TeamID, Name: auth.Team},
+		},
+	}}, nil
+}
+
+// identifySelfBot looks up the bot ID our messages are attributed to, so their echoes can be recognised
+func (sc *SlackClient) identifySelfBot() {
+	auth, err := sc.client.AuthTest()
+	if err != nil {
+		log.Printf("%s could not identify our bot: %v", sc.Tag(), err)
+		return
+	}
+	sc.selfBotID = auth.BotID
+}
+
+// callbackEventDecoder decodes Events API callbacks, dropping those Slack retries after we've handled them
+type callbackEventDecoder struct {
+	seen  map[string]struct{}
+	order []string
+
+	sync.Mutex
+}
+
+func newCallbackEventDecoder() *callbackEventDecoder {
+	return &callbackEventDecoder{seen: make(map[string]struct{})}
+}
+
+// decode returns the event in an Events API callback, or false if it isn't one or we've seen it before
+func (d *callbackEventDecoder) decode(payload []byte) (slack.RTMEvent, bool) {
+	var callback slackevents.EventsAPICallbackEvent
+	if err := json.Unmarshal(payload, &callback); err != nil || callback.InnerEvent == nil {
+		return slack.RTMEvent{}, false
+	}
+
+	d.Lock()
+	if _, found := d.seen[callback.EventID]; found && callback.EventID != "" {
+		d.Unlock()
+		return slack.RTMEvent{}, false
+	}
+	d.seen[callback.EventID] = struct{}{}
+	d.order = append(d.order, callback.EventID)
+	if len(d.order) > recentEventIDs {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+	d.Unlock()
+
+	return decodeEvent(*callback.InnerEvent), true
+}
+
+// socketModeEventSource receives events over a Socket Mode websocket, which needs an app-level token
+type socketModeEventSource struct {
+	client  *slack.Client
+	socket  *socketmode.Client
+	decoder *callbackEventDecoder
+
+	events    chan slack.RTMEvent
+	reconnect chan struct{}
+}
+
+func newSocketModeEventSource(client *slack.Client, options ...socketmode.Option) *socketModeEventSource {
+	return &socketModeEventSource{
+		client:    client,
+		socket:    socketmode.New(client, options...),
+		decoder:   newCallbackEventDecoder(),
+		events:    make(chan slack.RTMEvent, 50),
+		reconnect: make(chan struct{}, 1),
+	}
+}
+
+func (s *socketModeEventSource) Events() <-chan slack.RTMEvent {
+	return s.events
+}
+
+func (s *socketModeEventSource) Run(stopChan <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopChan
+		cancel()
+	}()
+	go s.translateEvents(ctx)
+
+	// The socketmode client reconnects when Slack asks it to, but gives up on any other failure
+	for attempt := 1; ; attempt++ {
+		runCtx, cancelRun := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-s.reconnect:
+				cancelRun()
+			case <-runCtx.Done():
+			}
+		}()
+		err := s.socket.RunContext(runCtx)
+		reconnecting := runCtx.Err() != nil
+		cancelRun()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if reconnecting {
+			s.send(ctx, slack.RTMEvent{Type: "disconnected", Data: &slack.DisconnectedEvent{
+				Intentional: true,
+				Cause:       errors.New("reconnecting on request"),
+			}})
+			attempt = 0
+			continue
+		}
+		s.send(ctx, slack.RTMEvent{Type: "disconnected", Data: &slack.DisconnectedEvent{Cause: err}})
+
+		delay := time.Duration(attempt) * 5 * time.Second
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (s *socketModeEventSource) Reconnect() error {
+	select {
+	case s.reconnect <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *socketModeEventSource) send(ctx context.Context, event slack.RTMEvent) {
+	select {
+	case s.events <- event:
+	case <-ctx.Done():
+	}
+}
+
+// translateEvents turns Socket Mode events into RTM ones, acknowledging each request as it arrives
+func (s *socketModeEventSource) translateEvents(ctx context.Context) {
+	for {
+		var evt socketmode.Event
+		select {
+		case <-ctx.Done():
+			return
+		case evt = <-s.socket.Events:
+		}
+
+		if evt.Request != nil && evt.Request.EnvelopeID != "" {
+			if err := s.socket.Ack(*evt.Request); err != nil {
+				log.Printf("could not acknowledge socket mode request %v: %v", evt.Request.EnvelopeID, err)
+			}
+		}
+
+		switch evt.Type {
+		case socketmode.EventTypeConnecting:
+			s.send(ctx, slack.RTMEvent{Type: "connecting", Data: evt.Data})
+
+		case socketmode.EventTypeConnected:
+			connected, err := connectedEvent(s.client, evt.Data.(*socketmode.ConnectedEvent).ConnectionCount)
+			if err != nil {
+				s.send(ctx, slack.RTMEvent{Type: "connection_error", Data: &slack.ConnectionErrorEvent{ErrorObj: err}})
+				continue
+			}
+			s.send(ctx, connected)
+
+		case socketmode.EventTypeHello:
+			s.send(ctx, slack.RTMEvent{Type: "hello", Data: &slack.HelloEvent{}})
+
+		case socketmode.EventTypeDisconnect:
+			// Slack wants us to reconnect, which the socketmode client does by itself
+			s.send(ctx, slack.RTMEvent{Type: "disconnected", Data: &slack.DisconnectedEvent{
+				Intentional: true,
+				Cause:       errors.New("slack asked for a reconnection"),
+			}})
+
+		case socketmode.EventTypeConnectionError:
+			s.send(ctx, slack.RTMEvent{Type: "connection_error", Data: evt.Data})
+
+		case socketmode.EventTypeIncomingError:
+			s.send(ctx, slack.RTMEvent{Type: "incoming_error", Data: evt.Data})
+
+		case socketmode.EventTypeInvalidAuth:
+			s.send(ctx, slack.RTMEvent{Type: "invalid_auth", Data: evt.Data})
+
+		case socketmode.EventTypeEventsAPI:
+			if event, ok := s.decoder.decode(evt.Request.Payload); ok {
+				s.send(ctx, event)
+			}
+		}
+	}
+}
+
+// eventsAPIEventSource receives events Slack sends to an HTTP endpoint, verifying them with the app's
+// signing secret. Slack needs to be able to reach it, e.g. through a reverse proxy.
+type eventsAPIEventSource struct {
+	client        *slack.Client
+	addr          string
+	signingSecret string
+	decoder       *callbackEventDecoder
+
+	events   chan slack.RTMEvent
+	stopChan <-chan struct{}
+}
+
+func newEventsAPIEventSource(client *slack.Client, addr, signingSecret string) *eventsAPIEventSource {
+	return &eventsAPIEventSource{
+		client:        client,
+		addr:          addr,
+		signingSecret: signingSecret,
+		decoder:       newCallbackEventDecoder(),
+		events:        make(chan slack.RTMEvent, 50),
+	}
+}
+
+func (s *eventsAPIEventSource) Events() <-chan slack.RTMEvent {
+	return s.events
+}
+
+func (s *eventsAPIEventSource) Run(stopChan <-chan struct{}) {
+	s.stopChan = stopChan
+
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := &http.Server{Handler: s}
+	go func() {
+		<-stopChan
+		server.Close()
+	}()
+
+	// There's no connection as such, so we're connected as soon as Slack can reach us
+	s.send(slack.RTMEvent{Type: "connecting", Data: &slack.ConnectingEvent{Attempt: 1, ConnectionCount: 1}})
+	connected, err := connectedEvent(s.client, 1)
+	if err != nil {
+		log.Fatalf("could not identify ourselves to slack: %v", err)
+	}
+	s.send(connected)
+	s.send(slack.RTMEvent{Type: "hello", Data: &slack.HelloEvent{}})
+
+	if err := server.Serve(l); err != http.ErrServerClosed {
+		log.Printf("events API receiver on %v stopped: %v", s.addr, err)
+	}
+}
+
+func (s *eventsAPIEventSource) Reconnect() error {
+	return errors.New("the events API has no connection to reconnect, slack sends events as they happen")
+}
+
+func (s *eventsAPIEventSource) send(event slack.RTMEvent) {
+	select {
+	case s.events <- event:
+	case <-s.stopChan:
+	}
+}
+
+// ServeHTTP handles a request from Slack: either verifying the URL, or delivering an event.
+func (s *eventsAPIEventSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEventsAPIBody))
+	if err != nil {
+		http.Error(w, "could not read request", http.StatusBadRequest)
+		return
+	}
+
+	verifier, err := slack.NewSecretsVerifier(r.Header, s.signingSecret)
+	if err == nil {
+		verifier.Write(body)
+		err = verifier.Ensure()
+	}
+	if err != nil {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	switch request.Type {
+	case slackevents.URLVerification:
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, request.Challenge)
+
+	case slackevents.CallbackEvent:
+		if event, ok := s.decoder.decode(body); ok {
+			s.send(event)
+		}
+	}
+}
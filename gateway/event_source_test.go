@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+func TestDecodeEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		wantType string
+		check    func(data interface{}) bool
+	}{
+		{
+			"message",
+			`{"type":"message","channel":"C1","user":"U1","text":"hi","ts":"1.000001","channel_type":"channel"}`,
+			"message",
+			func(data interface{}) bool {
+				m, ok := data.(*slack.MessageEvent)
+				return ok && m.Channel == "C1" && m.User == "U1" && m.Text == "hi" && m.Timestamp == "1.000001"
+			},
+		},
+		{
+			"file shared, with only the file ID",
+			`{"type":"file_shared","file_id":"F1","user_id":"U1","file":{"id":"F1"},"channel_id":"C1"}`,
+			"file_shared",
+			func(data interface{}) bool {
+				f, ok := data.(*slack.FileSharedEvent)
+				return ok && f.FileID == "F1" && f.File.Name == ""
+			},
+		},
+		{
+			"unknown type",
+			`{"type":"app_home_opened","user":"U1"}`,
+			"unmarshalling_error",
+			func(data interface{}) bool {
+				_, ok := data.(*slack.UnmarshallingErrorEvent)
+				return ok
+			},
+		},
+		{
+			"invalid JSON",
+			`{"type":`,
+			"unmarshalling_error",
+			func(data interface{}) bool {
+				_, ok := data.(*slack.UnmarshallingErrorEvent)
+				return ok
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := decodeEvent([]byte(tt.raw))
+			if event.Type != tt.wantType {
+				t.Errorf("decodeEvent() type = %v, want %v", event.Type, tt.wantType)
+			}
+			if !tt.check(event.Data) {
+				t.Errorf("decodeEvent() data = %#v", event.Data)
+			}
+		})
+	}
+}
+
+func TestCallbackEventDecoder(t *testing.T) {
+	d := newCallbackEventDecoder()
+	callback := func(eventID string) []byte {
+		return []byte(`{"type":"event_callback","event_id":"` + eventID +
+			`","event":{"type":"message","channel":"C1","user":"U1","text":"hi","ts":"1.000001"}}`)
+	}
+
+	if event, ok := d.decode(callback("Ev1")); !ok || event.Type != "message" {
+		t.Errorf("decode() = %v, %v, want a message", event, ok)
+	}
+	if _, ok := d.decode(callback("Ev1")); ok {
+		t.Errorf("decode() of a retried event = true, want false")
+	}
+	if _, ok := d.decode(callback("Ev2")); !ok {
+		t.Errorf("decode() of a new event = false, want true")
+	}
+	if _, ok := d.decode([]byte(`{"type":"url_verification","challenge":"x"}`)); ok {
+		t.Errorf("decode() of a non-callback = true, want false")
+	}
+
+	// Only the most recent event IDs are remembered
+	for i := 0; i < recentEventIDs; i++ {
+		d.decode(callback("Ev" + strconv.Itoa(i+3)))
+	}
+	if _, ok := d.decode(callback("Ev1")); !ok {
+		t.Errorf("decode() of a long-forgotten event = false, want true")
+	}
+}
+
+func TestEventsAPIEventSource(t *testing.T) {
+	const secret = "8f742231b10e8888abcd99yyyzzz85a5"
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	s := newEventsAPIEventSource(nil, "", secret)
+	s.stopChan = stopChan
+
+	post := func(body string, sign bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("v0:" + timestamp + ":" + body))
+		r.Header.Set("X-Slack-Request-Timestamp", timestamp)
+		if sign {
+			r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+		} else {
+			r.Header.Set("X-Slack-Signature", "v0=00")
+		}
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := post(`{"type":"url_verification","challenge":"abc123"}`, true); w.Code != http.StatusOK ||
+		w.Body.String() != "abc123" {
+		t.Errorf("url_verification: got %v %q", w.Code, w.Body.String())
+	}
+
+	message := `{"type":"event_callback","event_id":"Ev1","event":{"type":"message","channel":"C1","user":"U1","text":"hi","ts":"1.000001"}}`
+	if w := post(message, false); w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned event: got %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+	if w := post(message, true); w.Code != http.StatusOK {
+		t.Errorf("signed event: got %v, want %v", w.Code, http.StatusOK)
+	}
+	// A retry of the same event is acknowledged, but not delivered again
+	if w := post(message, true); w.Code != http.StatusOK {
+		t.Errorf("retried event: got %v, want %v", w.Code, http.StatusOK)
+	}
+
+	select {
+	case event := <-s.Events():
+		if m, ok := event.Data.(*slack.MessageEvent); !ok || m.Text != "hi" {
+			t.Errorf("delivered event = %#v, want the message", event)
+		}
+	default:
+		t.Fatalf("no event delivered")
+	}
+	select {
+	case event := <-s.Events():
+		t.Errorf("unexpected event delivered: %#v", event)
+	default:
+	}
+}
@@ -10,8 +10,16 @@ const (
 	NickChangeEvent
 	TopicChangeEvent
 	SelfJoinEvent
+	SelfPartEvent
 	JoinEvent
 	PartEvent
+	ChannelRenameEvent
+	ReadMarkerEvent
+	UnreadSummaryEvent
+	MentionEvent
+	MultilineMessageEvent
+	FileSharedEvent
+	NoticeEvent
 )
 
 // A SlackEvent is an event from Slack that should be communicated
@@ -33,6 +41,27 @@ type MessageEventData struct {
 	From    SlackUser
 	Target  string
 	Message string
+
+	// Slack ts of the message, if it corresponds to one
+	Timestamp string
+	// Unique ID of this line of the message, derived from its conversation and Timestamp
+	MsgID string
+}
+
+// MultilineMessageEventData represents the lines of a multi-line message, which capable IRC
+// clients can receive as a single message
+type MultilineMessageEventData struct {
+	Lines []*MessageEventData
+}
+
+// FileSharedEventData represents a file shared to a channel, which IRC clients can be offered for download
+type FileSharedEventData struct {
+	From   SlackUser
+	Target string
+
+	Name string
+	Size int
+	URL  string
 }
 
 // NickChangeEventData represents a Slack user changing their display name
@@ -52,4 +81,17 @@ type TopicChangeEventData struct {
 type JoinPartEventData struct {
 	User   SlackUser
 	Target string
+	Reason string
+}
+
+// ChannelRenameEventData represents a channel we are a member of being renamed
+type ChannelRenameEventData struct {
+	OldName string
+	NewName string
+}
+
+// ReadMarkerEventData represents a conversation's read cursor moving forward
+type ReadMarkerEventData struct {
+	Target    string
+	Timestamp string
 }
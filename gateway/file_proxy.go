@@ -0,0 +1,266 @@
+package gateway
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Path the file proxy serves links under
+const fileProxyPath = "/files/"
+
+// Files larger than this fraction of the cache are streamed without being cached
+const fileProxyMaxCachedFraction = 4
+
+// FileProxy serves files shared on Slack through opaque, expiring links, fetching them with the
+// gateway's token so IRC users can open them without logging in to Slack.
+type FileProxy struct {
+	baseURL string
+	linkTTL time.Duration
+	fetch   func(url string) (*http.Response, error)
+
+	links map[string]proxiedFile
+
+	cache     map[string]*list.Element
+	cacheLRU  *list.List
+	cacheSize int64
+	maxCache  int64
+
+	sync.Mutex
+}
+
+type proxiedFile struct {
+	url     string
+	name    string
+	expires time.Time
+}
+
+type cachedFile struct {
+	url         string
+	contentType string
+	content     []byte
+}
+
+// NewFileProxy creates a file proxy whose links start with baseURL and last for linkTTL. Up to
+// cacheSize bytes of files are kept in memory.
+func NewFileProxy(baseURL string, linkTTL time.Duration, cacheSize int64, fetch func(url string) (*http.Response, error)) *FileProxy {
+	return &FileProxy{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		linkTTL: linkTTL,
+		fetch:   fetch,
+
+		links: make(map[string]proxiedFile),
+
+		cache:    make(map[string]*list.Element),
+		cacheLRU: list.New(),
+		maxCache: cacheSize,
+	}
+}
+
+// Link returns a proxy link for a file's Slack URL.
+func (fp *FileProxy) Link(fileURL, name string) string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		log.Printf("could not generate file proxy link, using the Slack URL: %v", err)
+		return fileURL
+	}
+	id := hex.EncodeToString(token)
+
+	fp.Lock()
+	defer fp.Unlock()
+
+	now := time.Now()
+	for linkID, file := range fp.links {
+		if now.After(file.expires) {
+			delete(fp.links, linkID)
+		}
+	}
+	fp.links[id] = proxiedFile{fileURL, name, now.Add(fp.linkTTL)}
+
+	return fp.baseURL + fileProxyPath + id + "/" + url.PathEscape(name)
+}
+
+func (fp *FileProxy) lookup(id string) (proxiedFile, bool) {
+	fp.Lock()
+	defer fp.Unlock()
+
+	file, found := fp.links[id]
+	if !found || time.Now().After(file.expires) {
+		return proxiedFile{}, false
+	}
+	return file, true
+}
+
+func (fp *FileProxy) cached(fileURL string) (*cachedFile, bool) {
+	fp.Lock()
+	defer fp.Unlock()
+
+	element, found := fp.cache[fileURL]
+	if !found {
+		return nil, false
+	}
+	fp.cacheLRU.MoveToFront(element)
+	return element.Value.(*cachedFile), true
+}
+
+func (fp *FileProxy) addToCache(file *cachedFile) {
+	fp.Lock()
+	defer fp.Unlock()
+
+	if _, found := fp.cache[file.url]; found {
+		return
+	}
+	fp.cache[file.url] = fp.cacheLRU.PushFront(file)
+	fp.cacheSize += int64(len(file.content))
+
+	for fp.cacheSize > fp.maxCache {
+		oldest := fp.cacheLRU.Back()
+		evicted := fp.cacheLRU.Remove(oldest).(*cachedFile)
+		delete(fp.cache, evicted.url)
+		fp.cacheSize -= int64(len(evicted.content))
+	}
+}
+
+// ServeHTTP serves a file for a proxy link, from the cache or streamed from Slack.
+func (fp *FileProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, fileProxyPath), "/")
+	file, found := fp.lookup(id)
+	if !strings.HasPrefix(r.URL.Path, fileProxyPath) || !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if cached, found := fp.cached(file.url); found {
+		setFileContentType(w, file.name, cached.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(cached.content)))
+		if r.Method == http.MethodGet {
+			w.Write(cached.content)
+		}
+		return
+	}
+
+	resp, err := fp.fetch(file.url)
+	if err != nil {
+		log.Printf("could not fetch %v for the file proxy: %v", file.name, err)
+		http.Error(w, "could not fetch file from slack", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("could not fetch %v for the file proxy: %v", file.name, resp.Status)
+		http.Error(w, "could not fetch file from slack", http.StatusBadGateway)
+		return
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	setFileContentType(w, file.name, contentType)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// Small enough files are kept as they stream past
+	if resp.ContentLength < 0 || resp.ContentLength > fp.maxCache/fileProxyMaxCachedFraction {
+		io.Copy(w, resp.Body)
+		return
+	}
+	var content bytes.Buffer
+	if _, err := io.Copy(w, io.TeeReader(resp.Body, &content)); err == nil && int64(content.Len()) == resp.ContentLength {
+		fp.addToCache(&cachedFile{file.url, contentType, content.Bytes()})
+	}
+}
+
+// setFileContentType sets how a file is served. Anyone could have uploaded it, so only types a browser
+// just displays are shown inline; anything else, HTML and SVG included, is downloaded instead of rendered.
+func setFileContentType(w http.ResponseWriter, name, contentType string) {
+	disposition := "inline"
+	if mediaType, _, _ := mime.ParseMediaType(contentType); !isInlineMediaType(mediaType) {
+		disposition = "attachment"
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+}
+
+// isInlineMediaType reports whether files of a media type can be shown in the browser without running anything
+func isInlineMediaType(mediaType string) bool {
+	if mediaType == "text/plain" {
+		return true
+	}
+	if mediaType == "image/svg+xml" {
+		return false
+	}
+	kind, _, _ := strings.Cut(mediaType, "/")
+	return kind == "image" || kind == "video" || kind == "audio"
+}
+
+// Serve listens for requests on addr until stopChan is closed.
+func (fp *FileProxy) Serve(addr string, stopChan <-chan struct{}) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := &http.Server{Handler: fp}
+	go func() {
+		<-stopChan
+		server.Close()
+	}()
+
+	if err := server.Serve(l); err != http.ErrServerClosed {
+		log.Printf("file proxy on %v stopped: %v", addr, err)
+	}
+}
+
+// fetchPrivateFile requests a file only visible to the workspace, using the gateway's token
+func (sc *SlackClient) fetchPrivateFile(fileURL string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+sc.config.Token)
+	return sc.httpClient.Do(req)
+}
+
+// fileLink returns the link IRC clients are sent for a file, through the file proxy if it's enabled
+func (sc *SlackClient) fileLink(fileURL, name string) string {
+	if sc.fileProxy == nil || fileURL == "" {
+		return fileURL
+	}
+	return sc.fileProxy.Link(fileURL, name)
+}
+
+// fileProxyBaseURL returns the configured file proxy URL, or one made from its listen address
+func (c *Config) fileProxyBaseURL() string {
+	if c.FileProxyURL != "" {
+		return c.FileProxyURL
+	}
+
+	host, port, _ := net.SplitHostPort(c.FileProxyListenAddr)
+	if host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("http://%s", net.JoinHostPort(host, port))
+}
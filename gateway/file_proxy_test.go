@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileProxy(t *testing.T) {
+	files := map[string]string{
+		"https://files.slack.com/small.png": "tiny screenshot",
+		"https://files.slack.com/large.png": strings.Repeat("x", 100),
+	}
+	fetches := make(map[string]int)
+	fp := NewFileProxy("http://tanya:8080/", time.Hour, 100, func(url string) (*http.Response, error) {
+		fetches[url]++
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": []string{"image/png"}},
+			Body:          io.NopCloser(strings.NewReader(files[url])),
+			ContentLength: int64(len(files[url])),
+		}, nil
+	})
+
+	get := func(link string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		fp.ServeHTTP(w, httptest.NewRequest(http.MethodGet, link, nil))
+		return w
+	}
+
+	small := fp.Link("https://files.slack.com/small.png", "my screenshot.png")
+	if !strings.HasPrefix(small, "http://tanya:8080/files/") || !strings.HasSuffix(small, "/my%20screenshot.png") {
+		t.Errorf("FileProxy.Link() = %v", small)
+	}
+	large := fp.Link("https://files.slack.com/large.png", "large.png")
+
+	for i := 0; i < 2; i++ {
+		for link, url := range map[string]string{small: "https://files.slack.com/small.png", large: "https://files.slack.com/large.png"} {
+			w := get(link)
+			if w.Code != http.StatusOK || w.Body.String() != files[url] || w.Header().Get("Content-Type") != "image/png" {
+				t.Errorf("FileProxy.ServeHTTP(%v) = %v %q", link, w.Code, w.Body.String())
+			}
+		}
+	}
+
+	// Only the small file fits in the cache
+	if fetches["https://files.slack.com/small.png"] != 1 || fetches["https://files.slack.com/large.png"] != 2 {
+		t.Errorf("FileProxy fetched %v, want the small file cached", fetches)
+	}
+
+	if w := get("http://tanya:8080/files/nonsense/small.png"); w.Code != http.StatusNotFound {
+		t.Errorf("FileProxy.ServeHTTP() = %v for an unknown link, want 404", w.Code)
+	}
+
+	fp.linkTTL = -time.Second
+	expired := fp.Link("https://files.slack.com/small.png", "small.png")
+	if w := get(expired); w.Code != http.StatusNotFound {
+		t.Errorf("FileProxy.ServeHTTP() = %v for an expired link, want 404", w.Code)
+	}
+}
+
+func TestFileProxyContentType(t *testing.T) {
+	tests := []struct {
+		contentType     string
+		wantType        string
+		wantDisposition string
+	}{
+		{"image/png", "image/png", `inline; filename=file`},
+		{"video/mp4", "video/mp4", `inline; filename=file`},
+		{"audio/mpeg", "audio/mpeg", `inline; filename=file`},
+		{"text/plain; charset=utf-8", "text/plain; charset=utf-8", `inline; filename=file`},
+		{"text/html", "application/octet-stream", `attachment; filename=file`},
+		{"image/svg+xml", "application/octet-stream", `attachment; filename=file`},
+		{"application/pdf", "application/octet-stream", `attachment; filename=file`},
+		{"", "application/octet-stream", `attachment; filename=file`},
+	}
+	for _, tt := range tests {
+		fp := NewFileProxy("http://tanya:8080/", time.Hour, 100, func(url string) (*http.Response, error) {
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Type": []string{tt.contentType}},
+				Body:          io.NopCloser(strings.NewReader("content")),
+				ContentLength: int64(len("content")),
+			}, nil
+		})
+		link := fp.Link("https://files.slack.com/file", "file")
+
+		// The second request is served from the cache
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			fp.ServeHTTP(w, httptest.NewRequest(http.MethodGet, link, nil))
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("FileProxy.ServeHTTP() Content-Type = %q for %q, want %q", got, tt.contentType, tt.wantType)
+			}
+			if got := w.Header().Get("Content-Disposition"); got != tt.wantDisposition {
+				t.Errorf("FileProxy.ServeHTTP() Content-Disposition = %q for %q, want %q", got, tt.contentType, tt.wantDisposition)
+			}
+			if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("FileProxy.ServeHTTP() X-Content-Type-Options = %q, want nosniff", got)
+			}
+		}
+	}
+}
+
+func TestConfig_fileProxyBaseURL(t *testing.T) {
+	tests := []struct {
+		config Config
+		want   string
+	}{
+		{Config{FileProxyListenAddr: ":8080"}, "http://localhost:8080"},
+		{Config{FileProxyListenAddr: "10.0.0.1:8080"}, "http://10.0.0.1:8080"},
+		{Config{FileProxyListenAddr: ":8080", FileProxyURL: "https://files.example.com"}, "https://files.example.com"},
+	}
+	for _, tt := range tests {
+		if got := tt.config.fileProxyBaseURL(); got != tt.want {
+			t.Errorf("Config.fileProxyBaseURL() = %v, want %v", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package gateway
+
+import (
+	"io"
+
+	"github.com/slack-go/slack"
+)
+
+// UploadFile uploads a file to a conversation, with an optional comment
+func (sc *SlackClient) UploadFile(conversationID, filename string, file io.Reader, size int, comment string) error {
+	_, err := sc.client.UploadFile(slack.UploadFileParameters{
+		Reader:         file,
+		FileSize:       size,
+		Filename:       filename,
+		Title:          filename,
+		InitialComment: sc.UnparseMessageText(comment),
+		Channel:        conversationID,
+	})
+	return err
+}
+
+// DownloadFile downloads a file shared on Slack from its private download URL
+func (sc *SlackClient) DownloadFile(url string, w io.Writer) error {
+	return sc.client.GetFile(url, w)
+}
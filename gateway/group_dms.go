@@ -0,0 +1,173 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// groupDMChannelName builds a readable IRC channel name for a group DM (mpim) from the nicks of its members,
+// excluding ourselves. Slack channel names can't contain '+', so these never collide with real channels.
+func groupDMChannelName(members []*SlackUser, selfID string) string {
+	var nicks []string
+	for _, member := range members {
+		if member == nil || member.SlackID == selfID {
+			continue
+		}
+		nicks = append(nicks, strings.ToLower(member.Nick))
+	}
+	sort.Strings(nicks)
+
+	return "#" + strings.Join(nicks, "+")
+}
+
+// groupDMName rebuilds the name of a group DM from its cached members, looking each up in userInfo so that
+// nick changes are picked up
+func groupDMName(members, userInfo map[string]*SlackUser, selfID string) string {
+	var users []*SlackUser
+	for userID, member := range members {
+		if user := userInfo[userID]; user != nil {
+			member = user
+		}
+		users = append(users, member)
+	}
+	return groupDMChannelName(users, selfID)
+}
+
+// renameGroupDMsWithMember regenerates the names of the group DMs a user is in after their nick changes,
+// returning ChannelRenameEvents for those we're a member of. Callers must hold the lock.
+func (sc *SlackClient) renameGroupDMsWithMember(userID string) (events []*SlackEvent) {
+	var selfID string
+	if sc.self != nil {
+		selfID = sc.self.SlackID
+	}
+
+	for channelID, channel := range sc.channelInfo {
+		if channel == nil || !channel.GroupDM {
+			continue
+		}
+		members := sc.channelMembers[channelID]
+		if _, isMember := members[userID]; !isMember {
+			continue
+		}
+
+		if event := sc.renameChannel(channel, groupDMName(members, sc.userInfo, selfID)); event != nil {
+			events = append(events, event)
+		}
+	}
+	return
+}
+
+// nameGroupDM fetches the members of a group DM, caching them, and replaces the Slack-generated
+// "mpdm-alice--bob-1" name of the channel with one built from the members' nicks.
+func (sc *SlackClient) nameGroupDM(channel *SlackChannel) error {
+	members, err := sc.getChannelUsersFromAPI(channel.SlackID)
+	if err != nil {
+		return err
+	}
+
+	var selfID string
+	if sc.self != nil {
+		selfID = sc.self.SlackID
+	}
+
+	memberMap := make(map[string]*SlackUser)
+	for _, member := range members {
+		memberMap[member.SlackID] = member
+	}
+
+	sc.Lock()
+	channel.Name = groupDMChannelName(members, selfID)
+	sc.channelMembers[channel.SlackID] = memberMap
+	sc.Unlock()
+	return nil
+}
+
+// ResolveUsersToGroupDM resolves a set of SlackUsers to the group DM containing exactly them and us,
+// opening one if it doesn't exist
+func (sc *SlackClient) ResolveUsersToGroupDM(users []*SlackUser) (*SlackChannel, error) {
+	var userIDs []string
+	for _, user := range users {
+		userIDs = append(userIDs, user.SlackID)
+	}
+
+	ocp := &slack.OpenConversationParameters{
+		ReturnIM: true,
+		Users:    userIDs,
+	}
+	channel, _, _, err := sc.client.OpenConversation(ocp)
+	if err != nil {
+		return nil, err
+	}
+
+	return sc.ResolveChannel(channel.ID)
+}
+
+// SendGroupDirectMessage sends a message to the group DM with the given SlackUsers, returning the group DM's
+// channel name
+func (sc *SlackClient) SendGroupDirectMessage(users []*SlackUser, msg string) (string, error) {
+	channel, err := sc.ResolveUsersToGroupDM(users)
+	if err != nil {
+		return "", err
+	}
+
+	sc.RLock()
+	name := channel.Name
+	sc.RUnlock()
+	return name, sc.sendMessage(channel.SlackID, msg)
+}
+
+// handleGroupDMOpened marks a group DM as joined, returning a SelfJoinEvent if we weren't already in it
+func (sc *SlackClient) handleGroupDMOpened(channelID string) (*SlackEvent, error) {
+	channel, err := sc.ResolveChannel(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	sc.Lock()
+	_, alreadyJoined := sc.channelMemberships[channel.SlackID]
+	sc.channelMemberships[channel.SlackID] = channel
+	sc.Unlock()
+
+	if alreadyJoined {
+		return nil, nil
+	}
+
+	return &SlackEvent{
+		EventType: SelfJoinEvent,
+		Data: &JoinPartEventData{
+			User:   *sc.self,
+			Target: channel.Name,
+		},
+	}, nil
+}
+
+// parseGroupDMEventChannel extracts the channel ID from the raw body of an mpim_* event, which
+// Slack sends with either a channel ID or a full channel object
+func parseGroupDMEventChannel(raw json.RawMessage) (string, error) {
+	var event struct {
+		Channel json.RawMessage `json:"channel"`
+	}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return "", err
+	}
+
+	var channelID string
+	if err := json.Unmarshal(event.Channel, &channelID); err == nil {
+		return channelID, nil
+	}
+
+	var channel struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(event.Channel, &channel); err != nil {
+		return "", err
+	}
+	if channel.ID == "" {
+		return "", fmt.Errorf("no channel in event: %s", raw)
+	}
+	return channel.ID, nil
+}
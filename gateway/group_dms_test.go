@@ -0,0 +1,113 @@
+package gateway
+
+import "testing"
+
+func TestGroupDMChannelName(t *testing.T) {
+	self := &SlackUser{SlackID: "U0SELF", Nick: "papika"}
+	tests := []struct {
+		name    string
+		members []*SlackUser
+		want    string
+	}{
+		{
+			name: "excludes self and sorts",
+			members: []*SlackUser{
+				self,
+				{SlackID: "U267NCD1U", Nick: "kedo"},
+				{SlackID: "U2VEKS57B", Nick: "Cozzie Alert"},
+			},
+			want: "#cozzie alert+kedo",
+		},
+		{
+			name: "skips unresolved members",
+			members: []*SlackUser{
+				nil,
+				{SlackID: "U267NCD1U", Nick: "kedo"},
+			},
+			want: "#kedo",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := groupDMChannelName(tt.members, self.SlackID); got != tt.want {
+				t.Errorf("groupDMChannelName() = \"%v\", want \"%v\"", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGroupDMEventChannel(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "channel ID",
+			raw:  `{"type":"mpim_open","user":"U267NCD1U","channel":"G024BE91L"}`,
+			want: "G024BE91L",
+		},
+		{
+			name: "channel object",
+			raw:  `{"type":"mpim_joined","channel":{"id":"G024BE91L","is_mpim":true}}`,
+			want: "G024BE91L",
+		},
+		{
+			name:    "missing channel",
+			raw:     `{"type":"mpim_joined"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGroupDMEventChannel([]byte(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseGroupDMEventChannel() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseGroupDMEventChannel() = \"%v\", want \"%v\"", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlackClient_renameGroupDMsWithMember(t *testing.T) {
+	self := &SlackUser{SlackID: "U0SELF", Nick: "papika"}
+	kedo := &SlackUser{SlackID: "U267NCD1U", Nick: "kedo"}
+	cozzie := &SlackUser{SlackID: "U2VEKS57B", Nick: "cozzie"}
+
+	sc := NewSlackClient()
+	sc.self = self
+	sc.userInfo = map[string]*SlackUser{self.SlackID: self, kedo.SlackID: kedo, cozzie.SlackID: cozzie}
+	sc.channelInfo = map[string]*SlackChannel{
+		"G024BE91L": {SlackID: "G024BE91L", Name: "#cozzie+kedo", GroupDM: true},
+		"G0G9QF9GW": {SlackID: "G0G9QF9GW", Name: "#cozzie", GroupDM: true},
+	}
+	sc.channelMemberships = map[string]*SlackChannel{"G024BE91L": sc.channelInfo["G024BE91L"]}
+	sc.channelMembers = map[string]map[string]*SlackUser{
+		"G024BE91L": {self.SlackID: self, kedo.SlackID: kedo, cozzie.SlackID: cozzie},
+		"G0G9QF9GW": {self.SlackID: self, cozzie.SlackID: cozzie},
+	}
+	sc.regenerateReverseMappings()
+
+	sc.Lock()
+	sc.userInfo[kedo.SlackID] = &SlackUser{SlackID: kedo.SlackID, Nick: "Zkedo"}
+	events := sc.renameGroupDMsWithMember(kedo.SlackID)
+	sc.Unlock()
+
+	if len(events) != 1 {
+		t.Fatalf("SlackClient.renameGroupDMsWithMember() returned %v events, want 1: %+v", len(events), events)
+	}
+	want := ChannelRenameEventData{OldName: "#cozzie+kedo", NewName: "#cozzie+zkedo"}
+	if got := *events[0].Data.(*ChannelRenameEventData); got != want {
+		t.Errorf("SlackClient.renameGroupDMsWithMember() = %+v, want %+v", got, want)
+	}
+	if channel := sc.ResolveNameToChannel("#cozzie+zkedo"); channel == nil || channel.SlackID != "G024BE91L" {
+		t.Error("SlackClient.renameGroupDMsWithMember() did not update the name mapping")
+	}
+	if sc.channelInfo["G0G9QF9GW"].Name != "#cozzie" {
+		t.Error("SlackClient.renameGroupDMsWithMember() renamed a group DM the user isn't in")
+	}
+}
@@ -0,0 +1,243 @@
+package gateway
+
+import (
+	"log"
+	"sort"
+
+	"github.com/slack-go/slack"
+)
+
+// Maximum number of messages fetched from Slack to find the oldest messages in a range, since Slack
+// only pages backwards from the newest
+const historyFetchLimit = 1000
+
+// ConversationActivity records the latest message in a conversation
+type ConversationActivity struct {
+	// IRC channel name or nick of the conversation
+	Target    string
+	Timestamp string
+}
+
+// getConversationHistory fetches up to limit messages from a conversation between oldest and latest
+// (either may be empty), following pagination. Messages are returned newest first, as Slack sends them.
+func (sc *SlackClient) getConversationHistory(channelID, oldest, latest string, limit int) (messages []slack.Message, err error) {
+	params := &slack.GetConversationHistoryParameters{
+		ChannelID: channelID,
+		Oldest:    oldest,
+		Latest:    latest,
+		Limit:     min(limit, 200),
+	}
+
+	for {
+		var history *slack.GetConversationHistoryResponse
+		err = sc.retryRateLimited("conversations.history", func() (err error) {
+			history, err = sc.client.GetConversationHistory(params)
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		messages = append(messages, history.Messages...)
+		if !history.HasMore || history.ResponseMetaData.NextCursor == "" || len(messages) >= limit {
+			break
+		}
+		params.Cursor = history.ResponseMetaData.NextCursor
+	}
+
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return
+}
+
+// getThreadReplies fetches the replies to a thread posted strictly between oldest and latest (either of which
+// may be empty), oldest first. The thread parent is not included.
+func (sc *SlackClient) getThreadReplies(channelID, threadTS, oldest, latest string) (replies []slack.Message, err error) {
+	params := &slack.GetConversationRepliesParameters{
+		ChannelID: channelID,
+		Timestamp: threadTS,
+		Oldest:    oldest,
+		Latest:    latest,
+		Limit:     200,
+	}
+
+	for {
+		var messages []slack.Message
+		var hasMore bool
+		err = sc.retryRateLimited("conversations.replies", func() (err error) {
+			messages, hasMore, params.Cursor, err = sc.client.GetConversationReplies(params)
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		for _, message := range messages {
+			if message.Timestamp != threadTS && message.Timestamp > oldest && (latest == "" || message.Timestamp < latest) {
+				replies = append(replies, message)
+			}
+		}
+		if !hasMore || params.Cursor == "" {
+			break
+		}
+	}
+
+	return
+}
+
+// getMessagesBetween fetches the newest limit messages posted to a conversation strictly between oldest and
+// latest (either of which may be empty), plus their thread replies, oldest first. Replies to threads started
+// before oldest aren't visible in the conversation history, so can't be found this way.
+//
+// Since the limit may cut the history short, floor is returned as the ts from which the result is complete.
+func (sc *SlackClient) getMessagesBetween(channelID, oldest, latest string, limit int) (messages []slack.Message, floor string, err error) {
+	history, err := sc.getConversationHistory(channelID, oldest, latest, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	floor = oldest
+	if len(history) >= limit {
+		floor = history[len(history)-1].Timestamp
+	}
+
+	// Broadcast thread replies appear both in the history and the thread, so de-duplicate by ts
+	messagesByTS := make(map[string]slack.Message)
+	for _, message := range history {
+		messagesByTS[message.Timestamp] = message
+
+		if message.ReplyCount > 0 && message.LatestReply > oldest {
+			replies, err := sc.getThreadReplies(channelID, message.Timestamp, oldest, latest)
+			if err != nil {
+				return nil, "", err
+			}
+			for _, reply := range replies {
+				messagesByTS[reply.Timestamp] = reply
+			}
+		}
+	}
+
+	messages = make([]slack.Message, 0, len(messagesByTS))
+	for _, message := range messagesByTS {
+		messages = append(messages, message)
+	}
+	sortMessagesByTimestamp(messages)
+	return messages, floor, nil
+}
+
+// sortMessagesByTimestamp sorts messages oldest first. Slack timestamps are fixed-width
+// decimal strings, so they can be compared as strings.
+func sortMessagesByTimestamp(messages []slack.Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Timestamp < messages[j].Timestamp
+	})
+}
+
+// GetHistory returns the messages of a conversation strictly between oldest and latest (either of which may be
+// empty) as they would have been relayed to IRC, oldest first. If there are more than limit, the newest are
+// returned if newest is set, otherwise the oldest. Recent history is served from the cache where possible.
+func (sc *SlackClient) GetHistory(channelID, oldest, latest string, limit int, newest bool) ([]*MessageEventData, error) {
+	messages, found := sc.historyCache.Query(channelID, oldest, latest, limit, newest)
+	if !found {
+		fetchLimit := limit
+		if !newest {
+			fetchLimit = historyFetchLimit
+		}
+
+		var floor string
+		var err error
+		messages, floor, err = sc.getMessagesBetween(channelID, oldest, latest, fetchLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		// Anything fetched up to the present can answer later requests
+		if latest == "" {
+			sc.historyCache.Store(channelID, floor, messages)
+		}
+		messages = limitMessages(messages, limit, newest)
+	}
+
+	var history []*MessageEventData
+	for _, message := range messages {
+		messageEvent := slack.MessageEvent(message)
+		messageEvent.Channel = channelID
+
+		for _, event := range sc.messageToEvents(&messageEvent) {
+			if event.EventType == MessageEvent {
+				history = append(history, event.Data.(*MessageEventData))
+			}
+		}
+	}
+
+	if len(history) > limit {
+		if newest {
+			history = history[len(history)-limit:]
+		} else {
+			history = history[:limit]
+		}
+	}
+	return history, nil
+}
+
+// GetActiveConversations returns the joined channels and open DMs with messages strictly between oldest and
+// latest (either of which may be empty), along with the latest such message in each. Only activity we've seen
+// and the history cache are consulted, since asking Slack would mean a request per conversation; conversations
+// we know nothing about for the range are left out.
+func (sc *SlackClient) GetActiveConversations(oldest, latest string) ([]ConversationActivity, error) {
+	var channelIDs []string
+	sc.RLock()
+	for channelID := range sc.channelMemberships {
+		channelIDs = append(channelIDs, channelID)
+	}
+	for dmID := range sc.dmInfo {
+		channelIDs = append(channelIDs, dmID)
+	}
+	sc.RUnlock()
+
+	var activity []ConversationActivity
+	for _, channelID := range channelIDs {
+		ts, found := sc.backfillTracker.LastSeen(channelID)
+		if found && ts <= oldest {
+			continue
+		}
+
+		if !found || (latest != "" && ts >= latest) {
+			messages, cached := sc.historyCache.Query(channelID, oldest, latest, 1, true)
+			if !cached || len(messages) == 0 {
+				continue
+			}
+			ts = messages[0].Timestamp
+		}
+
+		target, err := sc.conversationTarget(channelID)
+		if err != nil {
+			log.Printf("%s could not resolve conversation %v: %v", sc.Tag(), channelID, err)
+			continue
+		}
+		activity = append(activity, ConversationActivity{Target: target, Timestamp: ts})
+	}
+
+	sort.Slice(activity, func(i, j int) bool {
+		return activity[i].Timestamp < activity[j].Timestamp
+	})
+	return activity, nil
+}
+
+// conversationTarget returns the IRC channel name or nick for a conversation
+func (sc *SlackClient) conversationTarget(channelID string) (string, error) {
+	if isDmChannel(channelID) {
+		user, err := sc.ResolveDMToUser(channelID)
+		if err != nil {
+			return "", err
+		}
+		return user.Nick, nil
+	}
+
+	channel, err := sc.ResolveChannel(channelID)
+	if err != nil {
+		return "", err
+	}
+	return channel.Name, nil
+}
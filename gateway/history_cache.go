@@ -0,0 +1,139 @@
+package gateway
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/slack-go/slack"
+)
+
+// Maximum number of messages cached per conversation
+const historyCacheSize = 1000
+
+// HistoryCache holds the recent messages of conversations, so that history requests can be answered
+// without calling Slack. Each conversation's cache is complete from some point up to the present, and is
+// kept up to date by messages arriving over RTM.
+type HistoryCache struct {
+	conversations map[string]*cachedConversation
+
+	sync.Mutex
+}
+
+type cachedConversation struct {
+	// Every message with a ts at or after floor is cached. An empty floor means the entire history is.
+	floor string
+	// Messages, oldest first
+	messages []slack.Message
+}
+
+// NewHistoryCache creates a new history cache.
+func NewHistoryCache() *HistoryCache {
+	return &HistoryCache{
+		conversations: make(map[string]*cachedConversation),
+	}
+}
+
+// Reset clears the cache, since messages may have been missed while disconnected.
+func (hc *HistoryCache) Reset() {
+	hc.Lock()
+	defer hc.Unlock()
+
+	hc.conversations = make(map[string]*cachedConversation)
+}
+
+// Add caches a message which just arrived, if its conversation is cached.
+func (hc *HistoryCache) Add(channelID string, message slack.Message) {
+	switch message.SubType {
+	case "", "bot_message", "pinned_item", "thread_broadcast":
+	default:
+		return
+	}
+
+	hc.Lock()
+	defer hc.Unlock()
+
+	if cached, found := hc.conversations[channelID]; found {
+		cached.insert([]slack.Message{message})
+	}
+}
+
+// Store caches the messages of a conversation from floor up to the present, merging them with any
+// messages already cached.
+func (hc *HistoryCache) Store(channelID, floor string, messages []slack.Message) {
+	hc.Lock()
+	defer hc.Unlock()
+
+	cached, found := hc.conversations[channelID]
+	if !found {
+		cached = &cachedConversation{floor: floor}
+		hc.conversations[channelID] = cached
+	} else if floor < cached.floor {
+		cached.floor = floor
+	}
+	cached.insert(messages)
+}
+
+// Query returns the messages of a conversation with a ts strictly between oldest and latest (either of
+// which may be empty), oldest first. If there are more than limit, the newest are returned if newest is set,
+// otherwise the oldest. The second return value is false if the cache can't answer the query.
+func (hc *HistoryCache) Query(channelID, oldest, latest string, limit int, newest bool) ([]slack.Message, bool) {
+	hc.Lock()
+	defer hc.Unlock()
+
+	cached, found := hc.conversations[channelID]
+	if !found {
+		return nil, false
+	}
+
+	var matching []slack.Message
+	for _, message := range cached.messages {
+		if message.Timestamp > oldest && (latest == "" || message.Timestamp < latest) {
+			matching = append(matching, message)
+		}
+	}
+
+	// Unless the whole range is cached, we can only answer if enough of its newest messages are
+	complete := cached.floor == "" || (oldest != "" && oldest >= cached.floor)
+	if !complete && !(newest && len(matching) >= limit) {
+		return nil, false
+	}
+
+	return limitMessages(matching, limit, newest), true
+}
+
+// insert merges messages into the cache, keeping it sorted and within size
+func (cc *cachedConversation) insert(messages []slack.Message) {
+	for _, message := range messages {
+		if message.Timestamp < cc.floor {
+			continue
+		}
+
+		i := sort.Search(len(cc.messages), func(i int) bool {
+			return cc.messages[i].Timestamp >= message.Timestamp
+		})
+		if i < len(cc.messages) && cc.messages[i].Timestamp == message.Timestamp {
+			cc.messages[i] = message
+			continue
+		}
+
+		cc.messages = append(cc.messages, slack.Message{})
+		copy(cc.messages[i+1:], cc.messages[i:])
+		cc.messages[i] = message
+	}
+
+	if len(cc.messages) > historyCacheSize {
+		cc.messages = cc.messages[len(cc.messages)-historyCacheSize:]
+		cc.floor = cc.messages[0].Timestamp
+	}
+}
+
+// limitMessages returns at most limit messages from either the newest or oldest end of a sorted list
+func limitMessages(messages []slack.Message, limit int, newest bool) []slack.Message {
+	if len(messages) <= limit {
+		return messages
+	}
+	if newest {
+		return messages[len(messages)-limit:]
+	}
+	return messages[:limit]
+}
@@ -0,0 +1,110 @@
+package gateway
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/slack-go/slack"
+)
+
+func cachedTimestamps(messages []slack.Message) []string {
+	var timestamps []string
+	for _, message := range messages {
+		timestamps = append(timestamps, message.Timestamp)
+	}
+	return timestamps
+}
+
+func historyMessage(ts string) slack.Message {
+	var message slack.Message
+	message.Timestamp = ts
+	return message
+}
+
+func TestHistoryCache_Query(t *testing.T) {
+	hc := NewHistoryCache()
+	hc.Add("C1", historyMessage("1.000003"))
+	if _, found := hc.Query("C1", "", "", 10, true); found {
+		t.Error("HistoryCache.Query() answered for an uncached conversation")
+	}
+
+	hc.Store("C1", "1.000002", []slack.Message{historyMessage("1.000004"), historyMessage("1.000002")})
+	hc.Add("C1", historyMessage("1.000005"))
+	hc.Add("C1", historyMessage("1.000003"))
+
+	tests := []struct {
+		name         string
+		oldest       string
+		latest       string
+		limit        int
+		newest       bool
+		want         []string
+		wantAnswered bool
+	}{
+		{
+			name:         "latest within cache",
+			limit:        2,
+			newest:       true,
+			want:         []string{"1.000004", "1.000005"},
+			wantAnswered: true,
+		},
+		{
+			name:         "latest beyond cache",
+			limit:        10,
+			newest:       true,
+			wantAnswered: false,
+		},
+		{
+			name:         "after within cache",
+			oldest:       "1.000002",
+			limit:        2,
+			want:         []string{"1.000003", "1.000004"},
+			wantAnswered: true,
+		},
+		{
+			name:         "after beyond cache",
+			oldest:       "1.000001",
+			limit:        2,
+			wantAnswered: false,
+		},
+		{
+			name:         "between",
+			oldest:       "1.000002",
+			latest:       "1.000005",
+			limit:        10,
+			want:         []string{"1.000003", "1.000004"},
+			wantAnswered: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, answered := hc.Query("C1", tt.oldest, tt.latest, tt.limit, tt.newest)
+			if answered != tt.wantAnswered {
+				t.Fatalf("HistoryCache.Query() answered = %v, want %v", answered, tt.wantAnswered)
+			}
+			if answered && !reflect.DeepEqual(cachedTimestamps(got), tt.want) {
+				t.Errorf("HistoryCache.Query() = %v, want %v", cachedTimestamps(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestAssignMsgIDs(t *testing.T) {
+	events := messageTextToEvents(&SlackUser{Nick: "kedo"}, "#chatter", "one\ntwo\nthree", "1500000000.000100")
+	assignMsgIDs("C0CHATTER", events)
+
+	var msgIDs []string
+	for _, event := range events {
+		msgIDs = append(msgIDs, event.Data.(*MessageEventData).MsgID)
+	}
+	want := []string{"C0CHATTER:1500000000.000100", "C0CHATTER:1500000000.000100-1", "C0CHATTER:1500000000.000100-2"}
+	if !reflect.DeepEqual(msgIDs, want) {
+		t.Errorf("assignMsgIDs() = %v, want %v", msgIDs, want)
+	}
+
+	for _, msgID := range []string{msgIDs[0], msgIDs[2], "1500000000.000100", "1500000000.000100-2"} {
+		if got := MsgIDTimestamp(msgID); got != "1500000000.000100" {
+			t.Errorf("MsgIDTimestamp(%v) = %v, want 1500000000.000100", msgID, got)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package gateway
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/slack-go/slack"
+)
+
+func TestSlackClient_GetActiveConversations(t *testing.T) {
+	// There's no Slack client, so any attempt to ask Slack about a conversation would panic
+	sc := NewSlackClient()
+	sc.channelInfo = map[string]*SlackChannel{
+		"C1": {SlackID: "C1", Name: "#general"},
+		"C2": {SlackID: "C2", Name: "#random"},
+		"C3": {SlackID: "C3", Name: "#quiet"},
+	}
+	sc.channelMemberships = map[string]*SlackChannel{
+		"C1": sc.channelInfo["C1"],
+		"C2": sc.channelInfo["C2"],
+		"C3": sc.channelInfo["C3"],
+	}
+	sc.dmInfo = map[string]*SlackUser{"D4": {SlackID: "U4", Nick: "kedo"}}
+
+	// #general and the DM were seen live, #random only through history, and #quiet not at all
+	sc.backfillTracker.MessageDelivered("C1", "1500000300.000000")
+	sc.backfillTracker.MessageDelivered("D4", "1500000100.000000")
+	sc.historyCache.Store("C2", "1500000000.000000", []slack.Message{
+		historyMessage("1500000250.000000"), historyMessage("1500000150.000000"),
+	})
+
+	tests := []struct {
+		name   string
+		oldest string
+		latest string
+		want   []ConversationActivity
+	}{
+		{
+			name:   "since",
+			oldest: "1500000120.000000",
+			want: []ConversationActivity{
+				{Target: "#random", Timestamp: "1500000250.000000"},
+				{Target: "#general", Timestamp: "1500000300.000000"},
+			},
+		},
+		{
+			name:   "between",
+			oldest: "1500000000.000000",
+			latest: "1500000200.000000",
+			want: []ConversationActivity{
+				{Target: "kedo", Timestamp: "1500000100.000000"},
+				{Target: "#random", Timestamp: "1500000150.000000"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sc.GetActiveConversations(tt.oldest, tt.latest)
+			if err != nil {
+				t.Fatalf("SlackClient.GetActiveConversations() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SlackClient.GetActiveConversations() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
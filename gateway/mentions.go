@@ -0,0 +1,127 @@
+package gateway
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/slack-go/slack"
+)
+
+// Matches the user, usergroup and special mentions in Slack message text, e.g. <@U123>, <!subteam^S123|@team>
+var slackMentionRegex = regexp.MustCompile(`<([@!][^>|]+)`)
+
+// MentionMatcher decides whether a message mentions us, by our user ID, one of our usergroups, @channel
+// or @here, or one of the configured keywords.
+type MentionMatcher struct {
+	keywords   []*regexp.Regexp
+	usergroups map[string]struct{}
+
+	sync.Mutex
+}
+
+// NewMentionMatcher creates a new mention matcher.
+func NewMentionMatcher() *MentionMatcher {
+	return &MentionMatcher{
+		usergroups: make(map[string]struct{}),
+	}
+}
+
+// SetKeywords sets the words which count as mentions, matched case-insensitively.
+func (mm *MentionMatcher) SetKeywords(keywords []string) {
+	var compiled []*regexp.Regexp
+	for _, keyword := range keywords {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			compiled = append(compiled, regexp.MustCompile(`(?i)(^|\W)`+regexp.QuoteMeta(keyword)+`($|\W)`))
+		}
+	}
+
+	mm.Lock()
+	defer mm.Unlock()
+
+	mm.keywords = compiled
+}
+
+// SetUsergroups replaces the usergroups we're a member of.
+func (mm *MentionMatcher) SetUsergroups(usergroupIDs []string) {
+	mm.Lock()
+	defer mm.Unlock()
+
+	mm.usergroups = make(map[string]struct{})
+	for _, usergroupID := range usergroupIDs {
+		mm.usergroups[usergroupID] = struct{}{}
+	}
+}
+
+// SetUsergroupMember records us joining or leaving a usergroup.
+func (mm *MentionMatcher) SetUsergroupMember(usergroupID string, member bool) {
+	mm.Lock()
+	defer mm.Unlock()
+
+	if member {
+		mm.usergroups[usergroupID] = struct{}{}
+	} else {
+		delete(mm.usergroups, usergroupID)
+	}
+}
+
+// Matches returns whether raw Slack message text mentions the given user.
+func (mm *MentionMatcher) Matches(selfID, text string) bool {
+	mm.Lock()
+	defer mm.Unlock()
+
+	for _, match := range slackMentionRegex.FindAllStringSubmatch(text, -1) {
+		switch ref := match[1]; {
+		case ref == "@"+selfID, ref == "!channel", ref == "!here", ref == "!everyone":
+			return true
+		case strings.HasPrefix(ref, "!subteam^"):
+			if _, found := mm.usergroups[strings.TrimPrefix(ref, "!subteam^")]; found {
+				return true
+			}
+		}
+	}
+
+	for _, keyword := range mm.keywords {
+		if keyword.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMention returns whether a message in a channel mentions us, and should be copied to &mentions
+func (sc *SlackClient) isMention(messageData *slack.MessageEvent) bool {
+	switch messageData.SubType {
+	case "", "bot_message", "thread_broadcast":
+	default:
+		return false
+	}
+
+	return messageData.Channel != "" && !isDmChannel(messageData.Channel) &&
+		messageData.User != sc.self.SlackID && sc.mentionMatcher.Matches(sc.self.SlackID, messageData.Text)
+}
+
+// bootstrapUsergroups fetches the usergroups we're a member of, so mentioning them counts as mentioning us
+func (sc *SlackClient) bootstrapUsergroups() {
+	var usergroups []slack.UserGroup
+	err := sc.retryRateLimited("usergroups.list", func() (err error) {
+		usergroups, err = sc.client.GetUserGroups(slack.GetUserGroupsOptionIncludeUsers(true))
+		return
+	})
+	if err != nil {
+		log.Printf("%s could not fetch usergroups, their mentions won't be highlighted: %v", sc.Tag(), err)
+		return
+	}
+
+	var usergroupIDs []string
+	for _, usergroup := range usergroups {
+		for _, userID := range usergroup.Users {
+			if userID == sc.self.SlackID {
+				usergroupIDs = append(usergroupIDs, usergroup.ID)
+				break
+			}
+		}
+	}
+	sc.mentionMatcher.SetUsergroups(usergroupIDs)
+}
@@ -0,0 +1,37 @@
+package gateway
+
+import "testing"
+
+func TestMentionMatcher_Matches(t *testing.T) {
+	mm := NewMentionMatcher()
+	mm.SetKeywords([]string{"tanya", " c++ ", ""})
+	mm.SetUsergroups([]string{"S1", "S2"})
+	mm.SetUsergroupMember("S2", false)
+	mm.SetUsergroupMember("S3", true)
+
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"hello <@USELF>", true},
+		{"hello <@USELF|tanya>", true},
+		{"hello <@UOTHER>", false},
+		{"<!here> lunch", true},
+		{"<!channel|@channel> lunch", true},
+		{"<!everyone> lunch", true},
+		{"<!subteam^S1|@oncall> help", true},
+		{"<!subteam^S2|@frontend> help", false},
+		{"<!subteam^S3> help", true},
+		{"ask Tanya about it", true},
+		{"tanyas are plural", false},
+		{"written in C++, apparently", true},
+		{"nothing to see here", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := mm.Matches("USELF", tt.text); got != tt.want {
+				t.Errorf("MentionMatcher.Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
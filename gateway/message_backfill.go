@@ -0,0 +1,193 @@
+package gateway
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Maximum number of messages to backfill per conversation after a reconnection
+const backfillLimit = 500
+
+// How backfill truncation notices show the time of the oldest message backfilled
+const backfillTimeFormat = "Jan 2 15:04:05"
+
+// BackfillTracker records the latest message seen in each conversation, so that anything posted while
+// we were disconnected from Slack can be fetched and replayed after reconnecting.
+type BackfillTracker struct {
+	lastSeen       map[string]string
+	disconnectedAt string
+
+	// While a backfill is running, messages may arrive both live and from history, so we remember
+	// everything delivered until it finishes.
+	backfilling bool
+	delivered   map[sentMessage]struct{}
+
+	sync.Mutex
+}
+
+// NewBackfillTracker creates a new backfill tracker.
+func NewBackfillTracker() *BackfillTracker {
+	return &BackfillTracker{
+		lastSeen:  map[string]string{},
+		delivered: map[sentMessage]struct{}{},
+	}
+}
+
+// MessageDelivered records a message as seen, returning false if it was already delivered
+// during the current backfill and should be dropped.
+func (bt *BackfillTracker) MessageDelivered(channelID, ts string) bool {
+	bt.Lock()
+	defer bt.Unlock()
+
+	if ts > bt.lastSeen[channelID] {
+		bt.lastSeen[channelID] = ts
+	}
+
+	if !bt.backfilling {
+		return true
+	}
+
+	msg := sentMessage{channelID, ts}
+	if _, found := bt.delivered[msg]; found {
+		return false
+	}
+	bt.delivered[msg] = struct{}{}
+	return true
+}
+
+// LastSeen returns the ts of the latest message seen in a conversation.
+func (bt *BackfillTracker) LastSeen(channelID string) (string, bool) {
+	bt.Lock()
+	defer bt.Unlock()
+
+	ts, found := bt.lastSeen[channelID]
+	return ts, found
+}
+
+// Disconnected records the time we lost our connection to Slack, which bounds the backfill
+// of conversations we haven't seen any messages in.
+func (bt *BackfillTracker) Disconnected(at time.Time) {
+	bt.Lock()
+	defer bt.Unlock()
+
+	if bt.disconnectedAt == "" {
+		bt.disconnectedAt = strconv.FormatInt(at.Unix(), 10) + ".000000"
+	}
+}
+
+// StartBackfill returns the ts to backfill each conversation from, or "" if we don't know.
+func (bt *BackfillTracker) StartBackfill(channelIDs []string) map[string]string {
+	bt.Lock()
+	defer bt.Unlock()
+
+	since := make(map[string]string)
+	for _, channelID := range channelIDs {
+		if ts, found := bt.lastSeen[channelID]; found {
+			since[channelID] = ts
+		} else {
+			since[channelID] = bt.disconnectedAt
+		}
+	}
+
+	bt.backfilling = true
+	bt.disconnectedAt = ""
+	return since
+}
+
+// FinishBackfill stops de-duplicating messages against the backfill.
+func (bt *BackfillTracker) FinishBackfill() {
+	bt.Lock()
+	defer bt.Unlock()
+
+	bt.backfilling = false
+	bt.delivered = make(map[sentMessage]struct{})
+}
+
+// startBackfill snapshots where to backfill each of our channels and DMs from. It must be called before
+// any events from the new connection are handled, since live messages move the latest seen message on.
+func (sc *SlackClient) startBackfill() map[string]string {
+	var channelIDs []string
+	sc.RLock()
+	for channelID := range sc.channelMemberships {
+		channelIDs = append(channelIDs, channelID)
+	}
+	for dmID := range sc.dmInfo {
+		channelIDs = append(channelIDs, dmID)
+	}
+	sc.RUnlock()
+
+	return sc.backfillTracker.StartBackfill(channelIDs)
+}
+
+// backfillMissedMessages fetches messages posted to our channels and DMs while we were disconnected, starting
+// from the snapshot taken by startBackfill, and replays them through the usual message handling. The original
+// ts is kept, so capable IRC clients will show them at the time they were sent.
+func (sc *SlackClient) backfillMissedMessages(incomingChan chan<- *SlackEvent, since map[string]string) {
+	startTime := time.Now()
+	defer sc.backfillTracker.FinishBackfill()
+
+	replayed := 0
+	for channelID, ts := range since {
+		if ts == "" {
+			continue
+		}
+
+		messages, floor, err := sc.getMessagesBetween(channelID, ts, "", backfillLimit)
+		if err != nil {
+			log.Printf("%s error while backfilling %v: %v", sc.Tag(), channelID, err)
+			continue
+		}
+		if floor != ts {
+			if notice, err := sc.backfillTruncatedNotice(channelID, floor); err != nil {
+				log.Printf("%s could not resolve truncated backfill of %v: %v", sc.Tag(), channelID, err)
+			} else {
+				incomingChan <- notice
+			}
+		}
+
+		for _, message := range messages {
+			messageEvent := slack.MessageEvent(message)
+			messageEvent.Channel = channelID
+			sc.handleMessageEvent(incomingChan, &messageEvent)
+		}
+		replayed += len(messages)
+	}
+
+	log.Printf("%s slack:backfill conversations:%v messages:%v time:%v", sc.Tag(),
+		len(since), replayed, time.Since(startTime))
+	if replayed > 0 {
+		incomingChan <- sc.newInternalMessageEvent(fmt.Sprintf(
+			"replayed %d messages sent while disconnected", replayed))
+	}
+}
+
+// backfillTruncatedNotice makes a notice from *tanya marking the hole left in a conversation's backfill when
+// the limit cut it short, at floor. Channels get it in the channel; DMs in private, naming the other user.
+func (sc *SlackClient) backfillTruncatedNotice(channelID, floor string) (*SlackEvent, error) {
+	target, err := sc.conversationTarget(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	where := ""
+	if isDmChannel(channelID) {
+		where = " with " + target
+		sc.RLock()
+		target = sc.self.Nick
+		sc.RUnlock()
+	}
+	return &SlackEvent{
+		EventType: NoticeEvent,
+		Data: &MessageEventData{
+			From:   *tanyaInternalUser,
+			Target: target,
+			Message: fmt.Sprintf("backfill%s stopped at %d messages: messages sent while disconnected before %s (ts %s) are missing",
+				where, backfillLimit, ParseSlackTimestamp(floor).Local().Format(backfillTimeFormat), floor),
+		},
+	}, nil
+}
@@ -0,0 +1,143 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+func TestBackfillTracker(t *testing.T) {
+	bt := NewBackfillTracker()
+
+	bt.MessageDelivered("C1", "1500000000.000200")
+	bt.MessageDelivered("C1", "1500000000.000100")
+	bt.Disconnected(time.Unix(1500000100, 0))
+	bt.Disconnected(time.Unix(1500000200, 0))
+
+	since := bt.StartBackfill([]string{"C1", "D2"})
+	expected := map[string]string{
+		"C1": "1500000000.000200",
+		"D2": "1500000100.000000",
+	}
+	if !reflect.DeepEqual(since, expected) {
+		t.Errorf("BackfillTracker.StartBackfill() = %v, want %v", since, expected)
+	}
+
+	if !bt.MessageDelivered("C1", "1500000150.000000") {
+		t.Error("BackfillTracker.MessageDelivered() dropped a new message")
+	}
+	if bt.MessageDelivered("C1", "1500000150.000000") {
+		t.Error("BackfillTracker.MessageDelivered() delivered a message twice during backfill")
+	}
+
+	bt.FinishBackfill()
+	if !bt.MessageDelivered("C1", "1500000150.000000") {
+		t.Error("BackfillTracker.MessageDelivered() dropped a message after backfill finished")
+	}
+}
+
+func TestSlackClient_startBackfill(t *testing.T) {
+	sc := NewSlackClient()
+	sc.channelMemberships = map[string]*SlackChannel{"C1": {SlackID: "C1", Name: "#general"}}
+	sc.dmInfo = map[string]*SlackUser{"D2": {SlackID: "U2", Nick: "kedo"}}
+	sc.backfillTracker.MessageDelivered("C1", "1500000000.000200")
+	sc.backfillTracker.Disconnected(time.Unix(1500000100, 0))
+
+	since := sc.startBackfill()
+
+	// A live message arriving before the backfill gets going mustn't move where it starts from
+	sc.backfillTracker.MessageDelivered("C1", "1500000150.000000")
+
+	expected := map[string]string{
+		"C1": "1500000000.000200",
+		"D2": "1500000100.000000",
+	}
+	if !reflect.DeepEqual(since, expected) {
+		t.Errorf("SlackClient.startBackfill() = %v, want %v", since, expected)
+	}
+	if sc.backfillTracker.MessageDelivered("C1", "1500000150.000000") {
+		t.Error("BackfillTracker.MessageDelivered() delivered a live message again during backfill")
+	}
+}
+
+func TestParseSlackTimestamp(t *testing.T) {
+	want := time.Unix(1500000000, 123456000)
+	if got := ParseSlackTimestamp("1500000000.123456"); !got.Equal(want) {
+		t.Errorf("ParseSlackTimestamp() = %v, want %v", got, want)
+	}
+}
+
+func TestFormatSlackTimestamp(t *testing.T) {
+	if got := FormatSlackTimestamp(time.Unix(1500000000, 123456789)); got != "1500000000.123456" {
+		t.Errorf("FormatSlackTimestamp() = %v, want 1500000000.123456", got)
+	}
+	if got := FormatSlackTimestamp(time.Time{}); got != "" {
+		t.Errorf("FormatSlackTimestamp() of the zero time = %v, want \"\"", got)
+	}
+}
+
+func TestSlackClient_backfillMissedMessagesTruncated(t *testing.T) {
+	// More messages were sent to #general while we were away than are backfilled, newest first
+	var history []slack.Message
+	for i := backfillLimit + 100; i > 0; i-- {
+		message := slack.Message{}
+		message.Timestamp = fmt.Sprintf("%d.000000", 1500000000+i)
+		message.User = "U1"
+		message.Text = "hi"
+		history = append(history, message)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		page := 0
+		fmt.Sscan(r.Form.Get("cursor"), &page)
+		limit := 0
+		fmt.Sscan(r.Form.Get("limit"), &limit)
+		start, end := page*limit, min((page+1)*limit, len(history))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok":                true,
+			"messages":          history[start:end],
+			"has_more":          end < len(history),
+			"response_metadata": map[string]string{"next_cursor": fmt.Sprint(page + 1)},
+		})
+	}))
+	defer srv.Close()
+
+	sc := NewSlackClient()
+	sc.client = slack.New("xoxp-test", slack.OptionAPIURL(srv.URL+"/"))
+	sc.self = &SlackUser{SlackID: "U0SELF", Nick: "papika"}
+	sc.userInfo["U1"] = &SlackUser{SlackID: "U1", Nick: "kedo"}
+	sc.channelInfo["C1"] = &SlackChannel{SlackID: "C1", Name: "#general"}
+
+	incomingChan := make(chan *SlackEvent, 2*backfillLimit)
+	sc.backfillMissedMessages(incomingChan, map[string]string{"C1": "1500000000.000000"})
+	close(incomingChan)
+
+	var notices []string
+	messages := 0
+	for event := range incomingChan {
+		switch event.EventType {
+		case NoticeEvent:
+			data := event.Data.(*MessageEventData)
+			notices = append(notices, data.Target+" "+data.Message)
+		case MessageEvent:
+			if event.Data.(*MessageEventData).Target == "#general" {
+				messages++
+			}
+		}
+	}
+	if messages != backfillLimit {
+		t.Errorf("SlackClient.backfillMissedMessages() replayed %d messages, want %d", messages, backfillLimit)
+	}
+	// The oldest message backfilled is the 500th newest
+	if len(notices) != 1 || !strings.HasPrefix(notices[0], "#general backfill stopped at 500 messages") ||
+		!strings.Contains(notices[0], "(ts 1500000101.000000)") {
+		t.Errorf("SlackClient.backfillMissedMessages() sent notices %q, want one marking the hole", notices)
+	}
+}
@@ -11,23 +11,107 @@ import (
 
 var slackFakeUser = &SlackUser{Nick: "SLACK", SlackID: "SLACK"}
 
-func messageTextToEvents(sender *SlackUser, target, messageText string) []*SlackEvent {
+// Separates the conversation ID from the Slack ts in message IDs, as a ts is only unique within its conversation
+const msgIDConversationSeparator = ":"
+
+// Separates the Slack ts from the line number in the message IDs of multi-line messages
+const msgIDLineSeparator = "-"
+
+func messageTextToEvents(sender *SlackUser, target, messageText, ts string) []*SlackEvent {
 	var events []*SlackEvent
 
 	parsedMessage := bufio.NewScanner(strings.NewReader(messageText))
 	for parsedMessage.Scan() {
 		messageLine := parsedMessage.Text()
 		if len(messageLine) > 0 {
-			events = append(events, newSlackMessageEvent(sender, target, messageLine))
+			events = append(events, newSlackMessageEvent(sender, target, messageLine, ts))
 		}
 	}
 
 	return events
 }
 
+// messageID makes the message ID of a Slack message from its conversation and ts, e.g. "C123:1503435956.000247"
+func messageID(conversationID, ts string) string {
+	return conversationID + msgIDConversationSeparator + ts
+}
+
+// assignMsgIDs gives each line produced from a Slack message in a conversation a unique message ID. The first
+// line uses the message's ID, and the following lines add a suffix.
+func assignMsgIDs(conversationID string, events []*SlackEvent) {
+	lines := make(map[string]int)
+	for _, event := range events {
+		data, ok := event.Data.(*MessageEventData)
+		if !ok || data.Timestamp == "" {
+			continue
+		}
+
+		data.MsgID = messageID(conversationID, data.Timestamp)
+		if line := lines[data.Timestamp]; line > 0 {
+			data.MsgID += fmt.Sprintf("%s%d", msgIDLineSeparator, line)
+		}
+		lines[data.Timestamp]++
+	}
+}
+
+// groupMultilineEvents combines consecutive lines of the same message into one MultilineMessageEvent
+func groupMultilineEvents(events []*SlackEvent) []*SlackEvent {
+	var grouped []*SlackEvent
+	for i := 0; i < len(events); {
+		first, ok := events[i].Data.(*MessageEventData)
+		ok = ok && events[i].EventType == MessageEvent && first.Timestamp != ""
+
+		end := i + 1
+		for ok && end < len(events) && events[end].EventType == MessageEvent {
+			line := events[end].Data.(*MessageEventData)
+			if line.Timestamp != first.Timestamp || line.Target != first.Target || line.From != first.From {
+				break
+			}
+			end++
+		}
+
+		if end-i == 1 {
+			grouped = append(grouped, events[i])
+		} else {
+			var lines []*MessageEventData
+			for _, event := range events[i:end] {
+				lines = append(lines, event.Data.(*MessageEventData))
+			}
+			grouped = append(grouped, &SlackEvent{
+				EventType: MultilineMessageEvent,
+				Data:      &MultilineMessageEventData{Lines: lines},
+			})
+		}
+		i = end
+	}
+	return grouped
+}
+
+// MsgIDTimestamp returns the Slack ts a message ID was derived from. IDs saved before they included the
+// conversation are just the ts.
+func MsgIDTimestamp(msgID string) string {
+	if _, afterConversation, found := strings.Cut(msgID, msgIDConversationSeparator); found {
+		msgID = afterConversation
+	}
+	ts, _, _ := strings.Cut(msgID, msgIDLineSeparator)
+	return ts
+}
+
 func (sc *SlackClient) handleMessageEvent(incomingChan chan<- *SlackEvent, messageData *slack.MessageEvent) {
+	if messageData.Channel != "" && messageData.Timestamp != "" &&
+		!sc.backfillTracker.MessageDelivered(messageData.Channel, messageData.Timestamp) {
+		return
+	}
+	sc.historyCache.Add(messageData.Channel, slack.Message(*messageData))
+
+	// Over the Events API, messages posted with a bot token can come back attributed only to the bot
+	if messageData.User == "" && messageData.BotID != "" && messageData.BotID == sc.selfBotID {
+		messageData.User = sc.self.SlackID
+	}
+
 	switch messageData.User {
-	case "USLACKBOT":
+	case slackbotUser.SlackID:
+		sc.handleSlackbotMessage(incomingChan, messageData)
 		return
 	case sc.self.SlackID:
 		// Most of the time this lock acquisition will immediately succeed, and we have no need for it afterwards.
@@ -41,8 +125,66 @@ func (sc *SlackClient) handleMessageEvent(incomingChan chan<- *SlackEvent, messa
 		}
 	}
 
+	// Thread replies don't make a conversation unread unless they're also sent to the channel
+	isThreadReply := messageData.ThreadTimestamp != "" && messageData.ThreadTimestamp != messageData.Timestamp &&
+		messageData.SubType != "thread_broadcast"
+	switch messageData.SubType {
+	case "", "bot_message", "thread_broadcast":
+		if messageData.Channel != "" && messageData.User != sc.self.SlackID && !isThreadReply {
+			sc.unreadTracker.MessageReceived(messageData.Channel, sc.messageMentionsSelf(messageData))
+		}
+	}
+
+	if messageData.Channel != "" && !isDmChannel(messageData.Channel) {
+		channel, err := sc.ResolveChannel(messageData.Channel)
+		if err != nil {
+			log.Printf("%s could not resolve channel for message [%v]: %+v", sc.Tag(), err, messageData)
+			return
+		}
+
+		// Group DMs don't always announce themselves before their first message
+		if channel.GroupDM {
+			joinEvent, err := sc.handleGroupDMOpened(channel.SlackID)
+			if err != nil {
+				log.Printf("%s could not join group DM for message [%v]: %+v", sc.Tag(), err, messageData)
+			} else if joinEvent != nil {
+				incomingChan <- joinEvent
+			}
+		}
+	}
+
+	switch messageData.SubType {
+	case "channel_convert_to_private", "channel_convert_to_public":
+		// The channel keeps its ID, so all we need to do is pick up the new privacy setting
+		if _, err := sc.handleChannelRefreshed(messageData.Channel); err != nil {
+			log.Printf("%s could not refresh converted channel [%v]: %+v", sc.Tag(), err, messageData)
+		}
+	}
+
+	events := sc.messageToEvents(messageData)
+	for _, event := range groupMultilineEvents(events) {
+		incomingChan <- event
+	}
+
+	// Copy mentions of us into &mentions too
+	if sc.isMention(messageData) {
+		for _, event := range events {
+			if event.EventType == MessageEvent {
+				incomingChan <- &SlackEvent{EventType: MentionEvent, Data: event.Data}
+			}
+		}
+	}
+}
+
+// messageToEvents converts a Slack message into the events IRC clients should see. Apart from resolving
+// users and channels it has no side effects, so it is also used to convert history.
+func (sc *SlackClient) messageToEvents(messageData *slack.MessageEvent) (events []*SlackEvent) {
+	defer func() { assignMsgIDs(messageData.Channel, events) }()
+
 	var sender *SlackUser
-	if messageData.User != "" {
+	if messageData.User == slackbotUser.SlackID {
+		sender = slackbotUser
+	} else if messageData.User != "" {
 		var err error
 		if sender, err = sc.ResolveUser(messageData.User); err != nil {
 			log.Printf("%s could not resolve user for message [%v]: %+v", sc.Tag(), err, messageData)
@@ -98,9 +240,7 @@ func (sc *SlackClient) handleMessageEvent(incomingChan chan<- *SlackEvent, messa
 			messageText = "[" + sc.self.Nick + "] " + messageText
 		}
 
-		for _, messageEvent := range messageTextToEvents(sender, target, messageText) {
-			incomingChan <- messageEvent
-		}
+		events = messageTextToEvents(sender, target, messageText, messageData.Timestamp)
 
 		// Handle message file attachments
 		verb := "shared"
@@ -109,9 +249,9 @@ func (sc *SlackClient) handleMessageEvent(incomingChan chan<- *SlackEvent, messa
 		}
 
 		for _, file := range messageData.Files {
-			incomingChan <- newSlackMessageEvent(
+			events = append(events, newSlackMessageEvent(
 				sender, target, fmt.Sprintf("@%s %s a file: %s %s",
-					sender.Nick, verb, file.Name, file.URLPrivate))
+					sender.Nick, verb, file.Name, sc.fileLink(file.URLPrivate, file.Name)), messageData.Timestamp))
 		}
 
 	case "bot_message":
@@ -131,9 +271,7 @@ func (sc *SlackClient) handleMessageEvent(incomingChan chan<- *SlackEvent, messa
 			}
 		}
 
-		for _, messageEvent := range messageTextToEvents(sender, target, messageText) {
-			incomingChan <- messageEvent
-		}
+		events = messageTextToEvents(sender, target, messageText, messageData.Timestamp)
 
 	case "message_changed":
 		subMessage := messageData.SubMessage
@@ -179,24 +317,34 @@ func (sc *SlackClient) handleMessageEvent(incomingChan chan<- *SlackEvent, messa
 			return
 		}
 
-		incomingChan <- newSlackMessageEvent(
+		events = append(events, newSlackMessageEvent(
 			user,
 			target,
 			fmt.Sprint(sc.ParseMessageText(subMessage.Attachments[0].Fallback)),
-		)
+			messageData.Timestamp,
+		))
 
 	case "channel_topic":
 		if sender == nil || target == "" {
 			return
 		}
 
-		incomingChan <- &SlackEvent{
+		events = append(events, &SlackEvent{
 			EventType: TopicChangeEvent,
 			Data: &TopicChangeEventData{
 				From:     *sender,
 				Target:   target,
 				NewTopic: messageData.Topic,
 			},
+		})
+
+	case "channel_convert_to_private", "channel_convert_to_public":
+		if target == "" {
+			return
+		}
+
+		if sender != nil && messageData.Text != "" {
+			events = messageTextToEvents(sender, target, sc.ParseMessageText(messageData.Text), messageData.Timestamp)
 		}
 
 	case "channel_leave", "channel_join", "channel_archive", "channel_unarchive":
@@ -211,4 +359,6 @@ func (sc *SlackClient) handleMessageEvent(incomingChan chan<- *SlackEvent, messa
 		log.Printf("%s unhandled message sub-type [%v]: %+v SubMessage:%+v",
 			sc.Tag(), messageData.SubType, messageData, messageData.SubMessage)
 	}
+
+	return
 }
@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/slack-go/slack"
+)
+
+func TestGroupMultilineEvents(t *testing.T) {
+	kedo := &SlackUser{Nick: "kedo"}
+	events := messageTextToEvents(kedo, "#chatter", "one\ntwo", "1500000000.000100")
+	events = append(events, messageTextToEvents(kedo, "#chatter", "three", "1500000000.000200")...)
+	events = append(events, &SlackEvent{EventType: TopicChangeEvent, Data: &TopicChangeEventData{}})
+	events = append(events, messageTextToEvents(kedo, "#chatter", "four\nfive", "")...)
+
+	var got []SlackEventType
+	for _, event := range groupMultilineEvents(events) {
+		got = append(got, event.EventType)
+	}
+	want := []SlackEventType{MultilineMessageEvent, MessageEvent, TopicChangeEvent, MessageEvent, MessageEvent}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("groupMultilineEvents() = %v, want %v", got, want)
+	}
+
+	lines := groupMultilineEvents(events)[0].Data.(*MultilineMessageEventData).Lines
+	if len(lines) != 2 || lines[0].Message != "one" || lines[1].Message != "two" {
+		t.Errorf("groupMultilineEvents() lines = %+v, want one, two", lines)
+	}
+}
+
+func TestSlackClient_handleMessageEvent_botEcho(t *testing.T) {
+	sc := newLifecycleTestClient()
+	sc.userInfo[sc.self.SlackID] = sc.self
+	sc.selfBotID = "B0SELF"
+	sc.sentMessageQueue.MessageSent("C2EFNRK1S", "1500000000.000100")
+
+	incomingChan := make(chan *SlackEvent, 10)
+	sc.handleMessageEvent(incomingChan, &slack.MessageEvent{Msg: slack.Msg{
+		Channel: "C2EFNRK1S", BotID: "B0SELF", SubType: "bot_message", Text: "hello", Timestamp: "1500000000.000100",
+	}})
+	if len(incomingChan) != 0 {
+		t.Errorf("handleMessageEvent() of our own bot message sent %v events, want none", len(incomingChan))
+	}
+}
+
+func TestSlackClient_handleMessageEvent_slackbot(t *testing.T) {
+	sc := newLifecycleTestClient()
+	var err error
+	if sc.slackbotFilter, err = compileSlackbotFilter([]string{"^you've been invited"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		channel    string
+		text       string
+		wantType   SlackEventType
+		wantTarget string
+		wantEvents int
+	}{
+		{"channel", "C2EFNRK1S", "Only visible to you: try /help", NoticeEvent, "#chatter-technical", 1},
+		{"multi-line in channel", "C2EFNRK1S", "one\ntwo", NoticeEvent, "#chatter-technical", 2},
+		{"DM", "D0SLACKBOT", "Reminder: stretch.", MessageEvent, "papika", 1},
+		{"multi-line DM", "D0SLACKBOT", "Reminder:\nstretch.", MultilineMessageEvent, "", 1},
+		{"filtered", "C2EFNRK1S", "You've been invited to #random", 0, "", 0},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			incomingChan := make(chan *SlackEvent, 10)
+			sc.handleMessageEvent(incomingChan, &slack.MessageEvent{Msg: slack.Msg{
+				Channel: tt.channel, User: "USLACKBOT", Text: tt.text, Timestamp: fmt.Sprintf("1500000000.%06d", i),
+			}})
+			close(incomingChan)
+
+			var events []*SlackEvent
+			for event := range incomingChan {
+				events = append(events, event)
+			}
+			if len(events) != tt.wantEvents {
+				t.Fatalf("handleMessageEvent() sent %d events, want %d", len(events), tt.wantEvents)
+			}
+			for _, event := range events {
+				if event.EventType != tt.wantType {
+					t.Errorf("handleMessageEvent() sent event type %v, want %v", event.EventType, tt.wantType)
+				}
+				if data, ok := event.Data.(*MessageEventData); ok && (data.From != *slackbotUser || data.Target != tt.wantTarget) {
+					t.Errorf("handleMessageEvent() sent %+v, want from slackbot to %v", data, tt.wantTarget)
+				}
+			}
+		})
+	}
+
+	if _, err := compileSlackbotFilter([]string{"("}); err == nil {
+		t.Errorf("compileSlackbotFilter() of an invalid pattern succeeded")
+	}
+}
@@ -3,8 +3,10 @@ package gateway
 import (
 	"fmt"
 	"log"
-	"regexp"
+	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // ParseMessageText takes raw Slack message payload and resolves the user
@@ -87,23 +89,174 @@ func (sc *SlackClient) ParseMessageTextWithOptions(text string, alwaysIncludeLin
 func (sc *SlackClient) UnparseMessageText(text string) string {
 	text = sc.slackURLEncoder.Replace(text)
 
-	atMentionRegex := regexp.MustCompile(`@[A-Za-z][A-Za-z0-9_\- ]*`)
-	uniqueMentions := make(map[string]string)
-	for _, match := range atMentionRegex.FindAllString(text, -1) {
-		uniqueMentions[match] = match
+	sc.RLock()
+	defer sc.RUnlock()
+
+	var b strings.Builder
+	i := 0
+
+	// IRC clients tab-complete nicks at the start of a line as "nick: ", so optionally treat that as a mention.
+	if sc.config.NickColonMentions {
+		if userID, n := sc.matchNickPrefix(text); n > 0 && strings.HasPrefix(text[n:], ":") {
+			fmt.Fprintf(&b, "<@%v>", userID)
+			i = n
+		}
+	}
+
+	for i < len(text) {
+		if text[i] == '@' && (i == 0 || !isNickRuneBefore(text[:i])) {
+			if userID, n := sc.matchNickPrefix(text[i+1:]); n > 0 {
+				fmt.Fprintf(&b, "<@%v>", userID)
+				i += 1 + n
+				continue
+			}
+		}
+
+		b.WriteByte(text[i])
+		i++
+	}
+
+	return b.String()
+}
+
+// matchNickPrefix finds the longest known nick which text begins with, returning the matching user's ID
+// and the length in bytes of the match. Callers must hold at least a read lock.
+func (sc *SlackClient) matchNickPrefix(text string) (userID string, length int) {
+	return sc.nickIndex.match(text)
+}
+
+// nickIndexEntry is a user whose nick folds to a given key of a nickIndex
+type nickIndexEntry struct {
+	nick   string
+	userID string
+}
+
+// nickIndex maps nicks folded with foldNickRune to the users who have them, so mentions can be found without
+// scanning every user. It's kept in step with nickToUserMap.
+type nickIndex struct {
+	// Users by folded nick, sorted by Slack ID
+	users map[string][]nickIndexEntry
+	// Length in runes of the longest nick ever added. Removing nicks doesn't shrink it, which only means
+	// match looks a little further than it needs to.
+	maxRunes int
+}
+
+// newNickIndex builds a nickIndex from a map of nick to Slack ID
+func newNickIndex(nickToUserMap map[string]string) *nickIndex {
+	idx := &nickIndex{users: make(map[string][]nickIndexEntry)}
+	for nick, userID := range nickToUserMap {
+		idx.add(nick, userID)
+	}
+	return idx
+}
+
+// add indexes a user's nick, keeping the users sharing its folded form sorted by Slack ID
+func (idx *nickIndex) add(nick, userID string) {
+	if nick == "" {
+		return
+	}
+
+	key := foldNick(nick)
+	entries := idx.users[key]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].userID >= userID })
+	for j := i; j < len(entries) && entries[j].userID == userID; j++ {
+		if entries[j].nick == nick {
+			return
+		}
+	}
+	entries = append(entries, nickIndexEntry{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = nickIndexEntry{nick: nick, userID: userID}
+	idx.users[key] = entries
+
+	if n := utf8.RuneCountInString(nick); n > idx.maxRunes {
+		idx.maxRunes = n
 	}
+}
 
-	for mention := range uniqueMentions {
-		if user := sc.ResolveNickToUser(mention[1:]); user != nil {
-			uniqueMentions[mention] = fmt.Sprintf("<@%v>", user.SlackID)
+// remove drops a user's nick from the index, if it's there
+func (idx *nickIndex) remove(nick, userID string) {
+	key := foldNick(nick)
+	entries := idx.users[key]
+	for i, entry := range entries {
+		if entry.nick == nick && entry.userID == userID {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
 		}
 	}
 
-	replacements := make([]string, 0)
-	for mention, id := range uniqueMentions {
-		replacements = append(replacements, mention, id)
+	if len(entries) == 0 {
+		delete(idx.users, key)
+	} else {
+		idx.users[key] = entries
+	}
+}
+
+// match finds the longest indexed nick which text begins with, followed by a word boundary. If several nicks
+// fold to the same text, one matching its case exactly wins, then the one with the lowest Slack ID.
+func (idx *nickIndex) match(text string) (userID string, length int) {
+	// Fold as much of text as could be a nick, noting where each rune ends in text and in the folded text
+	var folded strings.Builder
+	var textEnds, foldedEnds []int
+	for i := 0; i < len(text) && len(textEnds) < idx.maxRunes; {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		folded.WriteRune(foldNickRune(r))
+		i += size
+		textEnds = append(textEnds, i)
+		foldedEnds = append(foldedEnds, folded.Len())
 	}
+	foldedText := folded.String()
+
+	for k := len(textEnds) - 1; k >= 0; k-- {
+		entries := idx.users[foldedText[:foldedEnds[k]]]
+		if len(entries) == 0 {
+			continue
+		}
+
+		// Don't match "@bob" inside of "@bobby".
+		end := textEnds[k]
+		if next, _ := utf8.DecodeRuneInString(text[end:]); end < len(text) && isNickRune(next) {
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.nick == text[:end] {
+				return entry.userID, end
+			}
+		}
+		return entries[0].userID, end
+	}
+	return "", 0
+}
+
+// foldNick folds each rune of nick with foldNickRune
+func foldNick(nick string) string {
+	return strings.Map(foldNickRune, nick)
+}
+
+// foldNickRune maps a rune to its canonical form for nick comparison. This is rfc1459 casemapping extended
+// with Unicode case folding, and treats spaces and the non-breaking spaces we substitute in nicks as equal.
+func foldNickRune(r rune) rune {
+	switch r {
+	case '\u00a0':
+		return ' '
+	case '[':
+		return '{'
+	case ']':
+		return '}'
+	case '\\':
+		return '|'
+	case '~':
+		return '^'
+	}
+	return unicode.ToLower(r)
+}
+
+func isNickRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-'
+}
 
-	replacer := strings.NewReplacer(replacements...)
-	return replacer.Replace(text)
+func isNickRuneBefore(text string) bool {
+	r, _ := utf8.DecodeLastRuneInString(text)
+	return isNickRune(r)
 }
@@ -204,6 +204,67 @@ func TestSlackClient_UnparseMessageText(t *testing.T) {
 			text:   "<@kedo> i like my girls like I like my boys... feminine",
 			want:   "&lt;@kedo&gt; i like my girls like I like my boys... feminine",
 		},
+		{
+			name: "unicode nick reference",
+			fields: fields{
+				userInfo: map[string]*SlackUser{
+					"U2VEKS57B": {
+						SlackID:  "U2VEKS57B",
+						Nick:     "ピュア\u00a0バリアー",
+						RealName: "ピュア バリアー",
+					},
+				},
+			},
+			text: "ok @ピュア バリアー!",
+			want: "ok <@U2VEKS57B>!",
+		},
+		{
+			name: "case insensitive nick reference",
+			fields: fields{
+				userInfo: map[string]*SlackUser{
+					"U267NCD1U": {
+						SlackID:  "U267NCD1U",
+						Nick:     "Kedo[away]",
+						RealName: "Kenny Do",
+					},
+				},
+			},
+			text: "@kedo{AWAY} wake up",
+			want: "<@U267NCD1U> wake up",
+		},
+		{
+			name: "longest nick reference wins",
+			fields: fields{
+				userInfo: map[string]*SlackUser{
+					"U267NCD1U": {
+						SlackID:  "U267NCD1U",
+						Nick:     "cozzie",
+						RealName: "Cozzie Kuns",
+					},
+					"U2VEKS57B": {
+						SlackID:  "U2VEKS57B",
+						Nick:     "cozzie\u00a0alert",
+						RealName: "Cozzie Alert",
+					},
+				},
+			},
+			text: "@cozzie alert and @cozzie",
+			want: "<@U2VEKS57B> and <@U267NCD1U>",
+		},
+		{
+			name: "partial nick reference",
+			fields: fields{
+				userInfo: map[string]*SlackUser{
+					"U267NCD1U": {
+						SlackID:  "U267NCD1U",
+						Nick:     "kedo",
+						RealName: "Kenny Do",
+					},
+				},
+			},
+			text: "@kedoo and kenny@kedo.com",
+			want: "@kedoo and kenny@kedo.com",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -218,3 +279,146 @@ func TestSlackClient_UnparseMessageText(t *testing.T) {
 		})
 	}
 }
+
+func TestSlackClient_UnparseMessageTextNickColon(t *testing.T) {
+	userInfo := map[string]*SlackUser{
+		"U267NCD1U": {
+			SlackID:  "U267NCD1U",
+			Nick:     "kedo",
+			RealName: "Kenny Do",
+		},
+	}
+	tests := []struct {
+		name              string
+		nickColonMentions bool
+		text              string
+		want              string
+	}{
+		{
+			name:              "disabled",
+			nickColonMentions: false,
+			text:              "kedo: hello",
+			want:              "kedo: hello",
+		},
+		{
+			name:              "enabled",
+			nickColonMentions: true,
+			text:              "Kedo: hello",
+			want:              "<@U267NCD1U>: hello",
+		},
+		{
+			name:              "enabled but not at start",
+			nickColonMentions: true,
+			text:              "hello kedo: hello",
+			want:              "hello kedo: hello",
+		},
+		{
+			name:              "enabled with unknown nick",
+			nickColonMentions: true,
+			text:              "note: hello",
+			want:              "note: hello",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := NewSlackClient()
+			sc.config.NickColonMentions = tt.nickColonMentions
+			sc.userInfo = userInfo
+			sc.regenerateReverseMappings()
+
+			if got := sc.UnparseMessageText(tt.text); got != tt.want {
+				t.Errorf("SlackClient.UnparseMessageText() = \"%v\", want \"%v\"", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlackClient_UnparseMessageTextFoldedNickTie(t *testing.T) {
+	userInfo := map[string]*SlackUser{
+		"U2": {SlackID: "U2", Nick: "Kedo"},
+		"U3": {SlackID: "U3", Nick: "kedo"},
+		"U1": {SlackID: "U1", Nick: "KEDO"},
+		"U4": {SlackID: "U4", Nick: "kedo[m]"},
+		"U5": {SlackID: "U5", Nick: "KEDO{M}"},
+	}
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "exact case wins",
+			text: "@kedo hi",
+			want: "<@U3> hi",
+		},
+		{
+			name: "another exact case",
+			text: "@Kedo hi",
+			want: "<@U2> hi",
+		},
+		{
+			name: "no exact case falls back to lowest ID",
+			text: "@kEdO hi",
+			want: "<@U1> hi",
+		},
+		{
+			name: "longest folded nick wins",
+			text: "@KEDO[M] hi",
+			want: "<@U4> hi",
+		},
+		{
+			name: "exact case of longest folded nick",
+			text: "@KEDO{M} hi",
+			want: "<@U5> hi",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Map iteration order varies, so make sure the result doesn't
+			for i := 0; i < 20; i++ {
+				sc := NewSlackClient()
+				sc.userInfo = userInfo
+				sc.regenerateReverseMappings()
+
+				if got := sc.UnparseMessageText(tt.text); got != tt.want {
+					t.Fatalf("SlackClient.UnparseMessageText() = \"%v\", want \"%v\"", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNickIndexIncremental(t *testing.T) {
+	idx := newNickIndex(nil)
+	idx.add("kedo", "U3")
+	idx.add("KEDO", "U1")
+	idx.add("Kedo", "U2")
+	idx.add("Kedo", "U2")
+
+	tests := []struct {
+		text     string
+		wantUser string
+	}{
+		{"kedo", "U3"},
+		{"Kedo", "U2"},
+		{"kEdO", "U1"},
+	}
+	for _, tt := range tests {
+		if got, _ := idx.match(tt.text); got != tt.wantUser {
+			t.Errorf("nickIndex.match(%q) = %v, want %v", tt.text, got, tt.wantUser)
+		}
+	}
+
+	// With the lowest ID renamed away, the next lowest wins ties
+	idx.remove("KEDO", "U1")
+	idx.add("papika", "U1")
+	if got, _ := idx.match("kEdO"); got != "U2" {
+		t.Errorf("nickIndex.match(%q) after a rename = %v, want U2", "kEdO", got)
+	}
+	if got, _ := idx.match("Papika"); got != "U1" {
+		t.Errorf("nickIndex.match(%q) after a rename = %v, want U1", "Papika", got)
+	}
+	if len(idx.users[foldNick("kedo")]) != 2 {
+		t.Errorf("nickIndex has %v for kedo, want U2 and U3", idx.users[foldNick("kedo")])
+	}
+}
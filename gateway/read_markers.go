@@ -0,0 +1,118 @@
+package gateway
+
+import (
+	"log"
+
+	"github.com/slack-go/slack"
+)
+
+// handleConversationMarked handles Slack reporting that a conversation was read up to ts, e.g. from
+// another Slack client, returning an event if the read cursor moved forward.
+func (sc *SlackClient) handleConversationMarked(channelID, ts string) *SlackEvent {
+	if !sc.conversationMarker.SetReadCursor(channelID, ts) {
+		return nil
+	}
+	sc.conversationRead(channelID, ts)
+
+	return sc.newReadMarkerEvent(channelID, ts)
+}
+
+func (sc *SlackClient) newReadMarkerEvent(channelID, ts string) *SlackEvent {
+	target, err := sc.conversationTarget(channelID)
+	if err != nil {
+		log.Printf("%s could not resolve marked conversation %v: %v", sc.Tag(), channelID, err)
+		return nil
+	}
+
+	return &SlackEvent{
+		EventType: ReadMarkerEvent,
+		Data: &ReadMarkerEventData{
+			Target:    target,
+			Timestamp: ts,
+		},
+	}
+}
+
+// GetReadCursor returns the ts up to which a conversation has been read, or "" if it isn't known yet.
+func (sc *SlackClient) GetReadCursor(channelID string) string {
+	ts, _ := sc.conversationMarker.ReadCursor(channelID)
+	return ts
+}
+
+// MarkConversationRead moves a conversation's read cursor forward to ts, returning the resulting cursor.
+// Slack is updated after a short delay, so that reading through a conversation only marks it once.
+func (sc *SlackClient) MarkConversationRead(channelID, ts string) string {
+	cursor := sc.conversationMarker.MarkConversation(channelID, ts)
+	sc.conversationRead(channelID, cursor)
+	return cursor
+}
+
+// bootstrapReadState fetches the read cursors and unread counts of our channels and DMs, telling IRC clients
+// about cursors as they arrive. client.counts covers everything in one call, but if it isn't available we
+// fall back to asking about each conversation we don't know the cursor of yet.
+func (sc *SlackClient) bootstrapReadState(incomingChan chan<- *SlackEvent) {
+	channelIDs := make(map[string]bool)
+	sc.RLock()
+	for channelID := range sc.channelMemberships {
+		channelIDs[channelID] = true
+	}
+	for dmID := range sc.dmInfo {
+		channelIDs[dmID] = true
+	}
+	sc.RUnlock()
+
+	var counts []clientCount
+	err := sc.retryRateLimited("client.counts", func() (err error) {
+		counts, err = sc.getClientCounts()
+		return
+	})
+	if err == nil {
+		for _, count := range counts {
+			if !channelIDs[count.ID] {
+				continue
+			}
+
+			if count.LastRead != "" {
+				if markerEvent := sc.handleConversationMarked(count.ID, count.LastRead); markerEvent != nil {
+					incomingChan <- markerEvent
+				}
+			}
+			sc.unreadTracker.Set(count.ID, count.HasUnreads, 0, count.MentionCount)
+		}
+	} else {
+		log.Printf("%s client.counts unavailable, fetching conversations individually: %v", sc.Tag(), err)
+		sc.bootstrapReadStateFromInfo(channelIDs, incomingChan)
+	}
+
+	if !sc.unreadTracker.isReady() {
+		sc.unreadTracker.SetReady()
+		incomingChan <- &SlackEvent{EventType: UnreadSummaryEvent}
+	}
+}
+
+// bootstrapReadStateFromInfo fetches the read cursor and unread count of each conversation we don't know
+// the read cursor of yet from conversations.info.
+func (sc *SlackClient) bootstrapReadStateFromInfo(channelIDs map[string]bool, incomingChan chan<- *SlackEvent) {
+	for channelID := range channelIDs {
+		if _, found := sc.conversationMarker.ReadCursor(channelID); found {
+			continue
+		}
+
+		var channel *slack.Channel
+		err := sc.retryRateLimited("conversations.info", func() (err error) {
+			channel, err = sc.client.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: channelID})
+			return
+		})
+		if err != nil {
+			log.Printf("%s error while fetching read cursor for %v: %v", sc.Tag(), channelID, err)
+			continue
+		}
+
+		if channel.LastRead != "" {
+			if markerEvent := sc.handleConversationMarked(channelID, channel.LastRead); markerEvent != nil {
+				incomingChan <- markerEvent
+			}
+		}
+		sc.unreadTracker.Set(channelID, false, channel.UnreadCountDisplay, 0)
+	}
+}
@@ -0,0 +1,438 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// A recording is a JSONL file of everything a gateway received from Slack: each event, and each Web API
+// response along with the request it answered. Entries are written as they arrive, with how long after the
+// start of the recording that was, so a recording is usable even if tanya has to be killed.
+type recordedEntry struct {
+	At time.Duration `json:"at"`
+
+	// Events, as slack-go decoded them. Unmapped events are kept as Slack sent them.
+	Event    string          `json:"event,omitempty"`
+	Unmapped bool            `json:"unmapped,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+
+	// Web API responses, keyed by method and the request's parameters, less the token
+	Method       string          `json:"method,omitempty"`
+	Params       string          `json:"params,omitempty"`
+	Status       int             `json:"status,omitempty"`
+	Response     json.RawMessage `json:"response,omitempty"`
+	ResponseText string          `json:"response_text,omitempty"`
+
+	// Any error carried by an event, or returned instead of a response
+	Error string `json:"error,omitempty"`
+}
+
+// Recorder writes what a gateway receives from Slack to a recording
+type Recorder struct {
+	file  *os.File
+	enc   *json.Encoder
+	start time.Time
+	// Events can still arrive while the gateway stops, after the recording is closed
+	closed bool
+
+	sync.Mutex
+}
+
+// NewRecorder starts a new recording at path, overwriting anything already there
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: f, enc: json.NewEncoder(f), start: time.Now()}, nil
+}
+
+// Close finishes the recording
+func (r *Recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.closed = true
+	return r.file.Close()
+}
+
+func (r *Recorder) write(entry recordedEntry) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		return
+	}
+	entry.At = time.Since(r.start)
+	if err := r.enc.Encode(entry); err != nil {
+		log.Printf("error while recording to %v: %v", r.file.Name(), err)
+	}
+}
+
+func (r *Recorder) recordEvent(event slack.RTMEvent) {
+	entry := recordedEntry{Event: event.Type}
+	if unmarshallingError, ok := event.Data.(*slack.UnmarshallingErrorEvent); ok {
+		if unmapped, ok := unmarshallingError.ErrorObj.(*slack.UnmappedError); ok {
+			entry.Event, entry.Unmapped, entry.Data = unmapped.EventType, true, unmapped.RawEvent
+			r.write(entry)
+			return
+		}
+	}
+
+	data, eventErr := withoutEventError(event.Data)
+	if eventErr != nil {
+		entry.Error = eventErr.Error()
+	}
+
+	var err error
+	if entry.Data, err = json.Marshal(data); err != nil {
+		entry.Error = err.Error()
+	}
+	r.write(entry)
+}
+
+func (r *Recorder) recordResponse(method string, params url.Values, status int, body []byte, err error) {
+	entry := recordedEntry{Method: method, Params: params.Encode(), Status: status}
+	if err != nil {
+		entry.Error = err.Error()
+	} else if json.Valid(body) {
+		entry.Response = body
+	} else {
+		entry.ResponseText = string(body)
+	}
+	r.write(entry)
+}
+
+// Errors don't survive being encoded as JSON, so events carrying one are recorded without it, and have it
+// put back from the entry's error on replay
+func withoutEventError(data interface{}) (interface{}, error) {
+	switch d := data.(type) {
+	case *slack.ConnectionErrorEvent:
+		c := *d
+		c.ErrorObj = nil
+		return &c, d.ErrorObj
+	case *slack.DisconnectedEvent:
+		c := *d
+		c.Cause = nil
+		return &c, d.Cause
+	case *slack.IncomingEventError:
+		return &slack.IncomingEventError{}, d.ErrorObj
+	case *slack.UnmarshallingErrorEvent:
+		return &slack.UnmarshallingErrorEvent{}, d.ErrorObj
+	case *slack.AckErrorEvent:
+		c := *d
+		c.ErrorObj = nil
+		return &c, d.ErrorObj
+	case *slack.OutgoingErrorEvent:
+		c := *d
+		c.ErrorObj = nil
+		return &c, d.ErrorObj
+	}
+	return data, nil
+}
+
+func setEventError(data interface{}, err error) {
+	switch d := data.(type) {
+	case *slack.ConnectionErrorEvent:
+		d.ErrorObj = err
+	case *slack.DisconnectedEvent:
+		d.Cause = err
+	case *slack.IncomingEventError:
+		d.ErrorObj = err
+	case *slack.UnmarshallingErrorEvent:
+		d.ErrorObj = err
+	case *slack.AckErrorEvent:
+		d.ErrorObj = err
+	case *slack.OutgoingErrorEvent:
+		d.ErrorObj = err
+	}
+}
+
+// Events the event sources make up themselves, which aren't in slack.EventMapping
+var internalEventTypes = map[string]interface{}{
+	"hello":               slack.HelloEvent{},
+	"ack":                 slack.AckMessage{},
+	"connecting":          slack.ConnectingEvent{},
+	"connected":           slack.ConnectedEvent{},
+	"connection_error":    slack.ConnectionErrorEvent{},
+	"disconnected":        slack.DisconnectedEvent{},
+	"incoming_error":      slack.IncomingEventError{},
+	"unmarshalling_error": slack.UnmarshallingErrorEvent{},
+	"invalid_auth":        slack.InvalidAuthEvent{},
+	"ack_error":           slack.AckErrorEvent{},
+	"outgoing_error":      slack.OutgoingErrorEvent{},
+	"latency_report":      slack.LatencyReport{},
+}
+
+// replayedEvent turns a recorded event back into the event it was recorded from
+func replayedEvent(entry recordedEntry) slack.RTMEvent {
+	if entry.Unmapped {
+		return slack.RTMEvent{Type: "unmarshalling_error", Data: &slack.UnmarshallingErrorEvent{
+			ErrorObj: slack.NewUnmappedError("replay", entry.Event, entry.Data),
+		}}
+	}
+
+	v, found := internalEventTypes[entry.Event]
+	if !found {
+		v, found = slack.EventMapping[entry.Event]
+	}
+	if !found {
+		return slack.RTMEvent{Type: "unmarshalling_error", Data: &slack.UnmarshallingErrorEvent{
+			ErrorObj: slack.NewUnmappedError("replay", entry.Event, entry.Data),
+		}}
+	}
+
+	data := reflect.New(reflect.TypeOf(v)).Interface()
+	if err := json.Unmarshal(entry.Data, data); err != nil {
+		return slack.RTMEvent{Type: "unmarshalling_error", Data: &slack.UnmarshallingErrorEvent{ErrorObj: err}}
+	}
+	if entry.Error != "" {
+		setEventError(data, errors.New(entry.Error))
+	}
+	return slack.RTMEvent{Type: entry.Event, Data: data}
+}
+
+// recordingEventSource records every event from another event source as it passes them on
+type recordingEventSource struct {
+	eventSource
+	recorder *Recorder
+
+	events chan slack.RTMEvent
+}
+
+func (s *recordingEventSource) Events() <-chan slack.RTMEvent {
+	return s.events
+}
+
+func (s *recordingEventSource) Run(stopChan <-chan struct{}) {
+	go s.eventSource.Run(stopChan)
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case event := <-s.eventSource.Events():
+			s.recorder.recordEvent(event)
+			select {
+			case s.events <- event:
+			case <-stopChan:
+				return
+			}
+		}
+	}
+}
+
+// apiMethod returns the Web API method a request is for, if it is for one
+func apiMethod(apiURL string, u *url.URL) (string, bool) {
+	if !strings.HasPrefix(u.String(), apiURL) {
+		return "", false
+	}
+	return strings.SplitN(strings.TrimPrefix(u.String(), apiURL), "?", 2)[0], true
+}
+
+// requestParams returns the parameters of a Web API request, leaving the request as it was
+func requestParams(req *http.Request) url.Values {
+	params := req.URL.Query()
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if req.Body != nil && mediaType == "application/x-www-form-urlencoded" {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if form, parseErr := url.ParseQuery(string(body)); err == nil && parseErr == nil {
+			for key, values := range form {
+				params[key] = append(params[key], values...)
+			}
+		}
+	}
+
+	params.Del("token")
+	return params
+}
+
+// recordingTransport records the response to every Web API request made through it
+type recordingTransport struct {
+	apiURL   string
+	recorder *Recorder
+	next     http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	method, isAPI := apiMethod(t.apiURL, req.URL)
+	if !isAPI {
+		return t.next.RoundTrip(req)
+	}
+
+	params := requestParams(req)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.recorder.recordResponse(method, params, 0, nil, err)
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	t.recorder.recordResponse(method, params, resp.StatusCode, body, err)
+	return resp, err
+}
+
+// Replay plays a recording back in place of Slack. Events arrive with the same timing as they did when
+// recorded, and Web API requests are answered with the recorded response to the same request, or failing
+// that the next recorded response to the same method.
+type Replay struct {
+	events    []recordedEntry
+	responses []*replayedResponse
+
+	sync.Mutex
+}
+
+type replayedResponse struct {
+	recordedEntry
+	used bool
+}
+
+// LoadReplay loads a recording to be replayed
+func LoadReplay(path string) (*Replay, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	replay := &Replay{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var entry recordedEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			// A recording cut short by tanya being killed may end with half an entry
+			log.Printf("ignoring the rest of %v: %v", path, err)
+			break
+		}
+
+		if entry.Event != "" {
+			replay.events = append(replay.events, entry)
+		} else if entry.Method != "" {
+			replay.responses = append(replay.responses, &replayedResponse{recordedEntry: entry})
+		}
+	}
+	return replay, nil
+}
+
+// response finds the recorded response to a Web API request
+func (r *Replay) response(method string, params url.Values) (recordedEntry, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	encodedParams := params.Encode()
+	matches := []func(*replayedResponse) bool{
+		func(resp *replayedResponse) bool { return !resp.used && resp.Params == encodedParams },
+		// Requests made more often than when recorded get the last response to them again
+		func(resp *replayedResponse) bool { return resp.Params == encodedParams },
+		// and requests whose parameters differ, such as by a timestamp, get the next response to the method
+		func(resp *replayedResponse) bool { return !resp.used },
+	}
+	for _, match := range matches {
+		var found *replayedResponse
+		for _, resp := range r.responses {
+			if resp.Method == method && match(resp) {
+				found = resp
+				if !resp.used {
+					break
+				}
+			}
+		}
+		if found != nil {
+			found.used = true
+			return found.recordedEntry, true
+		}
+	}
+	return recordedEntry{}, false
+}
+
+// replayTransport answers Web API requests from a recording, and fails any others
+type replayTransport struct {
+	apiURL string
+	replay *Replay
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode: http.StatusNotFound,
+		Header:     http.Header{"Content-Type": []string{"text/plain"}},
+		Body:       io.NopCloser(strings.NewReader("not recorded")),
+		Request:    req,
+	}
+
+	method, isAPI := apiMethod(t.apiURL, req.URL)
+	if !isAPI {
+		return resp, nil
+	}
+
+	entry, found := t.replay.response(method, requestParams(req))
+	switch {
+	case !found:
+		log.Printf("replay: no recorded response to %v", method)
+		resp.StatusCode = http.StatusOK
+		resp.Header.Set("Content-Type", "application/json")
+		resp.Body = io.NopCloser(strings.NewReader(`{"ok":false,"error":"not_recorded"}`))
+	case entry.Error != "":
+		return nil, errors.New(entry.Error)
+	case entry.Response != nil:
+		resp.StatusCode = entry.Status
+		resp.Header.Set("Content-Type", "application/json")
+		resp.Body = io.NopCloser(bytes.NewReader(entry.Response))
+	default:
+		resp.StatusCode = entry.Status
+		resp.Body = io.NopCloser(strings.NewReader(entry.ResponseText))
+	}
+	return resp, nil
+}
+
+// replayEventSource sends the events in a recording, then waits to be stopped
+type replayEventSource struct {
+	replay *Replay
+	events chan slack.RTMEvent
+}
+
+func (s *replayEventSource) Events() <-chan slack.RTMEvent {
+	return s.events
+}
+
+func (s *replayEventSource) Reconnect() error {
+	return errors.New("a replayed session has no connection to reconnect")
+}
+
+func (s *replayEventSource) Run(stopChan <-chan struct{}) {
+	start := time.Now()
+	for _, entry := range s.replay.events {
+		select {
+		case <-stopChan:
+			return
+		case <-time.After(time.Until(start.Add(entry.At))):
+		}
+
+		select {
+		case s.events <- replayedEvent(entry):
+		case <-stopChan:
+			return
+		}
+	}
+
+	log.Printf("replay: all %d events replayed", len(s.replay.events))
+	<-stopChan
+}
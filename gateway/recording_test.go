@@ -0,0 +1,196 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/slack-go/slack"
+)
+
+func TestRecordedEventsReplay(t *testing.T) {
+	tests := []struct {
+		name  string
+		event slack.RTMEvent
+		check func(event slack.RTMEvent) bool
+	}{
+		{
+			"message",
+			slack.RTMEvent{Type: "message", Data: &slack.MessageEvent{Msg: slack.Msg{Channel: "C1", User: "U1", Text: "hi"}}},
+			func(event slack.RTMEvent) bool {
+				m, ok := event.Data.(*slack.MessageEvent)
+				return ok && m.Channel == "C1" && m.User == "U1" && m.Text == "hi"
+			},
+		},
+		{
+			"connected",
+			slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{ConnectionCount: 2,
+				Info: &slack.Info{User: &slack.UserDetails{ID: "U1"}}}},
+			func(event slack.RTMEvent) bool {
+				c, ok := event.Data.(*slack.ConnectedEvent)
+				return ok && c.ConnectionCount == 2 && c.Info.User.ID == "U1"
+			},
+		},
+		{
+			"disconnected, with its cause",
+			slack.RTMEvent{Type: "disconnected", Data: &slack.DisconnectedEvent{Intentional: true, Cause: errors.New("bye")}},
+			func(event slack.RTMEvent) bool {
+				d, ok := event.Data.(*slack.DisconnectedEvent)
+				return ok && d.Intentional && d.Cause != nil && d.Cause.Error() == "bye"
+			},
+		},
+		{
+			"connection error",
+			slack.RTMEvent{Type: "connection_error", Data: &slack.ConnectionErrorEvent{Attempt: 3, ErrorObj: errors.New("timeout")}},
+			func(event slack.RTMEvent) bool {
+				c, ok := event.Data.(*slack.ConnectionErrorEvent)
+				return ok && c.Attempt == 3 && c.ErrorObj.Error() == "timeout"
+			},
+		},
+		{
+			"unmapped, which keeps its raw event",
+			slack.RTMEvent{Type: "unmarshalling_error", Data: &slack.UnmarshallingErrorEvent{
+				ErrorObj: slack.NewUnmappedError("test", "mpim_marked", json.RawMessage(`{"type":"mpim_marked","channel":"G1"}`)),
+			}},
+			func(event slack.RTMEvent) bool {
+				u, ok := event.Data.(*slack.UnmarshallingErrorEvent)
+				if !ok {
+					return false
+				}
+				unmapped, ok := u.ErrorObj.(*slack.UnmappedError)
+				return ok && unmapped.EventType == "mpim_marked" &&
+					string(unmapped.RawEvent) == `{"type":"mpim_marked","channel":"G1"}`
+			},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		recorder.recordEvent(tt.event)
+	}
+	recorder.Close()
+
+	replay, err := LoadReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replay.events) != len(tests) {
+		t.Fatalf("replayed %d events, want %d", len(replay.events), len(tests))
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := replayedEvent(replay.events[i])
+			if event.Type != tt.event.Type || !tt.check(event) {
+				t.Errorf("replayed event = %#v, want %#v", event, tt.event)
+			}
+		})
+	}
+}
+
+func TestRecordedResponsesReplay(t *testing.T) {
+	const apiURL = "https://slack.test/api/"
+
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.recordResponse("users.info", url.Values{"user": {"U1"}}, 200, []byte(`{"ok":true,"user":{"id":"U1"}}`), nil)
+	recorder.recordResponse("users.info", url.Values{"user": {"U2"}}, 200, []byte(`{"ok":true,"user":{"id":"U2"}}`), nil)
+	recorder.recordResponse("chat.postMessage", url.Values{"text": {"first"}}, 200, []byte(`{"ok":true,"ts":"1"}`), nil)
+	recorder.recordResponse("chat.postMessage", url.Values{"text": {"second"}}, 200, []byte(`{"ok":true,"ts":"2"}`), nil)
+	recorder.recordResponse("auth.test", nil, 0, nil, errors.New("connection refused"))
+	recorder.Close()
+
+	replay, err := LoadReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &replayTransport{apiURL: apiURL, replay: replay}}
+
+	tests := []struct {
+		name    string
+		method  string
+		params  url.Values
+		want    string
+		wantErr bool
+	}{
+		{"same request, out of order", "users.info", url.Values{"user": {"U2"}}, `"U2"`, false},
+		{"same request again", "users.info", url.Values{"user": {"U2"}}, `"U2"`, false},
+		{"other request", "users.info", url.Values{"user": {"U1"}}, `"U1"`, false},
+		{"different request, in recorded order", "chat.postMessage", url.Values{"text": {"other"}}, `"ts":"1"`, false},
+		{"next different request", "chat.postMessage", url.Values{"text": {"another"}}, `"ts":"2"`, false},
+		{"unrecorded method", "conversations.list", nil, "not_recorded", false},
+		{"recorded error", "auth.test", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Tokens differ between recording and replay, and aren't part of the request
+			params := url.Values{"token": {"xoxp-secret"}}
+			for key, values := range tt.params {
+				params[key] = values
+			}
+			resp, err := client.PostForm(apiURL+tt.method, params)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("%v succeeded, want the recorded error", tt.method)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if !strings.Contains(string(body), tt.want) {
+				t.Errorf("%v = %s, want %v in it", tt.method, body, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordingTransport(t *testing.T) {
+	const apiURL = "https://slack.test/api/"
+
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &replayTransport{apiURL: apiURL, replay: &Replay{responses: []*replayedResponse{
+		{recordedEntry: recordedEntry{Method: "users.info", Status: 200, Response: json.RawMessage(`{"ok":true}`)}},
+	}}}
+	client := &http.Client{Transport: &recordingTransport{apiURL: apiURL, recorder: recorder, next: upstream}}
+
+	resp, err := client.PostForm(apiURL+"users.info?include_locale=true", url.Values{"token": {"xoxp-secret"}, "user": {"U1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `{"ok":true}` {
+		t.Errorf("response passed on = %s, want it unchanged", body)
+	}
+	recorder.Close()
+
+	replay, err := LoadReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replay.responses) != 1 {
+		t.Fatalf("recorded %d responses, want 1", len(replay.responses))
+	}
+	got := replay.responses[0]
+	if got.Method != "users.info" || got.Params != "include_locale=true&user=U1" || string(got.Response) != `{"ok":true}` {
+		t.Errorf("recorded %+v, want users.info with its parameters but not the token", got.recordedEntry)
+	}
+}
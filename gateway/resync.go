@@ -0,0 +1,308 @@
+package gateway
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Channels whose member lists are fetched at once while resyncing
+const resyncUserListWorkers = 4
+
+// resyncMappings reloads workspace/conversation metadata from Slack after a reconnection, diffing it against
+// what we had before. Cached objects which haven't changed are kept, along with the member lists of channels
+// we're still in. Returns the events needed to bring IRC clients up to date, or an error if the new state
+// couldn't be fetched, in which case what we had is kept.
+func (sc *SlackClient) resyncMappings(selfID string) ([]*SlackEvent, error) {
+	startTime := time.Now()
+	ws, err := sc.fetchWorkspaceState()
+	if err != nil {
+		return nil, err
+	}
+	events := sc.applyWorkspaceState(ws, selfID)
+
+	log.Printf("%s slack:resync channels:%v users:%v dms:%v memberships:%v events:%v time:%v", sc.Tag(),
+		len(sc.channelInfo), len(sc.userInfo), len(sc.dmInfo), len(sc.channelMemberships), len(events),
+		time.Since(startTime))
+	return events, nil
+}
+
+// Resync reloads workspace/conversation metadata and the member lists of the channels we're in, as after a
+// reconnection, without reconnecting. Events for anything that changed are sent as they're found.
+func (sc *SlackClient) Resync() error {
+	sc.RLock()
+	self := sc.self
+	sc.RUnlock()
+	if self == nil {
+		return errors.New("not connected to slack yet")
+	}
+
+	events, err := sc.resyncMappings(self.SlackID)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if err := sc.sendEvent(event); err != nil {
+			return err
+		}
+	}
+
+	sc.RLock()
+	incomingChan := sc.incomingChan
+	sc.RUnlock()
+	sc.resyncChannelUserLists(incomingChan)
+	return nil
+}
+
+// applyWorkspaceState replaces our cached state with a freshly fetched snapshot, returning events
+// describing the differences
+func (sc *SlackClient) applyWorkspaceState(ws *workspaceState, selfID string) (events []*SlackEvent) {
+	sc.Lock()
+
+	// Keep unchanged user objects, and let clients know about any nick changes we missed. Our own nick
+	// change is handled as part of the connect burst.
+	for userID, user := range ws.userInfo {
+		oldUser, found := sc.userInfo[userID]
+		if !found || oldUser == nil || user == nil {
+			continue
+		}
+
+		if *oldUser == *user {
+			ws.userInfo[userID] = oldUser
+			continue
+		}
+
+		if oldUser.Nick != user.Nick && userID != selfID {
+			events = append(events, &SlackEvent{
+				EventType: NickChangeEvent,
+				Data: &NickChangeEventData{
+					From:    *oldUser,
+					NewNick: user.Nick,
+				},
+			})
+		}
+	}
+
+	// Users resolved on demand (e.g. from shared channels) aren't part of the user list, but are still valid
+	for userID, user := range sc.userInfo {
+		if _, found := ws.userInfo[userID]; !found {
+			ws.userInfo[userID] = user
+		}
+	}
+	for dmID, user := range ws.dmInfo {
+		if user != nil {
+			ws.dmInfo[dmID] = ws.userInfo[user.SlackID]
+		}
+	}
+
+	// Keep unchanged channel objects. Group DMs keep their generated names, since their members can't change,
+	// but rebuild them from the refreshed users in case any of their nicks have.
+	var newGroupDMs []*SlackChannel
+	for channelID, channel := range ws.channelInfo {
+		oldChannel, found := sc.channelInfo[channelID]
+		if !found || oldChannel == nil {
+			if channel.GroupDM {
+				newGroupDMs = append(newGroupDMs, channel)
+			}
+			continue
+		}
+
+		if channel.GroupDM {
+			channel.Name = oldChannel.Name
+			if members, found := sc.channelMembers[channelID]; found {
+				channel.Name = groupDMName(members, ws.userInfo, selfID)
+			}
+		}
+		if *oldChannel == *channel {
+			ws.channelInfo[channelID] = oldChannel
+			if _, isMember := ws.channelMemberships[channelID]; isMember {
+				ws.channelMemberships[channelID] = oldChannel
+			}
+		}
+	}
+
+	// Diff channel memberships, renames and topics
+	for channelID, channel := range ws.channelMemberships {
+		oldChannel, wasMember := sc.channelMemberships[channelID]
+		if !wasMember {
+			// New group DMs are announced below, once they've been named
+			if !channel.GroupDM || sc.channelInfo[channelID] != nil {
+				events = append(events, newJoinPartEvent(SelfJoinEvent, ws.userInfo[selfID], channel.Name))
+			}
+			continue
+		}
+
+		if oldChannel.Name != channel.Name {
+			events = append(events, &SlackEvent{
+				EventType: ChannelRenameEvent,
+				Data: &ChannelRenameEventData{
+					OldName: oldChannel.Name,
+					NewName: channel.Name,
+				},
+			})
+		}
+
+		if oldChannel.Topic.Value != channel.Topic.Value {
+			setBy := slackFakeUser
+			if creator := ws.userInfo[channel.Topic.Creator]; creator != nil {
+				setBy = creator
+			}
+
+			events = append(events, &SlackEvent{
+				EventType: TopicChangeEvent,
+				Data: &TopicChangeEventData{
+					From:     *setBy,
+					Target:   channel.Name,
+					NewTopic: channel.Topic.Value,
+				},
+			})
+		}
+	}
+	for channelID, oldChannel := range sc.channelMemberships {
+		if _, isMember := ws.channelMemberships[channelID]; !isMember {
+			partEvent := newJoinPartEvent(SelfPartEvent, ws.userInfo[selfID], oldChannel.Name)
+			partEvent.Data.(*JoinPartEventData).Reason = "Left while disconnected"
+			events = append(events, partEvent)
+		}
+	}
+
+	// Keep cached member lists for channels we're still in, pointing them at the refreshed user objects
+	channelMembers := make(map[string]map[string]*SlackUser)
+	for channelID, members := range sc.channelMembers {
+		if _, isMember := ws.channelMemberships[channelID]; !isMember {
+			continue
+		}
+
+		refreshedMembers := make(map[string]*SlackUser)
+		for userID := range members {
+			if user := ws.userInfo[userID]; user != nil {
+				refreshedMembers[userID] = user
+			}
+		}
+		channelMembers[channelID] = refreshedMembers
+	}
+
+	sc.channelInfo = ws.channelInfo
+	sc.userInfo = ws.userInfo
+	sc.dmInfo = ws.dmInfo
+	sc.channelMemberships = ws.channelMemberships
+	sc.channelMembers = channelMembers
+	sc.self = ws.userInfo[selfID]
+	sc.Unlock()
+
+	// New group DMs still need names, and are announced once they have them
+	sc.nameGroupDMs(newGroupDMs)
+	for _, groupDM := range newGroupDMs {
+		if _, isMember := ws.channelMemberships[groupDM.SlackID]; isMember {
+			events = append(events, newJoinPartEvent(SelfJoinEvent, sc.self, groupDM.Name))
+		}
+	}
+
+	sc.regenerateReverseMappings()
+	sc.cleanupMappings()
+	return
+}
+
+func newJoinPartEvent(eventType SlackEventType, user *SlackUser, target string) *SlackEvent {
+	if user == nil {
+		user = tanyaInternalUser
+	}
+
+	return &SlackEvent{
+		EventType: eventType,
+		Data: &JoinPartEventData{
+			User:   *user,
+			Target: target,
+		},
+	}
+}
+
+// resyncChannelUserLists re-fetches the member lists we still have cached after a reconnection, sending
+// JOIN/PART events for anyone who came or went while we were disconnected
+func (sc *SlackClient) resyncChannelUserLists(incomingChan chan<- *SlackEvent) {
+	var wg sync.WaitGroup
+	channelIDs := make(chan string)
+	startTime := time.Now()
+
+	sc.RLock()
+	var pending []string
+	for channelID := range sc.channelMembers {
+		pending = append(pending, channelID)
+	}
+	sc.RUnlock()
+
+	// A few at a time, as a request per channel at once would run into the rate limit on large workspaces
+	wg.Add(resyncUserListWorkers)
+	for i := 0; i < resyncUserListWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for channelID := range channelIDs {
+				if err := sc.resyncChannelUserList(channelID, incomingChan); err != nil {
+					log.Printf("%s error while resyncing user list for %v: %v", sc.Tag(), channelID, err)
+				}
+			}
+		}()
+	}
+	for _, channelID := range pending {
+		channelIDs <- channelID
+	}
+	close(channelIDs)
+	wg.Wait()
+
+	log.Printf("%s slack:resync channel_userlists:%v time:%v", sc.Tag(), len(pending), time.Since(startTime))
+}
+
+func (sc *SlackClient) resyncChannelUserList(channelID string, incomingChan chan<- *SlackEvent) error {
+	userIDs, err := sc.getChannelUserIDsFromAPI(channelID)
+	if err != nil {
+		return err
+	}
+
+	channel, err := sc.ResolveChannel(channelID)
+	if err != nil {
+		return err
+	}
+
+	sc.RLock()
+	oldMembers := make(map[string]*SlackUser)
+	for userID, user := range sc.channelMembers[channelID] {
+		oldMembers[userID] = user
+	}
+	sc.RUnlock()
+
+	members := make(map[string]*SlackUser)
+	var joined []*SlackUser
+	for _, userID := range userIDs {
+		if user, found := oldMembers[userID]; found {
+			members[userID] = user
+			delete(oldMembers, userID)
+			continue
+		}
+
+		user, err := sc.ResolveUser(userID)
+		if err != nil {
+			return err
+		}
+		members[userID] = user
+		joined = append(joined, user)
+	}
+
+	sc.Lock()
+	sc.channelMembers[channelID] = members
+	sc.Unlock()
+
+	// Anyone left in oldMembers is no longer in the channel
+	for _, user := range joined {
+		if user != sc.self {
+			incomingChan <- newJoinPartEvent(JoinEvent, user, channel.Name)
+		}
+	}
+	for _, user := range oldMembers {
+		if user != sc.self {
+			incomingChan <- newJoinPartEvent(PartEvent, user, channel.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+func TestSlackClient_applyWorkspaceState(t *testing.T) {
+	self := &SlackUser{SlackID: "U0SELF", Nick: "papika"}
+	kedo := &SlackUser{SlackID: "U267NCD1U", Nick: "kedo"}
+	cozzie := &SlackUser{SlackID: "U2VEKS57B", Nick: "cozzie"}
+
+	sc := NewSlackClient()
+	sc.self = self
+	sc.userInfo = map[string]*SlackUser{self.SlackID: self, kedo.SlackID: kedo, cozzie.SlackID: cozzie}
+	sc.channelInfo = map[string]*SlackChannel{
+		"C2EFNRK1S": {SlackID: "C2EFNRK1S", Name: "#chatter-technical"},
+		"C024BE91L": {SlackID: "C024BE91L", Name: "#random"},
+		"C0G9QF9GW": {SlackID: "C0G9QF9GW", Name: "#old-name", Topic: slack.Topic{Value: "old topic"}},
+	}
+	sc.channelMemberships = map[string]*SlackChannel{
+		"C2EFNRK1S": sc.channelInfo["C2EFNRK1S"],
+		"C0G9QF9GW": sc.channelInfo["C0G9QF9GW"],
+	}
+	sc.channelMembers = map[string]map[string]*SlackUser{
+		"C2EFNRK1S": {self.SlackID: self, kedo.SlackID: kedo},
+	}
+	sc.regenerateReverseMappings()
+
+	// While we were away: kedo changed nick, we left #chatter-technical and joined #random,
+	// and #old-name was renamed and had its topic changed by cozzie.
+	newKedo := &SlackUser{SlackID: "U267NCD1U", Nick: "kedo_"}
+	ws := &workspaceState{
+		userInfo: map[string]*SlackUser{
+			self.SlackID:   {SlackID: "U0SELF", Nick: "papika"},
+			kedo.SlackID:   newKedo,
+			cozzie.SlackID: {SlackID: "U2VEKS57B", Nick: "cozzie"},
+		},
+		channelInfo: map[string]*SlackChannel{
+			"C2EFNRK1S": {SlackID: "C2EFNRK1S", Name: "#chatter-technical"},
+			"C024BE91L": {SlackID: "C024BE91L", Name: "#random"},
+			"C0G9QF9GW": {
+				SlackID: "C0G9QF9GW",
+				Name:    "#new-name",
+				Topic:   slack.Topic{Value: "new topic", Creator: cozzie.SlackID},
+			},
+		},
+		dmInfo: map[string]*SlackUser{},
+	}
+	ws.channelMemberships = map[string]*SlackChannel{
+		"C024BE91L": ws.channelInfo["C024BE91L"],
+		"C0G9QF9GW": ws.channelInfo["C0G9QF9GW"],
+	}
+
+	events := sc.applyWorkspaceState(ws, self.SlackID)
+
+	want := map[SlackEventType]interface{}{
+		NickChangeEvent:    &NickChangeEventData{From: *kedo, NewNick: "kedo_"},
+		SelfJoinEvent:      &JoinPartEventData{User: *self, Target: "#random"},
+		ChannelRenameEvent: &ChannelRenameEventData{OldName: "#old-name", NewName: "#new-name"},
+		TopicChangeEvent:   &TopicChangeEventData{From: *cozzie, Target: "#new-name", NewTopic: "new topic"},
+		SelfPartEvent:      &JoinPartEventData{User: *self, Target: "#chatter-technical", Reason: "Left while disconnected"},
+	}
+	if len(events) != len(want) {
+		t.Errorf("SlackClient.applyWorkspaceState() returned %v events, want %v: %+v", len(events), len(want), events)
+	}
+	for _, event := range events {
+		if !reflect.DeepEqual(event.Data, want[event.EventType]) {
+			t.Errorf("SlackClient.applyWorkspaceState() event %v = %+v, want %+v",
+				event.EventType, event.Data, want[event.EventType])
+		}
+	}
+
+	// Unchanged objects should be kept, and changed ones replaced
+	if sc.userInfo[self.SlackID] != self || sc.userInfo[cozzie.SlackID] != cozzie {
+		t.Error("SlackClient.applyWorkspaceState() replaced unchanged user objects")
+	}
+	if sc.ResolveNickToUser("kedo_") != newKedo || sc.ResolveNickToUser("kedo") != nil {
+		t.Error("SlackClient.applyWorkspaceState() did not update nick mappings")
+	}
+	if sc.ResolveNameToChannel("#new-name") == nil || sc.ResolveNameToChannel("#old-name") != nil {
+		t.Error("SlackClient.applyWorkspaceState() did not update channel name mappings")
+	}
+	if _, found := sc.channelMembers["C2EFNRK1S"]; found {
+		t.Error("SlackClient.applyWorkspaceState() kept member list for a channel we left")
+	}
+}
+
+func TestSlackClient_applyWorkspaceStateGroupDMRename(t *testing.T) {
+	self := &SlackUser{SlackID: "U0SELF", Nick: "papika"}
+	kedo := &SlackUser{SlackID: "U267NCD1U", Nick: "kedo"}
+	cozzie := &SlackUser{SlackID: "U2VEKS57B", Nick: "cozzie"}
+
+	sc := NewSlackClient()
+	sc.self = self
+	sc.userInfo = map[string]*SlackUser{self.SlackID: self, kedo.SlackID: kedo, cozzie.SlackID: cozzie}
+	sc.channelInfo = map[string]*SlackChannel{
+		"G024BE91L": {SlackID: "G024BE91L", Name: "#cozzie+kedo", GroupDM: true},
+	}
+	sc.channelMemberships = map[string]*SlackChannel{"G024BE91L": sc.channelInfo["G024BE91L"]}
+	sc.channelMembers = map[string]map[string]*SlackUser{
+		"G024BE91L": {self.SlackID: self, kedo.SlackID: kedo, cozzie.SlackID: cozzie},
+	}
+	sc.regenerateReverseMappings()
+
+	// Slack still calls the group DM by its own generated name, but kedo changed nick while we were away
+	ws := &workspaceState{
+		userInfo: map[string]*SlackUser{
+			self.SlackID:   {SlackID: "U0SELF", Nick: "papika"},
+			kedo.SlackID:   {SlackID: "U267NCD1U", Nick: "zkedo"},
+			cozzie.SlackID: {SlackID: "U2VEKS57B", Nick: "cozzie"},
+		},
+		channelInfo: map[string]*SlackChannel{
+			"G024BE91L": {SlackID: "G024BE91L", Name: "mpdm-papika--kedo--cozzie-1", GroupDM: true},
+		},
+		dmInfo: map[string]*SlackUser{},
+	}
+	ws.channelMemberships = map[string]*SlackChannel{"G024BE91L": ws.channelInfo["G024BE91L"]}
+
+	var renames []*ChannelRenameEventData
+	for _, event := range sc.applyWorkspaceState(ws, self.SlackID) {
+		if event.EventType == ChannelRenameEvent {
+			renames = append(renames, event.Data.(*ChannelRenameEventData))
+		}
+	}
+
+	want := []*ChannelRenameEventData{{OldName: "#cozzie+kedo", NewName: "#cozzie+zkedo"}}
+	if !reflect.DeepEqual(renames, want) {
+		t.Errorf("SlackClient.applyWorkspaceState() renames = %+v, want %+v", renames, want)
+	}
+	if sc.ResolveNameToChannel("#cozzie+zkedo") == nil || sc.ResolveNameToChannel("#cozzie+kedo") != nil {
+		t.Error("SlackClient.applyWorkspaceState() did not update group DM name mappings")
+	}
+}
+
+func TestSlackClient_resyncChannelUserLists(t *testing.T) {
+	const channels = 20
+	var lock sync.Mutex
+	var inFlight, maxInFlight int
+	rateLimited := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		// The first request is rate limited, and should be retried
+		if !rateLimited {
+			rateLimited = true
+			lock.Unlock()
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		lock.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprint(w, `{"ok": true, "members": ["U1"], "response_metadata": {"next_cursor": ""}}`)
+
+		lock.Lock()
+		inFlight--
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	sc := NewSlackClient()
+	sc.client = slack.New("xoxp-test", slack.OptionAPIURL(srv.URL+"/"))
+	sc.userInfo["U1"] = &SlackUser{SlackID: "U1", Nick: "kedo"}
+	for i := 0; i < channels; i++ {
+		channelID := fmt.Sprintf("C%d", i)
+		sc.channelInfo[channelID] = &SlackChannel{SlackID: channelID, Name: "#" + channelID}
+		sc.channelMembers[channelID] = make(map[string]*SlackUser)
+	}
+
+	incomingChan := make(chan *SlackEvent, channels)
+	sc.resyncChannelUserLists(incomingChan)
+
+	if len(incomingChan) != channels {
+		t.Errorf("SlackClient.resyncChannelUserLists() sent %d joins, want %d", len(incomingChan), channels)
+	}
+	if maxInFlight > resyncUserListWorkers {
+		t.Errorf("SlackClient.resyncChannelUserLists() made %d requests at once, want at most %d", maxInFlight, resyncUserListWorkers)
+	}
+}
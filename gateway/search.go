@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"log"
+
+	"github.com/slack-go/slack"
+)
+
+// Number of messages on each page of search results
+const searchPageSize = 20
+
+// SearchResults is a page of the messages matching a search, newest first, as they would be relayed to IRC
+type SearchResults struct {
+	Messages []*MessageEventData
+	// Which page this is, counting from 1, of how many, and how many messages match in all
+	Page, Pages, Total int
+}
+
+// SearchMessages searches Slack's message history, with Slack's own query modifiers (in:, from:, before:,
+// etc.). This needs a user token; bot tokens can't search.
+func (sc *SlackClient) SearchMessages(query string, page int) (*SearchResults, error) {
+	params := slack.NewSearchParameters()
+	params.Sort = "timestamp"
+	params.Count = searchPageSize
+	params.Page = page
+
+	var messages *slack.SearchMessages
+	err := sc.retryRateLimited("search.messages", func() (err error) {
+		messages, err = sc.client.SearchMessages(query, params)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := &SearchResults{Page: messages.Paging.Page, Pages: messages.Paging.Pages, Total: messages.Total}
+	for _, match := range messages.Matches {
+		target, err := sc.conversationTarget(match.Channel.ID)
+		if err != nil {
+			log.Printf("%s could not resolve conversation %v of search result: %v", sc.Tag(), match.Channel.ID, err)
+			continue
+		}
+
+		// Bots have no user, only a name
+		from := &SlackUser{Nick: match.Username}
+		if match.User != "" {
+			if from, err = sc.ResolveUser(match.User); err != nil {
+				log.Printf("%s could not resolve user %v of search result: %v", sc.Tag(), match.User, err)
+				continue
+			}
+		}
+
+		results.Messages = append(results.Messages, &MessageEventData{
+			From:      *from,
+			Target:    target,
+			Message:   sc.ParseMessageText(match.Text),
+			Timestamp: match.Timestamp,
+			MsgID:     messageID(match.Channel.ID, match.Timestamp),
+		})
+	}
+	return results, nil
+}
@@ -1,19 +1,24 @@
 package gateway
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/socketmode"
 )
 
-// Number of times GetConversations calls should be retried
-const getConvoRetries = 3
+// Number of times rate limited Slack API calls should be retried
+const slackAPIRetries = 3
 
 // SlackChannel holds data for a channel on Slack
 type SlackChannel struct {
@@ -21,6 +26,7 @@ type SlackChannel struct {
 	Name    string
 	Created time.Time
 	Private bool
+	GroupDM bool
 
 	Topic slack.Topic
 }
@@ -30,7 +36,8 @@ func slackChannelFromDto(channel *slack.Channel) *SlackChannel {
 		SlackID: channel.ID,
 		Name:    "#" + channel.Name,
 		Created: channel.Created.Time(),
-		Private: channel.IsGroup,
+		Private: channel.IsGroup || channel.IsMpIM,
+		GroupDM: channel.IsMpIM,
 		Topic:   channel.Topic,
 	}
 }
@@ -61,9 +68,14 @@ func slackUserFromDto(user *slack.User) *SlackUser {
 
 // SlackClient holds information for the websockets conn to Slack
 type SlackClient struct {
+	config *Config
 	client *slack.Client
-	rtm    *slack.RTM
+	events eventSource
 	self   *SlackUser
+	// Bot user ID our messages are attributed to, if the token is a bot token
+	selfBotID string
+	// Slash commands the workspace has, such as "/remind", which we can run
+	slashCommands map[string]bool
 
 	channelInfo        map[string]*SlackChannel
 	userInfo           map[string]*SlackUser
@@ -72,6 +84,7 @@ type SlackClient struct {
 	channelMembers     map[string]map[string]*SlackUser
 
 	nickToUserMap      map[string]string
+	nickIndex          *nickIndex
 	channelNameToIDMap map[string]string
 	userIDToDMIDMap    map[string]string
 
@@ -79,6 +92,24 @@ type SlackClient struct {
 	slackURLDecoder    *strings.Replacer
 	conversationMarker *ConversationMarker
 	sentMessageQueue   *SentQueue
+	backfillTracker    *BackfillTracker
+	historyCache       *HistoryCache
+	unreadTracker      *UnreadTracker
+	mentionMatcher     *MentionMatcher
+	fileProxy          *FileProxy
+	// Slackbot messages matching any of these aren't passed on
+	slackbotFilter []*regexp.Regexp
+
+	// Base URL of the Slack Web API, for the methods slack-go doesn't wrap
+	apiURL string
+	// Client for every request to Slack, so they can be recorded or replayed
+	httpClient *http.Client
+
+	// Where Poop sends events, for those caused by something other than Slack, e.g. joining a channel from IRC
+	incomingChan chan<- *SlackEvent
+	// Whether we're connected to Slack, and when that last changed
+	connected      bool
+	connectedSince time.Time
 
 	ownMessageLock sync.Mutex
 	sync.RWMutex
@@ -87,6 +118,8 @@ type SlackClient struct {
 // NewSlackClient creates a new SlackClient with some default values
 func NewSlackClient() *SlackClient {
 	return &SlackClient{
+		config: &Config{},
+
 		channelInfo:        make(map[string]*SlackChannel),
 		userInfo:           make(map[string]*SlackUser),
 		dmInfo:             make(map[string]*SlackUser),
@@ -94,6 +127,7 @@ func NewSlackClient() *SlackClient {
 		channelMembers:     make(map[string]map[string]*SlackUser),
 
 		nickToUserMap:      make(map[string]string),
+		nickIndex:          newNickIndex(nil),
 		channelNameToIDMap: make(map[string]string),
 		userIDToDMIDMap:    make(map[string]string),
 
@@ -101,46 +135,70 @@ func NewSlackClient() *SlackClient {
 		slackURLDecoder:    strings.NewReplacer("&gt;", ">", "&lt;", "<", "&amp;", "&"),
 		conversationMarker: NewConversationMarker(),
 		sentMessageQueue:   NewSentQueue(),
+		backfillTracker:    NewBackfillTracker(),
+		historyCache:       NewHistoryCache(),
+		unreadTracker:      NewUnreadTracker(),
+		mentionMatcher:     NewMentionMatcher(),
+
+		apiURL:     slack.APIURL,
+		httpClient: http.DefaultClient,
 	}
 }
 
-func (sc *SlackClient) getConversations(gcp *slack.GetConversationsParameters) (channels []slack.Channel, cursor string, err error) {
+// retryRateLimited calls a Slack API method, waiting and retrying if Slack tells us we're rate limited
+func (sc *SlackClient) retryRateLimited(method string, call func() error) (err error) {
 	var rateLimitErr *slack.RateLimitedError
 
-	for retries := 0; retries < getConvoRetries; retries++ {
+	for retries := 0; retries < slackAPIRetries; retries++ {
 		if retries > 0 {
-			log.Printf("%s slack:getconversations ratelimit wait for %s seconds", sc.Tag(), rateLimitErr.RetryAfter.String())
+			log.Printf("%s slack:%s ratelimit wait for %s seconds", sc.Tag(), method, rateLimitErr.RetryAfter.String())
 			time.Sleep(rateLimitErr.RetryAfter)
 		}
 
-		channels, cursor, err = sc.client.GetConversations(gcp)
-		if err == nil {
+		err = call()
+		if err == nil || !errors.As(err, &rateLimitErr) {
 			return
 		}
+	}
 
-		if !errors.As(err, &rateLimitErr) {
-			return nil, "", err
-		}
+	return
+}
+
+func (sc *SlackClient) getConversations(gcp *slack.GetConversationsParameters) (channels []slack.Channel, cursor string, err error) {
+	err = sc.retryRateLimited("getconversations", func() (err error) {
+		channels, cursor, err = sc.client.GetConversations(gcp)
+		return
+	})
+	if err != nil {
+		return nil, "", err
 	}
 
 	return
 }
 
-// Clear all stored state and reload workspace/conversation metadata from Slack.
-// Called upon reconnection to ensure all cached state is up-to-date.
-func (sc *SlackClient) bootstrapMappings() {
-	startTime := time.Now()
+// workspaceState holds a snapshot of workspace/conversation metadata fetched from Slack
+type workspaceState struct {
+	channelInfo        map[string]*SlackChannel
+	userInfo           map[string]*SlackUser
+	dmInfo             map[string]*SlackUser
+	channelMemberships map[string]*SlackChannel
+	groupDMs           []*SlackChannel
+}
 
-	channelInfo := make(map[string]*SlackChannel)
-	userInfo := make(map[string]*SlackUser)
-	dmInfo := make(map[string]*SlackUser)
-	channelMemberships := make(map[string]*SlackChannel)
+// fetchWorkspaceState downloads the channel, user and DM lists for the workspace
+func (sc *SlackClient) fetchWorkspaceState() (*workspaceState, error) {
+	ws := &workspaceState{
+		channelInfo:        make(map[string]*SlackChannel),
+		userInfo:           make(map[string]*SlackUser),
+		dmInfo:             make(map[string]*SlackUser),
+		channelMemberships: make(map[string]*SlackChannel),
+	}
 
 	hasMore := true
 	gcp := &slack.GetConversationsParameters{
 		ExcludeArchived: true,
 		Limit:           1000,
-		Types:           []string{"public_channel", "private_channel"},
+		Types:           []string{"public_channel", "private_channel", "mpim"},
 	}
 	for hasMore {
 		var channels []slack.Channel
@@ -148,15 +206,18 @@ func (sc *SlackClient) bootstrapMappings() {
 
 		channels, gcp.Cursor, err = sc.getConversations(gcp)
 		if err != nil {
-			log.Fatalf("%s [fatal] slack:init %s err: %v", sc.Tag(), "GetConversations", err)
+			return nil, fmt.Errorf("GetConversations: %w", err)
 		}
 
 		for _, channel := range channels {
 			slackChannel := slackChannelFromDto(&channel)
 
-			channelInfo[channel.ID] = slackChannel
-			if channel.IsMember {
-				channelMemberships[channel.ID] = slackChannel
+			ws.channelInfo[channel.ID] = slackChannel
+			if channel.IsMember || channel.IsMpIM {
+				ws.channelMemberships[channel.ID] = slackChannel
+			}
+			if channel.IsMpIM {
+				ws.groupDMs = append(ws.groupDMs, slackChannel)
 			}
 		}
 
@@ -165,10 +226,10 @@ func (sc *SlackClient) bootstrapMappings() {
 
 	users, err := sc.client.GetUsers()
 	if err != nil {
-		log.Fatalf("%s [fatal] slack:init %s err: %v", sc.Tag(), "GetUsers", err)
+		return nil, fmt.Errorf("GetUsers: %w", err)
 	}
 	for _, user := range users {
-		userInfo[user.ID] = slackUserFromDto(&user)
+		ws.userInfo[user.ID] = slackUserFromDto(&user)
 	}
 
 	ucParams := &slack.GetConversationsParameters{
@@ -179,20 +240,34 @@ func (sc *SlackClient) bootstrapMappings() {
 	}
 	ims, _, err := sc.getConversations(ucParams)
 	if err != nil {
-		log.Fatalf("%s [fatal] slack:init %s err: %v", sc.Tag(), "GetConversations", err)
+		return nil, fmt.Errorf("GetConversations: %w", err)
 	}
 	for _, im := range ims {
-		dmInfo[im.ID] = userInfo[im.User]
+		ws.dmInfo[im.ID] = ws.userInfo[im.User]
+	}
+
+	return ws, nil
+}
+
+// Clear all stored state and load workspace/conversation metadata from Slack.
+// Called upon the initial connection; reconnections use resyncMappings instead.
+func (sc *SlackClient) bootstrapMappings(selfID string) {
+	startTime := time.Now()
+	ws, err := sc.fetchWorkspaceState()
+	if err != nil {
+		log.Fatalf("%s [fatal] slack:init err: %v", sc.Tag(), err)
 	}
 
 	sc.Lock()
-	sc.channelInfo = channelInfo
-	sc.userInfo = userInfo
-	sc.dmInfo = dmInfo
-	sc.channelMemberships = channelMemberships
+	sc.channelInfo = ws.channelInfo
+	sc.userInfo = ws.userInfo
+	sc.dmInfo = ws.dmInfo
+	sc.channelMemberships = ws.channelMemberships
 	sc.channelMembers = make(map[string]map[string]*SlackUser)
+	sc.self = ws.userInfo[selfID]
 	sc.Unlock()
 
+	sc.nameGroupDMs(ws.groupDMs)
 	sc.conversationMarker.Reset()
 	sc.regenerateReverseMappings()
 	sc.cleanupMappings()
@@ -201,6 +276,33 @@ func (sc *SlackClient) bootstrapMappings() {
 		len(sc.channelInfo), len(sc.userInfo), len(sc.dmInfo), len(sc.channelMemberships), time.Since(startTime))
 }
 
+// Group DM names are built from their members' nicks, so can only be generated once users are loaded
+func (sc *SlackClient) nameGroupDMs(groupDMs []*SlackChannel) {
+	for _, groupDM := range groupDMs {
+		if err := sc.nameGroupDM(groupDM); err != nil {
+			log.Printf("%s error while naming group DM %v: %v", sc.Tag(), groupDM.SlackID, err)
+		}
+	}
+}
+
+// mapNick maps a nick to a user in nickToUserMap and the nick index, replacing any other user it was mapped
+// to. Callers must hold the lock.
+func (sc *SlackClient) mapNick(nick, userID string) {
+	if previous, found := sc.nickToUserMap[nick]; found {
+		sc.nickIndex.remove(nick, previous)
+	}
+	sc.nickToUserMap[nick] = userID
+	sc.nickIndex.add(nick, userID)
+}
+
+// unmapNick removes a nick from nickToUserMap and the nick index. Callers must hold the lock.
+func (sc *SlackClient) unmapNick(nick string) {
+	if userID, found := sc.nickToUserMap[nick]; found {
+		sc.nickIndex.remove(nick, userID)
+		delete(sc.nickToUserMap, nick)
+	}
+}
+
 // Regenerate the cached reverse nick/channel name mappings
 // If two channels have the same name, then whelp the first one we find wins
 func (sc *SlackClient) regenerateReverseMappings() {
@@ -214,6 +316,7 @@ func (sc *SlackClient) regenerateReverseMappings() {
 		}
 		sc.nickToUserMap[user.Nick] = user.SlackID
 	}
+	sc.nickIndex = newNickIndex(sc.nickToUserMap)
 
 	sc.channelNameToIDMap = make(map[string]string)
 	for _, channel := range sc.channelInfo {
@@ -274,7 +377,7 @@ func (sc *SlackClient) ResolveUser(slackID string) (user *SlackUser, err error)
 
 	sc.Lock()
 	sc.userInfo[user.SlackID] = user
-	sc.nickToUserMap[user.Nick] = user.SlackID
+	sc.mapNick(user.Nick, user.SlackID)
 	sc.Unlock()
 	return
 }
@@ -294,6 +397,11 @@ func (sc *SlackClient) ResolveChannel(slackID string) (channel *SlackChannel, er
 		return
 	}
 	channel = slackChannelFromDto(channelInfo)
+	if channel.GroupDM {
+		if err = sc.nameGroupDM(channel); err != nil {
+			return
+		}
+	}
 
 	sc.Lock()
 	sc.channelInfo[channel.SlackID] = channel
@@ -430,16 +538,61 @@ type ClientChans struct {
 	StopChan     <-chan struct{}
 }
 
-// Initialize bootstraps the SlackClient with a client token
-func (sc *SlackClient) Initialize(token string, debug bool) {
-	if debug {
-		sc.client = slack.New(
-			token, slack.OptionDebug(true), slack.OptionLog(log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile)))
-	} else {
-		sc.client = slack.New(token)
+// ClientOptions are how a SlackClient is run, beyond its configuration
+type ClientOptions struct {
+	// Log everything slack-go does
+	Debug bool
+	// Record everything received from Slack
+	Recorder *Recorder
+	// Play back a recording instead of connecting to Slack
+	Replay *Replay
+}
+
+// Initialize bootstraps the SlackClient with the gateway configuration
+func (sc *SlackClient) Initialize(config *Config, clientOptions ClientOptions) {
+	sc.config = config
+	sc.apiURL = config.apiURL()
+	switch {
+	case clientOptions.Replay != nil:
+		sc.httpClient = &http.Client{Transport: &replayTransport{apiURL: sc.apiURL, replay: clientOptions.Replay}}
+	case clientOptions.Recorder != nil:
+		sc.httpClient = &http.Client{Transport: &recordingTransport{
+			apiURL: sc.apiURL, recorder: clientOptions.Recorder, next: http.DefaultTransport}}
+	}
+
+	options := []slack.Option{slack.OptionAPIURL(sc.apiURL), slack.OptionHTTPClient(sc.httpClient)}
+	var socketOptions []socketmode.Option
+	if clientOptions.Debug {
+		logger := log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile)
+		options = append(options, slack.OptionDebug(true), slack.OptionLog(logger))
+		socketOptions = append(socketOptions, socketmode.OptionDebug(true), socketmode.OptionLog(logger))
 	}
+	if config.AppToken != "" {
+		options = append(options, slack.OptionAppLevelToken(config.AppToken))
+	}
+	sc.client = slack.New(config.Token, options...)
 
-	sc.rtm = sc.client.NewRTM()
+	if clientOptions.Replay != nil {
+		sc.events = &replayEventSource{replay: clientOptions.Replay, events: make(chan slack.RTMEvent)}
+	} else {
+		var err error
+		if sc.events, err = newEventSource(sc.client, config, socketOptions...); err != nil {
+			log.Fatalf("%s %v", sc.Tag(), err)
+		}
+		if clientOptions.Recorder != nil {
+			sc.events = &recordingEventSource{
+				eventSource: sc.events, recorder: clientOptions.Recorder, events: make(chan slack.RTMEvent)}
+		}
+	}
+	sc.mentionMatcher.SetKeywords(config.MentionKeywords)
+	var err error
+	if sc.slackbotFilter, err = compileSlackbotFilter(config.IgnoreSlackbot); err != nil {
+		log.Fatalf("%s %v", sc.Tag(), err)
+	}
+	if config.FileProxyListenAddr != "" {
+		sc.fileProxy = NewFileProxy(
+			config.fileProxyBaseURL(), config.FileProxyLinkTTL, config.FileProxyCacheSize, sc.fetchPrivateFile)
+	}
 }
 
 // SendMessage sends a message to a SlackChannel
@@ -458,6 +611,10 @@ func (sc *SlackClient) SendDirectMessage(user *SlackUser, msg string) error {
 }
 
 func (sc *SlackClient) sendMessage(conversationID, msg string) error {
+	if s, ok := sc.config.detectSnippet(msg); ok {
+		return sc.uploadSnippet(conversationID, s)
+	}
+
 	// Since Slack will echo messages that we send back to us, in order to suppress the echo, we need to
 	// temporarily inhibit the incoming RTM channel while we wait for the API call response with the message ts.
 	sc.ownMessageLock.Lock()
@@ -470,14 +627,14 @@ func (sc *SlackClient) sendMessage(conversationID, msg string) error {
 	}
 
 	sc.sentMessageQueue.MessageSent(conversationID, ts)
-	sc.conversationMarker.MarkConversation(sc.client, conversationID, ts)
+	sc.conversationMarker.ScheduleMark(conversationID, ts)
 	return nil
 }
 
-func newSlackMessageEvent(from *SlackUser, target, message string) *SlackEvent {
+func newSlackMessageEvent(from *SlackUser, target, message, ts string) *SlackEvent {
 	return &SlackEvent{
 		EventType: MessageEvent,
-		Data:      &MessageEventData{*from, target, message},
+		Data:      &MessageEventData{From: *from, Target: target, Message: message, Timestamp: ts},
 	}
 }
 
@@ -487,7 +644,27 @@ func (sc *SlackClient) newInternalMessageEvent(message string) *SlackEvent {
 		to = sc.self.Nick
 	}
 
-	return newSlackMessageEvent(tanyaInternalUser, to, message)
+	return newSlackMessageEvent(tanyaInternalUser, to, message, "")
+}
+
+// FormatSlackTimestamp converts a time.Time to a Slack message ts, or "" for the zero time
+func FormatSlackTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/int(time.Microsecond))
+}
+
+// ParseSlackTimestamp converts a Slack message ts ("1503435956.000247") to a time.Time
+func ParseSlackTimestamp(ts string) time.Time {
+	secs, micros, _ := strings.Cut(ts, ".")
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	usec, _ := strconv.ParseInt(micros, 10, 64)
+
+	return time.Unix(sec, usec*int64(time.Microsecond))
 }
 
 func isDmChannel(channelID string) bool {
@@ -496,8 +673,15 @@ func isDmChannel(channelID string) bool {
 
 // Poop is a goroutine entry point that handles the communication with Slack
 func (sc *SlackClient) Poop(chans *ClientChans) {
-	go sc.rtm.ManageConnection()
-	defer sc.rtm.Disconnect()
+	sc.Lock()
+	sc.incomingChan = chans.IncomingChan
+	sc.Unlock()
+
+	go sc.events.Run(chans.StopChan)
+	go sc.conversationMarker.Run(sc.client.MarkConversation, chans.StopChan)
+	if sc.fileProxy != nil {
+		go sc.fileProxy.Serve(sc.config.FileProxyListenAddr, chans.StopChan)
+	}
 
 	for {
 		select {
@@ -505,7 +689,7 @@ func (sc *SlackClient) Poop(chans *ClientChans) {
 			return
 
 		default:
-			event := <-sc.rtm.IncomingEvents
+			event := <-sc.events.Events()
 			switch event.Type {
 			case "connection_error":
 				connEventError := event.Data.(*slack.ConnectionErrorEvent)
@@ -531,11 +715,32 @@ func (sc *SlackClient) Poop(chans *ClientChans) {
 
 			case "connected":
 				connectedData := event.Data.(*slack.ConnectedEvent)
-				sc.bootstrapMappings()
-				go sc.bootstrapChannelUserList()
-				sc.self = sc.userInfo[connectedData.Info.User.ID]
+
+				// On reconnection, work out what changed while we were away instead of starting over
+				var resyncEvents []*SlackEvent
+				var backfillSince map[string]string
+				reconnected := sc.self != nil
+				if !reconnected {
+					sc.bootstrapMappings(connectedData.Info.User.ID)
+					go sc.bootstrapChannelUserList()
+				} else {
+					var err error
+					if resyncEvents, err = sc.resyncMappings(connectedData.Info.User.ID); err != nil {
+						log.Printf("%s error while resyncing, keeping what we had: %v", sc.Tag(), err)
+					}
+					go sc.resyncChannelUserLists(chans.IncomingChan)
+
+					// Snapshot where to backfill from now, before live messages move it on
+					backfillSince = sc.startBackfill()
+				}
+				if !sc.config.usesRTM() {
+					sc.identifySelfBot()
+				}
+				// Before clients can send commands, so none are posted as text while we don't know them yet
+				sc.bootstrapSlashCommands()
 
 				log.Printf("%s tanya connected to slack as %v\n", sc.Tag(), sc.self)
+				sc.setConnected(true)
 
 				chans.IncomingChan <- &SlackEvent{
 					EventType: SlackConnectedEvent,
@@ -543,6 +748,14 @@ func (sc *SlackClient) Poop(chans *ClientChans) {
 						UserInfo: sc.self,
 					},
 				}
+				for _, resyncEvent := range resyncEvents {
+					chans.IncomingChan <- resyncEvent
+				}
+				if reconnected {
+					go sc.backfillMissedMessages(chans.IncomingChan, backfillSince)
+				}
+				go sc.bootstrapReadState(chans.IncomingChan)
+				go sc.bootstrapUsergroups()
 
 			case "hello":
 				chans.IncomingChan <- sc.newInternalMessageEvent("connected to slack!")
@@ -550,12 +763,21 @@ func (sc *SlackClient) Poop(chans *ClientChans) {
 			case "disconnected":
 				disconnectedData := event.Data.(*slack.DisconnectedEvent)
 				log.Printf("%s disconnected from slack: %v", sc.Tag(), disconnectedData.Cause)
+				sc.setConnected(false)
+				sc.backfillTracker.Disconnected(time.Now())
+				sc.historyCache.Reset()
 				chans.IncomingChan <- sc.newInternalMessageEvent("disconnected from slack!")
 
 			case "message":
 				messageData := event.Data.(*slack.MessageEvent)
 				sc.handleMessageEvent(chans.IncomingChan, messageData)
 
+			case "subteam_self_added":
+				sc.mentionMatcher.SetUsergroupMember(event.Data.(*slack.SubteamSelfAddedEvent).SubteamID, true)
+
+			case "subteam_self_removed":
+				sc.mentionMatcher.SetUsergroupMember(event.Data.(*slack.SubteamSelfRemovedEvent).SubteamID, false)
+
 			case "user_change":
 				userData := event.Data.(*slack.UserChangeEvent)
 				newUserInfo := slackUserFromDto(&userData.User)
@@ -567,14 +789,27 @@ func (sc *SlackClient) Poop(chans *ClientChans) {
 
 				// Un-map the old nick, if we had one, and insert an entry for the new
 				if hadOldUserInfo {
-					delete(sc.nickToUserMap, oldUserInfo.Nick)
+					sc.unmapNick(oldUserInfo.Nick)
 				}
-				sc.nickToUserMap[newUserInfo.Nick] = newUserInfo.SlackID
+				sc.mapNick(newUserInfo.Nick, newUserInfo.SlackID)
 
 				// Here we also need to update sc.self if our user info was updated
 				if userData.User.ID == sc.self.SlackID {
 					sc.self = newUserInfo
 				}
+
+				// Point cached member lists at the new user info
+				for _, members := range sc.channelMembers {
+					if _, isMember := members[newUserInfo.SlackID]; isMember {
+						members[newUserInfo.SlackID] = newUserInfo
+					}
+				}
+
+				// Group DMs are named after their members, so rename any this user is in
+				var renameEvents []*SlackEvent
+				if hadOldUserInfo && (oldUserInfo.Nick != newUserInfo.Nick) {
+					renameEvents = sc.renameGroupDMsWithMember(newUserInfo.SlackID)
+				}
 				sc.Unlock()
 
 				// Send nick change event if necessary
@@ -587,10 +822,22 @@ func (sc *SlackClient) Poop(chans *ClientChans) {
 						},
 					}
 				}
+				for _, renameEvent := range renameEvents {
+					chans.IncomingChan <- renameEvent
+				}
 
 			case "file_shared":
 				fileSharedEvent := event.Data.(*slack.FileSharedEvent)
 				file := fileSharedEvent.File
+				if file.Name == "" && fileSharedEvent.FileID != "" {
+					// The Events API only sends the file's ID
+					fileInfo, _, _, err := sc.client.GetFileInfo(fileSharedEvent.FileID, 0, 0)
+					if err != nil {
+						log.Printf("%s could not get info for shared file %v: %v", sc.Tag(), fileSharedEvent.FileID, err)
+						continue
+					}
+					file = *fileInfo
+				}
 				if len(file.Channels) == 0 {
 					continue
 				}
@@ -608,9 +855,22 @@ func (sc *SlackClient) Poop(chans *ClientChans) {
 				}
 
 				shareMessage := fmt.Sprintf(
-					"@%s shared a file: %s %s", user.Nick, file.Name, file.URLPrivateDownload,
+					"@%s shared a file: %s %s", user.Nick, file.Name, sc.fileLink(file.URLPrivateDownload, file.Name),
 				)
-				chans.IncomingChan <- newSlackMessageEvent(user, target.Name, sc.slackURLDecoder.Replace(shareMessage))
+				shareEvent := newSlackMessageEvent(
+					user, target.Name, sc.slackURLDecoder.Replace(shareMessage), fileSharedEvent.EventTimestamp)
+				assignMsgIDs(file.Channels[0], []*SlackEvent{shareEvent})
+				chans.IncomingChan <- shareEvent
+				chans.IncomingChan <- &SlackEvent{
+					EventType: FileSharedEvent,
+					Data: &FileSharedEventData{
+						From:   *user,
+						Target: target.Name,
+						Name:   file.Name,
+						Size:   file.Size,
+						URL:    file.URLPrivateDownload,
+					},
+				}
 
 			case "channel_joined":
 				channelJoinedEvent := event.Data.(*slack.ChannelJoinedEvent)
@@ -620,8 +880,28 @@ func (sc *SlackClient) Poop(chans *ClientChans) {
 					joinEvent = sc.newInternalMessageEvent(fmt.Sprintf(
 						"error handling channel_joined event [%v]: %+v", err, channelJoinedEvent))
 				}
+				if joinEvent != nil {
+					chans.IncomingChan <- joinEvent
+				}
 
-				chans.IncomingChan <- joinEvent
+			case "group_joined":
+				groupJoinedEvent := event.Data.(*slack.GroupJoinedEvent)
+
+				var joinEvent *SlackEvent
+				var err error
+				if groupJoinedEvent.Channel.IsMpIM {
+					joinEvent, err = sc.handleGroupDMOpened(groupJoinedEvent.Channel.ID)
+				} else {
+					joinEvent, err = sc.handleMemberJoinedChannel(groupJoinedEvent.Channel.ID, sc.self.SlackID)
+				}
+
+				if err != nil {
+					joinEvent = sc.newInternalMessageEvent(fmt.Sprintf(
+						"error handling group_joined event [%v]: %+v", err, groupJoinedEvent))
+				}
+				if joinEvent != nil {
+					chans.IncomingChan <- joinEvent
+				}
 
 			case "channel_left":
 				channelLeftEvent := event.Data.(*slack.ChannelLeftEvent)
@@ -631,12 +911,80 @@ func (sc *SlackClient) Poop(chans *ClientChans) {
 					partEvent = sc.newInternalMessageEvent(fmt.Sprintf(
 						"error handling channel_left event [%v]: %+v", err, channelLeftEvent))
 				}
+				if partEvent != nil {
+					chans.IncomingChan <- partEvent
+				}
+
+			case "group_left":
+				groupLeftEvent := event.Data.(*slack.GroupLeftEvent)
+				partEvent, err := sc.handleMemberLeftChannel(groupLeftEvent.Channel, sc.self.SlackID)
+
+				if err != nil {
+					partEvent = sc.newInternalMessageEvent(fmt.Sprintf(
+						"error handling group_left event [%v]: %+v", err, groupLeftEvent))
+				}
+				if partEvent != nil {
+					chans.IncomingChan <- partEvent
+				}
+
+			case "channel_created":
+				channelCreatedEvent := event.Data.(*slack.ChannelCreatedEvent)
+				sc.handleChannelCreated(&channelCreatedEvent.Channel)
+
+			case "channel_rename":
+				channelRenameEvent := event.Data.(*slack.ChannelRenameEvent)
+				if renameEvent := sc.handleChannelRenamed(
+					channelRenameEvent.Channel.ID, channelRenameEvent.Channel.Name); renameEvent != nil {
+					chans.IncomingChan <- renameEvent
+				}
+
+			case "group_rename":
+				groupRenameEvent := event.Data.(*slack.GroupRenameEvent)
+				if renameEvent := sc.handleChannelRenamed(
+					groupRenameEvent.Group.ID, groupRenameEvent.Group.Name); renameEvent != nil {
+					chans.IncomingChan <- renameEvent
+				}
+
+			case "channel_archive":
+				channelArchiveEvent := event.Data.(*slack.ChannelArchiveEvent)
+				if partEvent := sc.handleChannelRemoved(channelArchiveEvent.Channel, "Channel archived"); partEvent != nil {
+					chans.IncomingChan <- partEvent
+				}
 
-				chans.IncomingChan <- partEvent
+			case "group_archive":
+				groupArchiveEvent := event.Data.(*slack.GroupArchiveEvent)
+				if partEvent := sc.handleChannelRemoved(groupArchiveEvent.Channel, "Channel archived"); partEvent != nil {
+					chans.IncomingChan <- partEvent
+				}
+
+			case "channel_deleted":
+				channelDeletedEvent := event.Data.(*slack.ChannelDeletedEvent)
+				if partEvent := sc.handleChannelRemoved(channelDeletedEvent.Channel, "Channel deleted"); partEvent != nil {
+					chans.IncomingChan <- partEvent
+				}
+
+			case "channel_unarchive", "group_unarchive":
+				var channelID string
+				switch unarchiveEvent := event.Data.(type) {
+				case *slack.ChannelUnarchiveEvent:
+					channelID = unarchiveEvent.Channel
+				case *slack.GroupUnarchiveEvent:
+					channelID = unarchiveEvent.Channel
+				}
+
+				joinEvent, err := sc.handleChannelRefreshed(channelID)
+				if err != nil {
+					joinEvent = sc.newInternalMessageEvent(fmt.Sprintf(
+						"error handling %v event [%v]: %+v", event.Type, err, event.Data))
+				}
+				if joinEvent != nil {
+					chans.IncomingChan <- joinEvent
+				}
 
 			case "member_joined_channel":
 				memberJoinedChannelEvent := event.Data.(*slack.MemberJoinedChannelEvent)
-				if memberJoinedChannelEvent.User == sc.self.SlackID {
+				if memberJoinedChannelEvent.User == sc.self.SlackID && sc.config.usesRTM() {
+					// RTM follows up with channel_joined or group_joined, but that's all the Events API sends
 					continue
 				}
 
@@ -647,12 +995,14 @@ func (sc *SlackClient) Poop(chans *ClientChans) {
 					joinEvent = sc.newInternalMessageEvent(fmt.Sprintf(
 						"error handling member_joined_channel event [%v]: %+v", err, memberJoinedChannelEvent))
 				}
-
-				chans.IncomingChan <- joinEvent
+				if joinEvent != nil {
+					chans.IncomingChan <- joinEvent
+				}
 
 			case "member_left_channel":
 				memberLeftChannelEvent := event.Data.(*slack.MemberLeftChannelEvent)
-				if memberLeftChannelEvent.User == sc.self.SlackID {
+				if memberLeftChannelEvent.User == sc.self.SlackID && sc.config.usesRTM() {
+					// RTM follows up with channel_left or group_left, but that's all the Events API sends
 					continue
 				}
 
@@ -663,27 +1013,73 @@ func (sc *SlackClient) Poop(chans *ClientChans) {
 					partEvent = sc.newInternalMessageEvent(fmt.Sprintf(
 						"error handling member_left_channel event [%v]: %+v", err, memberLeftChannelEvent))
 				}
-
-				chans.IncomingChan <- partEvent
+				if partEvent != nil {
+					chans.IncomingChan <- partEvent
+				}
 
 			case "unmarshalling_error":
 				unmarshallingErrorEvent := event.Data.(*slack.UnmarshallingErrorEvent)
 
 				switch err := unmarshallingErrorEvent.ErrorObj.(type) {
-				case slack.UnmappedError:
+				case *slack.UnmappedError:
 					switch err.EventType {
 					case "clear_mention_notification",
 						"thread_subscribed", "update_thread_state", "thread_marked":
 						// ignore these, but idk how to tell when library support gets added
 						continue
+
+					case "mpim_marked":
+						var markedEvent slack.ChannelInfoEvent
+						if parseErr := json.Unmarshal(err.RawEvent, &markedEvent); parseErr != nil {
+							log.Printf("%s could not parse %v event [%v]: %s", sc.Tag(), err.EventType, parseErr, err.RawEvent)
+							continue
+						}
+
+						if markerEvent := sc.handleConversationMarked(markedEvent.Channel, markedEvent.Timestamp); markerEvent != nil {
+							chans.IncomingChan <- markerEvent
+						}
+						continue
+
+					case "mpim_joined", "mpim_open":
+						channelID, parseErr := parseGroupDMEventChannel(err.RawEvent)
+						if parseErr != nil {
+							log.Printf("%s could not parse %v event [%v]: %s", sc.Tag(), err.EventType, parseErr, err.RawEvent)
+							continue
+						}
+
+						joinEvent, joinErr := sc.handleGroupDMOpened(channelID)
+						if joinErr != nil {
+							joinEvent = sc.newInternalMessageEvent(fmt.Sprintf(
+								"error handling %v event [%v]: %s", err.EventType, joinErr, err.RawEvent))
+						}
+						if joinEvent != nil {
+							chans.IncomingChan <- joinEvent
+						}
+						continue
 					}
 
+					log.Printf("%s unmapped event [%v]: %s", sc.Tag(), err.EventType, err.RawEvent)
+
 				default:
 					log.Printf("%s unmarshalling error: %+v", sc.Tag(), event.Data)
 				}
 
-			case "channel_marked", "group_marked", "thread_marked", "im_marked", "im_open",
-				"channel_archive", "channel_unarchive",
+			case "channel_marked", "group_marked", "im_marked":
+				var channelID, ts string
+				switch markedEvent := event.Data.(type) {
+				case *slack.ChannelMarkedEvent:
+					channelID, ts = markedEvent.Channel, markedEvent.Timestamp
+				case *slack.GroupMarkedEvent:
+					channelID, ts = markedEvent.Channel, markedEvent.Timestamp
+				case *slack.IMMarkedEvent:
+					channelID, ts = markedEvent.Channel, markedEvent.Timestamp
+				}
+
+				if markerEvent := sc.handleConversationMarked(channelID, ts); markerEvent != nil {
+					chans.IncomingChan <- markerEvent
+				}
+
+			case "thread_marked", "im_open",
 				"latency_report", "user_typing", "pref_change", "dnd_updated_user", "desktop_notification",
 				"file_created", "file_public", "file_change",
 				"reaction_added", "reaction_removed", "pin_added", "pin_removed":
@@ -696,6 +1092,41 @@ func (sc *SlackClient) Poop(chans *ClientChans) {
 	}
 }
 
+func (sc *SlackClient) setConnected(connected bool) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	sc.connected = connected
+	sc.connectedSince = time.Now()
+}
+
+// ConnectionStatus returns whether we're connected to Slack, and since when we have or haven't been
+func (sc *SlackClient) ConnectionStatus() (connected bool, since time.Time) {
+	sc.RLock()
+	defer sc.RUnlock()
+
+	return sc.connected, sc.connectedSince
+}
+
+// Reconnect drops the connection to Slack and makes a new one, catching up on what changed in between as
+// after any other reconnection
+func (sc *SlackClient) Reconnect() error {
+	return sc.events.Reconnect()
+}
+
+// sendEvent sends an event caused by something other than Slack to Poop's listener
+func (sc *SlackClient) sendEvent(event *SlackEvent) error {
+	sc.RLock()
+	incomingChan := sc.incomingChan
+	sc.RUnlock()
+	if incomingChan == nil {
+		return errors.New("not connected to slack yet")
+	}
+
+	incomingChan <- event
+	return nil
+}
+
 // Tag is a descriptor of the SlackClient suitable for logging or simple human identification.
 func (sc *SlackClient) Tag() string {
 	switch sc.self {
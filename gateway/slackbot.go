@@ -0,0 +1,55 @@
+package gateway
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// slackbotUser is who Slackbot's messages come from: reminders, its replies to us, and the messages apps send
+// only to us through it. Slackbot isn't in users.list, so it would otherwise have no nick.
+var slackbotUser = &SlackUser{SlackID: "USLACKBOT", Nick: "slackbot", RealName: "Slackbot"}
+
+// compileSlackbotFilter compiles the IgnoreSlackbot patterns, which match case-insensitively
+func compileSlackbotFilter(patterns []string) ([]*regexp.Regexp, error) {
+	var filter []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IgnoreSlackbot pattern %q: %v", pattern, err)
+		}
+		filter = append(filter, re)
+	}
+	return filter, nil
+}
+
+// handleSlackbotMessage passes on a message from Slackbot unless IgnoreSlackbot filters it out. In channels
+// nobody else sees it, so it's sent as a notice; in DMs it's a message like any other.
+func (sc *SlackClient) handleSlackbotMessage(incomingChan chan<- *SlackEvent, messageData *slack.MessageEvent) {
+	text := sc.ParseMessageText(messageData.Text)
+	for _, re := range sc.slackbotFilter {
+		if re.MatchString(text) {
+			return
+		}
+	}
+
+	events := sc.messageToEvents(messageData)
+	var notices, messages []*SlackEvent
+	for _, event := range events {
+		data, ok := event.Data.(*MessageEventData)
+		if ok && event.EventType == MessageEvent && strings.HasPrefix(data.Target, "#") {
+			notices = append(notices, &SlackEvent{EventType: NoticeEvent, Data: data})
+		} else {
+			messages = append(messages, event)
+		}
+	}
+
+	for _, event := range notices {
+		incomingChan <- event
+	}
+	for _, event := range groupMultilineEvents(messages) {
+		incomingChan <- event
+	}
+}
@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// slashCommandResponse is the response to chat.command
+type slashCommandResponse struct {
+	slack.SlackResponse
+	// What Slack replied to us alone, if anything, e.g. "Got it! I'll remind you…"
+	Response string `json:"response"`
+}
+
+// RunSlashCommand runs a slash command (e.g. "/remind") in a conversation as if it were typed there in Slack,
+// returning the reply Slack shows only to us, if any. Replies commands send later arrive as ephemeral messages.
+// This calls chat.command, which the official clients use; slack-go doesn't wrap it, and it needs a user
+// token.
+func (sc *SlackClient) RunSlashCommand(conversationID, command, args string) (string, error) {
+	if !strings.HasPrefix(command, "/") {
+		command = "/" + command
+	}
+	form := url.Values{
+		"channel": {conversationID},
+		"command": {command},
+		"text":    {sc.UnparseMessageText(args)},
+	}
+
+	var resp slashCommandResponse
+	err := sc.retryRateLimited("chat.command", func() error {
+		resp = slashCommandResponse{}
+		return sc.callUnwrappedMethod("chat.command", form, &resp)
+	})
+	if err != nil {
+		return "", err
+	}
+	return sc.ParseMessageText(resp.Response), nil
+}
+
+// commandsListResponse is the response to commands.list, with the workspace's commands by name
+type commandsListResponse struct {
+	slack.SlackResponse
+	Commands map[string]json.RawMessage `json:"commands"`
+}
+
+// bootstrapSlashCommands fetches the slash commands the workspace has, so only messages starting with one
+// are run as a command. This calls commands.list, which the official clients use; slack-go doesn't wrap it,
+// and, like chat.command, it needs a user token, so with a bot token no commands are run.
+func (sc *SlackClient) bootstrapSlashCommands() {
+	if !sc.config.hasUserToken() {
+		return
+	}
+
+	var resp commandsListResponse
+	err := sc.retryRateLimited("commands.list", func() error {
+		resp = commandsListResponse{}
+		return sc.callUnwrappedMethod("commands.list", url.Values{}, &resp)
+	})
+	if err != nil {
+		log.Printf("%s could not fetch slash commands, messages starting with one will be posted: %v", sc.Tag(), err)
+		return
+	}
+
+	commands := make(map[string]bool, len(resp.Commands))
+	for command := range resp.Commands {
+		commands[strings.ToLower(command)] = true
+	}
+	sc.Lock()
+	sc.slashCommands = commands
+	sc.Unlock()
+}
+
+// HasSlashCommand returns whether the workspace has a slash command (e.g. "/remind") we can run
+func (sc *SlackClient) HasSlashCommand(command string) bool {
+	sc.RLock()
+	defer sc.RUnlock()
+
+	return sc.slashCommands[strings.ToLower(command)]
+}
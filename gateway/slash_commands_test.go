@@ -0,0 +1,14 @@
+package gateway
+
+import "testing"
+
+func TestSlackClient_bootstrapSlashCommandsBotToken(t *testing.T) {
+	// There's no HTTP client, so any attempt to ask Slack for the commands would panic
+	sc := NewSlackClient()
+	sc.config.Token = "xoxb-bot"
+	sc.bootstrapSlashCommands()
+
+	if sc.HasSlashCommand("/remind") {
+		t.Errorf("SlackClient.HasSlashCommand(%q) = true with a bot token, want false", "/remind")
+	}
+}
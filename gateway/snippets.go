@@ -0,0 +1,89 @@
+package gateway
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/slack-go/slack"
+)
+
+// Marks text to be uploaded as a snippet, when it both starts and ends the message
+const snippetCodeMarker = "```"
+
+// Maximum length of the preview line posted along with a snippet
+const snippetPreviewLength = 80
+
+// snippet is text from IRC which is better uploaded as a file than posted as a message
+type snippet struct {
+	content     string
+	snippetType string
+}
+
+// detectSnippet returns whether a message should be uploaded as a snippet: if it's wrapped in a code
+// marker, or longer than the configured number of lines or bytes. A word on the same line as the
+// opening marker is taken as the language, e.g. ```go.
+func (c *Config) detectSnippet(msg string) (snippet, bool) {
+	trimmed := strings.TrimSpace(msg)
+	if len(trimmed) > 2*len(snippetCodeMarker) &&
+		strings.HasPrefix(trimmed, snippetCodeMarker) && strings.HasSuffix(trimmed, snippetCodeMarker) {
+		content := trimmed[len(snippetCodeMarker) : len(trimmed)-len(snippetCodeMarker)]
+
+		snippetType := "text"
+		if firstLine, rest, found := strings.Cut(content, "\n"); found &&
+			firstLine != "" && !strings.ContainsAny(firstLine, " \t") {
+			snippetType = strings.ToLower(firstLine)
+			content = rest
+		}
+
+		if content = strings.Trim(content, "\n"); strings.TrimSpace(content) != "" {
+			return snippet{content, snippetType}, true
+		}
+	}
+
+	lines := strings.Count(msg, "\n") + 1
+	if (c.SnippetMinLines > 0 && lines >= c.SnippetMinLines) || (c.SnippetMinBytes > 0 && len(msg) >= c.SnippetMinBytes) {
+		return snippet{msg, "text"}, true
+	}
+	return snippet{}, false
+}
+
+// preview returns a line describing the snippet, posted along with it
+func (s snippet) preview() string {
+	firstLine, _, _ := strings.Cut(strings.TrimSpace(s.content), "\n")
+	if len(firstLine) > snippetPreviewLength {
+		cut := snippetPreviewLength
+		for cut > 0 && !utf8.RuneStart(firstLine[cut]) {
+			cut--
+		}
+		firstLine = firstLine[:cut] + "…"
+	}
+
+	lines := strings.Count(s.content, "\n") + 1
+	if lines == 1 {
+		return firstLine
+	}
+	return fmt.Sprintf("%s (%d lines)", firstLine, lines)
+}
+
+// uploadSnippet uploads a snippet to a conversation, with a preview line as its comment. Slack echoes
+// the upload back, so IRC clients see the link to it.
+func (sc *SlackClient) uploadSnippet(conversationID string, s snippet) error {
+	extension := "txt"
+	if s.snippetType != "text" {
+		extension = s.snippetType
+	}
+
+	return sc.retryRateLimited("files.upload", func() error {
+		_, err := sc.client.UploadFile(slack.UploadFileParameters{
+			Content:        s.content,
+			FileSize:       len(s.content),
+			Filename:       "snippet." + extension,
+			Title:          "snippet",
+			SnippetType:    s.snippetType,
+			InitialComment: sc.UnparseMessageText(s.preview()),
+			Channel:        conversationID,
+		})
+		return err
+	})
+}
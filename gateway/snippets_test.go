@@ -0,0 +1,51 @@
+package gateway
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfig_detectSnippet(t *testing.T) {
+	config := &Config{SnippetMinLines: 3, SnippetMinBytes: 100}
+
+	tests := []struct {
+		name        string
+		msg         string
+		want        bool
+		content     string
+		snippetType string
+	}{
+		{"short", "hello there", false, "", ""},
+		{"two lines", "hello\nthere", false, "", ""},
+		{"many lines", "panic: oops\n\tat main.go:1\n\tat main.go:2", true, "panic: oops\n\tat main.go:1\n\tat main.go:2", "text"},
+		{"long", strings.Repeat("a", 100), true, strings.Repeat("a", 100), "text"},
+		{"code marker", "```x := 1```", true, "x := 1", "text"},
+		{"code marker with language", "```go\nx := 1\n```", true, "x := 1", "go"},
+		{"empty code marker", "``````", false, "", ""},
+		{"inline code", "run `make` first", false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := config.detectSnippet(tt.msg)
+			if ok != tt.want || got.content != tt.content || got.snippetType != tt.snippetType {
+				t.Errorf("Config.detectSnippet() = %+v, %v, want %q, %q, %v", got, ok, tt.content, tt.snippetType, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnippet_preview(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"one line", "one line"},
+		{"panic: oops\n\tat main.go:1", "panic: oops (2 lines)"},
+		{strings.Repeat("あ", 30), strings.Repeat("あ", 26) + "…"},
+	}
+	for _, tt := range tests {
+		if got := (snippet{content: tt.content}).preview(); got != tt.want {
+			t.Errorf("snippet.preview() = %q, want %q", got, tt.want)
+		}
+	}
+}
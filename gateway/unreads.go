@@ -0,0 +1,224 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// UnreadCount summarizes the unread messages in a conversation
+type UnreadCount struct {
+	// IRC channel name or nick of the conversation
+	Target string
+	DM     bool
+
+	// Number of unread messages, or zero if Slack only told us there are some
+	Unreads  int
+	Mentions int
+}
+
+// UnreadTracker keeps unread and mention counts per conversation. They are fetched from Slack when we
+// connect, then kept current as messages arrive and conversations are read.
+type UnreadTracker struct {
+	counts map[string]*unreadCount
+	ready  bool
+
+	sync.Mutex
+}
+
+type unreadCount struct {
+	hasUnreads bool
+	unreads    int
+	mentions   int
+}
+
+// NewUnreadTracker creates a new unread tracker.
+func NewUnreadTracker() *UnreadTracker {
+	return &UnreadTracker{
+		counts: make(map[string]*unreadCount),
+	}
+}
+
+// Set records the counts Slack reported for a conversation.
+func (ut *UnreadTracker) Set(channelID string, hasUnreads bool, unreads, mentions int) {
+	ut.Lock()
+	defer ut.Unlock()
+
+	ut.counts[channelID] = &unreadCount{hasUnreads || unreads > 0 || mentions > 0, unreads, mentions}
+}
+
+func (ut *UnreadTracker) isReady() bool {
+	ut.Lock()
+	defer ut.Unlock()
+
+	return ut.ready
+}
+
+// SetReady records that the counts have been fetched from Slack.
+func (ut *UnreadTracker) SetReady() {
+	ut.Lock()
+	defer ut.Unlock()
+
+	ut.ready = true
+}
+
+// MessageReceived counts a new message from someone else in a conversation.
+func (ut *UnreadTracker) MessageReceived(channelID string, mention bool) {
+	ut.Lock()
+	defer ut.Unlock()
+
+	count, found := ut.counts[channelID]
+	if !found {
+		count = &unreadCount{}
+		ut.counts[channelID] = count
+	}
+
+	// If Slack didn't tell us how many there were, we still don't know
+	if !count.hasUnreads || count.unreads > 0 {
+		count.unreads++
+	}
+	count.hasUnreads = true
+	if mention {
+		count.mentions++
+	}
+}
+
+// Read clears the counts for a conversation.
+func (ut *UnreadTracker) Read(channelID string) {
+	ut.Lock()
+	defer ut.Unlock()
+
+	delete(ut.counts, channelID)
+}
+
+// snapshot returns the conversations with unread messages, and whether the counts have been fetched yet
+func (ut *UnreadTracker) snapshot() (map[string]unreadCount, bool) {
+	ut.Lock()
+	defer ut.Unlock()
+
+	counts := make(map[string]unreadCount)
+	for channelID, count := range ut.counts {
+		if count.hasUnreads {
+			counts[channelID] = *count
+		}
+	}
+	return counts, ut.ready
+}
+
+// GetUnreadCounts returns the conversations with unread messages, those with the most mentions and then
+// unreads first, and whether the counts have been fetched from Slack yet.
+func (sc *SlackClient) GetUnreadCounts() ([]UnreadCount, bool) {
+	counts, ready := sc.unreadTracker.snapshot()
+
+	var unreads []UnreadCount
+	for channelID, count := range counts {
+		target, err := sc.conversationTarget(channelID)
+		if err != nil {
+			log.Printf("%s could not resolve unread conversation %v: %v", sc.Tag(), channelID, err)
+			continue
+		}
+
+		// DMs aren't channels, so resolving one as a channel would only ask Slack about it for nothing
+		dm := isDmChannel(channelID)
+		if !dm {
+			if channel, err := sc.ResolveChannel(channelID); err == nil {
+				dm = channel.GroupDM
+			}
+		}
+
+		unreads = append(unreads, UnreadCount{
+			Target:   target,
+			DM:       dm,
+			Unreads:  count.unreads,
+			Mentions: count.mentions,
+		})
+	}
+
+	sort.Slice(unreads, func(i, j int) bool {
+		if unreads[i].Mentions != unreads[j].Mentions {
+			return unreads[i].Mentions > unreads[j].Mentions
+		}
+		if unreads[i].Unreads != unreads[j].Unreads {
+			return unreads[i].Unreads > unreads[j].Unreads
+		}
+		return unreads[i].Target < unreads[j].Target
+	})
+	return unreads, ready
+}
+
+// messageMentionsSelf returns whether a message should count as a mention of us
+func (sc *SlackClient) messageMentionsSelf(messageData *slack.MessageEvent) bool {
+	return isDmChannel(messageData.Channel) || sc.mentionMatcher.Matches(sc.self.SlackID, messageData.Text)
+}
+
+// conversationRead clears the unread counts of a conversation once its read cursor catches up with the
+// latest message we've seen in it
+func (sc *SlackClient) conversationRead(channelID, ts string) {
+	if latest, found := sc.backfillTracker.LastSeen(channelID); !found || ts >= latest {
+		sc.unreadTracker.Read(channelID)
+	}
+}
+
+// clientCount is a conversation's entry in a client.counts response
+type clientCount struct {
+	ID           string `json:"id"`
+	LastRead     string `json:"last_read"`
+	HasUnreads   bool   `json:"has_unreads"`
+	MentionCount int    `json:"mention_count"`
+}
+
+type clientCountsResponse struct {
+	slack.SlackResponse
+	Channels []clientCount `json:"channels"`
+	MPIMs    []clientCount `json:"mpims"`
+	IMs      []clientCount `json:"ims"`
+}
+
+// getClientCounts calls client.counts, which the official clients use to fetch the unread state of every
+// conversation at once. slack-go doesn't wrap it, and it isn't available to every token type.
+func (sc *SlackClient) getClientCounts() ([]clientCount, error) {
+	var counts clientCountsResponse
+	if err := sc.callUnwrappedMethod("client.counts", url.Values{}, &counts); err != nil {
+		return nil, err
+	}
+	return append(append(counts.Channels, counts.MPIMs...), counts.IMs...), nil
+}
+
+// callUnwrappedMethod calls a Web API method slack-go doesn't wrap with our token, decoding its response into
+// result. A rate limit is returned as a *slack.RateLimitedError, so callers can retry with retryRateLimited.
+func (sc *SlackClient) callUnwrappedMethod(method string, form url.Values, result interface{ Err() error }) error {
+	req, err := http.NewRequest(http.MethodPost, sc.apiURL+method, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+sc.config.Token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := sc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return &slack.RateLimitedError{RetryAfter: time.Duration(retryAfter) * time.Second}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %v", method, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return err
+	}
+	return result.Err()
+}
@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnreadTracker(t *testing.T) {
+	ut := NewUnreadTracker()
+
+	ut.Set("C1", false, 3, 1)
+	ut.Set("C2", true, 0, 0)
+	ut.Set("C3", false, 0, 0)
+	ut.MessageReceived("C1", false)
+	ut.MessageReceived("C2", true)
+	ut.MessageReceived("D1", false)
+
+	counts, ready := ut.snapshot()
+	if ready {
+		t.Error("UnreadTracker.snapshot() reported ready before SetReady()")
+	}
+	want := map[string]unreadCount{
+		"C1": {true, 4, 1},
+		"C2": {true, 0, 1},
+		"D1": {true, 1, 0},
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("UnreadTracker.snapshot() = %+v, want %+v", counts, want)
+	}
+
+	ut.Read("C1")
+	ut.SetReady()
+	counts, ready = ut.snapshot()
+	if _, found := counts["C1"]; found || !ready {
+		t.Errorf("UnreadTracker.snapshot() = %+v, %v after reading C1", counts, ready)
+	}
+}
+
+func TestSlackClient_GetUnreadCountsDM(t *testing.T) {
+	// There's no Slack client, so any attempt to ask Slack about a conversation would panic
+	sc := NewSlackClient()
+	sc.channelInfo = map[string]*SlackChannel{"C1": {SlackID: "C1", Name: "#general"}}
+	sc.channelNameToIDMap = map[string]string{"#general": "C1"}
+	sc.dmInfo = map[string]*SlackUser{"D2": {SlackID: "U2", Nick: "kedo"}}
+	sc.unreadTracker.MessageReceived("C1", false)
+	sc.unreadTracker.MessageReceived("D2", true)
+
+	unreads, _ := sc.GetUnreadCounts()
+	want := []UnreadCount{
+		{Target: "kedo", DM: true, Unreads: 1, Mentions: 1},
+		{Target: "#general", Unreads: 1},
+	}
+	if !reflect.DeepEqual(unreads, want) {
+		t.Errorf("SlackClient.GetUnreadCounts() = %+v, want %+v", unreads, want)
+	}
+
+	// The DM isn't taken for a channel
+	if len(sc.channelInfo) != 1 || !reflect.DeepEqual(sc.channelNameToIDMap, map[string]string{"#general": "C1"}) {
+		t.Errorf("SlackClient.GetUnreadCounts() changed the channel maps to %v, %v", sc.channelInfo, sc.channelNameToIDMap)
+	}
+}
@@ -4,11 +4,11 @@ go 1.25
 
 require (
 	github.com/BurntSushi/toml v1.2.1
+	github.com/gorilla/websocket v1.5.3
 	github.com/slack-go/slack v0.23.1
 	golang.org/x/term v0.4.0
 )
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
 	golang.org/x/sys v0.4.0 // indirect
 )
@@ -0,0 +1,166 @@
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Capability names negotiated with clients via CAP
+const (
+	CapBatch         = "batch"
+	CapChannelRename = "draft/channel-rename"
+	CapChatHistory   = "draft/chathistory"
+	CapMessageTags   = "message-tags"
+	CapMultiline     = "draft/multiline"
+	CapReadMarker    = "draft/read-marker"
+	CapServerTime    = "server-time"
+)
+
+// supportedCaps holds the capabilities advertised in response to CAP LS, along with their
+// values for clients speaking CAP version 302
+var supportedCaps = map[string]string{
+	CapBatch:         "",
+	CapChannelRename: "",
+	CapChatHistory:   "",
+	CapMessageTags:   "",
+	CapMultiline:     fmt.Sprintf("max-bytes=%d,max-lines=%d", multilineMaxBytes, multilineMaxLines),
+	CapReadMarker:    "",
+	CapServerTime:    "",
+}
+
+// tagCaps maps the message tags we generate to the capability a client needs to receive them.
+// Any other tag requires message-tags.
+var tagCaps = map[string]string{
+	"batch": CapBatch,
+	"time":  CapServerTime,
+}
+
+// cmdCaps maps the commands we send which clients must have negotiated a capability to receive
+var cmdCaps = map[Command]string{
+	MarkReadCmd: CapReadMarker,
+}
+
+// capLSList formats the list of supported capabilities for a CAP LS reply
+func capLSList(withValues bool) string {
+	var caps []string
+	for name, value := range supportedCaps {
+		if withValues && value != "" {
+			name = name + "=" + value
+		}
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+
+	return strings.Join(caps, " ")
+}
+
+// handleCapCommand handles a client's CAP negotiation. While negotiation is in progress,
+// registration is suspended until the client sends CAP END.
+func (cc *clientConnection) handleCapCommand(msg *Message) {
+	subcommand := strings.ToUpper(msg.Params[0])
+	if cc.state != clientStateRegistered && subcommand != "END" {
+		cc.capNegotiating = true
+	}
+
+	switch subcommand {
+	case "LS":
+		withValues := len(msg.Params) > 1 && msg.Params[1] >= "302"
+		cc.sendCapReply("LS", capLSList(withValues))
+
+	case "LIST":
+		cc.Lock()
+		var enabled []string
+		for name := range cc.caps {
+			enabled = append(enabled, name)
+		}
+		cc.Unlock()
+
+		sort.Strings(enabled)
+		cc.sendCapReply("LIST", strings.Join(enabled, " "))
+
+	case "REQ":
+		if len(msg.Params) < 2 {
+			cc.send(cc.reply(*ErrNeedMoreParams("CAP")))
+			return
+		}
+
+		// Requests are all-or-nothing, so validate everything before enabling anything
+		requested := strings.Fields(msg.Params[1])
+		for _, name := range requested {
+			if _, found := supportedCaps[strings.TrimPrefix(name, "-")]; !found {
+				cc.sendCapReply("NAK", msg.Params[1])
+				return
+			}
+		}
+
+		cc.Lock()
+		for _, name := range requested {
+			if strings.HasPrefix(name, "-") {
+				delete(cc.caps, name[1:])
+			} else {
+				cc.caps[name] = struct{}{}
+			}
+		}
+		cc.Unlock()
+		cc.sendCapReply("ACK", msg.Params[1])
+
+	case "END":
+		cc.capNegotiating = false
+		if cc.state == clientStateAwaitingCapEnd {
+			cc.setState(clientStateRegistered)
+			cc.finishRegistration()
+		}
+
+	default:
+		cc.send(cc.reply(NumericReply{
+			Code:   ERR_INVALIDCAPCMD,
+			Params: []string{subcommand, "Invalid CAP command"},
+		}))
+	}
+}
+
+func (cc *clientConnection) sendCapReply(subcommand, caps string) {
+	cc.send(&Message{
+		Prefix: cc.config.ServerName,
+		Cmd:    CapCmd,
+		Params: []string{cc.clientUser.Nick, subcommand, caps},
+	})
+}
+
+// hasCap returns whether the client has enabled the given capability
+func (cc *clientConnection) hasCap(name string) bool {
+	cc.Lock()
+	defer cc.Unlock()
+
+	_, found := cc.caps[name]
+	return found
+}
+
+// wantsMessage returns whether the client has the capability needed to receive a message
+func (cc *clientConnection) wantsMessage(m *Message) bool {
+	requiredCap, found := cmdCaps[m.Cmd]
+	return !found || cc.hasCap(requiredCap)
+}
+
+// filterTags strips any message tags the client hasn't negotiated the capability for
+func (cc *clientConnection) filterTags(m *Message) *Message {
+	if len(m.Tags) == 0 {
+		return m
+	}
+
+	tags := make(map[string]string)
+	for key, value := range m.Tags {
+		requiredCap, found := tagCaps[key]
+		if !found {
+			requiredCap = CapMessageTags
+		}
+		if cc.hasCap(requiredCap) {
+			tags[key] = value
+		}
+	}
+
+	filtered := *m
+	filtered.Tags = tags
+	return &filtered
+}
@@ -0,0 +1,224 @@
+package irc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Maximum number of messages returned for a single CHATHISTORY request
+const chatHistoryLimit = 100
+
+// ChatHistoryTarget is a conversation with activity, as returned by CHATHISTORY TARGETS
+type ChatHistoryTarget struct {
+	Name   string
+	Latest time.Time
+}
+
+// parseChatHistoryRef resolves a CHATHISTORY message reference ("timestamp=..." or "msgid=...") to a time
+func (cc *clientConnection) parseChatHistoryRef(ref string) (time.Time, bool) {
+	kind, value, found := strings.Cut(ref, "=")
+	if !found {
+		return time.Time{}, false
+	}
+
+	switch kind {
+	case "timestamp":
+		t, err := time.Parse(ServerTimeFormat, value)
+		return t, err == nil
+	case "msgid":
+		return cc.stateProvider.GetMessageTime(value)
+	}
+	return time.Time{}, false
+}
+
+// handleChatHistoryCommand answers a draft/chathistory CHATHISTORY request
+func (cc *clientConnection) handleChatHistoryCommand(msg *Message) {
+	subcommand := strings.ToUpper(msg.Params[0])
+	fail := func(code string, context ...string) {
+		cc.outgoingMessages <- (&Fail{
+			ServerName:  cc.config.ServerName,
+			Command:     "CHATHISTORY",
+			Code:        code,
+			Context:     append([]string{subcommand}, context...),
+			Description: chatHistoryFailDescriptions[code],
+		}).ToMessage()
+	}
+
+	params := msg.Params[1:]
+	wantParams := 3
+	switch subcommand {
+	case "BEFORE", "AFTER", "LATEST", "AROUND":
+	case "BETWEEN", "TARGETS":
+		wantParams = 4
+	default:
+		fail("UNKNOWN_COMMAND")
+		return
+	}
+	if len(params) < wantParams {
+		fail("NEED_MORE_PARAMS")
+		return
+	}
+
+	limit, err := strconv.Atoi(params[wantParams-1])
+	if err != nil || limit < 0 {
+		fail("INVALID_PARAMS")
+		return
+	}
+	if limit == 0 || limit > chatHistoryLimit {
+		limit = chatHistoryLimit
+	}
+
+	var refs []time.Time
+	for i, ref := range params[:wantParams-1] {
+		if i == 0 && subcommand != "TARGETS" {
+			continue
+		}
+		if subcommand == "LATEST" && ref == "*" {
+			refs = append(refs, time.Time{})
+			continue
+		}
+
+		t, ok := cc.parseChatHistoryRef(ref)
+		if !ok {
+			fail("INVALID_PARAMS")
+			return
+		}
+		refs = append(refs, t)
+	}
+
+	if subcommand == "TARGETS" {
+		cc.sendChatHistoryTargets(refs[0], refs[1], limit, fail)
+		return
+	}
+
+	target := params[0]
+	if len(target) > 0 && target[0] == '#' {
+		// Slack channel names are forcibly lowercased...RIP casemapping
+		target = strings.ToLower(target)
+	}
+
+	var history []Privmsg
+	switch subcommand {
+	case "BEFORE":
+		history, err = cc.stateProvider.GetChatHistory(target, time.Time{}, refs[0], limit, true)
+	case "AFTER":
+		history, err = cc.stateProvider.GetChatHistory(target, refs[0], time.Time{}, limit, false)
+	case "LATEST":
+		history, err = cc.stateProvider.GetChatHistory(target, refs[0], time.Time{}, limit, true)
+	case "AROUND":
+		// Half before the reference, and the rest from the referenced message on
+		var after []Privmsg
+		history, err = cc.stateProvider.GetChatHistory(target, time.Time{}, refs[0], limit/2, true)
+		if err == nil {
+			after, err = cc.stateProvider.GetChatHistory(
+				target, refs[0].Add(-time.Microsecond), time.Time{}, limit-len(history), false)
+			history = append(history, after...)
+		}
+	case "BETWEEN":
+		// Messages closest to the first reference are returned
+		if refs[0].Before(refs[1]) {
+			history, err = cc.stateProvider.GetChatHistory(target, refs[0], refs[1], limit, false)
+		} else {
+			history, err = cc.stateProvider.GetChatHistory(target, refs[1], refs[0], limit, true)
+		}
+	}
+	if err != nil {
+		fail("MESSAGE_ERROR", target)
+		return
+	}
+
+	batchID := cc.nextBatchID()
+	cc.sendBatchStart(batchID, "chathistory", target)
+	for _, p := range history {
+		if cc.hasCap(CapBatch) {
+			p.Tags = withTag(p.Tags, "batch", batchID)
+		}
+		cc.outgoingMessages <- p.ToMessage()
+	}
+	cc.sendBatchEnd(batchID)
+}
+
+func (cc *clientConnection) sendChatHistoryTargets(from, to time.Time, limit int, fail func(string, ...string)) {
+	after, before := from, to
+	if from.After(to) {
+		after, before = to, from
+	}
+
+	targets, err := cc.stateProvider.GetChatHistoryTargets(after, before)
+	if err != nil {
+		fail("MESSAGE_ERROR")
+		return
+	}
+
+	// Targets closest to the first timestamp are returned
+	if len(targets) > limit {
+		if from.After(to) {
+			targets = targets[len(targets)-limit:]
+		} else {
+			targets = targets[:limit]
+		}
+	}
+
+	batchID := cc.nextBatchID()
+	cc.sendBatchStart(batchID, "draft/chathistory-targets")
+	for _, target := range targets {
+		m := &Message{
+			Prefix: cc.config.ServerName,
+			Cmd:    ChatHistoryCmd,
+			Params: []string{"TARGETS", target.Name, "timestamp=" + ServerTime(target.Latest)},
+		}
+		if cc.hasCap(CapBatch) {
+			m.Tags = map[string]string{"batch": batchID}
+		}
+		cc.outgoingMessages <- m
+	}
+	cc.sendBatchEnd(batchID)
+}
+
+var chatHistoryFailDescriptions = map[string]string{
+	"UNKNOWN_COMMAND":  "Unknown CHATHISTORY subcommand",
+	"NEED_MORE_PARAMS": "Missing parameters",
+	"INVALID_PARAMS":   "Invalid message reference or limit",
+	"MESSAGE_ERROR":    "Could not retrieve history",
+}
+
+// withTag returns a copy of tags with a tag added
+func withTag(tags map[string]string, key, value string) map[string]string {
+	newTags := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		newTags[k] = v
+	}
+	newTags[key] = value
+	return newTags
+}
+
+// nextBatchID returns a batch reference tag unique to this connection
+func (cc *clientConnection) nextBatchID() string {
+	return fmt.Sprintf("tanya%d", atomic.AddUint64(&cc.batchCount, 1))
+}
+
+// sendBatchStart opens a batch, if the client supports them
+func (cc *clientConnection) sendBatchStart(batchID, batchType string, params ...string) {
+	if !cc.hasCap(CapBatch) {
+		return
+	}
+
+	cc.outgoingMessages <- (&Batch{
+		ServerName: cc.config.ServerName,
+		ID:         batchID,
+		Type:       batchType,
+		Params:     params,
+	}).ToMessage()
+}
+
+// sendBatchEnd closes a batch, if the client supports them
+func (cc *clientConnection) sendBatchEnd(batchID string) {
+	if !cc.hasCap(CapBatch) {
+		return
+	}
+
+	cc.outgoingMessages <- (&Batch{ServerName: cc.config.ServerName, ID: batchID}).ToMessage()
+}
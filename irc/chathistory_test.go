@@ -0,0 +1,112 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type historyQuery struct {
+	target        string
+	after, before time.Time
+	limit         int
+	latest        bool
+}
+
+// fakeHistoryProvider records the history queries it receives
+type fakeHistoryProvider struct {
+	ServerStateProvider
+	queries []historyQuery
+}
+
+func (f *fakeHistoryProvider) GetChatHistory(
+	target string, after, before time.Time, limit int, latest bool,
+) ([]Privmsg, error) {
+	f.queries = append(f.queries, historyQuery{target, after, before, limit, latest})
+	return []Privmsg{{From: User{Nick: "kedo", Ident: "U267NCD1U"}, Target: target, Message: "hello"}}, nil
+}
+
+func (f *fakeHistoryProvider) GetMessageTime(msgID string) (time.Time, bool) {
+	return time.Unix(1500000000, 0), msgID == "1500000000.000000"
+}
+
+func TestHandleChatHistoryCommand(t *testing.T) {
+	t1 := time.Unix(1500000000, 0)
+	t2 := time.Unix(1500000100, 0)
+
+	tests := []struct {
+		name        string
+		line        string
+		wantQueries []historyQuery
+		wantLines   []string
+	}{
+		{
+			name:        "latest",
+			line:        "CHATHISTORY LATEST #Chatter * 50",
+			wantQueries: []historyQuery{{"#chatter", time.Time{}, time.Time{}, 50, true}},
+			wantLines: []string{
+				":tanya BATCH +tanya1 chathistory #chatter",
+				"@batch=tanya1 :kedo!U267NCD1U@localhost PRIVMSG #chatter hello",
+				":tanya BATCH -tanya1",
+			},
+		},
+		{
+			name:        "before msgid",
+			line:        "CHATHISTORY BEFORE #chatter msgid=1500000000.000000 500",
+			wantQueries: []historyQuery{{"#chatter", time.Time{}, t1, chatHistoryLimit, true}},
+		},
+		{
+			name:        "between backwards",
+			line:        "CHATHISTORY BETWEEN #chatter timestamp=2017-07-14T02:41:40.000Z timestamp=2017-07-14T02:40:00.000Z 10",
+			wantQueries: []historyQuery{{"#chatter", t1.UTC(), t2.UTC(), 10, true}},
+		},
+		{
+			name: "around",
+			line: "CHATHISTORY AROUND kedo msgid=1500000000.000000 10",
+			wantQueries: []historyQuery{
+				{"kedo", time.Time{}, t1, 5, true},
+				{"kedo", t1.Add(-time.Microsecond), time.Time{}, 9, false},
+			},
+		},
+		{
+			name:      "unknown msgid",
+			line:      "CHATHISTORY AFTER #chatter msgid=nope 10",
+			wantLines: []string{":tanya FAIL CHATHISTORY INVALID_PARAMS AFTER :Invalid message reference or limit"},
+		},
+		{
+			name:      "missing params",
+			line:      "CHATHISTORY BETWEEN #chatter * 10",
+			wantLines: []string{":tanya FAIL CHATHISTORY NEED_MORE_PARAMS BETWEEN :Missing parameters"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &fakeHistoryProvider{}
+			cc := &clientConnection{
+				config:           &Config{ServerName: "tanya"},
+				stateProvider:    provider,
+				caps:             map[string]struct{}{CapBatch: {}},
+				outgoingMessages: make(chan *Message, 100),
+			}
+
+			msg, err := StringToMessage(tt.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cc.handleChatHistoryCommand(msg)
+			close(cc.outgoingMessages)
+
+			if tt.wantQueries != nil && !reflect.DeepEqual(provider.queries, tt.wantQueries) {
+				t.Errorf("history queries = %+v, want %+v", provider.queries, tt.wantQueries)
+			}
+
+			var lines []string
+			for m := range cc.outgoingMessages {
+				lines = append(lines, m.String())
+			}
+			if tt.wantLines != nil && !reflect.DeepEqual(lines, tt.wantLines) {
+				t.Errorf("sent lines = %q, want %q", lines, tt.wantLines)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,38 +16,73 @@ const (
 	clientStateRegistering clientState = iota
 	clientStateAwaitingNick
 	clientStateAwaitingUser
+	clientStateAwaitingCapEnd
 	clientStateRegistered
 )
 
 type clientConnection struct {
-	conn          *net.TCPConn
+	conn          net.Conn
 	config        *Config
 	stateProvider ServerStateProvider
 
 	clientUser User
 	serverUser *User
 
-	state       clientState
+	state          clientState
+	capNegotiating bool
+
+	// clientName identifies the client to the playback buffer, and is taken from PASS or USER ident@client
+	clientName string
+	playback   *PlaybackBuffer
+	batchCount uint64
+
+	// Multiline batches the client is sending, and those open in what we're sending it, mapped to
+	// whether they're being unwrapped because the client doesn't support them
+	incomingBatches  map[string]*incomingMultiline
+	multilineBatches map[string]bool
+	coalescer        *lineCoalescer
+
+	// Whether files shared on Slack are offered by DCC, and the comment for the next file the client sends
+	dccOffers  bool
+	dccComment string
+	// Marks where messages too long for one line continue, which the client can change with *tanya
+	splitMarker string
+
+	// The last search the client ran, and the page of its results it was last sent
+	lastSearch     string
+	lastSearchPage int
+
+	// When the client connected, and how to list every client connected to the server
+	connectedAt time.Time
+	clients     func() []*clientConnection
+
+	// joinedChans and caps are also accessed by the server when relaying Slack events
 	joinedChans map[string]struct{}
+	caps        map[string]struct{}
 
 	outgoingMessages chan *Message
 	serverChan       chan<- *ServerMessage
 
 	slackConnected <-chan struct{}
 	shutdown       chan struct{}
+	shutdownOnce   sync.Once
+
+	sync.Mutex
 }
 
 func newClientConnection(
-	conn *net.TCPConn,
+	conn net.Conn,
 	user *User,
 	config *Config,
 	stateProvider ServerStateProvider,
 	serverChan chan *ServerMessage,
 	slackConnectedChan <-chan struct{},
+	playback *PlaybackBuffer,
+	clients func() []*clientConnection,
 ) *clientConnection {
 	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 
-	return &clientConnection{
+	cc := &clientConnection{
 		conn:          conn,
 		config:        config,
 		stateProvider: stateProvider,
@@ -55,12 +91,37 @@ func newClientConnection(
 		serverUser: user,
 
 		joinedChans: make(map[string]struct{}),
+		caps:        make(map[string]struct{}),
 
 		outgoingMessages: make(chan *Message),
 		serverChan:       serverChan,
 
 		slackConnected: slackConnectedChan,
 		shutdown:       make(chan struct{}),
+
+		playback: playback,
+
+		incomingBatches:  make(map[string]*incomingMultiline),
+		multilineBatches: make(map[string]bool),
+
+		dccOffers:   config.DCCOffers,
+		splitMarker: config.SplitMarker,
+
+		connectedAt: time.Now(),
+		clients:     clients,
+	}
+	cc.setCoalesceWindow(config.CoalesceWindow)
+	return cc
+}
+
+// setCoalesceWindow sets how long the client's lines are waited for to be joined into one message, or stops
+// joining them if it's zero. Only handleConnInput sends messages, so only it may change this.
+func (cc *clientConnection) setCoalesceWindow(window time.Duration) {
+	cc.coalescer = nil
+	if window > 0 {
+		cc.coalescer = newLineCoalescer(window, func(target, message string) {
+			cc.forwardPrivmsg(&Privmsg{Target: target, Message: message})
+		})
 	}
 }
 
@@ -76,8 +137,65 @@ func (cc *clientConnection) finishRegistration() {
 			NewNick: cc.serverUser.Nick,
 		}).ToMessage()
 	}
+	cc.Lock()
 	cc.clientUser = *cc.serverUser
+	cc.Unlock()
 	cc.sendWelcome()
+
+	if cc.playback != nil {
+		cc.sendPlayback(cc.playback.Attach(cc.clientName))
+	}
+
+	// If Slack hasn't told us yet, the summary is sent to everyone once it has
+	if unreads, ready := cc.stateProvider.GetUnreadSummary(); ready {
+		cc.sendUnreadSummary(unreads)
+	}
+}
+
+// completeRegistration finishes registration once NICK and USER have been received, unless
+// the client is still negotiating capabilities, in which case it waits for CAP END
+func (cc *clientConnection) completeRegistration() {
+	if cc.capNegotiating {
+		cc.setState(clientStateAwaitingCapEnd)
+		return
+	}
+
+	cc.setState(clientStateRegistered)
+	cc.finishRegistration()
+}
+
+// setState changes the registration state. Only handleConnInput changes it, but it's read when relaying
+// Slack events, so it's changed under the lock and read elsewhere through registered.
+func (cc *clientConnection) setState(state clientState) {
+	cc.Lock()
+	cc.state = state
+	cc.Unlock()
+}
+
+// setNick changes the client's nick, which like the registration state is read elsewhere through user
+func (cc *clientConnection) setNick(nick string) {
+	cc.Lock()
+	cc.clientUser.Nick = nick
+	cc.Unlock()
+}
+
+// registered returns whether the client has finished registering
+func (cc *clientConnection) registered() bool {
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.state == clientStateRegistered
+}
+
+// user returns the client's user, as the server sees it
+func (cc *clientConnection) user() User {
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.clientUser
+}
+
+// close shuts the connection down, whether the client disconnected or the server is stopping
+func (cc *clientConnection) close() {
+	cc.shutdownOnce.Do(func() { close(cc.shutdown) })
 }
 
 func (cc *clientConnection) handleConnInput() {
@@ -103,7 +221,7 @@ SelectLoop:
 
 		default:
 			if !s.Scan() {
-				close(cc.shutdown)
+				cc.close()
 				continue
 			}
 			msgStr := s.Text()
@@ -128,24 +246,31 @@ SelectLoop:
 					continue
 				}
 
+				if batchID, found := msg.Tags["batch"]; found {
+					cc.addToMultilineBatch(batchID, msg)
+					continue
+				}
+
 				messagable, err := ParseMessage(msg)
-				if err == nil {
-					cc.serverChan <- &ServerMessage{
-						message: messagable,
-						cAddr:   cc.conn.RemoteAddr(),
-					}
+				if err != nil {
+					continue
+				}
+				cc.handlePrivmsg(messagable.(*Privmsg))
 
+			case BatchCmd:
+				if cc.state != clientStateRegistered {
+					continue
 				}
+				cc.handleBatchCommand(msg)
 			case NickCmd:
 				switch cc.state {
 				case clientStateRegistering:
-					cc.clientUser.Nick = msg.Params[0]
-					cc.state = clientStateAwaitingUser
+					cc.setNick(msg.Params[0])
+					cc.setState(clientStateAwaitingUser)
 				case clientStateAwaitingNick:
 					// Finish registration if we already have the USER
-					cc.clientUser.Nick = msg.Params[0]
-					cc.state = clientStateRegistered
-					cc.finishRegistration()
+					cc.setNick(msg.Params[0])
+					cc.completeRegistration()
 				default:
 					cc.outgoingMessages <- (&Nick{
 						From:    User{Nick: msg.Params[0], Ident: cc.serverUser.Ident},
@@ -153,16 +278,30 @@ SelectLoop:
 					}).ToMessage()
 				}
 
+			case PassCmd:
+				// tanya has no passwords, so treat it as the client name
+				if cc.state != clientStateRegistered {
+					cc.clientName = msg.Params[0]
+				}
+
 			case UserCmd:
+				if cc.state != clientStateRegistered {
+					if clientName := clientNameFromUsername(msg.Params[0]); clientName != "" {
+						cc.clientName = clientName
+					}
+				}
+
 				switch cc.state {
 				case clientStateRegistering:
-					cc.state = clientStateAwaitingNick
+					cc.setState(clientStateAwaitingNick)
 				case clientStateAwaitingUser:
 					// Finish registration if we already have the NICK
-					cc.state = clientStateRegistered
-					cc.finishRegistration()
+					cc.completeRegistration()
 				}
 
+			case CapCmd:
+				cc.handleCapCommand(msg)
+
 			case PingCmd:
 				var pingToken string
 				if len(msg.Params) > 0 {
@@ -182,10 +321,19 @@ SelectLoop:
 					channelName = strings.ToLower(channelName)
 
 					// Ignore if we've already joined this channel (to avoid sending WHO/NAMES again)
-					if _, found := cc.joinedChans[channelName]; found {
+					if cc.isJoined(channelName) {
 						continue SelectLoop
 					}
 
+					if channelName == MentionsChannel {
+						cc.joinMentionsChannel()
+						continue
+					}
+					if channelName == SearchChannel {
+						cc.joinSearchChannel()
+						continue
+					}
+
 					// TODO join the channel on the Slack-side too
 					cc.handleChannelJoined(channelName)
 				}
@@ -195,12 +343,12 @@ SelectLoop:
 				channelName := strings.ToLower(msg.Params[0])
 
 				// Ignore if we're not in this channel
-				if _, found := cc.joinedChans[channelName]; !found {
+				if !cc.isJoined(channelName) {
 					continue SelectLoop
 				}
 
 				// TODO part the channel on the Slack-side too
-				cc.handleChannelParted(channelName)
+				cc.handleChannelParted(channelName, "")
 
 			case ModeCmd:
 				if len(msg.Params) < 1 || msg.Params[0][0] != '#' {
@@ -246,6 +394,19 @@ SelectLoop:
 					cc.outgoingMessages <- cc.reply(*m)
 				}
 
+			case ChatHistoryCmd:
+				if cc.state != clientStateRegistered {
+					continue
+				}
+				// History may have to be fetched from Slack, so don't hold up the client's other commands
+				go cc.handleChatHistoryCommand(msg)
+
+			case MarkReadCmd:
+				if cc.state != clientStateRegistered {
+					continue
+				}
+				cc.handleMarkReadCommand(msg)
+
 			case WhoisCmd:
 				whoisNick := msg.Params[0]
 				whoisUser := cc.stateProvider.GetUserFromNick(whoisNick)
@@ -265,6 +426,47 @@ SelectLoop:
 	}
 }
 
+// handlePrivmsg handles a message from the client, which is usually relayed to Slack
+func (cc *clientConnection) handlePrivmsg(p *Privmsg) {
+	// Messages to *tanya are commands for us, not for Slack
+	if strings.EqualFold(p.Target, tanyaInternalUser.Nick) {
+		cc.handleInternalCommand(p.Message)
+		return
+	}
+	if p.Target == MentionsChannel {
+		cc.outgoingMessages <- cc.reply(*ErrCannotSendToChan(MentionsChannel))
+		return
+	}
+	// Messages to &search are searches
+	if p.Target == SearchChannel {
+		go cc.search(p.Message)
+		return
+	}
+	// Anything but a command Slack has, such as "/etc is full", is posted as it is
+	if command, args, ok := parseSlashCommand(p.Message, cc.config.SlashCommandPrefix); ok && cc.stateProvider.HasSlashCommand(command) {
+		go cc.runSlashCommand(p.Target, command, args)
+		return
+	}
+	if offer, ok := parseDCCSend(p.Message); ok {
+		go cc.receiveDCC(p.Target, offer)
+		return
+	}
+
+	if cc.coalescer != nil && !cc.hasCap(CapMultiline) {
+		cc.coalescer.Add(p.Target, p.Message)
+		return
+	}
+	cc.forwardPrivmsg(p)
+}
+
+// forwardPrivmsg passes a message from the client to the server, to send to Slack and the other clients
+func (cc *clientConnection) forwardPrivmsg(p *Privmsg) {
+	cc.serverChan <- &ServerMessage{
+		message: p,
+		cAddr:   cc.conn.RemoteAddr(),
+	}
+}
+
 // postProcessClientMessage modifies the message for consumption by the client
 // adding targets or swapping things as needed
 func (cc *clientConnection) postProcessClientMessage(m *Message) *Message {
@@ -281,7 +483,7 @@ func (cc *clientConnection) postProcessClientMessage(m *Message) *Message {
 			// the self user as the From field
 			if aMessagable.IsTargetChannel() {
 				retMessage := aMessagable
-				retMessage.From = cc.clientUser
+				retMessage.From = cc.user()
 				return retMessage.ToMessage()
 			}
 
@@ -293,8 +495,8 @@ func (cc *clientConnection) postProcessClientMessage(m *Message) *Message {
 			targetUser := cc.stateProvider.GetUserFromNick(targetNick)
 
 			retMessage.From = targetUser
-			retMessage.Target = cc.clientUser.Nick
-			retMessage.Message = "[" + cc.clientUser.Nick + "] " + retMessage.Message
+			retMessage.Target = cc.user().Nick
+			retMessage.Message = "[" + retMessage.Target + "] " + retMessage.Message
 			return retMessage.ToMessage()
 		}
 	default:
@@ -311,16 +513,31 @@ func (cc *clientConnection) handleConnOutput() {
 			return
 
 		case message := <-cc.outgoingMessages:
-			if cc.state == clientStateRegistered {
-				fmt.Fprintln(cc.conn, cc.postProcessClientMessage(message).String())
+			if cc.registered() && cc.wantsMessage(message) {
+				if message = cc.unwrapMultiline(message); message != nil {
+					for _, line := range cc.splitLongMessage(cc.filterTags(cc.postProcessClientMessage(message))) {
+						fmt.Fprintln(cc.conn, line.String())
+					}
+				}
 			}
 		}
 	}
 }
 
+// send queues a message for the client, or writes it immediately if the client hasn't finished
+// registering, since handleConnOutput drops messages until then
+func (cc *clientConnection) send(m *Message) {
+	if cc.registered() {
+		cc.outgoingMessages <- m
+		return
+	}
+
+	fmt.Fprintln(cc.conn, m.String())
+}
+
 func (cc *clientConnection) reply(reply NumericReply) *Message {
 	reply.ServerName = cc.config.ServerName
-	reply.Target = cc.clientUser.Nick
+	reply.Target = cc.user().Nick
 	return reply.ToMessage()
 }
 
@@ -356,10 +573,12 @@ func (cc *clientConnection) sendWelcome() {
 				"NICKLEN=32",
 				"TOPICLEN=160",
 				"AWAYLEN=160",
-				"CHANTYPES=#",
+				"CHANTYPES=#&",
 				"PREFIX=(ov)@+",
 				"CHANMODES=b,k,l,rimnpst",
 				"CASEMAPPING=rfc1459", // this is an especially egregious lie who even does rfc1459 casemapping
+				fmt.Sprintf("CHATHISTORY=%d", chatHistoryLimit),
+				"MSGREFTYPES=msgid,timestamp",
 				"are supported by this server",
 			},
 		}),
@@ -410,14 +629,17 @@ func (cc *clientConnection) handleChannelJoined(channelName string) {
 
 	topic := cc.stateProvider.GetChannelTopic(channelName)
 	users := cc.stateProvider.GetChannelUsers(channelName)
-
-	cc.joinedChans[channelName] = struct{}{}
 	cc.sendChannelJoinedResponse(channelName, topic, users)
 }
 
+// sendChannelJoinedResponse joins the client to a channel, sending it the JOIN, topic and NAMES
 func (cc *clientConnection) sendChannelJoinedResponse(channelName string, topic ChannelTopic, users []User) {
+	cc.Lock()
+	cc.joinedChans[channelName] = struct{}{}
+	cc.Unlock()
+
 	joinResponse := (&Join{
-		User:    cc.clientUser,
+		User:    cc.user(),
 		Channel: channelName,
 	}).ToMessage()
 	cc.outgoingMessages <- joinResponse
@@ -429,14 +651,51 @@ func (cc *clientConnection) sendChannelJoinedResponse(channelName string, topic
 	for _, m := range NamelistAsNumerics(users, channelName) {
 		cc.outgoingMessages <- cc.reply(*m)
 	}
+
+	cc.sendReadMarker(channelName)
 }
 
-func (cc *clientConnection) handleChannelParted(channelName string) {
+func (cc *clientConnection) handleChannelParted(channelName, reason string) {
+	cc.Lock()
 	delete(cc.joinedChans, channelName)
+	cc.Unlock()
 
 	partResponse := (&Part{
-		User:    cc.clientUser,
+		User:    cc.user(),
 		Channel: channelName,
+		Message: reason,
 	}).ToMessage()
 	cc.outgoingMessages <- partResponse
 }
+
+func (cc *clientConnection) handleChannelRenamed(oldName, newName, reason string) {
+	if !cc.isJoined(oldName) {
+		return
+	}
+
+	if !cc.hasCap(CapChannelRename) {
+		cc.handleChannelParted(oldName, reason)
+		cc.handleChannelJoined(newName)
+		return
+	}
+
+	cc.Lock()
+	delete(cc.joinedChans, oldName)
+	cc.joinedChans[newName] = struct{}{}
+	cc.Unlock()
+
+	cc.outgoingMessages <- (&Rename{
+		ServerName: cc.config.ServerName,
+		OldChannel: oldName,
+		NewChannel: newName,
+		Reason:     reason,
+	}).ToMessage()
+}
+
+func (cc *clientConnection) isJoined(channelName string) bool {
+	cc.Lock()
+	defer cc.Unlock()
+
+	_, found := cc.joinedChans[channelName]
+	return found
+}
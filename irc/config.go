@@ -1,15 +1,89 @@
 package irc
 
+import "time"
+
 // Config holds configurable parameters for the IRC server
 type Config struct {
 	ServerName string
 	ListenAddr string
 
 	MOTD string
+
+	// Number of channel and DM messages kept for playback to clients which weren't attached. Zero, the default,
+	// disables playback. Clients without a name all share one position in the buffer.
+	PlaybackBufferSize int
+	// If set, the playback buffer is saved here so it survives restarts
+	PlaybackFile string
+
+	// Lines a client without draft/multiline sends to the same target within this long of each other are
+	// joined into one Slack message. Zero sends every line separately.
+	CoalesceWindow time.Duration
+
+	// Appended to each piece but the last of a message too long for one IRC line, e.g. "…"
+	SplitMarker string
+
+	// Messages starting with this followed by a command name, such as "/remind me to stretch in 1 hour", run
+	// the Slack slash command in the conversation instead of being posted. Most clients send a message starting
+	// with "/" when "//" is typed. Empty disables slash commands.
+	SlashCommandPrefix string
+
+	// Largest file clients can send by DCC to be uploaded to Slack, in bytes
+	DCCMaxSize int64
+	// Whether clients are offered files shared on Slack by DCC, until they change it with *tanya
+	DCCOffers bool
 }
 
 // SetDefaults overwrites config entries with their default values
 func (c *Config) SetDefaults() {
 	c.ServerName = "tanya"
 	c.ListenAddr = ":6667"
+	c.SlashCommandPrefix = "/"
+	c.DCCMaxSize = 100 << 20
+}
+
+// RelayConfig holds configurable parameters for relaying to an existing IRC network as a client, rather
+// than running an IRC server
+type RelayConfig struct {
+	// Address of the IRC server to connect to, e.g. "irc.example.net:6697". Setting it makes the gateway a
+	// relay.
+	Server   string
+	TLS      bool
+	Password string
+
+	Nick     string
+	RealName string
+
+	// Slack channels to relay, mapped to the IRC channels they're relayed to
+	Channels map[string]string
+
+	// Relay each Slack user through an IRC connection of their own, named after them with PuppetSuffix,
+	// instead of sending everything from Nick with the sender's nick in the message
+	Puppets      bool
+	PuppetSuffix string
+	// Most puppets connected at once. The one which spoke least recently is disconnected to make room.
+	// Every puppet connects from the same host, so most networks' clone limits need an exemption for it.
+	MaxPuppets int
+	// IRC nicks Slack users are relayed as, by Slack nick, in place of the Slack nick
+	Nicks map[string]string
+
+	// IRC nicks whose messages aren't relayed to Slack, such as other bots or bridges. Messages from the
+	// relay's own connections never are.
+	IgnoreNicks []string
+	// Slack nicks whose messages aren't relayed to IRC
+	IgnoreSlackNicks []string
+
+	// Lines each connection may send at once, and how often it may send another after that, to stay under
+	// the network's flood limits. Zero FloodInterval sends lines as fast as they come.
+	FloodBurst    int
+	FloodInterval time.Duration
+}
+
+// SetDefaults overwrites config entries with their default values
+func (c *RelayConfig) SetDefaults() {
+	c.Nick = "tanya"
+	c.RealName = "tanya"
+	c.PuppetSuffix = "[s]"
+	c.MaxPuppets = 50
+	c.FloodBurst = 5
+	c.FloodInterval = 2 * time.Second
 }
@@ -0,0 +1,329 @@
+package irc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ctcpDelimiter wraps CTCP messages sent in a PRIVMSG
+const ctcpDelimiter = "\x01"
+
+// How long to wait for the other side of a DCC transfer to connect, or to send more data
+const dccTimeout = 2 * time.Minute
+
+// dccOffer is a DCC SEND offer, from a client to us or from us to a client
+type dccOffer struct {
+	Filename string
+	Host     string
+	Port     int
+	Size     int64
+
+	// Set for passive (reverse) DCC, where the side receiving the file listens instead
+	Token string
+}
+
+// FileOffer is a file shared on Slack, which clients that want them are offered by DCC
+type FileOffer struct {
+	From   User
+	Target string
+
+	Name string
+	Size int64
+	URL  string
+}
+
+// ctcp wraps a CTCP message for sending in a PRIVMSG
+func ctcp(message string) string {
+	return ctcpDelimiter + message + ctcpDelimiter
+}
+
+// parseDCCSend parses a CTCP DCC SEND offer, e.g. "\x01DCC SEND "a file.txt" 2130706433 5000 1024\x01"
+func parseDCCSend(text string) (dccOffer, bool) {
+	if !strings.HasPrefix(text, ctcpDelimiter) {
+		return dccOffer{}, false
+	}
+	text = strings.TrimSuffix(strings.TrimPrefix(text, ctcpDelimiter), ctcpDelimiter)
+
+	command, rest, _ := strings.Cut(text, " ")
+	subcommand, rest, _ := strings.Cut(rest, " ")
+	if !strings.EqualFold(command, "DCC") || !strings.EqualFold(subcommand, "SEND") {
+		return dccOffer{}, false
+	}
+
+	var filename string
+	if strings.HasPrefix(rest, `"`) {
+		end := strings.Index(rest[1:], `"`)
+		if end < 0 {
+			return dccOffer{}, false
+		}
+		filename, rest = rest[1:end+1], rest[end+2:]
+	} else {
+		filename, rest, _ = strings.Cut(rest, " ")
+	}
+
+	fields := strings.Fields(rest)
+	if filename == "" || len(fields) < 2 {
+		return dccOffer{}, false
+	}
+
+	offer := dccOffer{Filename: filename, Host: fields[0]}
+	var err error
+	if offer.Port, err = strconv.Atoi(fields[1]); err != nil || offer.Port < 0 || offer.Port > 65535 {
+		return dccOffer{}, false
+	}
+	if len(fields) > 2 {
+		if offer.Size, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			return dccOffer{}, false
+		}
+	}
+	if len(fields) > 3 {
+		offer.Token = fields[3]
+	}
+	if offer.Port == 0 && offer.Token == "" {
+		return dccOffer{}, false
+	}
+	return offer, true
+}
+
+// String formats the offer as a CTCP DCC SEND message
+func (o dccOffer) String() string {
+	filename := o.Filename
+	if strings.ContainsAny(filename, " \"") {
+		filename = `"` + strings.ReplaceAll(filename, `"`, "'") + `"`
+	}
+
+	message := fmt.Sprintf("DCC SEND %s %s %d %d", filename, o.Host, o.Port, o.Size)
+	if o.Token != "" {
+		message += " " + o.Token
+	}
+	return ctcp(message)
+}
+
+// dccHost formats an IP address for a DCC offer: IPv4 addresses as an integer, IPv6 as is
+func dccHost(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(ipv4)), 10)
+	}
+	return ip.String()
+}
+
+// receiveDCCFile reads a file sent over DCC, acknowledging what's been received as the protocol expects.
+// It stops once size bytes have arrived, or at EOF if the size is unknown.
+func receiveDCCFile(conn net.Conn, w io.Writer, size, maxSize int64) (int64, error) {
+	var received int64
+	buf := make([]byte, 32*1024)
+	ack := make([]byte, 4)
+	for size <= 0 || received < size {
+		conn.SetDeadline(time.Now().Add(dccTimeout))
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if received += int64(n); received > maxSize {
+				return received, fmt.Errorf("file is larger than the %d byte limit", maxSize)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return received, err
+			}
+
+			binary.BigEndian.PutUint32(ack, uint32(received))
+			if _, err := conn.Write(ack); err != nil {
+				return received, err
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			if size > 0 {
+				return received, fmt.Errorf("connection closed after %d of %d bytes", received, size)
+			}
+			return received, nil
+		} else if err != nil {
+			return received, err
+		}
+	}
+	return received, nil
+}
+
+// listenForDCC listens on the address the client reached us at, for the client to connect back to
+func (cc *clientConnection) listenForDCC() (*net.TCPListener, error) {
+	localIP := cc.conn.LocalAddr().(*net.TCPAddr).IP
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIP})
+	if err != nil {
+		return nil, err
+	}
+	l.SetDeadline(time.Now().Add(dccTimeout))
+	return l, nil
+}
+
+// acceptFromClient waits for the client to connect to a DCC listener, ignoring anyone else
+func (cc *clientConnection) acceptFromClient(l *net.TCPListener) (*net.TCPConn, error) {
+	clientIP := cc.conn.RemoteAddr().(*net.TCPAddr).IP
+	for {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		if conn.RemoteAddr().(*net.TCPAddr).IP.Equal(clientIP) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// receiveDCC accepts a file the client offered to send to target, and uploads it to Slack
+func (cc *clientConnection) receiveDCC(target string, offer dccOffer) {
+	err := cc.receiveDCCAndUpload(target, offer)
+	if err != nil {
+		log.Printf("%v DCC SEND of %q to %v failed: %v", cc, offer.Filename, target, err)
+		cc.sendFromInternalUser(fmt.Sprintf("could not send %s to %s: %v", offer.Filename, target, err))
+		return
+	}
+	cc.sendFromInternalUser(fmt.Sprintf("uploaded %s to %s", offer.Filename, target))
+}
+
+func (cc *clientConnection) receiveDCCAndUpload(target string, offer dccOffer) error {
+	maxSize := cc.config.DCCMaxSize
+	if offer.Size > maxSize {
+		return fmt.Errorf("file is larger than the %d byte limit", maxSize)
+	}
+
+	var conn *net.TCPConn
+	if offer.Port == 0 {
+		// Passive DCC: tell the client where to connect
+		l, err := cc.listenForDCC()
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+
+		reply := offer
+		reply.Host = dccHost(l.Addr().(*net.TCPAddr).IP)
+		reply.Port = l.Addr().(*net.TCPAddr).Port
+		cc.outgoingMessages <- (&Privmsg{From: cc.dccPeer(target), Target: cc.user().Nick, Message: reply.String()}).ToMessage()
+
+		if conn, err = cc.acceptFromClient(l); err != nil {
+			return err
+		}
+	} else {
+		// The address in the offer is often a private or otherwise unreachable one, and we only want to
+		// accept files from the client itself anyway
+		addr := &net.TCPAddr{IP: cc.conn.RemoteAddr().(*net.TCPAddr).IP, Port: offer.Port}
+		c, err := net.DialTimeout("tcp", addr.String(), dccTimeout)
+		if err != nil {
+			return err
+		}
+		conn = c.(*net.TCPConn)
+	}
+	defer conn.Close()
+
+	file, err := os.CreateTemp("", "tanya-dcc-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	size, err := receiveDCCFile(conn, file, offer.Size, maxSize)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return errors.New("file is empty")
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return cc.stateProvider.UploadFile(target, offer.Filename, file, int(size), cc.takeDCCComment())
+}
+
+// dccPeer returns who the client offered a file to, which is who it expects a passive DCC reply from
+func (cc *clientConnection) dccPeer(target string) User {
+	if !strings.HasPrefix(target, "#") {
+		if user := cc.stateProvider.GetUserFromNick(target); user.Nick != "" {
+			return user
+		}
+	}
+	return *tanyaInternalUser
+}
+
+// takeDCCComment returns the comment set for the client's next file, and clears it
+func (cc *clientConnection) takeDCCComment() string {
+	cc.Lock()
+	defer cc.Unlock()
+
+	comment := cc.dccComment
+	cc.dccComment = ""
+	return comment
+}
+
+// offerDCC offers the client a file shared on Slack by DCC, and sends it if the client accepts
+func (cc *clientConnection) offerDCC(offer FileOffer) {
+	if err := cc.sendDCC(offer); err != nil {
+		log.Printf("%v DCC offer of %q failed: %v", cc, offer.Name, err)
+	}
+}
+
+func (cc *clientConnection) sendDCC(offer FileOffer) error {
+	l, err := cc.listenForDCC()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	cc.outgoingMessages <- (&Privmsg{From: offer.From, Target: cc.user().Nick, Message: dccOffer{
+		Filename: offer.Name,
+		Host:     dccHost(l.Addr().(*net.TCPAddr).IP),
+		Port:     l.Addr().(*net.TCPAddr).Port,
+		Size:     offer.Size,
+	}.String()}).ToMessage()
+
+	conn, err := cc.acceptFromClient(l)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(dccTimeout))
+	if err := cc.stateProvider.DownloadFile(offer.URL, conn); err != nil {
+		return err
+	}
+
+	// Let the client read everything, and drain its acknowledgements, before closing
+	conn.CloseWrite()
+	_, err = io.Copy(io.Discard, conn)
+	return err
+}
+
+// HandleFileShared offers a file shared on Slack to clients which want DCC offers and are in the channel
+func (s *Server) HandleFileShared(offer FileOffer) {
+	s.RLock()
+	for _, v := range s.clientConnections {
+		if v.registered() && v.wantsDCCOffers() && v.isJoined(offer.Target) {
+			go v.offerDCC(offer)
+		}
+	}
+	s.RUnlock()
+}
+
+// wantsDCCOffers returns whether the client wants files shared on Slack offered to it by DCC
+func (cc *clientConnection) wantsDCCOffers() bool {
+	cc.Lock()
+	defer cc.Unlock()
+
+	return cc.dccOffers
+}
+
+// setDCCOffers sets whether the client wants files shared on Slack offered to it by DCC
+func (cc *clientConnection) setDCCOffers(enabled bool) {
+	cc.Lock()
+	defer cc.Unlock()
+
+	cc.dccOffers = enabled
+}
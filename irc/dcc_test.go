@@ -0,0 +1,195 @@
+package irc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDCCSend(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want dccOffer
+		ok   bool
+	}{
+		{"active", "\x01DCC SEND trace.txt 2130706433 5000 1024\x01", dccOffer{"trace.txt", "2130706433", 5000, 1024, ""}, true},
+		{"quoted filename", "\x01DCC SEND \"my trace.txt\" ::1 5000 1024\x01", dccOffer{"my trace.txt", "::1", 5000, 1024, ""}, true},
+		{"passive", "\x01DCC SEND trace.txt 2130706433 0 1024 42\x01", dccOffer{"trace.txt", "2130706433", 0, 1024, "42"}, true},
+		{"passive without token", "\x01DCC SEND trace.txt 2130706433 0 1024\x01", dccOffer{}, false},
+		{"other CTCP", "\x01ACTION waves\x01", dccOffer{}, false},
+		{"DCC CHAT", "\x01DCC CHAT chat 2130706433 5000\x01", dccOffer{}, false},
+		{"not CTCP", "DCC SEND trace.txt 2130706433 5000 1024", dccOffer{}, false},
+		{"bad port", "\x01DCC SEND trace.txt 2130706433 70000 1024\x01", dccOffer{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseDCCSend(tt.text)
+			if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDCCSend() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.ok)
+			}
+			if ok {
+				if roundTrip, _ := parseDCCSend(got.String()); !reflect.DeepEqual(roundTrip, got) {
+					t.Errorf("parseDCCSend(dccOffer.String()) = %+v, want %+v", roundTrip, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDCCHost(t *testing.T) {
+	if got := dccHost(net.ParseIP("127.0.0.1")); got != "2130706433" {
+		t.Errorf("dccHost() = %v, want 2130706433", got)
+	}
+	if got := dccHost(net.ParseIP("::1")); got != "::1" {
+		t.Errorf("dccHost() = %v, want ::1", got)
+	}
+}
+
+func TestReceiveDCCFile(t *testing.T) {
+	content := []byte(strings.Repeat("stack trace\n", 100))
+
+	tests := []struct {
+		name    string
+		size    int64
+		maxSize int64
+		wantErr bool
+	}{
+		{"known size", int64(len(content)), 1 << 20, false},
+		{"unknown size", 0, 1 << 20, false},
+		{"truncated", int64(len(content)) + 1, 1 << 20, true},
+		{"too large", int64(len(content)), 100, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			acked := make(chan uint32)
+			go func() {
+				conn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					close(acked)
+					return
+				}
+				conn.Write(content)
+				conn.(*net.TCPConn).CloseWrite()
+
+				var last uint32
+				ack := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(conn, ack); err != nil {
+						break
+					}
+					last = binary.BigEndian.Uint32(ack)
+				}
+				conn.Close()
+				acked <- last
+			}()
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var received bytes.Buffer
+			_, err = receiveDCCFile(conn, &received, tt.size, tt.maxSize)
+			conn.Close()
+			lastAck := <-acked
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("receiveDCCFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (!bytes.Equal(received.Bytes(), content) || lastAck != uint32(len(content))) {
+				t.Errorf("receiveDCCFile() received %d bytes, acknowledged %d, want %d", received.Len(), lastAck, len(content))
+			}
+		})
+	}
+}
+
+// fakeUploadProvider knows one user, and records the files uploaded through it
+type fakeUploadProvider struct {
+	ServerStateProvider
+	uploaded chan []byte
+}
+
+func (f *fakeUploadProvider) GetUserFromNick(nick string) User {
+	if nick == "kedo" {
+		return User{Nick: "kedo", Ident: "U267NCD1U"}
+	}
+	return User{}
+}
+
+func (f *fakeUploadProvider) UploadFile(target, filename string, file io.Reader, size int, comment string) error {
+	content, err := io.ReadAll(file)
+	f.uploaded <- content
+	return err
+}
+
+func TestReceiveDCCPassive(t *testing.T) {
+	content := []byte(strings.Repeat("stack trace\n", 100))
+
+	// The client's IRC connection, which DCC listens on the local end of and only accepts the remote end from
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	provider := &fakeUploadProvider{uploaded: make(chan []byte, 1)}
+	cc := &clientConnection{
+		conn:             server,
+		config:           &Config{ServerName: "tanya", DCCMaxSize: 1 << 20},
+		stateProvider:    provider,
+		clientUser:       User{Nick: "papika"},
+		outgoingMessages: make(chan *Message, 10),
+	}
+
+	offer := dccOffer{Filename: "trace.txt", Host: "2130706433", Size: int64(len(content)), Token: "42"}
+	errs := make(chan error, 1)
+	go func() { errs <- cc.receiveDCCAndUpload("kedo", offer) }()
+
+	// The reply has to come from whoever the file was offered to, or the client won't match it to its offer
+	reply, err := ParseMessage(<-cc.outgoingMessages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := reply.(*Privmsg)
+	replyOffer, ok := parseDCCSend(p.Message)
+	if !ok || p.From.Nick != "kedo" || p.Target != "papika" || replyOffer.Token != "42" || replyOffer.Port == 0 {
+		t.Fatalf("passive DCC reply = %+v, want an offer from kedo to papika with a port and the token", p)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", replyOffer.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(content)
+	io.Copy(io.Discard, conn)
+	conn.Close()
+
+	if err := <-errs; err != nil {
+		t.Fatalf("receiveDCCAndUpload() error = %v", err)
+	}
+	if uploaded := <-provider.uploaded; !bytes.Equal(uploaded, content) {
+		t.Errorf("uploaded %d bytes, want %d", len(uploaded), len(content))
+	}
+}
@@ -0,0 +1,315 @@
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// internalCommands describes the commands *tanya understands, for help
+var internalCommands = []struct {
+	usage       string
+	description string
+}{
+	{"help", "list these commands"},
+	{"status", "show the state of the connection to slack and of this server"},
+	{"unread", "summarize the channels and DMs with unread messages"},
+	{"reconnect", "drop the connection to slack and make a new one"},
+	{"resync", "reload users, channels and channel members from slack"},
+	{"join <#channel>", "join a channel on slack"},
+	{"leave <#channel>", "leave a channel on slack"},
+	{"search <query>", "search slack's messages, with slack's modifiers like in:#channel and from:@nick"},
+	{"search more", "show the next page of the last search's results"},
+	{"slash <#channel|nick> </command> [args]", "run a slack slash command in a channel or DM"},
+	{"whois <nick>", "show who a slack user is and the channels you share"},
+	{"clients", "list the IRC clients connected to this server"},
+	{"comment <text>", "comment on the next file you send by DCC"},
+	{"dcc on|off", "offer files shared on slack to this client by DCC"},
+	{"set [<option> [<value>]]", "show or change this client's settings: dcc, coalesce, splitmarker"},
+}
+
+// handleInternalCommand handles a message sent to *tanya by the client. Replies only go to the client.
+func (cc *clientConnection) handleInternalCommand(text string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "help":
+		for _, command := range internalCommands {
+			cc.sendFromInternalUser(fmt.Sprintf("%s: %s", command.usage, command.description))
+		}
+
+	case "status":
+		cc.sendStatus()
+
+	case "unread", "unreads":
+		unreads, ready := cc.stateProvider.GetUnreadSummary()
+		if !ready {
+			cc.sendFromInternalUser("still fetching unread counts from slack, the summary may be incomplete")
+		}
+		cc.sendUnreadSummary(unreads)
+
+	case "reconnect":
+		if err := cc.stateProvider.Reconnect(); err != nil {
+			cc.sendFromInternalUser(fmt.Sprintf("could not reconnect: %v", err))
+			return
+		}
+		cc.sendFromInternalUser("reconnecting to slack")
+
+	case "resync":
+		cc.sendFromInternalUser("resyncing with slack")
+		go func() {
+			startTime := time.Now()
+			if err := cc.stateProvider.Resync(); err != nil {
+				cc.sendFromInternalUser(fmt.Sprintf("could not resync: %v", err))
+				return
+			}
+			cc.sendFromInternalUser(fmt.Sprintf("resynced with slack in %v", time.Since(startTime).Round(time.Millisecond)))
+		}()
+
+	case "join":
+		if len(fields) < 2 || !strings.HasPrefix(fields[1], "#") {
+			cc.sendFromInternalUser("use: join <#channel>")
+			return
+		}
+		cc.joinSlackChannel(strings.ToLower(fields[1]))
+
+	case "leave", "part":
+		if len(fields) < 2 || !strings.HasPrefix(fields[1], "#") {
+			cc.sendFromInternalUser("use: leave <#channel>")
+			return
+		}
+		cc.leaveSlackChannel(strings.ToLower(fields[1]))
+
+	case "search":
+		query := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(text), fields[0]))
+		if query == "" {
+			cc.sendFromInternalUser("use: search <query>|more")
+			return
+		}
+		go cc.search(query)
+
+	case "slash":
+		if len(fields) < 3 {
+			cc.sendFromInternalUser("use: slash <#channel|nick> </command> [args]")
+			return
+		}
+		command, args, _ := parseSlashCommand("/"+strings.TrimPrefix(strings.Join(fields[2:], " "), "/"), "/")
+		if command == "" {
+			cc.sendFromInternalUser(fmt.Sprintf("not a slash command: %v", fields[2]))
+			return
+		}
+		go cc.runSlashCommand(fields[1], command, args)
+
+	case "whois":
+		if len(fields) < 2 {
+			cc.sendFromInternalUser("use: whois <nick>")
+			return
+		}
+		cc.sendWhois(fields[1])
+
+	case "clients":
+		cc.sendClients()
+
+	case "comment":
+		comment := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(text), fields[0]))
+		cc.Lock()
+		cc.dccComment = comment
+		cc.Unlock()
+		if comment == "" {
+			cc.sendFromInternalUser("cleared the comment for the next file you send")
+		} else {
+			cc.sendFromInternalUser("the next file you send will have the comment: " + comment)
+		}
+
+	case "dcc":
+		cc.handleSetCommand(fields)
+
+	case "set":
+		cc.handleSetCommand(fields[1:])
+
+	default:
+		cc.sendFromInternalUser(fmt.Sprintf("unknown command %q, send help for a list", fields[0]))
+	}
+}
+
+// sendStatus tells the client about the connection to Slack and the clients connected to the server
+func (cc *clientConnection) sendStatus() {
+	status := cc.stateProvider.GetConnectionStatus()
+	switch {
+	case status.Since.IsZero():
+		cc.sendFromInternalUser(fmt.Sprintf("not connected to slack yet (%s)", status.Detail))
+	case status.Connected:
+		cc.sendFromInternalUser(fmt.Sprintf("connected to slack %s for %v", status.Detail, sinceRounded(status.Since)))
+	default:
+		cc.sendFromInternalUser(fmt.Sprintf("disconnected from slack %s for %v", status.Detail, sinceRounded(status.Since)))
+	}
+
+	cc.sendFromInternalUser(fmt.Sprintf("%d IRC clients connected, %d slack channels joined",
+		len(cc.clients()), len(cc.stateProvider.GetJoinedChannels())))
+}
+
+// joinSlackChannel joins a channel on Slack, and on the client if we were already in it on Slack
+func (cc *clientConnection) joinSlackChannel(channelName string) {
+	for _, joined := range cc.stateProvider.GetJoinedChannels() {
+		if joined == channelName {
+			if !cc.isJoined(channelName) {
+				cc.handleChannelJoined(channelName)
+			}
+			cc.sendFromInternalUser(fmt.Sprintf("already in %v on slack", channelName))
+			return
+		}
+	}
+
+	// Every client is joined to the channel once Slack tells us we're in it
+	if err := cc.stateProvider.JoinChannel(channelName); err != nil {
+		cc.sendFromInternalUser(fmt.Sprintf("could not join %v: %v", channelName, err))
+		return
+	}
+	cc.sendFromInternalUser(fmt.Sprintf("joined %v on slack", channelName))
+}
+
+// leaveSlackChannel leaves a channel on Slack, which parts it on every client
+func (cc *clientConnection) leaveSlackChannel(channelName string) {
+	if err := cc.stateProvider.LeaveChannel(channelName); err != nil {
+		cc.sendFromInternalUser(fmt.Sprintf("could not leave %v: %v", channelName, err))
+		return
+	}
+	cc.sendFromInternalUser(fmt.Sprintf("left %v on slack", channelName))
+}
+
+// sendWhois tells the client who a Slack user is, and which of our channels they're in
+func (cc *clientConnection) sendWhois(nick string) {
+	user := cc.stateProvider.GetUserFromNick(nick)
+	if user.Nick == "" {
+		cc.sendFromInternalUser(fmt.Sprintf("no such nick: %v", nick))
+		return
+	}
+	cc.sendFromInternalUser(fmt.Sprintf("%s is %s, slack ID %s", user.Nick, user.RealName, user.Ident))
+
+	var shared []string
+	for _, channelName := range cc.stateProvider.GetJoinedChannels() {
+		for _, member := range cc.stateProvider.GetChannelUsers(channelName) {
+			if member.Ident == user.Ident {
+				shared = append(shared, channelName)
+				break
+			}
+		}
+	}
+	sort.Strings(shared)
+
+	if len(shared) == 0 {
+		cc.sendFromInternalUser(fmt.Sprintf("%s is in none of our channels", user.Nick))
+		return
+	}
+	cc.sendFromInternalUser(fmt.Sprintf("%s is in %s", user.Nick, strings.Join(shared, " ")))
+}
+
+// sendClients lists the clients connected to the server for the client
+func (cc *clientConnection) sendClients() {
+	clients := cc.clients()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].connectedAt.Before(clients[j].connectedAt) })
+
+	for _, client := range clients {
+		description := fmt.Sprintf("%s from %v, connected for %v", client.user().Nick, client,
+			sinceRounded(client.connectedAt))
+		// The client name is set before registration finishes, and not changed after
+		if !client.registered() {
+			description += ", still registering"
+		} else if client.clientName != "" {
+			description += ", playback as " + client.clientName
+		}
+		if client == cc {
+			description += " (you)"
+		}
+		cc.sendFromInternalUser(description)
+	}
+}
+
+// handleSetCommand shows or changes the client's settings, given the option and value
+func (cc *clientConnection) handleSetCommand(args []string) {
+	if len(args) == 0 {
+		for _, option := range []string{"dcc", "coalesce", "splitmarker"} {
+			cc.handleSetCommand([]string{option})
+		}
+		return
+	}
+
+	option := strings.ToLower(args[0])
+	value := strings.Join(args[1:], " ")
+	switch option {
+	case "dcc":
+		if value == "" {
+			cc.sendFromInternalUser(fmt.Sprintf("dcc: offers of shared files are %s, use: dcc on|off", onOff(cc.wantsDCCOffers())))
+			return
+		} else if value != "on" && value != "off" {
+			cc.sendFromInternalUser("use: dcc on|off")
+			return
+		}
+		cc.setDCCOffers(value == "on")
+		cc.sendFromInternalUser("DCC offers of shared files are now " + value)
+
+	case "coalesce":
+		if value == "" {
+			window := "off"
+			if cc.coalescer != nil {
+				window = cc.coalescer.window.String()
+			}
+			cc.sendFromInternalUser(fmt.Sprintf("coalesce: lines sent within %s are joined, use: set coalesce <duration>|off", window))
+			return
+		}
+
+		var window time.Duration
+		if value != "off" {
+			var err error
+			if window, err = time.ParseDuration(value); err != nil || window <= 0 {
+				cc.sendFromInternalUser("use: set coalesce <duration>|off, e.g. 500ms")
+				return
+			}
+		}
+		cc.setCoalesceWindow(window)
+		cc.sendFromInternalUser("coalescing lines is now " + value)
+
+	case "splitmarker":
+		cc.Lock()
+		marker := cc.splitMarker
+		cc.Unlock()
+		if value == "" {
+			if marker == "" {
+				marker = "off"
+			}
+			cc.sendFromInternalUser(fmt.Sprintf("splitmarker: split messages are marked with %s, use: set splitmarker <text>|off", marker))
+			return
+		}
+
+		marker = value
+		if value == "off" {
+			marker = ""
+		} else if len(marker) > maxSplitMarkerLength {
+			cc.sendFromInternalUser(fmt.Sprintf("the split marker can be at most %d bytes long", maxSplitMarkerLength))
+			return
+		}
+		cc.Lock()
+		cc.splitMarker = marker
+		cc.Unlock()
+		cc.sendFromInternalUser("the split marker is now " + value)
+
+	default:
+		cc.sendFromInternalUser(fmt.Sprintf("unknown option %q, try: dcc, coalesce, splitmarker", args[0]))
+	}
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// sinceRounded is how long ago a time was, to the second
+func sinceRounded(t time.Time) time.Duration {
+	return time.Since(t).Round(time.Second)
+}
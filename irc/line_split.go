@@ -0,0 +1,260 @@
+package irc
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Maximum length of an IRC line, including the trailing CRLF
+const maxLineLength = 512
+
+// Below this many bytes of room for text, splitting would only make things worse
+const minSplitLength = 32
+
+// Longest split marker a client can set, so the marker doesn't crowd out the text it marks
+const maxSplitMarkerLength = 16
+
+// A pair of bold codes, which cancel out, to end a color code before text which would otherwise be read as
+// part of it
+const cancellingFormatting = "\x02\x02"
+
+// IRC formatting control codes
+const (
+	formatBold          = '\x02'
+	formatColor         = '\x03'
+	formatHexColor      = '\x04'
+	formatReset         = '\x0f'
+	formatMonospace     = '\x11'
+	formatReverse       = '\x16'
+	formatItalic        = '\x1d'
+	formatStrikethrough = '\x1e'
+	formatUnderline     = '\x1f'
+)
+
+// splitLongMessage splits a PRIVMSG or NOTICE which doesn't fit on one IRC line into several. Lines of a
+// multiline batch are continued with draft/multiline-concat, so the client can put them back together.
+// Other lines end with the client's continuation marker.
+func (cc *clientConnection) splitLongMessage(m *Message) []*Message {
+	if (m.Cmd != PrivmsgCmd && m.Cmd != NoticeCmd) || len(m.Params) != 2 {
+		return []*Message{m}
+	}
+
+	unwrapped, inMultiline := cc.multilineBatches[m.Tags["batch"]]
+	concat := inMultiline && !unwrapped
+	cc.Lock()
+	marker := cc.splitMarker
+	cc.Unlock()
+	if concat {
+		marker = ""
+	}
+
+	// Tags are counted too. IRCv3 gives them a budget of their own, but not every client gets that right.
+	withoutText := *m
+	withoutText.Params = []string{m.Params[0], ""}
+	if concat {
+		withoutText.Tags = withTag(m.Tags, multilineConcatTag, "")
+	}
+	budget := maxLineLength - len(withoutText.String()) - len("\r\n")
+
+	pieces := splitText(m.Params[1], budget, marker)
+	if len(pieces) == 1 {
+		return []*Message{m}
+	}
+
+	messages := make([]*Message, len(pieces))
+	for i, piece := range pieces {
+		line := *m
+		line.Params = []string{m.Params[0], piece}
+		if i > 0 {
+			// Only the first line keeps the message ID, so each ID stays unique
+			line.Tags = make(map[string]string)
+			for key, value := range m.Tags {
+				if key != "msgid" {
+					line.Tags[key] = value
+				}
+			}
+			if concat {
+				line.Tags[multilineConcatTag] = ""
+			}
+		}
+		messages[i] = &line
+	}
+	return messages
+}
+
+// splitText splits text into pieces of at most max bytes, preferring to break between words. UTF-8
+// sequences and formatting codes are never broken, and formatting still active at the end of a piece is
+// reapplied at the start of the next. Every piece but the last ends with marker.
+func splitText(text string, max int, marker string) []string {
+	if len(text) <= max || max < minSplitLength {
+		return []string{text}
+	}
+
+	// A marker which could be read as part of a color code needs room to be kept apart from one
+	markerLength := len(marker)
+	if marker != "" && (isHexDigit(marker[0]) || marker[0] == ',') {
+		markerLength += len(cancellingFormatting)
+	}
+
+	var pieces []string
+	var carry string
+	for len(carry)+len(text) > max {
+		limit := max - len(carry) - markerLength
+		if limit < minSplitLength/2 {
+			// Too much formatting to carry over, so start the next piece plain
+			carry = ""
+			if len(text) <= max {
+				break
+			}
+			limit = max - markerLength
+		}
+
+		// Every piece has to take something from text, and leave something for the next
+		if limit > len(text)-1 {
+			limit = len(text) - 1
+		}
+		if limit < 1 {
+			limit = 1
+		}
+
+		cut := splitPoint(text, limit)
+		piece := strings.TrimRight(text[:cut], " ")
+		if continuesFormatting(piece, marker) {
+			// The marker would be read as part of the color code ending the piece
+			piece += cancellingFormatting
+		}
+		pieces = append(pieces, carry+piece+marker)
+
+		carry = activeFormatting(carry + text[:cut])
+		text = strings.TrimLeft(text[cut:], " ")
+		if continuesFormatting(carry, text) {
+			carry += cancellingFormatting
+		}
+	}
+	return append(pieces, carry+text)
+}
+
+// continuesFormatting reports whether the formatting code at the end of s would run on into next, as when a
+// color code is followed by digits
+func continuesFormatting(s, next string) bool {
+	_, inside := formattingCodeAt(s+next, len(s))
+	return inside
+}
+
+// splitPoint returns where to split text so the first part is at most limit bytes. limit must be less than
+// the length of text.
+func splitPoint(text string, limit int) int {
+	// Break at the last space, unless that leaves a very short piece
+	if space := strings.LastIndexByte(text[:limit+1], ' '); space > limit/2 {
+		return space
+	}
+
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	if start, inside := formattingCodeAt(text, cut); inside {
+		cut = start
+	}
+	if cut == 0 {
+		// A single code or character longer than the limit, which can't happen with a sane limit
+		cut = limit
+	}
+	return cut
+}
+
+// formattingCodeLength returns the length of the formatting code at the start of s, or 0 if there isn't one
+func formattingCodeLength(s string) int {
+	if s == "" {
+		return 0
+	}
+
+	switch s[0] {
+	case formatBold, formatReset, formatMonospace, formatReverse, formatItalic, formatStrikethrough, formatUnderline:
+		return 1
+
+	case formatColor:
+		n := 1 + countPrefix(s[1:], isDigit, 2)
+		if n > 1 && n < len(s) && s[n] == ',' {
+			if background := countPrefix(s[n+1:], isDigit, 2); background > 0 {
+				n += 1 + background
+			}
+		}
+		return n
+
+	case formatHexColor:
+		n := 1 + countPrefix(s[1:], isHexDigit, 6)
+		if n == 7 && n < len(s) && s[n] == ',' {
+			if countPrefix(s[n+1:], isHexDigit, 6) == 6 {
+				n += 7
+			}
+		}
+		return n
+	}
+	return 0
+}
+
+// formattingCodeAt returns the start of the formatting code containing position i of s, if i falls inside one
+func formattingCodeAt(s string, i int) (int, bool) {
+	for pos := 0; pos < i; pos++ {
+		if n := formattingCodeLength(s[pos:]); n > 0 {
+			if i < pos+n {
+				return pos, true
+			}
+			pos += n - 1
+		}
+	}
+	return 0, false
+}
+
+// activeFormatting returns the formatting codes needed to restore the formatting in effect at the end of s
+func activeFormatting(s string) string {
+	toggles := make(map[byte]bool)
+	var color string
+	for pos := 0; pos < len(s); pos++ {
+		n := formattingCodeLength(s[pos:])
+		if n == 0 {
+			continue
+		}
+
+		switch code := s[pos]; code {
+		case formatReset:
+			toggles = make(map[byte]bool)
+			color = ""
+		case formatColor, formatHexColor:
+			// A color code without a color resets it
+			color = ""
+			if n > 1 {
+				color = s[pos : pos+n]
+			}
+		default:
+			toggles[code] = !toggles[code]
+		}
+		pos += n - 1
+	}
+
+	var b strings.Builder
+	for _, code := range []byte{formatBold, formatItalic, formatUnderline, formatStrikethrough, formatMonospace, formatReverse} {
+		if toggles[code] {
+			b.WriteByte(code)
+		}
+	}
+	b.WriteString(color)
+	return b.String()
+}
+
+func countPrefix(s string, match func(byte) bool, max int) int {
+	n := 0
+	for n < len(s) && n < max && match(s[n]) {
+		n++
+	}
+	return n
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
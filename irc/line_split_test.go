@@ -0,0 +1,165 @@
+package irc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		max    int
+		marker string
+		want   []string
+	}{
+		{"fits", "short enough", 40, "", []string{"short enough"}},
+		{
+			"words",
+			"the quick brown fox jumps over the lazy dog and keeps on running",
+			40, "",
+			[]string{"the quick brown fox jumps over the lazy", "dog and keeps on running"},
+		},
+		{
+			"marker",
+			"the quick brown fox jumps over the lazy dog and keeps on running",
+			40, "…",
+			[]string{"the quick brown fox jumps over the…", "lazy dog and keeps on running"},
+		},
+		{
+			"no spaces",
+			strings.Repeat("a", 50),
+			40, "",
+			[]string{strings.Repeat("a", 40), strings.Repeat("a", 10)},
+		},
+		{
+			"utf-8",
+			strings.Repeat("あ", 20),
+			40, "",
+			[]string{strings.Repeat("あ", 13), strings.Repeat("あ", 7)},
+		},
+		{
+			"formatting carried over",
+			"\x02bold \x0304,12red words that keep going well past the line limit",
+			40, "",
+			[]string{"\x02bold \x0304,12red words that keep going", "\x02\x0304,12well past the line limit"},
+		},
+		{
+			"color code not broken",
+			strings.Repeat("a", 38) + "\x0304,12red",
+			40, "",
+			[]string{strings.Repeat("a", 38), "\x0304,12red"},
+		},
+		{
+			"too much formatting to carry over",
+			"\x02\x1d\x1f\x1e\x11\x16\x04FFFFFF,000000" + strings.Repeat("a", 34),
+			39, "[continued]",
+			[]string{"\x02\x1d\x1f\x1e\x11\x16\x04FFFFFF,000000aaaaaaaa[continued]", strings.Repeat("a", 26)},
+		},
+		{
+			"too much formatting to carry over, twice",
+			"\x02\x1d\x1f\x1e\x11\x16\x04FFFFFF,000000" + strings.Repeat("a", 80),
+			39, "[continued]",
+			[]string{
+				"\x02\x1d\x1f\x1e\x11\x16\x04FFFFFF,000000aaaaaaaa[continued]",
+				strings.Repeat("a", 28) + "[continued]",
+				strings.Repeat("a", 28) + "[continued]",
+				strings.Repeat("a", 16),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitText(tt.text, tt.max, tt.marker)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitText() = %q, want %q", got, tt.want)
+			}
+			for _, piece := range got {
+				if len(piece) > tt.max || !utf8.ValidString(piece) {
+					t.Errorf("splitText() piece %q is too long or invalid UTF-8", piece)
+				}
+			}
+		})
+	}
+}
+
+// stripFormatting removes formatting codes and spaces from s, leaving just the text which splitText must
+// keep intact
+func stripFormatting(s string) string {
+	var b strings.Builder
+	for pos := 0; pos < len(s); pos++ {
+		if n := formattingCodeLength(s[pos:]); n > 0 {
+			pos += n - 1
+		} else if s[pos] != ' ' {
+			b.WriteByte(s[pos])
+		}
+	}
+	return b.String()
+}
+
+func FuzzSplitText(f *testing.F) {
+	f.Add("the quick brown fox jumps over the lazy dog and keeps on running", 40, "…")
+	f.Add("\x02\x1d\x1f\x1e\x11\x16\x04FFFFFF,000000"+strings.Repeat("a", 25), 39, "[continued]")
+	f.Add(strings.Repeat("\x02\x1d\x1f\x1e\x11\x16\x04FFFFFF,000000word ", 20), 32, "[continued]")
+	f.Add(strings.Repeat("\x0304,12あ\x0f", 30), 33, "…")
+	f.Add(strings.Repeat("\x04ABCDEF", 40), 45, "")
+
+	f.Fuzz(func(t *testing.T, text string, max int, marker string) {
+		// Budgets are most of an IRC line, and markers a small part of that
+		if max < minSplitLength || max > maxLineLength || len(marker) > max/2 || !utf8.ValidString(marker) ||
+			strings.ContainsAny(marker, " \x02\x03\x04\x0f\x11\x16\x1d\x1e\x1f") || !utf8.ValidString(text) {
+			t.Skip()
+		}
+
+		pieces := splitText(text, max, marker)
+		var joined strings.Builder
+		for i, piece := range pieces {
+			if len(piece) > max || !utf8.ValidString(piece) {
+				t.Errorf("splitText() piece %q is too long or invalid UTF-8", piece)
+			}
+			if i < len(pieces)-1 {
+				piece = strings.TrimSuffix(piece, marker)
+			}
+			joined.WriteString(piece)
+		}
+		if got, want := stripFormatting(joined.String()), stripFormatting(text); got != want {
+			t.Errorf("splitText() pieces = %q, which lose text", pieces)
+		}
+	})
+}
+
+func TestSplitLongMessage(t *testing.T) {
+	cc := &clientConnection{config: &Config{}, multilineBatches: map[string]bool{"ml1": false}}
+	from := User{Nick: "kedo", Ident: "kedo", Host: "localhost"}
+	text := strings.Repeat("word ", 200)
+
+	for _, batched := range []bool{false, true} {
+		p := &Privmsg{From: from, Target: "#chatter", Message: text, Tags: map[string]string{"msgid": "1.0"}}
+		if batched {
+			p.Tags["batch"] = "ml1"
+		}
+
+		lines := cc.splitLongMessage(p.ToMessage())
+		if len(lines) < 3 {
+			t.Fatalf("clientConnection.splitLongMessage() = %d lines, want the message split", len(lines))
+		}
+		for i, line := range lines {
+			if len(line.String())+2 > maxLineLength {
+				t.Errorf("clientConnection.splitLongMessage() line %d is %d bytes", i, len(line.String())+2)
+			}
+			if _, found := line.Tags["msgid"]; found != (i == 0) {
+				t.Errorf("clientConnection.splitLongMessage() line %d msgid = %v", i, line.Tags["msgid"])
+			}
+			if _, found := line.Tags[multilineConcatTag]; found != (batched && i > 0) {
+				t.Errorf("clientConnection.splitLongMessage() line %d concat = %v, batched %v", i, found, batched)
+			}
+		}
+	}
+
+	short := (&Privmsg{From: from, Target: "#chatter", Message: "hi"}).ToMessage()
+	if got := cc.splitLongMessage(short); len(got) != 1 || got[0] != short {
+		t.Errorf("clientConnection.splitLongMessage() split a short message: %v", got)
+	}
+}
@@ -0,0 +1,43 @@
+package irc
+
+import (
+	"fmt"
+	"time"
+)
+
+// MentionsChannel is the virtual channel collecting messages which mention us from every channel
+const MentionsChannel = "&mentions"
+
+// joinMentionsChannel joins the client to &mentions. Nobody else is ever in it.
+func (cc *clientConnection) joinMentionsChannel() {
+	cc.Lock()
+	cc.joinedChans[MentionsChannel] = struct{}{}
+	cc.Unlock()
+
+	cc.sendChannelJoinedResponse(MentionsChannel, ChannelTopic{
+		Topic: "Messages mentioning you, from every channel",
+		SetBy: tanyaInternalUser.Nick,
+		SetAt: time.Now(),
+	}, []User{cc.clientUser})
+}
+
+// HandleMention copies a message mentioning us into &mentions, prefixed with the channel it was sent to.
+func (s *Server) HandleMention(p *Privmsg) {
+	mention := &Privmsg{
+		From:    p.From,
+		Target:  MentionsChannel,
+		Message: fmt.Sprintf("[%s] %s", p.Target, p.Message),
+	}
+	if serverTime, found := p.Tags["time"]; found {
+		mention.Tags = map[string]string{"time": serverTime}
+	}
+	message := mention.ToMessage()
+
+	s.RLock()
+	for _, v := range s.clientConnections {
+		if v.isJoined(MentionsChannel) {
+			v.outgoingMessages <- message
+		}
+	}
+	s.RUnlock()
+}
@@ -14,6 +14,7 @@ const (
 	UserCmd
 
 	PrivmsgCmd
+	NoticeCmd
 	JoinCmd
 	PartCmd
 	ModeCmd
@@ -24,6 +25,14 @@ const (
 	PingCmd
 	PongCmd
 
+	CapCmd
+	PassCmd
+	RenameCmd
+	BatchCmd
+	ChatHistoryCmd
+	FailCmd
+	MarkReadCmd
+
 	NumericReplyCmd
 )
 
@@ -32,6 +41,9 @@ type Message struct {
 	Prefix string
 	Cmd    Command
 	Params []string
+
+	// IRCv3 message tags, only sent to clients which have negotiated them
+	Tags map[string]string
 }
 
 var cmdToStrMap = map[Command]string{
@@ -39,6 +51,7 @@ var cmdToStrMap = map[Command]string{
 	UserCmd: "USER",
 
 	PrivmsgCmd: "PRIVMSG",
+	NoticeCmd:  "NOTICE",
 	JoinCmd:    "JOIN",
 	PartCmd:    "PART",
 	ModeCmd:    "MODE",
@@ -49,6 +62,15 @@ var cmdToStrMap = map[Command]string{
 	PingCmd: "PING",
 	PongCmd: "PONG",
 
+	CapCmd:    "CAP",
+	PassCmd:   "PASS",
+	RenameCmd: "RENAME",
+	BatchCmd:  "BATCH",
+
+	ChatHistoryCmd: "CHATHISTORY",
+	FailCmd:        "FAIL",
+	MarkReadCmd:    "MARKREAD",
+
 	NumericReplyCmd: "",
 }
 
@@ -59,6 +81,12 @@ func (m *Message) String() string {
 	}
 	var b strings.Builder
 
+	if len(m.Tags) > 0 {
+		b.WriteString("@")
+		b.WriteString(formatTags(m.Tags))
+		b.WriteString(" ")
+	}
+
 	messageHasPrefix := m.Prefix != ""
 	if messageHasPrefix {
 		b.WriteString(":")
@@ -74,7 +102,7 @@ func (m *Message) String() string {
 
 	for i, p := range m.Params {
 		b.WriteString(" ")
-		if i == len(m.Params)-1 && (strings.ContainsRune(p, ' ') || (len(p) > 0 && p[0] == ':')) {
+		if i == len(m.Params)-1 && (len(p) == 0 || strings.ContainsRune(p, ' ') || p[0] == ':') {
 			b.WriteString(":")
 		}
 		b.WriteString(p)
@@ -99,6 +127,16 @@ var ErrMalformedIRCMessage = errors.New("malformed IRC message")
 // StringToMessage takes a string with a line of input
 // and returns a Message corresponding to the line
 func StringToMessage(str string) (*Message, error) {
+	var tags map[string]string
+	if len(str) > 0 && str[0] == '@' {
+		tagsAndRest := strings.SplitN(str, " ", 2)
+		if len(tagsAndRest) < 2 {
+			return nil, ErrMalformedIRCMessage
+		}
+		tags = parseTags(tagsAndRest[0][1:])
+		str = strings.TrimLeft(tagsAndRest[1], " ")
+	}
+
 	splitStr := strings.Split(str, " ")
 
 	var cmdStr string
@@ -131,43 +169,68 @@ func StringToMessage(str string) (*Message, error) {
 		if len(params) < 4 {
 			return nil, ErrNeedMoreParams("USER")
 		}
-		return &Message{prefix, UserCmd, params}, nil
+		return &Message{prefix, UserCmd, params, tags}, nil
 	case "NICK":
 		if len(params) < 1 {
 			return nil, ErrNeedMoreParams("NICK")
 		}
-		return &Message{prefix, NickCmd, params}, nil
+		return &Message{prefix, NickCmd, params, tags}, nil
 	case "PRIVMSG":
 		if len(params) < 1 {
 			return nil, ErrNeedMoreParams("PRIVMSG")
 		}
-		return &Message{prefix, PrivmsgCmd, params}, nil
+		return &Message{prefix, PrivmsgCmd, params, tags}, nil
 	case "JOIN":
 		if len(params) < 1 {
 			return nil, ErrNeedMoreParams("JOIN")
 		}
-		return &Message{prefix, JoinCmd, params}, nil
+		return &Message{prefix, JoinCmd, params, tags}, nil
 	case "PART":
 		if len(params) < 1 {
 			return nil, ErrNeedMoreParams("PART")
 		}
-		return &Message{prefix, PartCmd, params}, nil
+		return &Message{prefix, PartCmd, params, tags}, nil
 	case "MODE":
-		return &Message{prefix, ModeCmd, params}, nil
+		return &Message{prefix, ModeCmd, params, tags}, nil
 	case "TOPIC":
 		if len(params) < 1 {
 			return nil, ErrNeedMoreParams("TOPIC")
 		}
-		return &Message{prefix, TopicCmd, params}, nil
+		return &Message{prefix, TopicCmd, params, tags}, nil
 	case "WHO":
-		return &Message{prefix, WhoCmd, params}, nil
+		return &Message{prefix, WhoCmd, params, tags}, nil
 	case "WHOIS":
 		if len(params) < 1 {
 			return nil, ErrNeedMoreParams("WHOIS")
 		}
-		return &Message{prefix, WhoisCmd, params}, nil
+		return &Message{prefix, WhoisCmd, params, tags}, nil
 	case "PING":
-		return &Message{prefix, PingCmd, params}, nil
+		return &Message{prefix, PingCmd, params, tags}, nil
+	case "PASS":
+		if len(params) < 1 {
+			return nil, ErrNeedMoreParams("PASS")
+		}
+		return &Message{prefix, PassCmd, params, tags}, nil
+	case "CAP":
+		if len(params) < 1 {
+			return nil, ErrNeedMoreParams("CAP")
+		}
+		return &Message{prefix, CapCmd, params, tags}, nil
+	case "CHATHISTORY":
+		if len(params) < 1 {
+			return nil, ErrNeedMoreParams("CHATHISTORY")
+		}
+		return &Message{prefix, ChatHistoryCmd, params, tags}, nil
+	case "MARKREAD":
+		if len(params) < 1 {
+			return nil, ErrNeedMoreParams("MARKREAD")
+		}
+		return &Message{prefix, MarkReadCmd, params, tags}, nil
+	case "BATCH":
+		if len(params) < 1 {
+			return nil, ErrNeedMoreParams("BATCH")
+		}
+		return &Message{prefix, BatchCmd, params, tags}, nil
 	default:
 		return nil, ErrUnknownCommand(cmdStr)
 	}
@@ -123,3 +123,51 @@ func TestStringToMessageWhois(t *testing.T) {
 		t.Error("Could not parse 'WHOIS a' as Whois command")
 	}
 }
+
+func TestMessageToStringEmptyTrailing(t *testing.T) {
+	expected := ":szi!szi@localhost PART #chatter :"
+	m := Message{
+		Prefix: "szi!szi@localhost",
+		Cmd:    PartCmd,
+		Params: []string{"#chatter", ""},
+	}
+	s := m.String()
+	if s != expected {
+		t.Error(
+			"Did not stringify empty trailing param properly",
+			"Got: [", s, "]",
+			"Expected: [", expected, "]",
+		)
+	}
+}
+
+func TestStringToMessageCap(t *testing.T) {
+	msg, err := StringToMessage("CAP REQ :draft/channel-rename")
+	if err != nil {
+		t.Error(err)
+	}
+	if msg.Cmd != CapCmd {
+		t.Error("Could not parse 'CAP REQ' as Cap command")
+	}
+
+	expectedParams := []string{"REQ", "draft/channel-rename"}
+	if !reflect.DeepEqual(msg.Params, expectedParams) {
+		t.Errorf("Parsed message params = %v, wanted %v", msg.Params, expectedParams)
+	}
+}
+
+func TestMessageTagsRoundTrip(t *testing.T) {
+	line := `@time=2019-01-02T03:04:05.000Z;x=a\sb\:c PRIVMSG #chatter :hello there`
+	msg, err := StringToMessage(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedTags := map[string]string{"time": "2019-01-02T03:04:05.000Z", "x": "a b;c"}
+	if !reflect.DeepEqual(msg.Tags, expectedTags) {
+		t.Errorf("Parsed message tags = %v, wanted %v", msg.Tags, expectedTags)
+	}
+	if got := msg.String(); got != line {
+		t.Errorf("Message.String() = %q, wanted %q", got, line)
+	}
+}
@@ -0,0 +1,266 @@
+package irc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MultilineBatchType is the batch type of IRCv3 draft/multiline messages
+const MultilineBatchType = "draft/multiline"
+
+// Limits on multiline batches from clients, advertised as the value of the draft/multiline capability
+const (
+	multilineMaxBytes = 40000
+	multilineMaxLines = 100
+)
+
+// Tag marking a line of a multiline batch which continues the previous line, rather than starting a new one
+const multilineConcatTag = "draft/multiline-concat"
+
+// Batch IDs of multiline batches are shared by every client, so they're numbered server-wide
+var multilineBatchCount uint64
+
+// MultilineMessages turns the lines of a message into a draft/multiline batch. Clients without the
+// capability receive the lines as separate messages. A single line is sent as is.
+func MultilineMessages(lines []*Privmsg) []*Message {
+	if len(lines) == 1 {
+		return []*Message{lines[0].ToMessage()}
+	}
+
+	batchID := fmt.Sprintf("multiline%d", atomic.AddUint64(&multilineBatchCount, 1))
+	from := lines[0].From.String()
+
+	// The batch carries the time and ID of the message as a whole
+	start := (&Batch{ServerName: from, ID: batchID, Type: MultilineBatchType, Params: []string{lines[0].Target}}).ToMessage()
+	for _, tag := range []string{"time", "msgid"} {
+		if value, found := lines[0].Tags[tag]; found {
+			start.Tags = withTag(start.Tags, tag, value)
+		}
+	}
+
+	messages := []*Message{start}
+	for _, line := range lines {
+		m := line.ToMessage()
+		m.Tags = withTag(m.Tags, "batch", batchID)
+		messages = append(messages, m)
+	}
+	return append(messages, (&Batch{ServerName: from, ID: batchID}).ToMessage())
+}
+
+// relayMessages turns a message from one client into the messages relayed to the others. Multi-line
+// messages are split back into lines, batched in channels. In DMs the lines are rewritten for each
+// client, so they're sent unbatched.
+func relayMessages(msg Messagable) []*Message {
+	p, ok := msg.(*Privmsg)
+	if !ok || !strings.Contains(p.Message, "\n") {
+		return []*Message{msg.ToMessage()}
+	}
+
+	var lines []*Privmsg
+	for _, line := range strings.Split(p.Message, "\n") {
+		if line != "" {
+			lines = append(lines, &Privmsg{From: p.From, Target: p.Target, Message: line})
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	if p.IsTargetChannel() {
+		return MultilineMessages(lines)
+	}
+
+	var messages []*Message
+	for _, line := range lines {
+		messages = append(messages, line.ToMessage())
+	}
+	return messages
+}
+
+// unwrapMultiline drops the BATCH commands of multiline batches the client can't receive, leaving
+// their lines as separate messages. It returns nil if the message shouldn't be sent.
+func (cc *clientConnection) unwrapMultiline(m *Message) *Message {
+	if m.Cmd == BatchCmd && len(m.Params) > 0 {
+		batchID := m.Params[0][1:]
+		if strings.HasPrefix(m.Params[0], "+") {
+			if len(m.Params) > 1 && m.Params[1] == MultilineBatchType {
+				unwrapped := !(cc.hasCap(CapMultiline) && cc.hasCap(CapBatch))
+				cc.multilineBatches[batchID] = unwrapped
+				if unwrapped {
+					return nil
+				}
+			}
+		} else if unwrapped, found := cc.multilineBatches[batchID]; found {
+			delete(cc.multilineBatches, batchID)
+			if unwrapped {
+				return nil
+			}
+		}
+		return m
+	}
+
+	if !cc.multilineBatches[m.Tags["batch"]] {
+		return m
+	}
+
+	unwrapped := *m
+	unwrapped.Tags = make(map[string]string)
+	for key, value := range m.Tags {
+		if key != "batch" {
+			unwrapped.Tags[key] = value
+		}
+	}
+	return &unwrapped
+}
+
+// incomingMultiline collects the lines of a multiline batch sent by the client
+type incomingMultiline struct {
+	target string
+	lines  []string
+	bytes  int
+}
+
+// handleBatchCommand handles a client opening or closing a multiline batch. Once closed, the batch
+// is sent to Slack as one message.
+func (cc *clientConnection) handleBatchCommand(msg *Message) {
+	if len(msg.Params) < 1 || len(msg.Params[0]) < 2 {
+		cc.outgoingMessages <- cc.reply(*ErrNeedMoreParams("BATCH"))
+		return
+	}
+
+	batchID := msg.Params[0][1:]
+	fail := func(code, description string) {
+		delete(cc.incomingBatches, batchID)
+		cc.outgoingMessages <- (&Fail{
+			ServerName:  cc.config.ServerName,
+			Command:     "BATCH",
+			Code:        code,
+			Description: description,
+		}).ToMessage()
+	}
+
+	switch msg.Params[0][0] {
+	case '+':
+		if len(msg.Params) < 3 || msg.Params[1] != MultilineBatchType || !cc.hasCap(CapMultiline) {
+			fail("INVALID_PARAMS", "Only draft/multiline batches are supported")
+			return
+		}
+		if msg.Params[2] == MentionsChannel || msg.Params[2] == SearchChannel {
+			fail("MULTILINE_INVALID_TARGET", "Cannot send to "+msg.Params[2])
+			return
+		}
+		cc.incomingBatches[batchID] = &incomingMultiline{target: msg.Params[2]}
+
+	case '-':
+		batch, found := cc.incomingBatches[batchID]
+		if !found {
+			fail("MULTILINE_INVALID", "No such batch")
+			return
+		}
+		delete(cc.incomingBatches, batchID)
+
+		if message := strings.Join(batch.lines, "\n"); strings.TrimSpace(message) != "" {
+			cc.forwardPrivmsg(&Privmsg{Target: batch.target, Message: message})
+		}
+
+	default:
+		fail("INVALID_PARAMS", "Invalid batch reference tag")
+	}
+}
+
+// addToMultilineBatch adds a line sent by the client to the multiline batch it's part of
+func (cc *clientConnection) addToMultilineBatch(batchID string, msg *Message) {
+	batch, found := cc.incomingBatches[batchID]
+	if !found {
+		return
+	}
+
+	fail := func(code string, context []string, description string) {
+		delete(cc.incomingBatches, batchID)
+		cc.outgoingMessages <- (&Fail{
+			ServerName:  cc.config.ServerName,
+			Command:     "BATCH",
+			Code:        code,
+			Context:     context,
+			Description: description,
+		}).ToMessage()
+	}
+
+	if len(msg.Params) < 2 || msg.Params[0] != batch.target {
+		fail("MULTILINE_INVALID_TARGET", []string{batch.target}, "Lines of a batch must all have its target")
+		return
+	}
+
+	line := msg.Params[1]
+	if batch.bytes += len(line); batch.bytes > multilineMaxBytes {
+		fail("MULTILINE_MAX_BYTES", []string{strconv.Itoa(multilineMaxBytes)}, "Multiline batch max-bytes exceeded")
+		return
+	}
+
+	if _, concat := msg.Tags[multilineConcatTag]; concat && len(batch.lines) > 0 {
+		batch.lines[len(batch.lines)-1] += line
+		return
+	}
+	if len(batch.lines) >= multilineMaxLines {
+		fail("MULTILINE_MAX_LINES", []string{strconv.Itoa(multilineMaxLines)}, "Multiline batch max-lines exceeded")
+		return
+	}
+	batch.lines = append(batch.lines, line)
+}
+
+// lineCoalescer joins lines sent to the same target in quick succession, for clients which can't send
+// multiline batches. Once no line has arrived for the window, the lines are flushed as one message.
+type lineCoalescer struct {
+	window time.Duration
+	flush  func(target, message string)
+
+	pending map[string]*coalescedLines
+
+	sync.Mutex
+}
+
+type coalescedLines struct {
+	lines []string
+	timer *time.Timer
+}
+
+func newLineCoalescer(window time.Duration, flush func(target, message string)) *lineCoalescer {
+	return &lineCoalescer{
+		window:  window,
+		flush:   flush,
+		pending: make(map[string]*coalescedLines),
+	}
+}
+
+// Add queues a line for a target, pushing back the flush of any lines already queued for it
+func (lc *lineCoalescer) Add(target, line string) {
+	lc.Lock()
+	defer lc.Unlock()
+
+	pending, found := lc.pending[target]
+	if !found {
+		pending = &coalescedLines{}
+		pending.timer = time.AfterFunc(lc.window, func() { lc.flushTarget(target, pending) })
+		lc.pending[target] = pending
+	} else {
+		pending.timer.Reset(lc.window)
+	}
+	pending.lines = append(pending.lines, line)
+}
+
+func (lc *lineCoalescer) flushTarget(target string, pending *coalescedLines) {
+	lc.Lock()
+	if lc.pending[target] != pending {
+		// Already flushed, and the timer was reset after it fired
+		lc.Unlock()
+		return
+	}
+	delete(lc.pending, target)
+	lc.Unlock()
+
+	lc.flush(target, strings.Join(pending.lines, "\n"))
+}
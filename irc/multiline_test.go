@@ -0,0 +1,106 @@
+package irc
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultilineMessages(t *testing.T) {
+	kedo := User{Nick: "kedo", Ident: "kedo"}
+	lines := []*Privmsg{
+		{From: kedo, Target: "#chatter", Message: "one", Tags: map[string]string{"msgid": "1.0", "time": "now"}},
+		{From: kedo, Target: "#chatter", Message: "two", Tags: map[string]string{"msgid": "1.0-1", "time": "now"}},
+	}
+
+	messages := MultilineMessages(lines)
+	if len(messages) != 4 {
+		t.Fatalf("MultilineMessages() = %v, want a batch of two lines", messages)
+	}
+	if got := MultilineMessages(lines[:1]); len(got) != 1 || got[0].Cmd != PrivmsgCmd {
+		t.Errorf("MultilineMessages() batched a single line: %v", got)
+	}
+
+	start, end := messages[0], messages[3]
+	if start.Cmd != BatchCmd || start.Prefix != kedo.String() ||
+		!reflect.DeepEqual(start.Params[1:], []string{MultilineBatchType, "#chatter"}) ||
+		start.Tags["msgid"] != "1.0" || start.Tags["time"] != "now" {
+		t.Errorf("MultilineMessages() start = %v", start)
+	}
+	if end.Cmd != BatchCmd || end.Params[0] != "-"+start.Params[0][1:] {
+		t.Errorf("MultilineMessages() end = %v", end)
+	}
+	for _, m := range messages[1:3] {
+		if m.Tags["batch"] != start.Params[0][1:] {
+			t.Errorf("MultilineMessages() line %v is missing the batch tag", m)
+		}
+	}
+}
+
+func TestRelayMessages(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		text   string
+		want   []Command
+	}{
+		{"single line", "#chatter", "hello", []Command{PrivmsgCmd}},
+		{"channel", "#chatter", "one\n\ntwo", []Command{BatchCmd, PrivmsgCmd, PrivmsgCmd, BatchCmd}},
+		{"DM", "kedo", "one\ntwo", []Command{PrivmsgCmd, PrivmsgCmd}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Command
+			for _, m := range relayMessages(&Privmsg{Target: tt.target, Message: tt.text}) {
+				got = append(got, m.Cmd)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("relayMessages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnwrapMultiline(t *testing.T) {
+	cc := &clientConnection{caps: map[string]struct{}{CapBatch: {}}, multilineBatches: make(map[string]bool)}
+
+	var got []*Message
+	for _, m := range MultilineMessages([]*Privmsg{{Target: "#chatter", Message: "one"}, {Target: "#chatter", Message: "two"}}) {
+		if m = cc.unwrapMultiline(m); m != nil {
+			got = append(got, m)
+		}
+	}
+
+	if len(got) != 2 || len(cc.multilineBatches) != 0 {
+		t.Fatalf("clientConnection.unwrapMultiline() = %v, want the two lines", got)
+	}
+	for _, m := range got {
+		if _, found := m.Tags["batch"]; found || m.Cmd != PrivmsgCmd {
+			t.Errorf("clientConnection.unwrapMultiline() left %v batched", m)
+		}
+	}
+}
+
+func TestLineCoalescer(t *testing.T) {
+	var lock sync.Mutex
+	flushed := make(map[string]string)
+	done := make(chan struct{}, 2)
+	lc := newLineCoalescer(20*time.Millisecond, func(target, message string) {
+		lock.Lock()
+		flushed[target] = message
+		lock.Unlock()
+		done <- struct{}{}
+	})
+
+	lc.Add("#chatter", "one")
+	lc.Add("kedo", "hi")
+	lc.Add("#chatter", "two")
+	<-done
+	<-done
+
+	want := map[string]string{"#chatter": "one\ntwo", "kedo": "hi"}
+	if !reflect.DeepEqual(flushed, want) {
+		t.Errorf("lineCoalescer flushed %q, want %q", flushed, want)
+	}
+}
@@ -35,10 +35,12 @@ const (
 	RPL_MOTDSTART  NumericCommand = 375
 	RPL_ENDOFMOTD  NumericCommand = 376
 
-	ERR_NOSUCHNICK     NumericCommand = 401
-	ERR_NOSUCHCHANNEL  NumericCommand = 403
-	ERR_UNKNOWNCOMMAND NumericCommand = 421
-	ERR_NEEDMOREPARAMS NumericCommand = 461
+	ERR_NOSUCHNICK       NumericCommand = 401
+	ERR_NOSUCHCHANNEL    NumericCommand = 403
+	ERR_CANNOTSENDTOCHAN NumericCommand = 404
+	ERR_INVALIDCAPCMD    NumericCommand = 410
+	ERR_UNKNOWNCOMMAND   NumericCommand = 421
+	ERR_NEEDMOREPARAMS   NumericCommand = 461
 )
 
 // A NumericReply is a numbered reply generated by the server
@@ -199,6 +201,14 @@ func ErrNoSuchChannel(channelName string) *NumericReply {
 	}
 }
 
+// ErrCannotSendToChan is the numeric reply to a message sent to a channel which doesn't accept messages
+func ErrCannotSendToChan(channelName string) *NumericReply {
+	return &NumericReply{
+		Code:   ERR_CANNOTSENDTOCHAN,
+		Params: []string{channelName, "Cannot send to channel"},
+	}
+}
+
 // ErrUnknownCommand is the numeric reply to an unknown or invalid command
 func ErrUnknownCommand(command string) *NumericReply {
 	return &NumericReply{
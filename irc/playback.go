@@ -0,0 +1,235 @@
+package irc
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PlaybackEntry is a message held in the playback buffer
+type PlaybackEntry struct {
+	Seq     uint64
+	Time    time.Time
+	Privmsg Privmsg
+}
+
+// PlaybackBuffer is a ring buffer of recent channel and DM traffic. It remembers how far each
+// named client got, so that clients can be sent what they missed when they reconnect. Clients
+// without a name all share the position of the empty name.
+type PlaybackBuffer struct {
+	entries []PlaybackEntry
+	start   int
+	count   int
+	nextSeq uint64
+
+	// clients holds the last sequence number delivered to each client name
+	clients map[string]uint64
+
+	path  string
+	dirty bool
+
+	sync.Mutex
+}
+
+// playbackState is the on-disk representation of a playback buffer
+type playbackState struct {
+	NextSeq uint64
+	Entries []PlaybackEntry
+	Clients map[string]uint64
+}
+
+// NewPlaybackBuffer creates a playback buffer holding up to size messages. If path is set, the buffer
+// is loaded from and saved to that file.
+func NewPlaybackBuffer(size int, path string) (*PlaybackBuffer, error) {
+	pb := &PlaybackBuffer{
+		entries: make([]PlaybackEntry, size),
+		nextSeq: 1,
+		clients: make(map[string]uint64),
+		path:    path,
+	}
+	if path == "" {
+		return pb, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return pb, nil
+	} else if err != nil {
+		return pb, err
+	}
+
+	var state playbackState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return pb, err
+	}
+
+	pb.nextSeq = state.NextSeq
+	for _, entry := range state.Entries {
+		pb.push(entry)
+	}
+	for name, seq := range state.Clients {
+		pb.clients[name] = seq
+	}
+	return pb, nil
+}
+
+// push adds an entry, overwriting the oldest one if the buffer is full. Callers must hold the lock.
+func (pb *PlaybackBuffer) push(entry PlaybackEntry) {
+	if len(pb.entries) == 0 {
+		return
+	}
+
+	if pb.count < len(pb.entries) {
+		pb.entries[(pb.start+pb.count)%len(pb.entries)] = entry
+		pb.count++
+	} else {
+		pb.entries[pb.start] = entry
+		pb.start = (pb.start + 1) % len(pb.entries)
+	}
+}
+
+// Append adds a message sent at the given time to the buffer.
+func (pb *PlaybackBuffer) Append(p Privmsg, at time.Time) {
+	pb.Lock()
+	defer pb.Unlock()
+
+	// The time is stored separately and re-added on playback
+	var tags map[string]string
+	if msgID, found := p.Tags["msgid"]; found {
+		tags = map[string]string{"msgid": msgID}
+	}
+	p.Tags = tags
+	pb.push(PlaybackEntry{Seq: pb.nextSeq, Time: at, Privmsg: p})
+	pb.nextSeq++
+	pb.dirty = true
+}
+
+// Attach returns the messages a client missed since it was last attached, and marks everything
+// up to now as delivered. Clients we haven't seen before get the whole buffer.
+func (pb *PlaybackBuffer) Attach(clientName string) []PlaybackEntry {
+	pb.Lock()
+	defer pb.Unlock()
+
+	lastSeq := pb.clients[clientName]
+
+	var missed []PlaybackEntry
+	for i := 0; i < pb.count; i++ {
+		entry := pb.entries[(pb.start+i)%len(pb.entries)]
+		if entry.Seq > lastSeq {
+			missed = append(missed, entry)
+		}
+	}
+
+	pb.clients[clientName] = pb.nextSeq - 1
+	pb.dirty = true
+	return missed
+}
+
+// Detach records that a client has seen everything in the buffer up to now.
+func (pb *PlaybackBuffer) Detach(clientName string) {
+	pb.Lock()
+	defer pb.Unlock()
+
+	pb.clients[clientName] = pb.nextSeq - 1
+	pb.dirty = true
+}
+
+// Save writes the buffer to disk, if it is persisted and has changed since it was last saved.
+func (pb *PlaybackBuffer) Save() error {
+	pb.Lock()
+	if pb.path == "" || !pb.dirty {
+		pb.Unlock()
+		return nil
+	}
+
+	state := playbackState{
+		NextSeq: pb.nextSeq,
+		Entries: make([]PlaybackEntry, 0, pb.count),
+		Clients: make(map[string]uint64, len(pb.clients)),
+	}
+	for i := 0; i < pb.count; i++ {
+		state.Entries = append(state.Entries, pb.entries[(pb.start+i)%len(pb.entries)])
+	}
+	for name, seq := range pb.clients {
+		state.Clients[name] = seq
+	}
+	pb.dirty = false
+	pb.Unlock()
+
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash can't leave a truncated buffer behind
+	tmpPath := pb.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, pb.path)
+}
+
+// playbackTarget returns the channel or nick a buffered message belongs to from the client's point of view
+func playbackTarget(p *Privmsg) string {
+	if p.IsTargetChannel() || p.IsFromSelf() {
+		return p.Target
+	}
+	return p.From.Nick
+}
+
+// clientNameFromUsername splits a client name off of a username of the form "ident@client"
+func clientNameFromUsername(username string) string {
+	if i := strings.LastIndexByte(username, '@'); i >= 0 {
+		return username[i+1:]
+	}
+	return ""
+}
+
+// Format of the timestamp prepended to played back messages for clients without server-time
+const playbackTimePrefixFormat = "[15:04:05] "
+
+// sendPlayback sends a client the messages it missed. Clients supporting batch and server-time get one
+// chathistory batch per conversation, while others get the messages in order with the time in the text.
+func (cc *clientConnection) sendPlayback(entries []PlaybackEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	if !cc.hasCap(CapBatch) || !cc.hasCap(CapServerTime) {
+		for _, entry := range entries {
+			p := entry.Privmsg
+			if !cc.hasCap(CapServerTime) {
+				p.Message = entry.Time.Local().Format(playbackTimePrefixFormat) + p.Message
+			}
+			p.Tags = withTag(p.Tags, "time", ServerTime(entry.Time))
+			cc.outgoingMessages <- p.ToMessage()
+		}
+		return
+	}
+
+	var targets []string
+	entriesByTarget := make(map[string][]PlaybackEntry)
+	for _, entry := range entries {
+		target := playbackTarget(&entry.Privmsg)
+		if _, found := entriesByTarget[target]; !found {
+			targets = append(targets, target)
+		}
+		entriesByTarget[target] = append(entriesByTarget[target], entry)
+	}
+
+	for _, target := range targets {
+		batchID := cc.nextBatchID()
+		cc.sendBatchStart(batchID, "chathistory", target)
+
+		for _, entry := range entriesByTarget[target] {
+			p := entry.Privmsg
+			p.Tags = withTag(withTag(p.Tags, "time", ServerTime(entry.Time)), "batch", batchID)
+			cc.outgoingMessages <- p.ToMessage()
+		}
+
+		cc.sendBatchEnd(batchID)
+	}
+}
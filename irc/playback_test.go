@@ -0,0 +1,81 @@
+package irc
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func playbackMessages(entries []PlaybackEntry) []string {
+	var messages []string
+	for _, entry := range entries {
+		messages = append(messages, entry.Privmsg.Message)
+	}
+	return messages
+}
+
+func TestPlaybackBuffer(t *testing.T) {
+	pb, err := NewPlaybackBuffer(3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := User{Nick: "kedo", Ident: "U267NCD1U"}
+	for _, message := range []string{"one", "two", "three", "four"} {
+		pb.Append(Privmsg{From: from, Target: "#chatter", Message: message}, time.Now())
+	}
+
+	if got, want := playbackMessages(pb.Attach("laptop")), []string{"two", "three", "four"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PlaybackBuffer.Attach() for a new client = %v, want %v", got, want)
+	}
+	if got := pb.Attach("laptop"); len(got) != 0 {
+		t.Errorf("PlaybackBuffer.Attach() for an attached client = %v, want nothing", playbackMessages(got))
+	}
+
+	pb.Detach("laptop")
+	pb.Append(Privmsg{From: from, Target: "#chatter", Message: "five"}, time.Now())
+
+	if got, want := playbackMessages(pb.Attach("laptop")), []string{"five"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PlaybackBuffer.Attach() after reconnecting = %v, want %v", got, want)
+	}
+}
+
+func TestPlaybackBufferPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "playback.json")
+
+	pb, err := NewPlaybackBuffer(10, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb.Append(Privmsg{Target: "#chatter", Message: "one"}, time.Now())
+	pb.Detach("laptop")
+	pb.Append(Privmsg{Target: "#chatter", Message: "two"}, time.Now())
+	if err := pb.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewPlaybackBuffer(10, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := playbackMessages(loaded.Attach("laptop")), []string{"two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PlaybackBuffer.Attach() after reload = %v, want %v", got, want)
+	}
+	if got, want := playbackMessages(loaded.Attach("phone")), []string{"one", "two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PlaybackBuffer.Attach() for a new client after reload = %v, want %v", got, want)
+	}
+}
+
+func TestClientNameFromUsername(t *testing.T) {
+	tests := map[string]string{
+		"tanya":         "",
+		"tanya@laptop":  "laptop",
+		"tanya@a@phone": "phone",
+	}
+	for username, want := range tests {
+		if got := clientNameFromUsername(username); got != want {
+			t.Errorf("clientNameFromUsername(%q) = %q, want %q", username, got, want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package irc
+
+import (
+	"strings"
+	"time"
+)
+
+// MarkRead is a draft/read-marker MARKREAD message. A zero Timestamp means the read marker is unknown.
+type MarkRead struct {
+	ServerName string
+	Target     string
+	Timestamp  time.Time
+}
+
+// ToMessage turns a MarkRead into a Message
+func (m *MarkRead) ToMessage() *Message {
+	timestamp := "*"
+	if !m.Timestamp.IsZero() {
+		timestamp = "timestamp=" + ServerTime(m.Timestamp)
+	}
+
+	return &Message{
+		m.ServerName,
+		MarkReadCmd,
+		[]string{m.Target, timestamp},
+		nil,
+	}
+}
+
+// handleMarkReadCommand handles a client querying or moving a read marker. Updates are relayed to the
+// other clients, and the reply always carries the resulting marker, which never moves backwards.
+func (cc *clientConnection) handleMarkReadCommand(msg *Message) {
+	fail := func(code, description string) {
+		cc.outgoingMessages <- (&Fail{
+			ServerName:  cc.config.ServerName,
+			Command:     "MARKREAD",
+			Code:        code,
+			Context:     msg.Params[:1],
+			Description: description,
+		}).ToMessage()
+	}
+
+	target := msg.Params[0]
+	if len(target) > 0 && target[0] == '#' {
+		// Slack channel names are forcibly lowercased...RIP casemapping
+		target = strings.ToLower(target)
+	}
+
+	if len(msg.Params) < 2 {
+		cc.outgoingMessages <- (&MarkRead{
+			ServerName: cc.config.ServerName,
+			Target:     target,
+			Timestamp:  cc.stateProvider.GetReadMarker(target),
+		}).ToMessage()
+		return
+	}
+
+	value, found := strings.CutPrefix(msg.Params[1], "timestamp=")
+	if !found {
+		fail("INVALID_PARAMS", "Invalid timestamp")
+		return
+	}
+	timestamp, err := time.Parse(ServerTimeFormat, value)
+	if err != nil {
+		fail("INVALID_PARAMS", "Invalid timestamp")
+		return
+	}
+
+	marker, err := cc.stateProvider.SetReadMarker(target, timestamp)
+	if err != nil {
+		fail("INTERNAL_ERROR", "Could not update read marker")
+		return
+	}
+
+	markRead := &MarkRead{ServerName: cc.config.ServerName, Target: target, Timestamp: marker}
+	cc.outgoingMessages <- markRead.ToMessage()
+	cc.serverChan <- &ServerMessage{
+		message: markRead,
+		cAddr:   cc.conn.RemoteAddr(),
+	}
+}
+
+// sendReadMarker tells a client the read marker of a channel it joined, if it supports them
+func (cc *clientConnection) sendReadMarker(channelName string) {
+	if !cc.hasCap(CapReadMarker) {
+		return
+	}
+
+	cc.outgoingMessages <- (&MarkRead{
+		ServerName: cc.config.ServerName,
+		Target:     channelName,
+		Timestamp:  cc.stateProvider.GetReadMarker(channelName),
+	}).ToMessage()
+}
@@ -0,0 +1,587 @@
+package irc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long an IRC server has to accept a relay connection's registration
+	relayRegistrationTimeout = 30 * time.Second
+	// Longest wait between attempts to reconnect to the IRC network
+	relayMaxReconnectDelay = time.Minute
+	// How long the relay waits to rejoin a channel it's kicked from
+	relayRejoinDelay = 10 * time.Second
+	// Longest nick puppets are given, which most networks allow
+	relayMaxNickLength = 30
+	// Room left in each line for the prefix the IRC server adds to it
+	relayPrefixAllowance = 100
+	// Messages from Slack waiting to be relayed before more are dropped
+	relayQueueSize = 1000
+	// Lines waiting to be sent on a relay connection before sending more blocks
+	relaySendQueueSize = 100
+)
+
+var errRelayClosed = errors.New("relay connection closed")
+
+// PrivmsgSender is where a Relay sends messages from IRC
+type PrivmsgSender interface {
+	SendPrivmsg(privMsg *Privmsg) error
+}
+
+// Relay connects to an existing IRC network as a client, and relays messages between the Slack channels
+// and IRC channels it's configured with. Slack users are relayed either by the relay itself, with their
+// nick in each message, or each by a puppet connection of their own.
+type Relay struct {
+	config   *RelayConfig
+	stopChan <-chan struct{}
+	sender   PrivmsgSender
+
+	// Lowercased channel names, mapped to the channel they're relayed to on the other side
+	ircChannels      map[string]string
+	slackChannels    map[string]string
+	ignoreNicks      map[string]bool
+	ignoreSlackNicks map[string]bool
+
+	main *relayConn
+	// Puppet connections, by the Slack user's ident
+	puppets map[string]*relayConn
+	queue   chan *Privmsg
+
+	sync.Mutex
+}
+
+// NewRelay creates a relay, which relays messages from IRC to sender
+func NewRelay(config *RelayConfig, stopChan <-chan struct{}, sender PrivmsgSender) *Relay {
+	r := &Relay{
+		config:   config,
+		stopChan: stopChan,
+		sender:   sender,
+
+		ircChannels:      make(map[string]string),
+		slackChannels:    make(map[string]string),
+		ignoreNicks:      make(map[string]bool),
+		ignoreSlackNicks: make(map[string]bool),
+
+		puppets: make(map[string]*relayConn),
+		queue:   make(chan *Privmsg, relayQueueSize),
+	}
+	for slackChannel, ircChannel := range config.Channels {
+		if !strings.HasPrefix(slackChannel, "#") {
+			slackChannel = "#" + slackChannel
+		}
+		r.ircChannels[strings.ToLower(slackChannel)] = ircChannel
+		r.slackChannels[strings.ToLower(ircChannel)] = slackChannel
+	}
+	for _, nick := range config.IgnoreNicks {
+		r.ignoreNicks[strings.ToLower(nick)] = true
+	}
+	for _, nick := range config.IgnoreSlackNicks {
+		r.ignoreSlackNicks[strings.ToLower(nick)] = true
+	}
+	return r
+}
+
+func (r *Relay) tag() string {
+	return fmt.Sprintf("[%v]", r.config.Server)
+}
+
+// Run connects to the IRC network, reconnecting whenever the connection is lost, and relays messages
+// until stopChan is closed
+func (r *Relay) Run() {
+	go r.relayQueued()
+
+	delay := time.Second
+	for {
+		conn, err := dialRelay(r.config, r.config.Nick, r.config.RealName, r.handleLine)
+		if err != nil {
+			log.Printf("%s error while connecting relay: %v", r.tag(), err)
+			select {
+			case <-r.stopChan:
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, relayMaxReconnectDelay)
+			continue
+		}
+		delay = time.Second
+
+		log.Printf("%s relay connected as %v", r.tag(), conn.currentNick())
+		for _, ircChannel := range r.ircChannels {
+			conn.send("JOIN %s", ircChannel)
+		}
+		r.Lock()
+		r.main = conn
+		r.Unlock()
+
+		select {
+		case <-conn.closed:
+			log.Printf("%s relay disconnected, reconnecting", r.tag())
+		case <-r.stopChan:
+			r.Lock()
+			conns := []*relayConn{r.main}
+			for _, puppet := range r.puppets {
+				conns = append(conns, puppet)
+			}
+			r.Unlock()
+			for _, c := range conns {
+				c.quit("tanya shutting down")
+			}
+			return
+		}
+
+		r.Lock()
+		r.main = nil
+		r.Unlock()
+	}
+}
+
+// HandlePrivmsg relays a message from Slack to IRC, if it was sent to a relayed channel
+func (r *Relay) HandlePrivmsg(p *Privmsg) {
+	if _, found := r.ircChannels[strings.ToLower(p.Target)]; !found || r.ignoreSlackNicks[strings.ToLower(p.From.Nick)] {
+		return
+	}
+
+	select {
+	case r.queue <- p:
+	default:
+		log.Printf("%s relay queue full, dropping message to %v", r.tag(), p.Target)
+	}
+}
+
+// relayQueued relays messages from Slack in order, so waiting for a puppet to connect doesn't hold up
+// the Slack event loop
+func (r *Relay) relayQueued() {
+	for {
+		select {
+		case <-r.stopChan:
+			return
+		case p := <-r.queue:
+			r.relayToIRC(p)
+		}
+	}
+}
+
+func (r *Relay) relayToIRC(p *Privmsg) {
+	ircChannel := r.ircChannels[strings.ToLower(p.Target)]
+	nick := p.From.Nick
+	if mapped, found := r.config.Nicks[nick]; found {
+		nick = mapped
+	}
+
+	var conn *relayConn
+	var prefix string
+	if r.config.Puppets {
+		conn = r.puppet(p.From, nick, ircChannel)
+	}
+	if conn == nil {
+		r.Lock()
+		conn = r.main
+		r.Unlock()
+		if conn == nil {
+			log.Printf("%s relay not connected, dropping message to %v", r.tag(), ircChannel)
+			return
+		}
+		prefix = "<" + nick + "> "
+	}
+
+	budget := maxLineLength - len("PRIVMSG "+ircChannel+" :"+prefix+"\r\n") - relayPrefixAllowance
+	for _, line := range strings.Split(p.Message, "\n") {
+		line = strings.ReplaceAll(line, "\r", "")
+		if line == "" {
+			continue
+		}
+		for _, piece := range splitText(line, budget, "") {
+			if err := conn.send("PRIVMSG %s :%s%s", ircChannel, prefix, piece); err != nil {
+				log.Printf("%s error while relaying message to %v: %v", r.tag(), ircChannel, err)
+				return
+			}
+		}
+	}
+}
+
+// puppet returns the puppet connection for a Slack user, connecting it and joining it to ircChannel if
+// needed, or nil if it couldn't be connected
+func (r *Relay) puppet(from User, nick, ircChannel string) *relayConn {
+	r.Lock()
+	conn, found := r.puppets[from.Ident]
+	if found && conn.isClosed() {
+		delete(r.puppets, from.Ident)
+		found = false
+	}
+	var evicted *relayConn
+	if !found && len(r.puppets) >= r.config.MaxPuppets {
+		var evictedIdent string
+		for ident, puppet := range r.puppets {
+			if evicted == nil || puppet.lastUsedAt().Before(evicted.lastUsedAt()) {
+				evicted, evictedIdent = puppet, ident
+			}
+		}
+		delete(r.puppets, evictedIdent)
+	}
+	r.Unlock()
+
+	if evicted != nil {
+		evicted.quit("Making room for another puppet")
+	}
+	if !found {
+		var err error
+		realName := from.RealName
+		if realName == "" {
+			realName = from.Nick
+		}
+		if conn, err = dialRelay(r.config, puppetNick(nick, r.config.PuppetSuffix), realName, nil); err != nil {
+			log.Printf("%s error while connecting puppet for %v: %v", r.tag(), from.Nick, err)
+			return nil
+		}
+
+		r.Lock()
+		r.puppets[from.Ident] = conn
+		r.Unlock()
+	}
+
+	conn.use(ircChannel)
+	return conn
+}
+
+// handleLine handles a line the IRC network sent the relay's own connection
+func (r *Relay) handleLine(conn *relayConn, line *relayLine) {
+	switch line.command {
+	case "KICK":
+		if strings.EqualFold(line.param(1), conn.currentNick()) {
+			ircChannel := line.param(0)
+			log.Printf("%s relay kicked from %v, rejoining in %v", r.tag(), ircChannel, relayRejoinDelay)
+			time.AfterFunc(relayRejoinDelay, func() { conn.send("JOIN %s", ircChannel) })
+		}
+	case "PRIVMSG":
+		r.relayToSlack(line.nick(), line.param(0), line.param(1))
+	}
+}
+
+func (r *Relay) relayToSlack(nick, ircChannel, text string) {
+	slackChannel, found := r.slackChannels[strings.ToLower(ircChannel)]
+	if !found || r.isIgnored(nick) {
+		return
+	}
+
+	if action, isAction := strings.CutPrefix(text, ctcpDelimiter+"ACTION "); isAction {
+		text = "* " + nick + " " + strings.TrimSuffix(action, ctcpDelimiter)
+	} else if strings.HasPrefix(text, ctcpDelimiter) {
+		return
+	} else {
+		text = "<" + nick + "> " + text
+	}
+
+	if err := r.sender.SendPrivmsg(&Privmsg{Target: slackChannel, Message: text}); err != nil {
+		log.Printf("%s error while relaying message to %v: %v", r.tag(), slackChannel, err)
+	}
+}
+
+// isIgnored returns whether messages from an IRC nick aren't relayed: it's configured to be ignored, or it's
+// one of the relay's own connections, whose messages came from Slack in the first place
+func (r *Relay) isIgnored(nick string) bool {
+	if r.ignoreNicks[strings.ToLower(nick)] {
+		return true
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.main != nil && strings.EqualFold(nick, r.main.currentNick()) {
+		return true
+	}
+	for _, puppet := range r.puppets {
+		if strings.EqualFold(nick, puppet.currentNick()) {
+			return true
+		}
+	}
+	return false
+}
+
+// puppetNick makes a nick valid on IRC networks, which only allow letters, digits and a few symbols, and
+// don't allow nicks to start with a digit or "-"
+func puppetNick(nick, suffix string) string {
+	var b strings.Builder
+	for _, c := range nick {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.ContainsRune("[]\\`_^{|}-", c) {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+
+	valid := b.String()
+	if valid == "" || isDigit(valid[0]) || valid[0] == '-' {
+		valid = "_" + valid
+	}
+	if max := relayMaxNickLength - len(suffix); len(valid) > max && max > 0 {
+		valid = valid[:max]
+	}
+	return valid + suffix
+}
+
+// relayConn is one of a relay's connections to the IRC network: its own, or a puppet's
+type relayConn struct {
+	conn net.Conn
+	nick string
+	// Channels a puppet has joined, as it joins them when it first speaks in them
+	joined   map[string]bool
+	lastUsed time.Time
+
+	// Lines waiting for writeLoop to send them, as fast as the network's flood limits allow
+	sendQueue chan string
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	sync.Mutex
+}
+
+// newRelayConn wraps a connection to the IRC network, sending at most burst lines at once and one more
+// each interval after that. A zero interval sends lines as soon as they're queued.
+func newRelayConn(conn net.Conn, nick string, burst int, interval time.Duration) *relayConn {
+	rc := &relayConn{
+		conn:      conn,
+		nick:      nick,
+		joined:    make(map[string]bool),
+		lastUsed:  time.Now(),
+		sendQueue: make(chan string, relaySendQueueSize),
+		closed:    make(chan struct{}),
+	}
+	go rc.writeLoop(max(burst, 1), interval)
+	return rc
+}
+
+// dialRelay connects to the IRC network and registers with a nick, or that nick with underscores added
+// if it's taken. Lines received after registration are passed to handle, if it's set.
+func dialRelay(config *RelayConfig, nick, realName string, handle func(*relayConn, *relayLine)) (*relayConn, error) {
+	dialer := &net.Dialer{Timeout: relayRegistrationTimeout}
+	var conn net.Conn
+	var err error
+	if config.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", config.Server, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", config.Server)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rc := newRelayConn(conn, nick, config.FloodBurst, config.FloodInterval)
+	if config.Password != "" {
+		rc.send("PASS %s", config.Password)
+	}
+	rc.send("NICK %s", nick)
+	rc.send("USER tanya 0 * :%s", realName)
+
+	conn.SetReadDeadline(time.Now().Add(relayRegistrationTimeout))
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		line := parseRelayLine(s.Text())
+		switch line.command {
+		case "PING":
+			rc.sendNow("PONG :%s", line.param(0))
+		case "001":
+			rc.nick = line.param(0)
+			conn.SetReadDeadline(time.Time{})
+			go rc.readLoop(s, handle)
+			return rc, nil
+		case "432", "433", "436", "437":
+			// Nick unavailable, so try another
+			if len(rc.nick) >= relayMaxNickLength {
+				rc.nick = rc.nick[:relayMaxNickLength-1]
+			}
+			rc.nick += "_"
+			rc.send("NICK %s", rc.nick)
+		case "ERROR":
+			rc.close()
+			return nil, errors.New(line.param(0))
+		}
+	}
+
+	rc.close()
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("connection closed during registration")
+}
+
+func (rc *relayConn) readLoop(s *bufio.Scanner, handle func(*relayConn, *relayLine)) {
+	defer rc.close()
+
+	for s.Scan() {
+		line := parseRelayLine(s.Text())
+		switch line.command {
+		case "PING":
+			rc.sendNow("PONG :%s", line.param(0))
+		case "NICK":
+			rc.Lock()
+			if strings.EqualFold(line.nick(), rc.nick) {
+				rc.nick = line.param(0)
+			}
+			rc.Unlock()
+		}
+
+		if handle != nil {
+			handle(rc, line)
+		}
+	}
+}
+
+// send queues a line to be sent once the flood limits allow, waiting for room in the queue if it's full
+func (rc *relayConn) send(format string, args ...interface{}) error {
+	if rc.isClosed() {
+		return errRelayClosed
+	}
+	select {
+	case rc.sendQueue <- fmt.Sprintf(format, args...):
+		return nil
+	case <-rc.closed:
+		return errRelayClosed
+	}
+}
+
+// sendNow sends a line straight away, ahead of any queued lines, for replies the network won't wait for
+func (rc *relayConn) sendNow(format string, args ...interface{}) error {
+	return rc.write(fmt.Sprintf(format, args...))
+}
+
+func (rc *relayConn) write(line string) error {
+	rc.Lock()
+	defer rc.Unlock()
+
+	_, err := io.WriteString(rc.conn, line+"\r\n")
+	return err
+}
+
+// writeLoop sends queued lines until the connection is closed. It holds up to burst tokens, spending one
+// on each line and getting one back each interval, so lines are sent in a burst and then paced.
+func (rc *relayConn) writeLoop(burst int, interval time.Duration) {
+	var refill <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		refill = ticker.C
+	}
+
+	tokens := burst
+	for {
+		queue := rc.sendQueue
+		if interval > 0 && tokens == 0 {
+			queue = nil
+		}
+
+		select {
+		case line := <-queue:
+			if err := rc.write(line); err != nil {
+				rc.close()
+				return
+			}
+			tokens--
+		case <-refill:
+			tokens = min(tokens+1, burst)
+		case <-rc.closed:
+			return
+		}
+	}
+}
+
+func (rc *relayConn) currentNick() string {
+	rc.Lock()
+	defer rc.Unlock()
+
+	return rc.nick
+}
+
+// use joins a puppet to a channel if it isn't already in it, and notes that it was used
+func (rc *relayConn) use(ircChannel string) {
+	rc.Lock()
+	rc.lastUsed = time.Now()
+	joined := rc.joined[ircChannel]
+	rc.joined[ircChannel] = true
+	rc.Unlock()
+
+	if !joined {
+		rc.send("JOIN %s", ircChannel)
+	}
+}
+
+func (rc *relayConn) lastUsedAt() time.Time {
+	rc.Lock()
+	defer rc.Unlock()
+
+	return rc.lastUsed
+}
+
+func (rc *relayConn) quit(message string) {
+	rc.sendNow("QUIT :%s", message)
+	rc.close()
+}
+
+func (rc *relayConn) close() {
+	rc.closeOnce.Do(func() {
+		close(rc.closed)
+		rc.conn.Close()
+	})
+}
+
+func (rc *relayConn) isClosed() bool {
+	select {
+	case <-rc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// relayLine is a line from an IRC server. StringToMessage is for lines from clients, so it doesn't
+// understand numerics, and lowercases prefixes.
+type relayLine struct {
+	prefix  string
+	command string
+	params  []string
+}
+
+func parseRelayLine(s string) *relayLine {
+	line := &relayLine{}
+	if strings.HasPrefix(s, "@") {
+		_, s, _ = strings.Cut(s, " ")
+	}
+	s = strings.TrimLeft(s, " ")
+	if strings.HasPrefix(s, ":") {
+		line.prefix, s, _ = strings.Cut(s[1:], " ")
+	}
+
+	line.command, s, _ = strings.Cut(strings.TrimLeft(s, " "), " ")
+	line.command = strings.ToUpper(line.command)
+	for s != "" {
+		if strings.HasPrefix(s, ":") {
+			line.params = append(line.params, s[1:])
+			break
+		}
+		var param string
+		param, s, _ = strings.Cut(s, " ")
+		if param != "" {
+			line.params = append(line.params, param)
+		}
+	}
+	return line
+}
+
+func (l *relayLine) param(i int) string {
+	if i >= len(l.params) {
+		return ""
+	}
+	return l.params[i]
+}
+
+func (l *relayLine) nick() string {
+	return ParseUserString(l.prefix).Nick
+}
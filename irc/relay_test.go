@@ -0,0 +1,304 @@
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const relayTestTimeout = 5 * time.Second
+
+// fakeNetwork is just enough of an IRC network to relay to: clients can register, join channels, and send
+// messages to them, which are passed on to the channel's other members
+type fakeNetwork struct {
+	l net.Listener
+
+	clients  map[string]net.Conn
+	channels map[string]map[string]bool
+	// Every PRIVMSG sent by a client, as "nick target text"
+	privmsgs chan string
+
+	sync.Mutex
+}
+
+func newFakeNetwork(t *testing.T) *fakeNetwork {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &fakeNetwork{
+		l:        l,
+		clients:  make(map[string]net.Conn),
+		channels: make(map[string]map[string]bool),
+		privmsgs: make(chan string, 100),
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go n.serve(conn)
+		}
+	}()
+	return n
+}
+
+func (n *fakeNetwork) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var nick string
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		line := parseRelayLine(s.Text())
+		n.Lock()
+		switch line.command {
+		case "NICK":
+			if _, taken := n.clients[line.param(0)]; taken {
+				fmt.Fprintf(conn, ":fake 433 * %s :Nickname is already in use\r\n", line.param(0))
+			} else {
+				nick = line.param(0)
+				n.clients[nick] = conn
+			}
+		case "USER":
+			fmt.Fprintf(conn, ":fake 001 %s :Welcome\r\n", nick)
+		case "PING":
+			fmt.Fprintf(conn, ":fake PONG fake :%s\r\n", line.param(0))
+		case "JOIN":
+			if n.channels[line.param(0)] == nil {
+				n.channels[line.param(0)] = make(map[string]bool)
+			}
+			n.channels[line.param(0)][nick] = true
+		case "PRIVMSG":
+			n.privmsgs <- fmt.Sprintf("%s %s %s", nick, line.param(0), line.param(1))
+			n.broadcast(nick, line.param(0), line.param(1))
+		case "QUIT":
+			delete(n.clients, nick)
+			n.Unlock()
+			return
+		}
+		n.Unlock()
+	}
+}
+
+// broadcast sends a message to everyone in a channel but its sender. The network must be locked.
+func (n *fakeNetwork) broadcast(from, channel, text string) {
+	for member := range n.channels[channel] {
+		if conn, found := n.clients[member]; found && member != from {
+			fmt.Fprintf(conn, ":%s!%s@fake PRIVMSG %s :%s\r\n", from, from, channel, text)
+		}
+	}
+}
+
+// say sends a message to a channel from a user who isn't connected
+func (n *fakeNetwork) say(from, channel, text string) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.broadcast(from, channel, text)
+}
+
+func (n *fakeNetwork) waitForMember(t *testing.T, channel, nick string) {
+	t.Helper()
+	for deadline := time.Now().Add(relayTestTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		n.Lock()
+		joined := n.channels[channel][nick]
+		n.Unlock()
+		if joined {
+			return
+		}
+	}
+	t.Fatalf("%v never joined %v", nick, channel)
+}
+
+func (n *fakeNetwork) expectPrivmsg(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case got := <-n.privmsgs:
+		if got != want {
+			t.Errorf("relayed to IRC %q, want %q", got, want)
+		}
+	case <-time.After(relayTestTimeout):
+		t.Fatalf("nothing relayed to IRC, want %q", want)
+	}
+}
+
+// fakeSlack collects what the relay sends to Slack
+type fakeSlack chan *Privmsg
+
+func (s fakeSlack) SendPrivmsg(p *Privmsg) error {
+	s <- p
+	return nil
+}
+
+func (s fakeSlack) expect(t *testing.T, wantTarget, wantMessage string) {
+	t.Helper()
+	select {
+	case p := <-s:
+		if p.Target != wantTarget || p.Message != wantMessage {
+			t.Errorf("relayed to Slack %v %q, want %v %q", p.Target, p.Message, wantTarget, wantMessage)
+		}
+	case <-time.After(relayTestTimeout):
+		t.Fatalf("nothing relayed to Slack, want %v %q", wantTarget, wantMessage)
+	}
+}
+
+func (s fakeSlack) expectNothing(t *testing.T) {
+	t.Helper()
+	select {
+	case p := <-s:
+		t.Errorf("relayed to Slack %v %q, want nothing", p.Target, p.Message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func startTestRelay(t *testing.T, puppets bool) (*Relay, *fakeNetwork, fakeSlack) {
+	network := newFakeNetwork(t)
+
+	var config RelayConfig
+	config.SetDefaults()
+	config.Server = network.l.Addr().String()
+	config.Channels = map[string]string{"general": "#slack-general"}
+	config.Puppets = puppets
+	config.Nicks = map[string]string{"kedo": "kedora"}
+	config.IgnoreNicks = []string{"otherbridge"}
+
+	stopChan := make(chan struct{})
+	t.Cleanup(func() { close(stopChan) })
+	slack := make(fakeSlack, 10)
+	relay := NewRelay(&config, stopChan, slack)
+	go relay.Run()
+
+	network.waitForMember(t, "#slack-general", "tanya")
+	return relay, network, slack
+}
+
+func TestRelay(t *testing.T) {
+	relay, network, slack := startTestRelay(t, false)
+	kedo := User{Nick: "kedo", Ident: "U0KEDO"}
+	papika := User{Nick: "papika", Ident: "U0PAPIKA"}
+
+	// Slack to IRC, from the relay with the (mapped) sender's nick, a line at a time
+	relay.HandlePrivmsg(&Privmsg{From: kedo, Target: "#general", Message: "rise and shine\nstomp"})
+	network.expectPrivmsg(t, "tanya #slack-general <kedora> rise and shine")
+	network.expectPrivmsg(t, "tanya #slack-general <kedora> stomp")
+	relay.HandlePrivmsg(&Privmsg{From: papika, Target: "#random", Message: "not relayed"})
+	relay.HandlePrivmsg(&Privmsg{From: papika, Target: "#general", Message: "good morning"})
+	network.expectPrivmsg(t, "tanya #slack-general <papika> good morning")
+
+	// IRC to Slack, except from ignored nicks
+	network.say("alice", "#slack-general", "hi there")
+	slack.expect(t, "#general", "<alice> hi there")
+	network.say("alice", "#slack-general", "\x01ACTION waves\x01")
+	slack.expect(t, "#general", "* alice waves")
+	network.say("otherbridge", "#slack-general", "<bob> relayed already")
+	network.say("alice", "#elsewhere", "not relayed")
+	slack.expectNothing(t)
+}
+
+func TestRelayPuppets(t *testing.T) {
+	relay, network, slack := startTestRelay(t, true)
+	kedo := User{Nick: "kedo", Ident: "U0KEDO", RealName: "Kedo"}
+
+	// Each Slack user gets a connection of their own, which isn't relayed back to Slack
+	relay.HandlePrivmsg(&Privmsg{From: kedo, Target: "#general", Message: "rise and shine"})
+	network.expectPrivmsg(t, "kedora[s] #slack-general rise and shine")
+	slack.expectNothing(t)
+
+	relay.HandlePrivmsg(&Privmsg{From: kedo, Target: "#general", Message: "stomp"})
+	network.expectPrivmsg(t, "kedora[s] #slack-general stomp")
+
+	relay.Lock()
+	puppets := len(relay.puppets)
+	relay.Unlock()
+	if puppets != 1 {
+		t.Errorf("relay has %d puppets, want 1", puppets)
+	}
+
+	network.say("alice", "#slack-general", "hi kedora[s]")
+	slack.expect(t, "#general", "<alice> hi kedora[s]")
+}
+
+func TestRelayConnThrottle(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	client, server := net.Pipe()
+	defer server.Close()
+	rc := newRelayConn(client, "tanya", 2, interval)
+	defer rc.close()
+
+	start := time.Now()
+	for i := range 4 {
+		rc.send("PRIVMSG #chan :%d", i)
+	}
+
+	// The first two lines go out at once, and the rest an interval apart
+	s := bufio.NewScanner(server)
+	for i := range 4 {
+		if !s.Scan() {
+			t.Fatalf("connection closed before line %d", i)
+		}
+		if want := fmt.Sprintf("PRIVMSG #chan :%d", i); s.Text() != want {
+			t.Errorf("sent %q, want %q", s.Text(), want)
+		}
+		elapsed := time.Since(start)
+		if i < 2 && elapsed >= interval {
+			t.Errorf("line %d sent after %v, want it in the burst", i, elapsed)
+		}
+		if i >= 2 && elapsed < time.Duration(i-1)*interval {
+			t.Errorf("line %d sent after %v, want at least %v", i, elapsed, time.Duration(i-1)*interval)
+		}
+	}
+
+	rc.close()
+	if err := rc.send("PRIVMSG #chan :late"); err != errRelayClosed {
+		t.Errorf("send after close = %v, want %v", err, errRelayClosed)
+	}
+}
+
+func TestPuppetNick(t *testing.T) {
+	tests := []struct {
+		nick string
+		want string
+	}{
+		{"kedo", "kedo[s]"},
+		{"kedo san", "kedo_san[s]"},
+		{"2kedo", "_2kedo[s]"},
+		{"-kedo", "_-kedo[s]"},
+		{"", "_[s]"},
+		{strings.Repeat("k", 40), strings.Repeat("k", 27) + "[s]"},
+	}
+
+	for _, tt := range tests {
+		if got := puppetNick(tt.nick, "[s]"); got != tt.want {
+			t.Errorf("puppetNick(%q) = %q, want %q", tt.nick, got, tt.want)
+		}
+	}
+}
+
+func TestParseRelayLine(t *testing.T) {
+	tests := []struct {
+		line        string
+		wantPrefix  string
+		wantCommand string
+		wantParams  []string
+	}{
+		{":irc.example.net 001 tanya :Welcome to IRC", "irc.example.net", "001", []string{"tanya", "Welcome to IRC"}},
+		{":Kedo!kedo@host PRIVMSG #chan :hi :)", "Kedo!kedo@host", "PRIVMSG", []string{"#chan", "hi :)"}},
+		{"@time=2024-01-01T00:00:00Z :a!b@c JOIN #chan", "a!b@c", "JOIN", []string{"#chan"}},
+		{"PING :token", "", "PING", []string{"token"}},
+		{"ping  token", "", "PING", []string{"token"}},
+	}
+
+	for _, tt := range tests {
+		got := parseRelayLine(tt.line)
+		if got.prefix != tt.wantPrefix || got.command != tt.wantCommand || strings.Join(got.params, "|") != strings.Join(tt.wantParams, "|") {
+			t.Errorf("parseRelayLine(%q) = %+v, want %v %v %q", tt.line, got, tt.wantPrefix, tt.wantCommand, tt.wantParams)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package irc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a client has to log in to a shared listener before it's disconnected
+	routerLoginTimeout = 30 * time.Second
+	// Most lines a client can send a shared listener before logging in
+	routerMaxLoginLines = 20
+)
+
+// Router is a listener shared by several Servers. Clients choose which one they're connected to when they
+// log in, soju-style: with a USER username of ident/gateway (or ident/gateway@client), or a PASS of
+// client/gateway.
+type Router struct {
+	listenAddr string
+	stopChan   <-chan struct{}
+
+	servers map[string]*Server
+
+	sync.RWMutex
+}
+
+// loginConn is a client connection whose login the Router has already read, which the Server it's handed
+// to reads again
+type loginConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *loginConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// NewRouter creates a shared listener on listenAddr
+func NewRouter(listenAddr string, stopChan <-chan struct{}) *Router {
+	return &Router{
+		listenAddr: listenAddr,
+		stopChan:   stopChan,
+		servers:    make(map[string]*Server),
+	}
+}
+
+// AddServer makes a Server reachable through the shared listener by name
+func (r *Router) AddServer(name string, s *Server) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.servers[name] = s
+}
+
+// Listen for and accept incoming connections, handing each to the Server it chooses
+func (r *Router) Listen() {
+	addr, err := net.ResolveTCPAddr("tcp", r.listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	log.Printf("[:%d] shared IRC listener now listening on %v", addr.Port, addr)
+	go func() {
+		<-r.stopChan
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			if strings.HasSuffix(err.Error(), "closed network connection") {
+				break
+			} else {
+				log.Fatal(err)
+			}
+		}
+
+		go r.route(conn)
+	}
+}
+
+// route reads a client's login up to its USER, then hands it to the Server it chose, with the gateway
+// name taken out of the login
+func (r *Router) route(conn *net.TCPConn) {
+	conn.SetReadDeadline(time.Now().Add(routerLoginTimeout))
+	reader := bufio.NewReader(conn)
+
+	var login bytes.Buffer
+	var name string
+	for lines := 0; ; lines++ {
+		if lines == routerMaxLoginLines {
+			fmt.Fprintf(conn, "ERROR :Closing link: no USER sent\r\n")
+			conn.Close()
+			return
+		}
+
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		msg, err := StringToMessage(strings.TrimRight(line, "\r\n"))
+		if err == nil && (msg.Cmd == PassCmd || msg.Cmd == UserCmd) {
+			var gatewayName string
+			if msg.Params[0], gatewayName = splitGatewayName(msg.Params[0]); gatewayName != "" {
+				name = gatewayName
+			}
+			line = msg.String() + "\r\n"
+		}
+		login.WriteString(line)
+
+		if err == nil && msg.Cmd == UserCmd {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	server, err := r.server(name)
+	if err != nil {
+		fmt.Fprintf(conn, "ERROR :Closing link: %v\r\n", err)
+		conn.Close()
+		return
+	}
+
+	// Anything the client sent after its USER has been read into the buffer too
+	rest, _ := reader.Peek(reader.Buffered())
+	server.Serve(&loginConn{Conn: conn, r: io.MultiReader(&login, bytes.NewReader(rest), conn)})
+}
+
+// server returns the Server with a name, or the only one if no name was given
+func (r *Router) server(name string) (*Server, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if s, found := r.servers[name]; found {
+		return s, nil
+	}
+
+	var names []string
+	for n, s := range r.servers {
+		names = append(names, n)
+		if name == "" && len(r.servers) == 1 {
+			return s, nil
+		}
+	}
+	sort.Strings(names)
+
+	if name == "" {
+		return nil, fmt.Errorf("choose a gateway by logging in as ident/gateway, one of: %v", strings.Join(names, ", "))
+	}
+	return nil, fmt.Errorf("no such gateway %q, choose one of: %v", name, strings.Join(names, ", "))
+}
+
+// splitGatewayName splits the gateway name off of a USER username of the form "ident/gateway" or
+// "ident/gateway@client", or a PASS of the form "client/gateway", returning the rest
+func splitGatewayName(param string) (rest, name string) {
+	i := strings.LastIndexByte(param, '/')
+	if i < 0 {
+		return param, ""
+	}
+
+	name, client, _ := strings.Cut(param[i+1:], "@")
+	rest = param[:i]
+	if client != "" {
+		rest += "@" + client
+	}
+	return rest, name
+}
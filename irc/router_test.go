@@ -0,0 +1,25 @@
+package irc
+
+import "testing"
+
+func TestSplitGatewayName(t *testing.T) {
+	tests := []struct {
+		param    string
+		wantRest string
+		wantName string
+	}{
+		{"papika", "papika", ""},
+		{"papika/work", "papika", "work"},
+		{"papika/work@laptop", "papika@laptop", "work"},
+		{"papika@laptop/work", "papika@laptop", "work"},
+		{"laptop/work", "laptop", "work"},
+		{"papika/", "papika", ""},
+	}
+
+	for _, tt := range tests {
+		rest, name := splitGatewayName(tt.param)
+		if rest != tt.wantRest || name != tt.wantName {
+			t.Errorf("splitGatewayName(%q) = %q, %q, want %q, %q", tt.param, rest, name, tt.wantRest, tt.wantName)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SearchChannel is the virtual channel a client can join to get search results there, rather than from *tanya
+const SearchChannel = "&search"
+
+// searchTimeFormat is how search results show when their message was sent
+const searchTimeFormat = "Jan 2 15:04"
+
+// originalMsgIDTag is the client tag search results carry the msgid of the message they found in, as each
+// result has a msgid of its own
+const originalMsgIDTag = "+tanya/original-msgid"
+
+// SearchResults is a page of the messages matching a search, newest first, each sent to its original target
+// and tagged with its original time and msgid
+type SearchResults struct {
+	Messages []Privmsg
+	// Which page this is, counting from 1, of how many, and how many messages match in all
+	Page, Pages, Total int
+}
+
+// joinSearchChannel joins the client to &search. Nobody else is ever in it.
+func (cc *clientConnection) joinSearchChannel() {
+	cc.Lock()
+	cc.joinedChans[SearchChannel] = struct{}{}
+	cc.Unlock()
+
+	cc.sendChannelJoinedResponse(SearchChannel, ChannelTopic{
+		Topic: "Send a query to search slack, or \"more\" for the next page of results",
+		SetBy: tanyaInternalUser.Nick,
+		SetAt: time.Now(),
+	}, []User{cc.clientUser})
+}
+
+// search searches for the client, sending it the results in &search if it has joined it, and from *tanya
+// otherwise. A query of "more" fetches the next page of the client's last search.
+func (cc *clientConnection) search(query string) {
+	inChannel := cc.isJoined(SearchChannel)
+	say := cc.sendFromInternalUser
+	if inChannel {
+		say = func(message string) {
+			cc.outgoingMessages <- (&Privmsg{From: *tanyaInternalUser, Target: SearchChannel, Message: message}).ToMessage()
+		}
+	}
+
+	query = strings.TrimSpace(query)
+	page := 1
+	if strings.EqualFold(query, "more") {
+		cc.Lock()
+		query, page = cc.lastSearch, cc.lastSearchPage+1
+		cc.Unlock()
+		if query == "" {
+			say("nothing searched for yet, send a query first")
+			return
+		}
+	}
+
+	results, err := cc.stateProvider.Search(query, page)
+	if err != nil {
+		say(fmt.Sprintf("could not search for %q: %v", query, err))
+		return
+	}
+	cc.Lock()
+	cc.lastSearch, cc.lastSearchPage = query, results.Page
+	cc.Unlock()
+
+	if results.Total == 0 {
+		say(fmt.Sprintf("no results for %q", query))
+		return
+	} else if len(results.Messages) == 0 {
+		say(fmt.Sprintf("no more results for %q", query))
+		return
+	}
+
+	say(fmt.Sprintf("%d results for %q, page %d of %d:", results.Total, query, results.Page, results.Pages))
+	searchedAt := time.Now().UnixNano()
+	for i, result := range results.Messages {
+		p := formatSearchResult(result, !inChannel, fmt.Sprintf("search-%d-%d", searchedAt, i))
+		if inChannel {
+			p.Target = SearchChannel
+		} else {
+			p.From, p.Target = *tanyaInternalUser, cc.user().Nick
+		}
+		cc.outgoingMessages <- p.ToMessage()
+	}
+	if results.Page < results.Pages {
+		say("send \"search more\" for the next page")
+	}
+}
+
+// formatSearchResult puts a search result on one line prefixed with where and when it was sent, and who by
+// if asked. The result gets msgID, as it's a message of its own; the original time tag is kept, and the
+// original msgid moves to originalMsgIDTag, so clients can refer back to the original message.
+func formatSearchResult(p Privmsg, withSender bool, msgID string) Privmsg {
+	where := p.Target
+	if sentAt, err := time.Parse(ServerTimeFormat, p.Tags["time"]); err == nil {
+		where += " " + sentAt.Local().Format(searchTimeFormat)
+	}
+
+	text := strings.Join(strings.Fields(p.Message), " ")
+	if withSender {
+		text = fmt.Sprintf("<%s> %s", p.From.Nick, text)
+	}
+	p.Message = fmt.Sprintf("[%s] %s", where, text)
+
+	tags := make(map[string]string, len(p.Tags)+1)
+	for key, value := range p.Tags {
+		tags[key] = value
+	}
+	if originalMsgID, found := p.Tags["msgid"]; found {
+		tags[originalMsgIDTag] = originalMsgID
+	}
+	tags["msgid"] = msgID
+	p.Tags = tags
+	return p
+}
@@ -0,0 +1,41 @@
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatSearchResult(t *testing.T) {
+	sentAt := time.Date(2024, time.March, 5, 9, 7, 0, 0, time.Local)
+	kedo := User{Nick: "kedo", Ident: "U0KEDO"}
+	tags := map[string]string{"time": ServerTime(sentAt), "msgid": "C0GENERAL:1709629620.000100"}
+
+	tests := []struct {
+		name       string
+		p          Privmsg
+		withSender bool
+		want       string
+	}{
+		{"channel", Privmsg{From: kedo, Target: "#general", Message: "good morning", Tags: tags}, false,
+			"[#general Mar 5 09:07] good morning"},
+		{"with sender", Privmsg{From: kedo, Target: "#general", Message: "good morning", Tags: tags}, true,
+			"[#general Mar 5 09:07] <kedo> good morning"},
+		{"multi-line", Privmsg{From: kedo, Target: "kedo", Message: "good\nmorning ", Tags: tags}, true,
+			"[kedo Mar 5 09:07] <kedo> good morning"},
+		{"no time", Privmsg{From: kedo, Target: "#general", Message: "good morning"}, false,
+			"[#general] good morning"},
+	}
+	for _, tt := range tests {
+		got := formatSearchResult(tt.p, tt.withSender, "search-1")
+		if got.Message != tt.want {
+			t.Errorf("%s: formatSearchResult() = %q, want %q", tt.name, got.Message, tt.want)
+		}
+		if got.Tags["msgid"] != "search-1" || got.Tags[originalMsgIDTag] != tt.p.Tags["msgid"] ||
+			got.Tags["time"] != tt.p.Tags["time"] || got.From != tt.p.From || got.Target != tt.p.Target {
+			t.Errorf("%s: formatSearchResult() = %+v, want the original sender, target and tags", tt.name, got)
+		}
+	}
+	if tags["msgid"] != "C0GENERAL:1709629620.000100" {
+		t.Errorf("formatSearchResult() changed the original's msgid to %v", tags["msgid"])
+	}
+}
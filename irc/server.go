@@ -2,6 +2,7 @@ package irc
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strings"
@@ -11,10 +12,14 @@ import (
 
 var tanyaInternalUser = &User{Nick: "*tanya", Ident: "tanya"}
 
+// How often the playback buffer is saved to disk, if it is persisted
+const playbackSaveInterval = 30 * time.Second
+
 // Server represents the IRC server listener for bridging IRC clients to Slack
 // and fanning out Slack events as necessary
 type Server struct {
 	clientConnections map[net.Addr]*clientConnection
+	serverChan        chan *ServerMessage
 	stopChan          <-chan struct{}
 
 	initOnce sync.Once
@@ -24,6 +29,8 @@ type Server struct {
 	config        *Config
 	stateProvider ServerStateProvider
 
+	playback *PlaybackBuffer
+
 	sync.RWMutex
 }
 
@@ -41,21 +48,52 @@ type ChannelTopic struct {
 	SetAt time.Time
 }
 
+// ConnectionStatus is the state of the connection to Slack
+type ConnectionStatus struct {
+	Connected bool
+	// When the connection was made, or lost if it isn't connected
+	Since time.Time
+	// Anything else worth knowing about the connection, e.g. how it's made
+	Detail string
+}
+
 // NewServer creates a new IRC server
 func NewServer(config *Config, stopChan <-chan struct{}, stateProvider ServerStateProvider) *Server {
+	var playback *PlaybackBuffer
+	if config.PlaybackBufferSize > 0 {
+		var err error
+		playback, err = NewPlaybackBuffer(config.PlaybackBufferSize, config.PlaybackFile)
+		if err != nil {
+			log.Printf("error while loading playback buffer from %v, starting with an empty one: %v", config.PlaybackFile, err)
+		}
+	}
+
 	return &Server{
 		clientConnections: make(map[net.Addr]*clientConnection),
+		serverChan:        make(chan *ServerMessage),
 		stopChan:          stopChan,
 
 		initChan: make(chan struct{}),
 
 		config:        config,
 		stateProvider: stateProvider,
+
+		playback: playback,
 	}
 }
 
-// Listen for and accept incoming connections on the configured address.
+// Listen for and accept incoming connections on the configured address. Without one, the server only
+// serves connections handed to it by a Router.
 func (s *Server) Listen() {
+	go s.handleIncomingMessageRouting(s.serverChan)
+	if s.playback != nil {
+		go s.persistPlayback()
+	}
+	if s.config.ListenAddr == "" {
+		go s.waitForKillListener(nil)
+		return
+	}
+
 	addr, err := net.ResolveTCPAddr("tcp", s.config.ListenAddr)
 	if err != nil {
 		log.Fatal(err)
@@ -68,8 +106,6 @@ func (s *Server) Listen() {
 	defer l.Close()
 
 	log.Printf("[:%d] IRC server now listening on %v", addr.Port, addr)
-	serverChan := make(chan *ServerMessage)
-	go s.handleIncomingMessageRouting(serverChan)
 	go s.waitForKillListener(l)
 
 	for {
@@ -85,17 +121,29 @@ func (s *Server) Listen() {
 			}
 		}
 
-		cc := newClientConnection(conn, &s.selfUser, s.config, s.stateProvider, serverChan, s.initChan)
-		log.Printf("[:%d] IRC client connected: %v", addr.Port, cc)
-
-		s.Lock()
-		s.clientConnections[conn.RemoteAddr()] = cc
-		s.Unlock()
+		s.Serve(conn)
+	}
+}
 
-		go cc.handleConnInput()
-		go cc.handleConnOutput()
-		go s.waitForClientCleanup(cc)
+// Serve handles a client connection, either accepted by Listen or handed over by a Router
+func (s *Server) Serve(conn net.Conn) {
+	select {
+	case <-s.stopChan:
+		conn.Close()
+		return
+	default:
 	}
+
+	s.Lock()
+	cc := newClientConnection(
+		conn, &s.selfUser, s.config, s.stateProvider, s.serverChan, s.initChan, s.playback, s.connectedClients)
+	s.clientConnections[conn.RemoteAddr()] = cc
+	s.Unlock()
+	log.Printf("[:%d] IRC client connected: %v", conn.LocalAddr().(*net.TCPAddr).Port, cc)
+
+	go cc.handleConnInput()
+	go cc.handleConnOutput()
+	go s.waitForClientCleanup(cc)
 }
 
 func (s *Server) waitForClientCleanup(cc *clientConnection) {
@@ -106,11 +154,56 @@ func (s *Server) waitForClientCleanup(cc *clientConnection) {
 	s.Lock()
 	delete(s.clientConnections, cc.conn.RemoteAddr())
 	s.Unlock()
+
+	if s.playback != nil && cc.registered() {
+		s.playback.Detach(cc.clientName)
+	}
+}
+
+// persistPlayback periodically saves the playback buffer, and once more on shutdown.
+func (s *Server) persistPlayback() {
+	ticker := time.NewTicker(playbackSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopChan:
+			if err := s.playback.Save(); err != nil {
+				log.Printf("error while saving playback buffer: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.playback.Save(); err != nil {
+				log.Printf("error while saving playback buffer: %v", err)
+			}
+		}
+	}
+}
+
+// bufferForPlayback adds channel and DM messages to the playback buffer
+func (s *Server) bufferForPlayback(m *Message) {
+	if s.playback == nil || m.Cmd != PrivmsgCmd {
+		return
+	}
+
+	messagable, err := ParseMessage(m)
+	if err != nil {
+		return
+	}
+	p := messagable.(*Privmsg)
+
+	at := time.Now()
+	if serverTime, err := time.Parse(ServerTimeFormat, p.Tags["time"]); err == nil {
+		at = serverTime
+	}
+	s.playback.Append(*p, at)
 }
 
 func (s *Server) waitForKillListener(l *net.TCPListener) {
 	<-s.stopChan
-	l.Close()
+	if l != nil {
+		l.Close()
+	}
 
 	// First grab the lock and grab the active connections
 	conns := make([]*clientConnection, 0)
@@ -123,7 +216,7 @@ func (s *Server) waitForKillListener(l *net.TCPListener) {
 	// Now try to close them. This list could be stale, but it won't
 	// cause any deadlocks
 	for _, conn := range conns {
-		close(conn.shutdown)
+		conn.close()
 	}
 }
 
@@ -133,16 +226,24 @@ func (s *Server) handleIncomingMessageRouting(incomingMessages <-chan *ServerMes
 		case <-s.stopChan:
 			return
 		case msg := <-incomingMessages:
-			// Do not send the message back to the originator of the messages
+			// Do not send the message back to the originator of the messages. Sending may retarget it,
+			// so only build the messages for the other clients afterwards.
 			err := handleIncomingMessage(msg.message, s.stateProvider)
+			messages := relayMessages(msg.message)
 			if err != nil {
 				s.broadcastFromInternalUser(err.Error())
+			} else {
+				for _, m := range messages {
+					s.bufferForPlayback(m)
+				}
 			}
 
 			s.RLock()
 			for addr, conn := range s.clientConnections {
 				if addr != msg.cAddr {
-					conn.outgoingMessages <- msg.message.ToMessage()
+					for _, m := range messages {
+						conn.outgoingMessages <- m
+					}
 				}
 			}
 			s.RUnlock()
@@ -161,10 +262,22 @@ func handleIncomingMessage(msg Messagable, ssp ServerStateProvider) error {
 	return nil
 }
 
+// connectedClients returns the clients currently connected, registered or not
+func (s *Server) connectedClients() []*clientConnection {
+	s.RLock()
+	defer s.RUnlock()
+
+	clients := make([]*clientConnection, 0, len(s.clientConnections))
+	for _, cc := range s.clientConnections {
+		clients = append(clients, cc)
+	}
+	return clients
+}
+
 func (s *Server) broadcastFromInternalUser(message string) {
 	s.RLock()
 	for _, conn := range s.clientConnections {
-		msg := &Privmsg{From: *tanyaInternalUser, Target: conn.clientUser.Nick, Message: message}
+		msg := &Privmsg{From: *tanyaInternalUser, Target: conn.user().Nick, Message: message}
 		conn.outgoingMessages <- msg.ToMessage()
 	}
 	s.RUnlock()
@@ -174,6 +287,7 @@ func (s *Server) broadcastFromInternalUser(message string) {
 func (s *Server) HandleOutgoingMessageRouting(outgoingMessages <-chan *Message) {
 	for {
 		message := <-outgoingMessages
+		s.bufferForPlayback(message)
 
 		s.RLock()
 		for _, v := range s.clientConnections {
@@ -188,8 +302,10 @@ func (s *Server) HandleOutgoingMessageRouting(outgoingMessages <-chan *Message)
 //
 // Sets the IRC user info for the gateway user and informs clients.
 func (s *Server) HandleConnectBurst(selfUser User) {
+	s.Lock()
 	oldSelfUser := s.selfUser
 	s.selfUser = selfUser
+	s.Unlock()
 
 	if oldSelfUser != selfUser {
 		nickChangeMessage := (&Nick{
@@ -221,6 +337,57 @@ func (s *Server) HandleChannelJoined(channelName string) {
 	s.RUnlock()
 }
 
+// HandleChannelParted handles a Slack-initiated channel departure, e.g. due to the channel
+// being archived or deleted.
+func (s *Server) HandleChannelParted(channelName, reason string) {
+	s.RLock()
+	for _, v := range s.clientConnections {
+		if v.isJoined(channelName) {
+			v.handleChannelParted(channelName, reason)
+		}
+	}
+	s.RUnlock()
+}
+
+// HandleChannelRenamed handles a channel being renamed on Slack. Clients supporting
+// draft/channel-rename are sent a RENAME, while others see a PART and re-JOIN.
+func (s *Server) HandleChannelRenamed(oldName, newName, reason string) {
+	s.RLock()
+	for _, v := range s.clientConnections {
+		v.handleChannelRenamed(oldName, newName, reason)
+	}
+	s.RUnlock()
+}
+
+// HandleReadMarker handles a conversation's read marker moving forward, e.g. from another Slack client.
+func (s *Server) HandleReadMarker(target string, timestamp time.Time) {
+	message := (&MarkRead{
+		ServerName: s.config.ServerName,
+		Target:     target,
+		Timestamp:  timestamp,
+	}).ToMessage()
+
+	s.RLock()
+	for _, v := range s.clientConnections {
+		v.outgoingMessages <- message
+	}
+	s.RUnlock()
+}
+
+// HandleUnreadSummaryReady sends every client a summary of unread conversations, once the unread counts
+// have been fetched from Slack.
+func (s *Server) HandleUnreadSummaryReady() {
+	unreads, _ := s.stateProvider.GetUnreadSummary()
+
+	s.RLock()
+	for _, v := range s.clientConnections {
+		if v.registered() {
+			v.sendUnreadSummary(unreads)
+		}
+	}
+	s.RUnlock()
+}
+
 // ServerStateProvider contains methods used by the IRC server to answer
 // client queries about channels and their members.
 type ServerStateProvider interface {
@@ -236,7 +403,58 @@ type ServerStateProvider interface {
 
 	GetJoinedChannels() []string
 
+	// JoinChannel joins a channel on Slack, after which HandleChannelJoined is called unless we were in it
+	JoinChannel(channelName string) error
+	// LeaveChannel leaves a channel on Slack, after which HandleChannelParted is called unless we weren't in it
+	LeaveChannel(channelName string) error
+
+	// SendPrivmsg sends a message to Slack. A message to a comma-separated list of nicks is sent to the group
+	// DM with them, and its target replaced with the group DM's channel name.
 	SendPrivmsg(privMsg *Privmsg) error
 
+	// RunSlashCommand runs a Slack slash command such as "/remind" in a channel or DM, returning any reply
+	// meant only for us
+	RunSlashCommand(target, command, args string) (string, error)
+	// HasSlashCommand returns whether Slack has a slash command we can run
+	HasSlashCommand(command string) bool
+
 	GetUserFromNick(nick string) User
+
+	// GetChatHistory returns the messages sent to a channel or DM strictly between after and before (either
+	// of which may be zero), oldest first. If there are more than limit, the newest are returned if latest is
+	// set, otherwise the oldest.
+	GetChatHistory(target string, after, before time.Time, limit int, latest bool) ([]Privmsg, error)
+
+	// GetChatHistoryTargets returns the channels and DMs with messages strictly between after and before,
+	// ordered by their latest message.
+	GetChatHistoryTargets(after, before time.Time) ([]ChatHistoryTarget, error)
+
+	// GetMessageTime resolves a msgid tag to the time its message was sent
+	GetMessageTime(msgID string) (time.Time, bool)
+
+	// Search returns a page of the messages matching a query, counting from 1, newest first
+	Search(query string, page int) (SearchResults, error)
+
+	// GetReadMarker returns the time up to which a channel or DM has been read, or the zero time if unknown
+	GetReadMarker(target string) time.Time
+
+	// SetReadMarker marks a channel or DM as read up to a time, returning the resulting read marker,
+	// which never moves backwards
+	SetReadMarker(target string, timestamp time.Time) (time.Time, error)
+
+	// GetUnreadSummary returns the channels and DMs with unread messages, and whether the unread counts
+	// have been fetched from Slack yet
+	GetUnreadSummary() ([]UnreadConversation, bool)
+
+	// UploadFile uploads a file sent by a client to a channel or DM, with an optional comment
+	UploadFile(target, filename string, file io.Reader, size int, comment string) error
+	// DownloadFile downloads a file shared on Slack
+	DownloadFile(url string, w io.Writer) error
+
+	// GetConnectionStatus reports on the connection to Slack
+	GetConnectionStatus() ConnectionStatus
+	// Reconnect drops the connection to Slack and makes a new one
+	Reconnect() error
+	// Resync reloads users, channels and channel members from Slack, as after a reconnection
+	Resync() error
 }
@@ -0,0 +1,44 @@
+package irc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// slashCommandPattern matches a slash command's name and arguments, once the prefix is removed
+var slashCommandPattern = regexp.MustCompile(`^([a-zA-Z0-9_-]+)(?:\s+(.*))?$`)
+
+// parseSlashCommand splits a one-line message starting with prefix and a command name into the slash command
+// (with its "/") and its arguments
+func parseSlashCommand(text, prefix string) (command, args string, ok bool) {
+	if prefix == "" || !strings.HasPrefix(text, prefix) || strings.Contains(text, "\n") {
+		return "", "", false
+	}
+
+	m := slashCommandPattern.FindStringSubmatch(strings.TrimPrefix(text, prefix))
+	if m == nil {
+		return "", "", false
+	}
+	return "/" + strings.ToLower(m[1]), strings.TrimSpace(m[2]), true
+}
+
+// runSlashCommand runs a slash command on Slack in a channel or DM, sending the client any reply meant only
+// for us as notices from *tanya, in the channel or in private
+func (cc *clientConnection) runSlashCommand(target, command, args string) {
+	response, err := cc.stateProvider.RunSlashCommand(target, command, args)
+	if err != nil {
+		response = fmt.Sprintf("%s failed: %v", command, err)
+	}
+
+	noticeTarget := target
+	if !strings.HasPrefix(target, "#") {
+		noticeTarget = cc.user().Nick
+	}
+	for _, line := range strings.Split(response, "\n") {
+		if line == "" {
+			continue
+		}
+		cc.outgoingMessages <- (&Privmsg{From: *tanyaInternalUser, Target: noticeTarget, Message: line}).ToNotice()
+	}
+}
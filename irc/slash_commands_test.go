@@ -0,0 +1,30 @@
+package irc
+
+import "testing"
+
+func TestParseSlashCommand(t *testing.T) {
+	tests := []struct {
+		text, prefix string
+		wantCommand  string
+		wantArgs     string
+		wantOK       bool
+	}{
+		{"/remind me to stretch in 1 hour", "/", "/remind", "me to stretch in 1 hour", true},
+		{"/Giphy", "/", "/giphy", "", true},
+		{"/poll  \"lunch?\" ", "/", "/poll", "\"lunch?\"", true},
+		{"!deploy prod", "!", "/deploy", "prod", true},
+		{"/usr/bin is full", "/", "", "", false},
+		{"/ not a command", "/", "", "", false},
+		{"/remind me\nto stretch", "/", "", "", false},
+		{"remind me", "/", "", "", false},
+		{"/remind me", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		command, args, ok := parseSlashCommand(tt.text, tt.prefix)
+		if command != tt.wantCommand || args != tt.wantArgs || ok != tt.wantOK {
+			t.Errorf("parseSlashCommand(%q, %q) = %q, %q, %v, want %q, %q, %v",
+				tt.text, tt.prefix, command, args, ok, tt.wantCommand, tt.wantArgs, tt.wantOK)
+		}
+	}
+}
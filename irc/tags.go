@@ -0,0 +1,88 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// ServerTimeFormat is the timestamp format used by the IRCv3 server-time "time" tag
+const ServerTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// ServerTime formats a time for use as the value of a "time" message tag
+func ServerTime(t time.Time) string {
+	return t.UTC().Format(ServerTimeFormat)
+}
+
+var tagValueEscaper = strings.NewReplacer(";", `\:`, " ", `\s`, `\`, `\\`, "\r", `\r`, "\n", `\n`)
+
+// unescapeTagValue reverses the IRCv3 message tag value escaping. Unknown escapes drop the
+// backslash, and a trailing lone backslash is dropped.
+func unescapeTagValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+
+		i++
+		if i >= len(value) {
+			break
+		}
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+// parseTags parses the tags section of a message, without the leading '@'
+func parseTags(tagStr string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(tagStr, ";") {
+		if tag == "" {
+			continue
+		}
+
+		keyValue := strings.SplitN(tag, "=", 2)
+		if len(keyValue) == 1 {
+			tags[keyValue[0]] = ""
+		} else {
+			tags[keyValue[0]] = unescapeTagValue(keyValue[1])
+		}
+	}
+	return tags
+}
+
+// formatTags formats message tags for the wire, without the leading '@'. Tags are sorted
+// to keep output deterministic.
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(key)
+		if value := tags[key]; value != "" {
+			b.WriteByte('=')
+			b.WriteString(tagValueEscaper.Replace(value))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,86 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Maximum length of a line of the unread summary, leaving room for the prefix within the IRC line limit
+const unreadSummaryLineLength = 400
+
+// UnreadConversation summarizes the unread messages in a channel or DM
+type UnreadConversation struct {
+	Target string
+	DM     bool
+
+	// Number of unread messages, or zero if only known to be some
+	Unreads  int
+	Mentions int
+}
+
+func (u UnreadConversation) String() string {
+	var counts []string
+	if u.Unreads > 0 {
+		counts = append(counts, fmt.Sprint(u.Unreads))
+	}
+	if u.Mentions == 1 && !u.DM {
+		counts = append(counts, "1 mention")
+	} else if u.Mentions > 1 && !u.DM {
+		counts = append(counts, fmt.Sprintf("%d mentions", u.Mentions))
+	}
+
+	if len(counts) == 0 {
+		return u.Target
+	}
+	return fmt.Sprintf("%s (%s)", u.Target, strings.Join(counts, ", "))
+}
+
+// formatUnreadSummary formats a compact summary of unread channels and DMs, wrapping long lists
+func formatUnreadSummary(unreads []UnreadConversation) []string {
+	if len(unreads) == 0 {
+		return []string{"nothing unread"}
+	}
+
+	var channels, dms []string
+	for _, u := range unreads {
+		if u.DM {
+			dms = append(dms, u.String())
+		} else {
+			channels = append(channels, u.String())
+		}
+	}
+
+	var lines []string
+	for _, section := range []struct {
+		label string
+		items []string
+	}{{"unread channels: ", channels}, {"unread DMs: ", dms}} {
+		if len(section.items) == 0 {
+			continue
+		}
+
+		line := section.label + section.items[0]
+		for _, item := range section.items[1:] {
+			if len(line)+len(item)+2 > unreadSummaryLineLength {
+				lines = append(lines, line)
+				line = section.label + item
+				continue
+			}
+			line += ", " + item
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// sendUnreadSummary sends the client a summary of unread conversations from *tanya
+func (cc *clientConnection) sendUnreadSummary(unreads []UnreadConversation) {
+	for _, line := range formatUnreadSummary(unreads) {
+		cc.sendFromInternalUser(line)
+	}
+}
+
+// sendFromInternalUser sends the client a message from *tanya
+func (cc *clientConnection) sendFromInternalUser(message string) {
+	cc.outgoingMessages <- (&Privmsg{From: *tanyaInternalUser, Target: cc.user().Nick, Message: message}).ToMessage()
+}
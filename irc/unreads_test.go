@@ -0,0 +1,54 @@
+package irc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFormatUnreadSummary(t *testing.T) {
+	tests := []struct {
+		name    string
+		unreads []UnreadConversation
+		want    []string
+	}{
+		{"nothing", nil, []string{"nothing unread"}},
+		{
+			"channels and DMs",
+			[]UnreadConversation{
+				{Target: "#general", Unreads: 12, Mentions: 2},
+				{Target: "kedo", DM: true, Unreads: 1, Mentions: 1},
+				{Target: "#random", Mentions: 1},
+				{Target: "#design"},
+			},
+			[]string{
+				"unread channels: #general (12, 2 mentions), #random (1 mention), #design",
+				"unread DMs: kedo (1)",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatUnreadSummary(tt.unreads); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("formatUnreadSummary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatUnreadSummary_Wraps(t *testing.T) {
+	var unreads []UnreadConversation
+	for i := 0; i < 100; i++ {
+		unreads = append(unreads, UnreadConversation{Target: "#channel-with-a-long-name", Unreads: 10})
+	}
+
+	lines := formatUnreadSummary(unreads)
+	if len(lines) < 2 {
+		t.Fatalf("formatUnreadSummary() = %d lines, want the summary wrapped", len(lines))
+	}
+	for _, line := range lines {
+		if len(line) > unreadSummaryLineLength || !strings.HasPrefix(line, "unread channels: ") {
+			t.Errorf("formatUnreadSummary() line %q too long or missing its label", line)
+		}
+	}
+}
@@ -35,6 +35,8 @@ type Privmsg struct {
 	From    User
 	Target  string
 	Message string
+
+	Tags map[string]string
 }
 
 // ToMessage turns a Privmsg into a Message
@@ -43,9 +45,17 @@ func (p *Privmsg) ToMessage() *Message {
 		p.From.String(),
 		PrivmsgCmd,
 		[]string{p.Target, p.Message},
+		p.Tags,
 	}
 }
 
+// ToNotice turns a Privmsg into a NOTICE Message, for messages clients shouldn't respond to automatically
+func (p *Privmsg) ToNotice() *Message {
+	m := p.ToMessage()
+	m.Cmd = NoticeCmd
+	return m
+}
+
 // IsTargetChannel returns whether the target for this PrivMsg is a channel
 func (p *Privmsg) IsTargetChannel() bool {
 	return len(p.Target) > 0 && p.Target[0] == '#'
@@ -74,6 +84,7 @@ func (n *Nick) ToMessage() *Message {
 		n.From.String(),
 		NickCmd,
 		[]string{n.NewNick},
+		nil,
 	}
 }
 
@@ -89,6 +100,7 @@ func (p *Pong) ToMessage() *Message {
 		p.ServerName,
 		PongCmd,
 		[]string{p.ServerName, p.Token},
+		nil,
 	}
 }
 
@@ -104,6 +116,7 @@ func (j *Join) ToMessage() *Message {
 		j.User.String(),
 		JoinCmd,
 		[]string{j.Channel},
+		nil,
 	}
 }
 
@@ -120,6 +133,7 @@ func (j *Part) ToMessage() *Message {
 		j.User.String(),
 		PartCmd,
 		[]string{j.Channel, j.Message},
+		nil,
 	}
 }
 
@@ -136,6 +150,72 @@ func (t *Topic) ToMessage() *Message {
 		t.From.String(),
 		TopicCmd,
 		[]string{t.Channel, t.Topic},
+		nil,
+	}
+}
+
+// Rename is a draft/channel-rename RENAME message
+type Rename struct {
+	ServerName string
+	OldChannel string
+	NewChannel string
+	Reason     string
+}
+
+// ToMessage turns a Rename into a Message
+func (r *Rename) ToMessage() *Message {
+	return &Message{
+		r.ServerName,
+		RenameCmd,
+		[]string{r.OldChannel, r.NewChannel, r.Reason},
+		nil,
+	}
+}
+
+// Batch is a BATCH message. A batch with a Type starts it, and one without ends it.
+type Batch struct {
+	ServerName string
+	ID         string
+	Type       string
+	Params     []string
+}
+
+// ToMessage turns a Batch into a Message
+func (b *Batch) ToMessage() *Message {
+	if b.Type == "" {
+		return &Message{
+			b.ServerName,
+			BatchCmd,
+			[]string{"-" + b.ID},
+			nil,
+		}
+	}
+
+	return &Message{
+		b.ServerName,
+		BatchCmd,
+		append([]string{"+" + b.ID, b.Type}, b.Params...),
+		nil,
+	}
+}
+
+// Fail is an IRCv3 standard reply reporting that a command failed
+type Fail struct {
+	ServerName  string
+	Command     string
+	Code        string
+	Context     []string
+	Description string
+}
+
+// ToMessage turns a Fail into a Message
+func (f *Fail) ToMessage() *Message {
+	params := append([]string{f.Command, f.Code}, f.Context...)
+	return &Message{
+		f.ServerName,
+		FailCmd,
+		append(params, f.Description),
+		nil,
 	}
 }
 
@@ -184,6 +264,7 @@ func ParseMessage(m *Message) (Messagable, error) {
 			From:    ParseUserString(m.Prefix),
 			Target:  target,
 			Message: msg,
+			Tags:    m.Tags,
 		}, nil
 	default:
 		return &Privmsg{}, fmt.Errorf("could not parse message")
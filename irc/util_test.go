@@ -3,6 +3,7 @@ package irc
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestToMessage(t *testing.T) {
@@ -65,6 +66,7 @@ func TestNick_ToMessage(t *testing.T) {
 				"",
 				NickCmd,
 				[]string{"czi"},
+				nil,
 			},
 		},
 		{
@@ -74,6 +76,7 @@ func TestNick_ToMessage(t *testing.T) {
 				"asid!acid@localhost",
 				NickCmd,
 				[]string{"czi"},
+				nil,
 			},
 		},
 	}
@@ -89,3 +92,41 @@ func TestNick_ToMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestRename_ToMessage(t *testing.T) {
+	r := &Rename{
+		ServerName: "tanya",
+		OldChannel: "#chatter-technical",
+		NewChannel: "#chatter-nontechnical",
+		Reason:     "Channel renamed on Slack",
+	}
+
+	want := ":tanya RENAME #chatter-technical #chatter-nontechnical :Channel renamed on Slack"
+	if got := r.ToMessage().String(); got != want {
+		t.Errorf("Rename.ToMessage() = \"%v\", want \"%v\"", got, want)
+	}
+}
+
+func TestBatch_ToMessage(t *testing.T) {
+	start := (&Batch{ServerName: "tanya", ID: "playback1", Type: "chathistory", Params: []string{"#chatter"}}).ToMessage()
+	if got, want := start.String(), ":tanya BATCH +playback1 chathistory #chatter"; got != want {
+		t.Errorf("Batch.ToMessage() = %q, want %q", got, want)
+	}
+
+	end := (&Batch{ServerName: "tanya", ID: "playback1"}).ToMessage()
+	if got, want := end.String(), ":tanya BATCH -playback1"; got != want {
+		t.Errorf("Batch.ToMessage() = %q, want %q", got, want)
+	}
+}
+
+func TestMarkRead_ToMessage(t *testing.T) {
+	m := (&MarkRead{ServerName: "tanya", Target: "#chatter", Timestamp: time.Unix(1500000000, 123456789)}).ToMessage()
+	if got, want := m.String(), ":tanya MARKREAD #chatter timestamp=2017-07-14T02:40:00.123Z"; got != want {
+		t.Errorf("MarkRead.ToMessage() = %q, want %q", got, want)
+	}
+
+	m = (&MarkRead{ServerName: "tanya", Target: "kedo"}).ToMessage()
+	if got, want := m.String(), ":tanya MARKREAD kedo *"; got != want {
+		t.Errorf("MarkRead.ToMessage() = %q, want %q", got, want)
+	}
+}
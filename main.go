@@ -2,13 +2,17 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/nolanlum/tanya/backend"
 	"github.com/nolanlum/tanya/gateway"
 	"github.com/nolanlum/tanya/irc"
 )
@@ -16,6 +20,8 @@ import (
 var configPathFlag = flag.String("config", "config.toml", "path to config file")
 var noGenFlag = flag.Bool("no-generate", false, "disables auto-generation of config files")
 var debugFlag = flag.Bool("debug", false, "toggles Slack library debug mode (logs to stdout)")
+var recordFlag = flag.String("record", "", "records everything received from Slack to a file, for --replay")
+var replayFlag = flag.String("replay", "", "plays back a file made by --record instead of connecting to Slack")
 
 func killHandler(sigChan <-chan os.Signal, stopChan chan<- struct{}) {
 	<-sigChan
@@ -23,48 +29,55 @@ func killHandler(sigChan <-chan os.Signal, stopChan chan<- struct{}) {
 	close(stopChan)
 }
 
-func slackUserToIRCUser(s *gateway.SlackUser) irc.User {
+func backendUserToIRCUser(u *backend.User) irc.User {
 	return irc.User{
-		Nick:     s.Nick,
-		Ident:    s.SlackID,
+		Nick:     u.Nick,
+		Ident:    u.ID,
 		Host:     "localhost",
-		RealName: s.RealName,
+		RealName: u.RealName,
 	}
 }
 
-func slackToPrivmsg(m *gateway.MessageEventData) *irc.Privmsg {
-	return &irc.Privmsg{
-		From:    slackUserToIRCUser(&m.From),
+func backendToPrivmsg(m *backend.Message) *irc.Privmsg {
+	p := &irc.Privmsg{
+		From:    backendUserToIRCUser(&m.From),
 		Target:  m.Target,
-		Message: m.Message,
+		Message: m.Text,
 	}
+	if !m.Time.IsZero() {
+		p.Tags = map[string]string{
+			"time":  irc.ServerTime(m.Time),
+			"msgid": m.ID,
+		}
+	}
+	return p
 }
 
-func slackToNick(n *gateway.NickChangeEventData) *irc.Nick {
+func backendToNick(n *backend.NickChangeEventData) *irc.Nick {
 	return &irc.Nick{
-		From:    slackUserToIRCUser(&n.From),
+		From:    backendUserToIRCUser(&n.From),
 		NewNick: n.NewNick,
 	}
 }
 
-func slackToTopic(t *gateway.TopicChangeEventData) *irc.Topic {
+func backendToTopic(t *backend.TopicChangeEventData) *irc.Topic {
 	return &irc.Topic{
-		From:    slackUserToIRCUser(&t.From),
+		From:    backendUserToIRCUser(&t.From),
 		Channel: t.Target,
 		Topic:   t.NewTopic,
 	}
 }
 
-func slackToJoin(j *gateway.JoinPartEventData) *irc.Join {
+func backendToJoin(j *backend.JoinPartEventData) *irc.Join {
 	return &irc.Join{
-		User:    slackUserToIRCUser(&j.User),
+		User:    backendUserToIRCUser(&j.User),
 		Channel: j.Target,
 	}
 }
 
-func slackToPart(j *gateway.JoinPartEventData) *irc.Part {
+func backendToPart(j *backend.JoinPartEventData) *irc.Part {
 	return &irc.Part{
-		User:    slackUserToIRCUser(&j.User),
+		User:    backendUserToIRCUser(&j.User),
 		Channel: j.Target,
 		Message: "Leaving",
 	}
@@ -72,64 +85,49 @@ func slackToPart(j *gateway.JoinPartEventData) *irc.Part {
 
 // this name specially chosen to trigger ATRAN
 type corpusCallosum struct {
-	sc *gateway.SlackClient
+	b backend.Backend
 }
 
 // ChannelExists implements irc.ServerStateProvider.ChannelExists
 func (c *corpusCallosum) ChannelExists(channelName string) bool {
-	return c.sc.ResolveNameToChannel(channelName) != nil
+	_, found := c.b.Channel(channelName)
+	return found
 }
 
 // GetChannelUsers implements irc.ServerStateProvider.GetChannelUsers
 func (c *corpusCallosum) GetChannelUsers(channelName string) []irc.User {
-	channel := c.sc.ResolveNameToChannel(channelName)
-	if channel == nil {
-		log.Printf("%s error while querying user list for %v: channel_not_found", c.sc.Tag(), channelName)
-		return nil
-	}
-
-	channelUsers, err := c.sc.GetChannelUsers(channel.SlackID)
+	channelUsers, err := c.b.ChannelMembers(channelName)
 	if err != nil {
-		log.Printf("%s error while querying user list for %v: %v", c.sc.Tag(), channelName, err)
+		log.Printf("%s error while querying user list for %v: %v", c.b.Tag(), channelName, err)
 		return nil
 	}
 
 	var users []irc.User
 	for _, user := range channelUsers {
-		users = append(users, slackUserToIRCUser(&user))
+		users = append(users, backendUserToIRCUser(&user))
 	}
 	return users
 }
 
 // GetChannelTopic implements irc.ServerStateProvider.GetChannelTopic
 func (c *corpusCallosum) GetChannelTopic(channelName string) (topic irc.ChannelTopic) {
-	channel := c.sc.ResolveNameToChannel(channelName)
-	if channel == nil {
-		log.Printf("%s error while querying topic for %v: channel_not_found", c.sc.Tag(), channelName)
+	channel, found := c.b.Channel(channelName)
+	if !found {
+		log.Printf("%s error while querying topic for %v: channel_not_found", c.b.Tag(), channelName)
 		return
 	}
 
-	topic.Topic = c.sc.ParseMessageText(channel.Topic.Value)
-	topic.Topic = strings.ReplaceAll(topic.Topic, "\n", " ")
-	topic.SetAt = channel.Topic.LastSet.Time()
-
-	if channel.Topic.Creator != "" {
-		setBy, err := c.sc.ResolveUser(channel.Topic.Creator)
-		if err != nil {
-			log.Printf("%s error while querying topic creator for %v: %v", c.sc.Tag(), channelName, err)
-			return
-		}
-		topic.SetBy = setBy.Nick
-	}
-
+	topic.Topic = strings.ReplaceAll(channel.Topic.Text, "\n", " ")
+	topic.SetBy = channel.Topic.SetBy
+	topic.SetAt = channel.Topic.SetAt
 	return
 }
 
 // GetChannelCTime implements irc.ServerStateProvider.GetChannelCTime
 func (c *corpusCallosum) GetChannelCTime(channelName string) time.Time {
-	channel := c.sc.ResolveNameToChannel(channelName)
-	if channel == nil {
-		log.Printf("%s error while querying ctime for %v: channel_not_found", c.sc.Tag(), channelName)
+	channel, found := c.b.Channel(channelName)
+	if !found {
+		log.Printf("%s error while querying ctime for %v: channel_not_found", c.b.Tag(), channelName)
 		return time.Time{}
 	}
 
@@ -138,9 +136,9 @@ func (c *corpusCallosum) GetChannelCTime(channelName string) time.Time {
 
 // GetChannelPrivate implements irc.ServerStateProvider.GetChannelPrivate
 func (c *corpusCallosum) GetChannelPrivate(channelName string) bool {
-	channel := c.sc.ResolveNameToChannel(channelName)
-	if channel == nil {
-		log.Printf("%s error while querying private flag for %v: channel_not_found", c.sc.Tag(), channelName)
+	channel, found := c.b.Channel(channelName)
+	if !found {
+		log.Printf("%s error while querying private flag for %v: channel_not_found", c.b.Tag(), channelName)
 		return false
 	}
 
@@ -149,45 +147,168 @@ func (c *corpusCallosum) GetChannelPrivate(channelName string) bool {
 
 // GetJoinedChannels implements irc.ServerStateProvider.GetJoinedChannels
 func (c *corpusCallosum) GetJoinedChannels() []string {
-	var channelNames []string
-	for _, channel := range c.sc.GetChannelMemberships() {
-		channelNames = append(channelNames, channel.Name)
-	}
-	return channelNames
+	return c.b.JoinedChannels()
+}
+
+// JoinChannel implements irc.ServerStateProvider.JoinChannel
+func (c *corpusCallosum) JoinChannel(channelName string) error {
+	return c.b.JoinChannel(channelName)
 }
 
-// SendPrivmsg sends an IRC PRIVMSG through Slack resolving channels properly
-func (c *corpusCallosum) SendPrivmsg(privMsg *irc.Privmsg) (err error) {
+// LeaveChannel implements irc.ServerStateProvider.LeaveChannel
+func (c *corpusCallosum) LeaveChannel(channelName string) error {
+	return c.b.LeaveChannel(channelName)
+}
+
+// SendPrivmsg sends an IRC PRIVMSG through the backend
+func (c *corpusCallosum) SendPrivmsg(privMsg *irc.Privmsg) error {
 	// TODO: we should enforce that we are not sending PRIVMSGs from other people
 
 	// Don't bother sending anything on an empty message
 	if len(privMsg.Message) == 0 {
-		return
+		return nil
 	}
 
-	if privMsg.IsTargetChannel() {
-		channel := c.sc.ResolveNameToChannel(privMsg.Target)
-		err = c.sc.SendMessage(channel, privMsg.Message)
-	} else if privMsg.IsValidTarget() {
-		slackUser := c.sc.ResolveNickToUser(privMsg.Target)
-		if slackUser != nil {
-			err = c.sc.SendDirectMessage(slackUser, privMsg.Message)
+	if privMsg.IsTargetChannel() || strings.Contains(privMsg.Target, ",") || privMsg.IsValidTarget() {
+		// Messages to a list of nicks land in a group DM, which other clients know by its channel name
+		target, err := c.b.Send(privMsg.Target, privMsg.Message)
+		if err == nil {
+			privMsg.Target = target
 		}
+		return err
 	}
+	return nil
+}
 
-	return
+// RunSlashCommand runs a Slack slash command through the backend
+func (c *corpusCallosum) RunSlashCommand(target, command, args string) (string, error) {
+	return c.b.SlashCommand(target, command, args)
+}
+
+// HasSlashCommand implements irc.ServerStateProvider.HasSlashCommand
+func (c *corpusCallosum) HasSlashCommand(command string) bool {
+	return c.b.HasSlashCommand(command)
 }
 
 func (c *corpusCallosum) GetUserFromNick(nick string) irc.User {
-	slackUser := c.sc.ResolveNickToUser(nick)
-	if slackUser != nil {
-		return slackUserToIRCUser(slackUser)
+	if user, found := c.b.UserByNick(nick); found {
+		return backendUserToIRCUser(&user)
 	}
 	return irc.User{}
 }
 
+// GetChatHistory implements irc.ServerStateProvider.GetChatHistory
+func (c *corpusCallosum) GetChatHistory(
+	target string, after, before time.Time, limit int, latest bool,
+) ([]irc.Privmsg, error) {
+	history, err := c.b.History(target, after, before, limit, latest)
+	if err != nil {
+		log.Printf("%s error while querying history for %v: %v", c.b.Tag(), target, err)
+		return nil, err
+	}
+
+	var privmsgs []irc.Privmsg
+	for _, m := range history {
+		privmsgs = append(privmsgs, *backendToPrivmsg(&m))
+	}
+	return privmsgs, nil
+}
+
+// GetChatHistoryTargets implements irc.ServerStateProvider.GetChatHistoryTargets
+func (c *corpusCallosum) GetChatHistoryTargets(after, before time.Time) ([]irc.ChatHistoryTarget, error) {
+	activity, err := c.b.ActiveConversations(after, before)
+	if err != nil {
+		log.Printf("%s error while querying history targets: %v", c.b.Tag(), err)
+		return nil, err
+	}
+
+	var targets []irc.ChatHistoryTarget
+	for _, a := range activity {
+		targets = append(targets, irc.ChatHistoryTarget{Name: a.Target, Latest: a.Latest})
+	}
+	return targets, nil
+}
+
+// GetMessageTime implements irc.ServerStateProvider.GetMessageTime
+func (c *corpusCallosum) GetMessageTime(msgID string) (time.Time, bool) {
+	return c.b.MessageTime(msgID)
+}
+
+// Search implements irc.ServerStateProvider.Search
+func (c *corpusCallosum) Search(query string, page int) (irc.SearchResults, error) {
+	results, err := c.b.Search(query, page)
+	if err != nil {
+		return irc.SearchResults{}, err
+	}
+
+	ircResults := irc.SearchResults{Page: results.Page, Pages: results.Pages, Total: results.Total}
+	for i := range results.Messages {
+		ircResults.Messages = append(ircResults.Messages, *backendToPrivmsg(&results.Messages[i]))
+	}
+	return ircResults, nil
+}
+
+// GetReadMarker implements irc.ServerStateProvider.GetReadMarker
+func (c *corpusCallosum) GetReadMarker(target string) time.Time {
+	marker, err := c.b.ReadMarker(target)
+	if err != nil {
+		log.Printf("%s error while querying read marker for %v: %v", c.b.Tag(), target, err)
+		return time.Time{}
+	}
+	return marker
+}
+
+// SetReadMarker implements irc.ServerStateProvider.SetReadMarker
+func (c *corpusCallosum) SetReadMarker(target string, timestamp time.Time) (time.Time, error) {
+	// IRC timestamps only have millisecond precision, so round up to cover every message in that millisecond
+	timestamp = timestamp.Truncate(time.Millisecond).Add(time.Millisecond - time.Microsecond)
+	return c.b.SetReadMarker(target, timestamp)
+}
+
+// GetUnreadSummary implements irc.ServerStateProvider.GetUnreadSummary
+func (c *corpusCallosum) GetUnreadSummary() ([]irc.UnreadConversation, bool) {
+	counts, ready := c.b.UnreadCounts()
+
+	var unreads []irc.UnreadConversation
+	for _, count := range counts {
+		unreads = append(unreads, irc.UnreadConversation{
+			Target:   count.Target,
+			DM:       count.DM,
+			Unreads:  count.Unreads,
+			Mentions: count.Mentions,
+		})
+	}
+	return unreads, ready
+}
+
+// UploadFile implements irc.ServerStateProvider.UploadFile
+func (c *corpusCallosum) UploadFile(target, filename string, file io.Reader, size int, comment string) error {
+	return c.b.UploadFile(target, filename, file, size, comment)
+}
+
+// DownloadFile implements irc.ServerStateProvider.DownloadFile
+func (c *corpusCallosum) DownloadFile(url string, w io.Writer) error {
+	return c.b.DownloadFile(url, w)
+}
+
+// GetConnectionStatus implements irc.ServerStateProvider.GetConnectionStatus
+func (c *corpusCallosum) GetConnectionStatus() irc.ConnectionStatus {
+	status := c.b.Status()
+	return irc.ConnectionStatus{Connected: status.Connected, Since: status.Since, Detail: status.Detail}
+}
+
+// Reconnect implements irc.ServerStateProvider.Reconnect
+func (c *corpusCallosum) Reconnect() error {
+	return c.b.Reconnect()
+}
+
+// Resync implements irc.ServerStateProvider.Resync
+func (c *corpusCallosum) Resync() error {
+	return c.b.Resync()
+}
+
 func writeMessageLoop(
-	recvChan <-chan *gateway.SlackEvent,
+	recvChan <-chan *backend.Event,
 	sendChan chan<- *irc.Message,
 	stopChan <-chan struct{},
 	server *irc.Server,
@@ -199,52 +320,179 @@ Loop:
 			break Loop
 		case msg := <-recvChan:
 			switch msg.EventType {
-			case gateway.SlackConnectedEvent:
+			case backend.ConnectedEvent:
 				// This is a state-changing event. Not 100% sure the main goroutine
 				// should be handling it but it doesn't make sense to have a separate
 				// server goroutine just for reconnected events, nor does it make sense
 				// to multiplex it onto sendChan.
-				b := msg.Data.(*gateway.SlackConnectedEventData)
-				server.HandleConnectBurst(slackUserToIRCUser(b.UserInfo))
-			case gateway.MessageEvent:
-				p := slackToPrivmsg(msg.Data.(*gateway.MessageEventData))
+				b := msg.Data.(*backend.ConnectedEventData)
+				server.HandleConnectBurst(backendUserToIRCUser(&b.Self))
+			case backend.MessageEvent:
+				p := backendToPrivmsg(msg.Data.(*backend.Message))
 				sendChan <- p.ToMessage()
-			case gateway.NickChangeEvent:
-				n := slackToNick(msg.Data.(*gateway.NickChangeEventData))
+			case backend.NoticeEvent:
+				p := backendToPrivmsg(msg.Data.(*backend.Message))
+				sendChan <- p.ToNotice()
+			case backend.MultilineMessageEvent:
+				var lines []*irc.Privmsg
+				for _, line := range msg.Data.(*backend.MultilineMessageEventData).Lines {
+					lines = append(lines, backendToPrivmsg(line))
+				}
+				for _, m := range irc.MultilineMessages(lines) {
+					sendChan <- m
+				}
+			case backend.NickChangeEvent:
+				n := backendToNick(msg.Data.(*backend.NickChangeEventData))
 				sendChan <- n.ToMessage()
-			case gateway.TopicChangeEvent:
-				t := slackToTopic(msg.Data.(*gateway.TopicChangeEventData))
+			case backend.TopicChangeEvent:
+				t := backendToTopic(msg.Data.(*backend.TopicChangeEventData))
 				sendChan <- t.ToMessage()
-			case gateway.SelfJoinEvent:
-				server.HandleChannelJoined(msg.Data.(*gateway.JoinPartEventData).Target)
-			case gateway.JoinEvent:
-				j := slackToJoin(msg.Data.(*gateway.JoinPartEventData))
+			case backend.SelfJoinEvent:
+				server.HandleChannelJoined(msg.Data.(*backend.JoinPartEventData).Target)
+			case backend.SelfPartEvent:
+				p := msg.Data.(*backend.JoinPartEventData)
+				server.HandleChannelParted(p.Target, p.Reason)
+			case backend.ChannelRenameEvent:
+				r := msg.Data.(*backend.ChannelRenameEventData)
+				server.HandleChannelRenamed(r.OldName, r.NewName, "Channel renamed on Slack")
+			case backend.ReadMarkerEvent:
+				m := msg.Data.(*backend.ReadMarkerEventData)
+				server.HandleReadMarker(m.Target, m.Time)
+			case backend.MentionEvent:
+				server.HandleMention(backendToPrivmsg(msg.Data.(*backend.Message)))
+			case backend.FileSharedEvent:
+				f := msg.Data.(*backend.FileSharedEventData)
+				server.HandleFileShared(irc.FileOffer{
+					From:   backendUserToIRCUser(&f.From),
+					Target: f.Target,
+					Name:   f.Name,
+					Size:   f.Size,
+					URL:    f.URL,
+				})
+			case backend.UnreadSummaryEvent:
+				server.HandleUnreadSummaryReady()
+			case backend.JoinEvent:
+				j := backendToJoin(msg.Data.(*backend.JoinPartEventData))
 				sendChan <- j.ToMessage()
-			case gateway.PartEvent:
-				p := slackToPart(msg.Data.(*gateway.JoinPartEventData))
+			case backend.PartEvent:
+				p := backendToPart(msg.Data.(*backend.JoinPartEventData))
 				sendChan <- p.ToMessage()
 			}
 		}
 	}
 }
 
-func launchGateway(conf *GatewayInstance, stopChan chan struct{}) {
-	slackIncomingChan := make(chan *gateway.SlackEvent)
+// recordingPath returns the file the i'th of n gateways is recorded to or replayed from. With more than one
+// gateway, each has its own file, numbered before the extension.
+func recordingPath(path string, i, n int) string {
+	if n <= 1 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), i, ext)
+}
+
+// clientOptions returns how the i'th of n gateways is run, according to the command line
+func clientOptions(i, n int) gateway.ClientOptions {
+	options := gateway.ClientOptions{Debug: *debugFlag}
+
+	var err error
+	switch {
+	case *recordFlag != "" && *replayFlag != "":
+		log.Fatal("--record and --replay can't be used together")
+	case *recordFlag != "":
+		path := recordingPath(*recordFlag, i, n)
+		if options.Recorder, err = gateway.NewRecorder(path); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("recording gateway %d to %v", i, path)
+	case *replayFlag != "":
+		path := recordingPath(*replayFlag, i, n)
+		if options.Replay, err = gateway.LoadReplay(path); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("replaying gateway %d from %v", i, path)
+	}
+	return options
+}
+
+func launchGateway(conf *GatewayInstance, options gateway.ClientOptions, router *irc.Router, stopChan chan struct{}) {
 	slackClient := gateway.NewSlackClient()
-	slackClient.Initialize(conf.Slack.Token, *debugFlag)
+	slackClient.Initialize(&conf.Slack, options)
+	if conf.Relay.Server != "" {
+		relayBackend(gateway.NewBackend(slackClient), &conf.Relay, stopChan)
+		return
+	}
+	serveBackend(gateway.NewBackend(slackClient), &conf.IRC, router, conf.Name, stopChan)
+}
+
+// relayBackend relays messages between a backend and an existing IRC network until stopChan is closed
+func relayBackend(b backend.Backend, relayConf *irc.RelayConfig, stopChan chan struct{}) {
+	backendEventChan := make(chan *backend.Event)
+	go b.Run(backendEventChan, stopChan)
 
-	go slackClient.Poop(&gateway.ClientChans{
-		IncomingChan: slackIncomingChan,
-		StopChan:     stopChan,
-	})
+	relay := irc.NewRelay(relayConf, stopChan, &corpusCallosum{b})
+	go relay.Run()
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case msg := <-backendEventChan:
+			switch msg.EventType {
+			case backend.MessageEvent:
+				relay.HandlePrivmsg(backendToPrivmsg(msg.Data.(*backend.Message)))
+			case backend.MultilineMessageEvent:
+				for _, line := range msg.Data.(*backend.MultilineMessageEventData).Lines {
+					relay.HandlePrivmsg(backendToPrivmsg(line))
+				}
+			case backend.NoticeEvent:
+				// Notices such as Slackbot's are meant only for us, so they aren't shown to the IRC channel
+				m := msg.Data.(*backend.Message)
+				log.Printf("%s not relaying notice from %v to %v, which only we can see", b.Tag(), m.From.Nick, m.Target)
+			}
+		}
+	}
+}
+
+// serveBackend runs an IRC server in front of a backend until stopChan is closed. If there's a router, the
+// server can also be reached through it by name.
+func serveBackend(b backend.Backend, ircConf *irc.Config, router *irc.Router, name string, stopChan chan struct{}) {
+	backendEventChan := make(chan *backend.Event)
+	go b.Run(backendEventChan, stopChan)
 
 	ircOutgoingChan := make(chan *irc.Message)
-	ircStateProvider := &corpusCallosum{slackClient}
-	ircServer := irc.NewServer(&conf.IRC, stopChan, ircStateProvider)
+	ircStateProvider := &corpusCallosum{b}
+	ircServer := irc.NewServer(ircConf, stopChan, ircStateProvider)
+	if router != nil {
+		router.AddServer(name, ircServer)
+	}
 	go ircServer.Listen()
 	go ircServer.HandleOutgoingMessageRouting(ircOutgoingChan)
 
-	writeMessageLoop(slackIncomingChan, ircOutgoingChan, stopChan, ircServer)
+	writeMessageLoop(backendEventChan, ircOutgoingChan, stopChan, ircServer)
+}
+
+// newRouter creates the shared listener, if one is configured, and takes the gateways only reachable
+// through it off of their own listeners
+func newRouter(conf *Config, stopChan chan struct{}) *irc.Router {
+	if conf.SharedListenAddr == "" {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for i := range conf.Gateway {
+		g := &conf.Gateway[i]
+		if names[g.Name] {
+			log.Fatalf("gateways must have different names to share a listener, but more than one is named %q", g.Name)
+		}
+		names[g.Name] = true
+
+		if g.IRC.ListenAddr == conf.SharedListenAddr {
+			g.IRC.ListenAddr = ""
+		}
+	}
+	return irc.NewRouter(conf.SharedListenAddr, stopChan)
 }
 
 func main() {
@@ -264,11 +512,20 @@ func main() {
 	signal.Notify(killSignalChan, os.Interrupt)
 	log.Println("starting tanya")
 
+	router := newRouter(conf, stopChan)
+	if router != nil {
+		go router.Listen()
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(len(conf.Gateway))
-	for _, g := range conf.Gateway {
+	for i, g := range conf.Gateway {
+		options := clientOptions(i, len(conf.Gateway))
+		if options.Recorder != nil {
+			defer options.Recorder.Close()
+		}
 		go func(g GatewayInstance) {
-			launchGateway(&g, stopChan)
+			launchGateway(&g, options, router, stopChan)
 			wg.Done()
 		}(g)
 	}
@@ -0,0 +1,702 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nolanlum/tanya/backend"
+	"github.com/nolanlum/tanya/fakeslack"
+	"github.com/nolanlum/tanya/gateway"
+	"github.com/nolanlum/tanya/irc"
+	"github.com/slack-go/slack"
+)
+
+// How long end-to-end tests wait for anything to happen
+const e2eTimeout = 5 * time.Second
+
+func fakeUser(id, nick string) slack.User {
+	return slack.User{
+		ID:       id,
+		Name:     nick,
+		RealName: nick,
+		Profile:  slack.UserProfile{DisplayNameNormalized: nick, RealNameNormalized: nick},
+	}
+}
+
+// fakeWorkspace is a fake Slack with a channel we're in with kedo, and a DM with kedo
+type fakeWorkspace struct {
+	*fakeslack.Server
+	general string
+	dm      string
+}
+
+func newFakeWorkspace() *fakeWorkspace {
+	s := fakeslack.NewServer(fakeUser("U0PAPIKA", "papika"))
+	s.AddUser(fakeUser("U0KEDO", "kedo"))
+
+	general := slack.Channel{}
+	general.ID = "C0GENERAL"
+	general.Name = "general"
+	general.IsChannel = true
+	general.Topic = slack.Topic{Value: "stomping on rich people", Creator: "U0KEDO"}
+	s.AddChannel(general, "U0PAPIKA", "U0KEDO")
+
+	return &fakeWorkspace{Server: s, general: general.ID, dm: s.AddDM("U0KEDO")}
+}
+
+// startGateway runs a gateway against a fake Slack until the test ends, returning the address its IRC
+// server listens on
+func startGateway(t *testing.T, apiURL, transport string, options gateway.ClientOptions) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var conf GatewayInstance
+	conf.SetDefaults()
+	conf.Slack.Token = "xoxp-fake"
+	conf.Slack.AppToken = "xapp-fake"
+	conf.Slack.APIURL = apiURL
+	conf.Slack.Transport = transport
+	conf.IRC.ListenAddr = addr
+
+	stopChan := make(chan struct{})
+	t.Cleanup(func() { close(stopChan) })
+	go launchGateway(&conf, options, nil, stopChan)
+
+	return addr
+}
+
+// ircTestClient is a scripted IRC client, which sends lines and waits for expected replies
+type ircTestClient struct {
+	t     *testing.T
+	conn  net.Conn
+	lines chan string
+}
+
+func dialIRC(t *testing.T, addr string) *ircTestClient {
+	var conn net.Conn
+	var err error
+	for deadline := time.Now().Add(e2eTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("could not connect to IRC server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &ircTestClient{t: t, conn: conn, lines: make(chan string, 1000)}
+	go func() {
+		s := bufio.NewScanner(conn)
+		for s.Scan() {
+			c.lines <- strings.TrimRight(s.Text(), "\r")
+		}
+		close(c.lines)
+	}()
+	return c
+}
+
+func (c *ircTestClient) send(format string, args ...interface{}) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.conn, format+"\r\n", args...); err != nil {
+		c.t.Fatalf("could not send to IRC server: %v", err)
+	}
+}
+
+// expect skips lines until one matches pattern, returning its submatches
+func (c *ircTestClient) expect(pattern string) []string {
+	c.t.Helper()
+	re := regexp.MustCompile(pattern)
+	timeout := time.After(e2eTimeout)
+	var skipped []string
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for %q, after:\n%v", pattern, strings.Join(skipped, "\n"))
+			}
+			if m := re.FindStringSubmatch(line); m != nil {
+				return m
+			}
+			skipped = append(skipped, line)
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %q, after:\n%v", pattern, strings.Join(skipped, "\n"))
+		}
+	}
+}
+
+// expectAll skips lines until each of patterns has matched one, in any order
+func (c *ircTestClient) expectAll(patterns ...string) {
+	c.t.Helper()
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		res = append(res, regexp.MustCompile(pattern))
+	}
+	timeout := time.After(e2eTimeout)
+	var skipped []string
+	for len(res) > 0 {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for %q, after:\n%v", res, strings.Join(skipped, "\n"))
+			}
+			matched := false
+			for i, re := range res {
+				if re.MatchString(line) {
+					res = append(res[:i], res[i+1:]...)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				skipped = append(skipped, line)
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %q, after:\n%v", res, strings.Join(skipped, "\n"))
+		}
+	}
+}
+
+func (c *ircTestClient) register(nick string) {
+	c.t.Helper()
+	c.send("NICK %s", nick)
+	c.send("USER %s 0 * :%s", nick, nick)
+	c.expect(`^:\S+ 001 ` + nick + ` `)
+}
+
+func TestGatewayEndToEnd(t *testing.T) {
+	for _, transport := range []string{gateway.TransportRTM, gateway.TransportSocketMode} {
+		t.Run(transport, func(t *testing.T) {
+			fake := newFakeWorkspace()
+			defer fake.Close()
+
+			irc := dialIRC(t, startGateway(t, fake.APIURL(), transport, gateway.ClientOptions{}))
+			irc.register("papika")
+
+			// The channel we're in on Slack is joined, with its topic and members
+			irc.expect(`^:papika!\S+ JOIN #general`)
+			irc.expect(`^:\S+ 332 papika #general :stomping on rich people$`)
+			if names := irc.expect(`^:\S+ 353 papika . #general :(.*)$`); !strings.Contains(names[1], "kedo") {
+				t.Errorf("NAMES #general = %q, want kedo in it", names[1])
+			}
+
+			if !fake.WaitForConnection(e2eTimeout) {
+				t.Fatalf("gateway never connected to slack")
+			}
+
+			// Messages on Slack reach IRC
+			fake.Post(fake.general, "U0KEDO", "rise and shine")
+			irc.expect(`^:kedo!\S+ PRIVMSG #general :rise and shine$`)
+			fake.Post(fake.dm, "U0KEDO", "psst")
+			irc.expect(`^:kedo!\S+ PRIVMSG papika :?psst$`)
+
+			// Messages from IRC are posted to Slack, and Slack's echo of them isn't relayed back
+			irc.send("PRIVMSG #general :morning")
+			messages := fake.WaitForMessages(fake.general, 2, e2eTimeout)
+			if len(messages) != 2 || messages[1].User != "U0PAPIKA" || messages[1].Text != "morning" {
+				t.Fatalf("messages in #general = %+v, want ours last", messages)
+			}
+			fake.Post(fake.general, "U0KEDO", "good morning")
+			if m := irc.expect(`^:(\S+?)!\S+ PRIVMSG #general :?(.*)$`); m[1] != "kedo" || m[2] != "good morning" {
+				t.Errorf("next message in #general = %q, want kedo's reply and not our own echo", m[0])
+			}
+
+			irc.send("PRIVMSG kedo :see you later")
+			messages = fake.WaitForMessages(fake.dm, 2, e2eTimeout)
+			if len(messages) != 2 || messages[1].Text != "see you later" {
+				t.Errorf("messages in DM = %+v, want ours last", messages)
+			}
+
+			if transport == gateway.TransportSocketMode && len(fake.Acks()) == 0 {
+				t.Errorf("no Socket Mode events were acknowledged")
+			}
+		})
+	}
+}
+
+func TestGatewayRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	recorder, err := gateway.NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("record", func(t *testing.T) {
+		fake := newFakeWorkspace()
+		defer fake.Close()
+
+		irc := dialIRC(t, startGateway(t, fake.APIURL(), gateway.TransportRTM, gateway.ClientOptions{Recorder: recorder}))
+		irc.register("papika")
+		irc.expect(`^:papika!\S+ JOIN #general`)
+		if !fake.WaitForConnection(e2eTimeout) {
+			t.Fatalf("gateway never connected to slack")
+		}
+
+		fake.Post(fake.general, "U0KEDO", "rise and shine")
+		irc.expect(`^:kedo!\S+ PRIVMSG #general :rise and shine$`)
+		fake.Post(fake.dm, "U0KEDO", "psst")
+		irc.expect(`^:kedo!\S+ PRIVMSG papika :?psst$`)
+	})
+	recorder.Close()
+
+	// With Slack gone, the same session plays out again from the recording alone
+	t.Run("replay", func(t *testing.T) {
+		replay, err := gateway.LoadReplay(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		irc := dialIRC(t, startGateway(t, "http://127.0.0.1:1/api/", gateway.TransportRTM, gateway.ClientOptions{Replay: replay}))
+		irc.register("papika")
+		irc.expect(`^:papika!\S+ JOIN #general`)
+		irc.expect(`^:\S+ 332 papika #general :stomping on rich people$`)
+		irc.expect(`^:kedo!\S+ PRIVMSG #general :rise and shine$`)
+		irc.expect(`^:kedo!\S+ PRIVMSG papika :?psst$`)
+	})
+}
+
+func TestMemoryBackendEndToEnd(t *testing.T) {
+	memory := backend.NewMemory(backend.User{ID: "U0PAPIKA", Nick: "papika"})
+	memory.AddUser(backend.User{ID: "U0KEDO", Nick: "kedo"})
+	memory.AddChannel(backend.Channel{Name: "#general", Topic: backend.Topic{Text: "stomping on rich people"}}, "papika", "kedo")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conf irc.Config
+	conf.SetDefaults()
+	conf.ListenAddr = l.Addr().String()
+	l.Close()
+
+	stopChan := make(chan struct{})
+	t.Cleanup(func() { close(stopChan) })
+	go serveBackend(memory, &conf, nil, "", stopChan)
+
+	irc := dialIRC(t, conf.ListenAddr)
+	irc.register("papika")
+	irc.expect(`^:papika!\S+ JOIN #general`)
+	irc.expect(`^:\S+ 332 papika #general :stomping on rich people$`)
+
+	memory.Post("kedo", "#general", "rise and shine")
+	irc.expect(`^:kedo!\S+ PRIVMSG #general :rise and shine$`)
+
+	irc.send("PRIVMSG kedo :see you later")
+	irc.send("PING :sync")
+	irc.expect(`PONG .*sync$`)
+	if messages := memory.Messages("kedo"); len(messages) != 1 || messages[0].Text != "see you later" {
+		t.Errorf("messages to kedo = %+v, want ours", messages)
+	}
+}
+
+func TestSharedListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	stopChan := make(chan struct{})
+	t.Cleanup(func() { close(stopChan) })
+	router := irc.NewRouter(addr, stopChan)
+	go router.Listen()
+
+	// Two workspaces, each with its own channel, and neither with a listener of its own
+	for _, name := range []string{"work", "home"} {
+		memory := backend.NewMemory(backend.User{ID: "U0PAPIKA", Nick: "papika"})
+		memory.AddChannel(backend.Channel{Name: "#" + name}, "papika")
+
+		var conf irc.Config
+		conf.SetDefaults()
+		conf.ListenAddr = ""
+		go serveBackend(memory, &conf, router, name, stopChan)
+	}
+
+	home := dialIRC(t, addr)
+	home.send("NICK papika")
+	home.send("USER papika/home@laptop 0 * :papika")
+	home.expect(`^:\S+ 001 papika `)
+	home.expect(`^:papika!\S+ JOIN #home`)
+
+	work := dialIRC(t, addr)
+	work.send("PASS laptop/work")
+	work.send("NICK papika")
+	work.send("USER papika 0 * :papika")
+	work.expect(`^:\S+ 001 papika `)
+	work.expect(`^:papika!\S+ JOIN #work`)
+
+	unknown := dialIRC(t, addr)
+	unknown.send("NICK papika")
+	unknown.send("USER papika/play 0 * :papika")
+	unknown.expect(`^ERROR :.*"play".*home, work`)
+}
+
+func TestInternalCommands(t *testing.T) {
+	for _, transport := range []string{gateway.TransportRTM, gateway.TransportSocketMode} {
+		t.Run(transport, func(t *testing.T) {
+			fake := newFakeWorkspace()
+			defer fake.Close()
+			random := slack.Channel{}
+			random.ID = "C0RANDOM"
+			random.Name = "random"
+			random.IsChannel = true
+			fake.AddChannel(random, "U0KEDO")
+
+			irc := dialIRC(t, startGateway(t, fake.APIURL(), transport, gateway.ClientOptions{}))
+			irc.register("papika")
+			irc.expect(`^:papika!\S+ JOIN #general`)
+			if !fake.WaitForConnection(e2eTimeout) {
+				t.Fatalf("gateway never connected to slack")
+			}
+			tanya := `^:\*tanya!\S+ PRIVMSG papika :`
+
+			irc.send("PRIVMSG *tanya :status")
+			irc.expect(tanya + `connected to slack over ` + transport + ` for `)
+			irc.expect(tanya + `1 IRC clients connected, 1 slack channels joined$`)
+
+			irc.send("PRIVMSG *tanya :clients")
+			irc.expect(tanya + `papika from 127\.0\.0\.1:\d+, connected for \S+ \(you\)$`)
+
+			// Joining and leaving on Slack joins and parts IRC too
+			irc.send("PRIVMSG *tanya :join #random")
+			irc.expectAll(`^:papika!\S+ JOIN #random`, tanya+`joined #random on slack$`)
+			irc.send("PRIVMSG *tanya :leave #random")
+			irc.expectAll(`^:papika!\S+ PART #random`, tanya+`left #random on slack$`)
+			irc.send("PRIVMSG *tanya :join #nowhere")
+			irc.expect(tanya + `could not join #nowhere: no such channel`)
+
+			irc.send("PRIVMSG *tanya :whois kedo")
+			irc.expect(tanya + `kedo is kedo, slack ID U0KEDO$`)
+			irc.expect(tanya + `kedo is in #general$`)
+
+			irc.send("PRIVMSG *tanya :set splitmarker +")
+			irc.expect(tanya + `the split marker is now \+$`)
+			irc.send("PRIVMSG *tanya :set splitmarker " + strings.Repeat("+", 17))
+			irc.expect(tanya + `the split marker can be at most 16 bytes long$`)
+			irc.send("PRIVMSG *tanya :set")
+			irc.expect(tanya + `dcc: offers of shared files are off`)
+			irc.expect(tanya + `coalesce: lines sent within off are joined`)
+			irc.expect(tanya + `splitmarker: split messages are marked with \+`)
+
+			irc.send("PRIVMSG *tanya :resync")
+			irc.expect(tanya + `resynced with slack in `)
+
+			// A failed resync keeps what we had instead of taking the gateway down
+			fake.FailMethod("users.list", "internal_error")
+			irc.send("PRIVMSG *tanya :resync")
+			irc.expect(tanya + `could not resync: GetUsers: internal_error$`)
+			fake.FailMethod("users.list", "")
+			irc.send("PRIVMSG *tanya :whois kedo")
+			irc.expect(tanya + `kedo is kedo, slack ID U0KEDO$`)
+
+			// Messages still arrive over the new connection after reconnecting
+			irc.send("PRIVMSG *tanya :reconnect")
+			irc.expect(tanya + `reconnecting to slack$`)
+			irc.expect(tanya + `connected to slack!$`)
+			fake.Post(fake.general, "U0KEDO", "welcome back")
+			irc.expect(`^:kedo!\S+ PRIVMSG #general :welcome back$`)
+
+			irc.send("PRIVMSG *tanya :fly")
+			irc.expect(tanya + `unknown command "fly", send help for a list$`)
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	fake := newFakeWorkspace()
+	defer fake.Close()
+
+	irc := dialIRC(t, startGateway(t, fake.APIURL(), gateway.TransportRTM, gateway.ClientOptions{}))
+	irc.register("papika")
+	irc.expect(`^:papika!\S+ JOIN #general`)
+	if !fake.WaitForConnection(e2eTimeout) {
+		t.Fatalf("gateway never connected to slack")
+	}
+	fake.Post(fake.general, "U0KEDO", "good morning")
+	fake.Post(fake.general, "U0KEDO", "good night")
+	ts := fake.Post(fake.dm, "U0KEDO", "morning\ntea")
+	irc.expect(`^:kedo!\S+ PRIVMSG papika :?tea$`)
+	tanya := `^:\*tanya!\S+ PRIVMSG papika :`
+	sent := `\w+ \d+ \d\d:\d\d`
+
+	// Results come from *tanya, newest first
+	irc.send("PRIVMSG *tanya :search MORNING")
+	irc.expect(tanya + `2 results for "MORNING", page 1 of 1:$`)
+	irc.expect(tanya + `\[kedo ` + sent + `\] <kedo> morning tea$`)
+	irc.expect(tanya + `\[#general ` + sent + `\] <kedo> good morning$`)
+	irc.send("PRIVMSG *tanya :search more")
+	irc.expect(tanya + `no more results for "MORNING"$`)
+	irc.send("PRIVMSG *tanya :search good in:#general from:@kedo night")
+	irc.expect(tanya + `1 results for .*$`)
+	irc.expect(tanya + `\[#general ` + sent + `\] <kedo> good night$`)
+	irc.send("PRIVMSG *tanya :search evening")
+	irc.expect(tanya + `no results for "evening"$`)
+
+	// Or in &search, from their senders, each with a msgid of its own and tagged with the original's
+	tagged := dialIRC(t, startGateway(t, fake.APIURL(), gateway.TransportRTM, gateway.ClientOptions{}))
+	tagged.send("CAP REQ :message-tags")
+	tagged.send("CAP END")
+	tagged.register("papika")
+	tagged.send("JOIN &search")
+	tagged.expect(`^:papika!\S+ JOIN :?&search$`)
+	tagged.send("PRIVMSG &search :morning tea")
+	tagged.expect(`^:\*tanya!\S+ PRIVMSG &search :1 results for "morning tea", page 1 of 1:$`)
+	tagged.expect(`^@\+tanya/original-msgid=` + regexp.QuoteMeta(fake.dm+":"+ts) + `;\S*msgid=search-\S* :kedo!\S+ PRIVMSG &search :\[kedo ` + sent + `\] morning tea$`)
+}
+
+func TestSlashCommands(t *testing.T) {
+	fake := newFakeWorkspace()
+	defer fake.Close()
+	ran := make(chan string, 10)
+	fake.AddSlashCommand("/remind", func(channelID, text string) string {
+		ran <- channelID + " " + text
+		return "Got it! I'll remind you " + text + "\nUse /remind list to see your reminders"
+	})
+	expectRan := func(want string) {
+		t.Helper()
+		select {
+		case got := <-ran:
+			if got != want {
+				t.Errorf("ran /remind as %q, want %q", got, want)
+			}
+		case <-time.After(e2eTimeout):
+			t.Fatalf("/remind never ran, want %q", want)
+		}
+	}
+
+	irc := dialIRC(t, startGateway(t, fake.APIURL(), gateway.TransportRTM, gateway.ClientOptions{}))
+	irc.register("papika")
+	irc.expect(`^:papika!\S+ JOIN #general`)
+	if !fake.WaitForConnection(e2eTimeout) {
+		t.Fatalf("gateway never connected to slack")
+	}
+
+	// Replies come back as notices, in the channel or in private
+	irc.send("PRIVMSG #general :/remind me to stretch in 1 hour")
+	expectRan(fake.general + " me to stretch in 1 hour")
+	irc.expect(`^:\*tanya!\S+ NOTICE #general :Got it! I'll remind you me to stretch in 1 hour$`)
+	irc.expect(`^:\*tanya!\S+ NOTICE #general :Use /remind list to see your reminders$`)
+	irc.send("PRIVMSG kedo :/REMIND @kedo to eat")
+	expectRan(fake.dm + " <@U0KEDO> to eat")
+	irc.expect(`^:\*tanya!\S+ NOTICE papika :Got it! I'll remind you @kedo to eat$`)
+
+	irc.send("PRIVMSG *tanya :slash #general /remind me at 5pm")
+	expectRan(fake.general + " me at 5pm")
+	irc.expect(`^:\*tanya!\S+ NOTICE #general :Got it! I'll remind you me at 5pm$`)
+	irc.send("PRIVMSG *tanya :slash #general /poll lunch?")
+	irc.expect(`^:\*tanya!\S+ NOTICE #general :/poll failed: no such command$`)
+
+	// Anything else is posted as usual, including messages starting with commands Slack doesn't have
+	irc.send("PRIVMSG #general :/usr/bin is full")
+	if messages := fake.WaitForMessages(fake.general, 1, e2eTimeout); len(messages) != 1 || messages[0].Text != "/usr/bin is full" {
+		t.Errorf("posted %+v, want /usr/bin is full", messages)
+	}
+	irc.send("PRIVMSG #general :/etc is full")
+	irc.send("PRIVMSG #general :and so is /var")
+	messages := fake.WaitForMessages(fake.general, 3, e2eTimeout)
+	if len(messages) != 3 || messages[1].Text != "/etc is full" || messages[2].Text != "and so is /var" {
+		t.Errorf("posted %+v, want /etc is full then and so is /var", messages)
+	}
+}
+
+func TestSlackbotNotices(t *testing.T) {
+	fake := newFakeWorkspace()
+	defer fake.Close()
+
+	irc := dialIRC(t, startGateway(t, fake.APIURL(), gateway.TransportRTM, gateway.ClientOptions{}))
+	irc.register("papika")
+	irc.expect(`^:papika!\S+ JOIN #general`)
+	if !fake.WaitForConnection(e2eTimeout) {
+		t.Fatalf("gateway never connected to slack")
+	}
+
+	fake.Post(fake.general, "USLACKBOT", "Only visible to you: kedo is away")
+	irc.expect(`^:slackbot!\S+ NOTICE #general :Only visible to you: kedo is away$`)
+	fake.Post(fake.general, "U0KEDO", "back now")
+	irc.expect(`^:kedo!\S+ PRIVMSG #general :back now$`)
+}
+
+// listenRelayNetwork is just enough of an IRC network for a relay to connect to, sending every line relay
+// connections send to lines
+func listenRelayNetwork(t *testing.T) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	lines := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s := bufio.NewScanner(conn)
+				for s.Scan() {
+					line := strings.TrimRight(s.Text(), "\r")
+					switch {
+					case strings.HasPrefix(line, "USER "):
+						fmt.Fprintf(conn, ":fake 001 tanya :Welcome\r\n")
+					case strings.HasPrefix(line, "PING "):
+						fmt.Fprintf(conn, ":fake PONG fake %s\r\n", strings.TrimPrefix(line, "PING "))
+					}
+					lines <- line
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), lines
+}
+
+// expectRelayed skips lines sent to the relay network until one matches pattern, returning the lines skipped
+func expectRelayed(t *testing.T, lines <-chan string, pattern string) []string {
+	t.Helper()
+	re := regexp.MustCompile(pattern)
+	timeout := time.After(e2eTimeout)
+	var skipped []string
+	for {
+		select {
+		case line := <-lines:
+			if re.MatchString(line) {
+				return skipped
+			}
+			skipped = append(skipped, line)
+		case <-timeout:
+			t.Fatalf("timed out waiting for the relay to send %q, after:\n%v", pattern, strings.Join(skipped, "\n"))
+		}
+	}
+}
+
+func TestRelaySlackbotNotices(t *testing.T) {
+	fake := newFakeWorkspace()
+	defer fake.Close()
+
+	addr, lines := listenRelayNetwork(t)
+	var conf GatewayInstance
+	conf.SetDefaults()
+	conf.Slack.Token = "xoxp-fake"
+	conf.Slack.AppToken = "xapp-fake"
+	conf.Slack.APIURL = fake.APIURL()
+	conf.Slack.Transport = gateway.TransportRTM
+	conf.Relay.Server = addr
+	conf.Relay.Channels = map[string]string{"general": "#relayed"}
+	conf.Relay.FloodInterval = 0
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go launchGateway(&conf, gateway.ClientOptions{}, nil, stopChan)
+
+	expectRelayed(t, lines, `^JOIN #relayed`)
+	if !fake.WaitForConnection(e2eTimeout) {
+		t.Fatalf("gateway never connected to slack")
+	}
+
+	// Slackbot's notice is only visible to us, so only kedo's message should reach the channel
+	fake.Post(fake.general, "USLACKBOT", "Only visible to you: kedo is away")
+	fake.Post(fake.general, "U0KEDO", "back now")
+	for _, line := range expectRelayed(t, lines, `^PRIVMSG #relayed :<kedo> back now$`) {
+		if strings.Contains(line, "kedo is away") {
+			t.Errorf("relayed Slackbot's notice: %q", line)
+		}
+	}
+}
+
+func TestMultilineMessages(t *testing.T) {
+	fake := newFakeWorkspace()
+	defer fake.Close()
+
+	irc := dialIRC(t, startGateway(t, fake.APIURL(), gateway.TransportRTM, gateway.ClientOptions{}))
+	irc.send("CAP REQ :batch draft/multiline message-tags")
+	irc.send("CAP END")
+	irc.register("papika")
+	irc.expect(`^:papika!\S+ JOIN #general`)
+	if !fake.WaitForConnection(e2eTimeout) {
+		t.Fatalf("gateway never connected to slack")
+	}
+
+	// The lines of a batch are posted as one message
+	irc.send("BATCH +ml draft/multiline #general")
+	irc.send("@batch=ml PRIVMSG #general :rise and")
+	irc.send("@batch=ml;draft/multiline-concat PRIVMSG #general : shine")
+	irc.send("@batch=ml PRIVMSG #general :stomp")
+	irc.send("BATCH -ml")
+	if messages := fake.WaitForMessages(fake.general, 1, e2eTimeout); len(messages) != 1 || messages[0].Text != "rise and shine\nstomp" {
+		t.Errorf("posted %+v, want one message of both lines", messages)
+	}
+}
+
+func TestGroupDMs(t *testing.T) {
+	fake := newFakeWorkspace()
+	defer fake.Close()
+	fake.AddUser(fakeUser("U0COZZIE", "cozzie"))
+	groupDM := slack.Channel{}
+	groupDM.ID = "G0MPIM"
+	groupDM.Name = "mpdm-papika--kedo--cozzie-1"
+	groupDM.IsMpIM = true
+	groupDM.IsPrivate = true
+	fake.AddChannel(groupDM, "U0PAPIKA", "U0KEDO", "U0COZZIE")
+
+	addr := startGateway(t, fake.APIURL(), gateway.TransportRTM, gateway.ClientOptions{})
+	laptop := dialIRC(t, addr)
+	laptop.register("papika")
+	laptop.expect(`^:papika!\S+ JOIN #cozzie\+kedo`)
+	phone := dialIRC(t, addr)
+	phone.register("papika")
+	phone.expect(`^:papika!\S+ JOIN #cozzie\+kedo`)
+	if !fake.WaitForConnection(e2eTimeout) {
+		t.Fatalf("gateway never connected to slack")
+	}
+
+	// Messaging a list of nicks posts to their group DM, which other clients see under its channel name
+	laptop.send("PRIVMSG kedo,cozzie :lunch?")
+	phone.expect(`^:papika!\S+ PRIVMSG #cozzie\+kedo :?lunch\?$`)
+	if messages := fake.WaitForMessages(groupDM.ID, 1, e2eTimeout); len(messages) != 1 || messages[0].Text != "lunch?" {
+		t.Errorf("messages in group DM = %+v, want ours", messages)
+	}
+
+	// The group DM is renamed when one of its members changes nick
+	fake.SendEvent(slack.UserChangeEvent{Type: "user_change", User: fakeUser("U0KEDO", "zkedo")})
+	phone.expectAll(`^:kedo!\S+ NICK :?zkedo$`, `^:papika!\S+ JOIN #cozzie\+zkedo`)
+}
+
+func TestSelfMembershipEvents(t *testing.T) {
+	fake := newFakeWorkspace()
+	defer fake.Close()
+	random := slack.Channel{}
+	random.ID = "C0RANDOM"
+	random.Name = "random"
+	random.IsChannel = true
+	fake.AddChannel(random, "U0KEDO")
+
+	irc := dialIRC(t, startGateway(t, fake.APIURL(), gateway.TransportSocketMode, gateway.ClientOptions{}))
+	irc.register("papika")
+	irc.expect(`^:papika!\S+ JOIN #general`)
+	if !fake.WaitForConnection(e2eTimeout) {
+		t.Fatalf("gateway never connected to slack")
+	}
+
+	// Socket Mode only tells us about joining or leaving a channel elsewhere through our own membership events
+	fake.SendEvent(slack.MemberJoinedChannelEvent{
+		Type: "member_joined_channel", User: "U0PAPIKA", Channel: random.ID, ChannelType: "C",
+	})
+	irc.expect(`^:papika!\S+ JOIN #random`)
+
+	fake.SendEvent(slack.MemberLeftChannelEvent{
+		Type: "member_left_channel", User: "U0PAPIKA", Channel: random.ID, ChannelType: "C",
+	})
+	irc.expect(`^:papika!\S+ PART #random`)
+}